@@ -1,28 +1,68 @@
 package godivert
 
-import "fmt"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Represents a WinDivertAddress struct
 // See : https://reqrypt.org/windivert-doc.html#divert_address
 // As go doesn't not support bit fields
 // we use a little trick to get the Direction, Loopback, Import and PseudoChecksum fields
+//
+// The struct doesn't follow the memory layout of the DLL, it is converted to
+// the 1.x or 2.x WINDIVERT_ADDRESS with MarshalABI and UnmarshalABI
+//
+// The bits of Data are:
+//
+//	0: Direction (1 for inbound)
+//	1: Loopback
+//	2: Impostor
+//	3-5: Pseudo IP, TCP and UDP checksums (1.x)
+//	6: Sniffed (2.x)
+//	7: IPv6 (2.x)
+//	8-10: Valid IP, TCP and UDP checksums (2.x)
 type WinDivertAddress struct {
 	Timestamp int64
 	IfIdx     uint32
 	SubIfIdx  uint32
-	Data      uint8
+	Data      uint16
+
+	// WinDivert 2.x only
+	Layer Layer
+	Event Event
+	// Raw per-layer data of the 2.x address
+	// The Network and NetworkForward layers data is stored in IfIdx and SubIfIdx instead
+	LayerData [64]byte
+}
+
+// Create a new Network layer address for a packet to inject
+// The other fields and flags are set with the setters
+func NewWinDivertAddress(direction Direction, ifIdx, subIfIdx uint32) *WinDivertAddress {
+	addr := &WinDivertAddress{
+		Layer:    WinDivertLayerNetwork,
+		Event:    WinDivertEventNetworkPacket,
+		IfIdx:    ifIdx,
+		SubIfIdx: subIfIdx,
+	}
+	addr.SetDirection(direction)
+	return addr
 }
 
 func (w *WinDivertAddress) String() string {
 	return fmt.Sprintf("{\n"+
 		"\t\tTimestamp=%d\n"+
+		"\t\tLayer=%v\n"+
+		"\t\tEvent=%v\n"+
 		"\t\tInteface={IfIdx=%d SubIfIdx=%d}\n"+
 		"\t\tDirection=%v\n"+
 		"\t\tLoopback=%t\n"+
 		"\t\tImpostor=%t\n"+
 		"\t\tPseudoChecksum={IP=%t TCP=%t UDP=%t}\n"+
 		"\t}",
-		w.Timestamp, w.IfIdx, w.SubIfIdx, w.Direction(), w.Loopback(), w.Impostor(),
+		w.Timestamp, w.Layer, w.Event, w.IfIdx, w.SubIfIdx, w.Direction(), w.Loopback(), w.Impostor(),
 		w.PseudoIPChecksum(), w.PseudoTCPChecksum(), w.PseudoUDPChecksum())
 }
 
@@ -58,3 +98,259 @@ func (w *WinDivertAddress) PseudoTCPChecksum() bool {
 func (w *WinDivertAddress) PseudoUDPChecksum() bool {
 	return (w.Data>>5)&0x1 == 1
 }
+
+// Returns true if the event was sniffed (WinDivert 2.x)
+func (w *WinDivertAddress) Sniffed() bool {
+	return (w.Data>>6)&0x1 == 1
+}
+
+// Returns true if the packet is an IPv6 packet (WinDivert 2.x)
+func (w *WinDivertAddress) IPv6() bool {
+	return (w.Data>>7)&0x1 == 1
+}
+
+// Returns true if the IPv4 checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) ValidIPChecksum() bool {
+	return (w.Data>>8)&0x1 == 1
+}
+
+// Returns true if the TCP checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) ValidTCPChecksum() bool {
+	return (w.Data>>9)&0x1 == 1
+}
+
+// Returns true if the UDP checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) ValidUDPChecksum() bool {
+	return (w.Data>>10)&0x1 == 1
+}
+
+// Sets or clears a bit of Data
+func (w *WinDivertAddress) setBit(bit uint, value bool) {
+	if value {
+		w.Data |= 1 << bit
+	} else {
+		w.Data &^= 1 << bit
+	}
+}
+
+// Sets the direction of the packet
+func (w *WinDivertAddress) SetDirection(direction Direction) {
+	w.setBit(0, bool(direction))
+}
+
+// Sets whether the packet is a loopback packet
+func (w *WinDivertAddress) SetLoopback(loopback bool) {
+	w.setBit(1, loopback)
+}
+
+// Sets whether the packet is an impostor
+func (w *WinDivertAddress) SetImpostor(impostor bool) {
+	w.setBit(2, impostor)
+}
+
+// Sets whether the packet uses a pseudo IP checksum
+func (w *WinDivertAddress) SetPseudoIPChecksum(pseudo bool) {
+	w.setBit(3, pseudo)
+}
+
+// Sets whether the packet uses a pseudo TCP checksum
+func (w *WinDivertAddress) SetPseudoTCPChecksum(pseudo bool) {
+	w.setBit(4, pseudo)
+}
+
+// Sets whether the packet uses a pseudo UDP checksum
+func (w *WinDivertAddress) SetPseudoUDPChecksum(pseudo bool) {
+	w.setBit(5, pseudo)
+}
+
+// Sets whether the event was sniffed (WinDivert 2.x)
+func (w *WinDivertAddress) SetSniffed(sniffed bool) {
+	w.setBit(6, sniffed)
+}
+
+// Sets whether the packet is an IPv6 packet (WinDivert 2.x)
+func (w *WinDivertAddress) SetIPv6(ipv6 bool) {
+	w.setBit(7, ipv6)
+}
+
+// Sets whether the IPv4 checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) SetValidIPChecksum(valid bool) {
+	w.setBit(8, valid)
+}
+
+// Sets whether the TCP checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) SetValidTCPChecksum(valid bool) {
+	w.setBit(9, valid)
+}
+
+// Sets whether the UDP checksum is valid (WinDivert 2.x)
+func (w *WinDivertAddress) SetValidUDPChecksum(valid bool) {
+	w.setBit(10, valid)
+}
+
+// Converts ticks of a performance counter running at frequency Hz to a duration
+func CounterDuration(ticks, frequency int64) time.Duration {
+	seconds := ticks / frequency
+	remainder := ticks % frequency
+	return time.Duration(seconds)*time.Second + time.Duration(remainder*int64(time.Second)/frequency)
+}
+
+// Converts a duration to ticks of a performance counter running at frequency Hz
+func CounterTicks(d time.Duration, frequency int64) int64 {
+	seconds := int64(d / time.Second)
+	remainder := int64(d % time.Second)
+	return seconds*frequency + remainder*frequency/int64(time.Second)
+}
+
+// Returns the frequency of the performance counter used by the timestamps and the time at which it started
+// WinDivert timestamps are QueryPerformanceCounter values
+func CounterReference() (frequency int64, boot time.Time, err error) {
+	frequency, counter, err := queryPerformanceCounter()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return frequency, time.Now().Add(-CounterDuration(counter, frequency)), nil
+}
+
+// Returns the Timestamp as the time elapsed since the performance counter started
+// See CounterReference to get the frequency of the counter
+func (w *WinDivertAddress) TimestampDuration(frequency int64) time.Duration {
+	return CounterDuration(w.Timestamp, frequency)
+}
+
+// Returns the time of the Timestamp, boot is the time at which the performance counter started
+// See CounterReference to get the frequency of the counter and the boot time
+func (w *WinDivertAddress) Time(frequency int64, boot time.Time) time.Time {
+	return boot.Add(w.TimestampDuration(frequency))
+}
+
+// Sets the Timestamp to the given time, boot is the time at which the performance counter started
+func (w *WinDivertAddress) SetTime(t time.Time, frequency int64, boot time.Time) {
+	w.Timestamp = CounterTicks(t.Sub(boot), frequency)
+}
+
+// Returns the data of a Reflect layer address
+func (w *WinDivertAddress) Reflect() (*ReflectData, error) {
+	if w.Layer != WinDivertLayerReflect {
+		return nil, fmt.Errorf("can't read reflect data of a %v layer address", w.Layer)
+	}
+
+	return &ReflectData{
+		Timestamp: int64(binary.LittleEndian.Uint64(w.LayerData[0:8])),
+		ProcessID: binary.LittleEndian.Uint32(w.LayerData[8:12]),
+		Layer:     Layer(binary.LittleEndian.Uint32(w.LayerData[12:16])),
+		Flags:     Flags(binary.LittleEndian.Uint64(w.LayerData[16:24])),
+		Priority:  int16(binary.LittleEndian.Uint16(w.LayerData[24:26])),
+	}, nil
+}
+
+// Represents the WINDIVERT_DATA_REFLECT struct describing an opened or closed WinDivert handle
+type ReflectData struct {
+	Timestamp int64
+	ProcessID uint32
+	Layer     Layer
+	Flags     Flags
+	Priority  int16
+}
+
+// Returns the WINDIVERT_ADDRESS struct of the given ABI as bytes
+func (w *WinDivertAddress) MarshalABI(abi ABIVersion) ([]byte, error) {
+	b := make([]byte, abi.AddressSize())
+	if err := w.encode(b, abi); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reads a WINDIVERT_ADDRESS struct of the given ABI
+func (w *WinDivertAddress) UnmarshalABI(b []byte, abi ABIVersion) error {
+	if len(b) < abi.AddressSize() {
+		return errors.New("WinDivertAddress buffer too small")
+	}
+
+	*w = WinDivertAddress{Timestamp: int64(binary.LittleEndian.Uint64(b[0:8]))}
+
+	if abi == ABIVersion1 {
+		w.IfIdx = binary.LittleEndian.Uint32(b[8:12])
+		w.SubIfIdx = binary.LittleEndian.Uint32(b[12:16])
+		w.Data = uint16(b[16] & 0x3f)
+		return nil
+	}
+
+	bits := binary.LittleEndian.Uint32(b[8:12])
+	w.Layer = Layer(bits & 0xff)
+	w.Event = Event((bits >> 8) & 0xff)
+
+	flag := func(bit uint, dataBit uint) {
+		if (bits>>bit)&0x1 == 1 {
+			w.Data |= 1 << dataBit
+		}
+	}
+	flag(16, 6)  // Sniffed
+	flag(18, 1)  // Loopback
+	flag(19, 2)  // Impostor
+	flag(20, 7)  // IPv6
+	flag(21, 8)  // IPChecksum
+	flag(22, 9)  // TCPChecksum
+	flag(23, 10) // UDPChecksum
+	if (bits>>17)&0x1 == 0 {
+		// Not outbound
+		w.Data |= 0x1
+	}
+
+	if w.Layer == WinDivertLayerNetwork || w.Layer == WinDivertLayerNetworkForward {
+		w.IfIdx = binary.LittleEndian.Uint32(b[16:20])
+		w.SubIfIdx = binary.LittleEndian.Uint32(b[20:24])
+	} else {
+		copy(w.LayerData[:], b[16:80])
+	}
+
+	return nil
+}
+
+// Writes the WINDIVERT_ADDRESS struct of the given ABI in b
+func (w *WinDivertAddress) encode(b []byte, abi ABIVersion) error {
+	if len(b) < abi.AddressSize() {
+		return errors.New("WinDivertAddress buffer too small")
+	}
+	for i := range b[:abi.AddressSize()] {
+		b[i] = 0
+	}
+
+	binary.LittleEndian.PutUint64(b[0:8], uint64(w.Timestamp))
+
+	if abi == ABIVersion1 {
+		binary.LittleEndian.PutUint32(b[8:12], w.IfIdx)
+		binary.LittleEndian.PutUint32(b[12:16], w.SubIfIdx)
+		b[16] = uint8(w.Data & 0x3f)
+		return nil
+	}
+
+	bits := uint32(w.Layer) | uint32(w.Event)<<8
+	flag := func(dataBit uint, bit uint) {
+		if (w.Data>>dataBit)&0x1 == 1 {
+			bits |= 1 << bit
+		}
+	}
+	flag(6, 16)  // Sniffed
+	flag(1, 18)  // Loopback
+	flag(2, 19)  // Impostor
+	flag(7, 20)  // IPv6
+	flag(8, 21)  // IPChecksum
+	flag(9, 22)  // TCPChecksum
+	flag(10, 23) // UDPChecksum
+	if w.Data&0x1 == 0 {
+		// Outbound
+		bits |= 1 << 17
+	}
+	binary.LittleEndian.PutUint32(b[8:12], bits)
+
+	if w.Layer == WinDivertLayerNetwork || w.Layer == WinDivertLayerNetworkForward {
+		binary.LittleEndian.PutUint32(b[16:20], w.IfIdx)
+		binary.LittleEndian.PutUint32(b[20:24], w.SubIfIdx)
+	} else {
+		copy(b[16:80], w.LayerData[:])
+	}
+
+	return nil
+}
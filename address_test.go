@@ -0,0 +1,250 @@
+package godivert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"testing"
+	"time"
+)
+
+// Returns a WINDIVERT_ADDRESS of the ABI with the given timestamp, the rest starting at offset 8
+func abiAddress(abi ABIVersion, timestamp uint64, rest ...byte) []byte {
+	b := make([]byte, abi.AddressSize())
+	binary.LittleEndian.PutUint64(b[0:8], timestamp)
+	copy(b[8:], rest)
+	return b
+}
+
+// Returns the little endian bytes of the words
+func words(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func TestAddressABI(t *testing.T) {
+	var flowData [64]byte
+	for i := range flowData {
+		flowData[i] = byte(i + 1)
+	}
+
+	var reflectData [64]byte
+	binary.LittleEndian.PutUint64(reflectData[0:8], 1234)
+	binary.LittleEndian.PutUint32(reflectData[8:12], 42)
+	binary.LittleEndian.PutUint32(reflectData[12:16], uint32(WinDivertLayerFlow))
+	binary.LittleEndian.PutUint64(reflectData[16:24], uint64(WinDivertFlagSniff))
+	binary.LittleEndian.PutUint16(reflectData[24:26], 0xfffe)
+
+	tests := []struct {
+		name string
+		abi  ABIVersion
+		addr WinDivertAddress
+		raw  []byte
+	}{
+		{
+			name: "1.x outbound loopback pseudo TCP checksum",
+			abi:  ABIVersion1,
+			addr: WinDivertAddress{Timestamp: 100, IfIdx: 7, SubIfIdx: 3, Data: 0x12},
+			// Direction:1, Loopback:1, Impostor:1, PseudoIPChecksum:1, PseudoTCPChecksum:1, PseudoUDPChecksum:1
+			raw: abiAddress(ABIVersion1, 100, append(words(7, 3), 0x12)...),
+		},
+		{
+			name: "1.x inbound impostor",
+			abi:  ABIVersion1,
+			addr: WinDivertAddress{Timestamp: -1, IfIdx: 1, Data: 0x05},
+			raw:  abiAddress(ABIVersion1, 0xffffffffffffffff, append(words(1, 0), 0x05)...),
+		},
+		{
+			name: "2.x network inbound IPv6 valid IP and TCP checksums",
+			abi:  ABIVersion2,
+			addr: WinDivertAddress{Timestamp: 100, IfIdx: 7, SubIfIdx: 3, Data: 0x381,
+				Layer: WinDivertLayerNetwork, Event: WinDivertEventNetworkPacket},
+			// Layer:8, Event:8, Sniffed:1, Outbound:1, Loopback:1, Impostor:1, IPv6:1, IPChecksum:1, TCPChecksum:1, UDPChecksum:1
+			raw: abiAddress(ABIVersion2, 100, words(0x00700000, 0, 7, 3)...),
+		},
+		{
+			name: "2.x forward outbound sniffed loopback",
+			abi:  ABIVersion2,
+			addr: WinDivertAddress{Timestamp: 5, IfIdx: 2, SubIfIdx: 9, Data: 0x42,
+				Layer: WinDivertLayerNetworkForward, Event: WinDivertEventNetworkPacket},
+			raw: abiAddress(ABIVersion2, 5, words(0x00070001, 0, 2, 9)...),
+		},
+		{
+			name: "2.x flow established outbound",
+			abi:  ABIVersion2,
+			addr: WinDivertAddress{Timestamp: 5, Layer: WinDivertLayerFlow, Event: WinDivertEventFlowEstablished,
+				LayerData: flowData},
+			raw: abiAddress(ABIVersion2, 5, append(words(0x00020102, 0), flowData[:]...)...),
+		},
+		{
+			name: "2.x reflect open",
+			abi:  ABIVersion2,
+			addr: WinDivertAddress{Timestamp: 5, Data: 0x01, Layer: WinDivertLayerReflect, Event: WinDivertEventReflectOpen,
+				LayerData: reflectData},
+			raw: abiAddress(ABIVersion2, 5, append(words(0x00000804, 0), reflectData[:]...)...),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := test.addr.MarshalABI(test.abi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(raw, test.raw) {
+				t.Errorf("MarshalABI() =\n%x, want\n%x", raw, test.raw)
+			}
+
+			var addr WinDivertAddress
+			if err := addr.UnmarshalABI(test.raw, test.abi); err != nil {
+				t.Fatal(err)
+			}
+			if addr != test.addr {
+				t.Errorf("UnmarshalABI() = %+v, want %+v", addr, test.addr)
+			}
+		})
+	}
+
+	var addr WinDivertAddress
+	if err := addr.UnmarshalABI(tests[len(tests)-1].raw, ABIVersion2); err != nil {
+		t.Fatal(err)
+	}
+	reflect, err := addr.Reflect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReflectData{Timestamp: 1234, ProcessID: 42, Layer: WinDivertLayerFlow, Flags: WinDivertFlagSniff, Priority: -2}
+	if *reflect != want {
+		t.Errorf("Reflect() = %+v, want %+v", *reflect, want)
+	}
+}
+
+func TestAddressFlags(t *testing.T) {
+	var addr WinDivertAddress
+	addr.Layer = WinDivertLayerNetwork
+	addr.SetDirection(WinDivertDirectionInbound)
+	addr.SetLoopback(true)
+	addr.SetIPv6(true)
+	addr.SetValidUDPChecksum(true)
+
+	raw, err := addr.MarshalABI(ABIVersion2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits := binary.LittleEndian.Uint32(raw[8:12]); bits != 1<<18|1<<20|1<<23 {
+		t.Errorf("bits = %#x, want %#x", bits, 1<<18|1<<20|1<<23)
+	}
+
+	var decoded WinDivertAddress
+	if err := decoded.UnmarshalABI(raw, ABIVersion2); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Direction() != WinDivertDirectionInbound || !decoded.Loopback() || decoded.Impostor() ||
+		!decoded.IPv6() || !decoded.ValidUDPChecksum() || decoded.ValidTCPChecksum() {
+		t.Errorf("decoded flags %#x, want %#x", decoded.Data, addr.Data)
+	}
+
+	if _, err := decoded.Reflect(); err == nil {
+		t.Error("Reflect() of a network address succeeded")
+	}
+
+	if err := decoded.UnmarshalABI(raw[:WinDivertAddressSizeV1], ABIVersion2); err == nil {
+		t.Error("UnmarshalABI() of a short buffer succeeded")
+	}
+}
+
+func TestAddressSetters(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(w *WinDivertAddress, value bool)
+		get  func(w *WinDivertAddress) bool
+		// Whether the flag exists in the WINDIVERT_ADDRESS of each ABI
+		inV1, inV2 bool
+	}{
+		{"Direction", func(w *WinDivertAddress, v bool) { w.SetDirection(Direction(v)) },
+			func(w *WinDivertAddress) bool { return bool(w.Direction()) }, true, true},
+		{"Loopback", (*WinDivertAddress).SetLoopback, (*WinDivertAddress).Loopback, true, true},
+		{"Impostor", (*WinDivertAddress).SetImpostor, (*WinDivertAddress).Impostor, true, true},
+		{"PseudoIPChecksum", (*WinDivertAddress).SetPseudoIPChecksum, (*WinDivertAddress).PseudoIPChecksum, true, false},
+		{"PseudoTCPChecksum", (*WinDivertAddress).SetPseudoTCPChecksum, (*WinDivertAddress).PseudoTCPChecksum, true, false},
+		{"PseudoUDPChecksum", (*WinDivertAddress).SetPseudoUDPChecksum, (*WinDivertAddress).PseudoUDPChecksum, true, false},
+		{"Sniffed", (*WinDivertAddress).SetSniffed, (*WinDivertAddress).Sniffed, false, true},
+		{"IPv6", (*WinDivertAddress).SetIPv6, (*WinDivertAddress).IPv6, false, true},
+		{"ValidIPChecksum", (*WinDivertAddress).SetValidIPChecksum, (*WinDivertAddress).ValidIPChecksum, false, true},
+		{"ValidTCPChecksum", (*WinDivertAddress).SetValidTCPChecksum, (*WinDivertAddress).ValidTCPChecksum, false, true},
+		{"ValidUDPChecksum", (*WinDivertAddress).SetValidUDPChecksum, (*WinDivertAddress).ValidUDPChecksum, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, value := range []bool{true, false} {
+				// Every other flag is set so that the setter must only change its own bit
+				addr := WinDivertAddress{Data: 0x7ff}
+				test.set(&addr, value)
+				if got := test.get(&addr); got != value {
+					t.Fatalf("%s() = %v after setting it to %v", test.name, got, value)
+				}
+				if value && addr.Data != 0x7ff || !value && bits.OnesCount16(addr.Data) != 10 {
+					t.Errorf("Set%s(%v) changed the other flags: %#x", test.name, value, addr.Data)
+				}
+
+				for _, abi := range []ABIVersion{ABIVersion1, ABIVersion2} {
+					raw, err := addr.MarshalABI(abi)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var decoded WinDivertAddress
+					if err := decoded.UnmarshalABI(raw, abi); err != nil {
+						t.Fatal(err)
+					}
+
+					want := value
+					if inABI := abi == ABIVersion1 && test.inV1 || abi == ABIVersion2 && test.inV2; !inABI {
+						// The flag doesn't exist in the ABI, it is lost
+						want = false
+					}
+					if got := test.get(&decoded); got != want {
+						t.Errorf("%d.x: %s() = %v after a round trip of %v, want %v", abi, test.name, got, value, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAddressTime(t *testing.T) {
+	const frequency = 10000000
+	boot := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		ticks int64
+	}{
+		{"boot", boot, 0},
+		{"one second", boot.Add(time.Second), frequency},
+		{"100ns resolution", boot.Add(90*time.Minute + 123456700), 90*60*frequency + 1234567},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var addr WinDivertAddress
+			addr.SetTime(test.at, frequency, boot)
+			if addr.Timestamp != test.ticks {
+				t.Errorf("SetTime() Timestamp = %d, want %d", addr.Timestamp, test.ticks)
+			}
+			if got := addr.Time(frequency, boot); !got.Equal(test.at) {
+				t.Errorf("Time() = %v, want %v", got, test.at)
+			}
+		})
+	}
+
+	// A day of ticks doesn't overflow
+	day := CounterTicks(24*time.Hour, 3579545)
+	if got := CounterDuration(day, 3579545); got != 24*time.Hour {
+		t.Errorf("CounterDuration() = %v, want 24h", got)
+	}
+}
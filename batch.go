@@ -0,0 +1,244 @@
+package godivert
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Maximum number of packets received or sent by a single RecvBatch or SendBatch call
+const WinDivertBatchMax = 0xff
+
+// Reusable buffers of WINDIVERT_ADDRESS structs for a whole batch
+var addrBatchPool = sync.Pool{
+	New: func() interface{} {
+		return new([WinDivertBatchMax * WinDivertAddressSizeV2]byte)
+	},
+}
+
+// Reusable buffers holding the packets of a batch to send
+var sendBatchPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 64*1024)
+		return &buffer
+	},
+}
+
+// Capacity above which a send buffer isn't kept in sendBatchPool
+// A batch of large packets can grow a buffer up to WinDivertBatchMax * MaxPacketSize bytes
+const maxPooledSendBuffer = 256 * 1024
+
+// Returned by RecvBatch when the driver returned more packets than addresses
+// The Missing packets following the returned ones have been received without address,
+// their Addr is nil: they are lost unless the caller reinjects them with an address of its own
+type MissingAddressError struct {
+	Missing int
+}
+
+func (e *MissingAddressError) Error() string {
+	return fmt.Sprintf("received %d packets without address", e.Missing)
+}
+
+// Returns the length of the IP packet at the beginning of the buffer
+func ipPacketLen(buffer []byte) (int, error) {
+	if len(buffer) < 1 {
+		return 0, errors.New("empty buffer")
+	}
+
+	switch buffer[0] >> 4 {
+	case 4:
+		if len(buffer) < 4 {
+			return 0, errors.New("truncated IPv4 header")
+		}
+		return int(binary.BigEndian.Uint16(buffer[2:4])), nil
+	case 6:
+		if len(buffer) < 6 {
+			return 0, errors.New("truncated IPv6 header")
+		}
+		return 40 + int(binary.BigEndian.Uint16(buffer[4:6])), nil
+	default:
+		return 0, fmt.Errorf("invalid IP version %d", buffer[0]>>4)
+	}
+}
+
+// Splits a buffer holding consecutive IP packets, as filled by WinDivertRecvEx, into packets
+// The Raw field of each packet is a slice of the buffer, nil entries are allocated
+// and existing packets are reused: their headers are parsed again when needed
+// Returns the number of packets found
+func SplitBatch(buffer []byte, packets []*Packet) (int, error) {
+	n := 0
+	for len(buffer) > 0 {
+		if n == len(packets) {
+			return n, errors.New("more packets in the buffer than in the slice")
+		}
+
+		packetLen, err := ipPacketLen(buffer)
+		if err != nil {
+			return n, err
+		}
+		if packetLen == 0 || packetLen > len(buffer) {
+			return n, fmt.Errorf("invalid packet length %d with %d bytes left", packetLen, len(buffer))
+		}
+
+		if packets[n] == nil {
+			packets[n] = &Packet{}
+		}
+		packets[n].reset(buffer[:packetLen:packetLen])
+
+		buffer = buffer[packetLen:]
+		n++
+	}
+	return n, nil
+}
+
+// Divert up to len(packets) packets from the Network Stack in a single call to WinDivertRecvEx
+// The packets are written in buffer which must be large enough to hold them,
+// the Raw field of the packets is a slice of it: the buffer can be reused once
+// the packets have been handled
+// nil entries of packets are allocated, existing packets and addresses are reused
+// Returns the number of packets received
+// If the buffer can't be split or doesn't match the addresses, the packets having an address
+// are returned along with the error: they must be handled, and reinjected, before the error
+// The packets received without address are reported with a *MissingAddressError
+// With WinDivert 1.x, a single packet is received
+// https://reqrypt.org/windivert-doc.html#divert_recv_ex
+func (wd *WinDivertHandle) RecvBatch(buffer []byte, packets []*Packet) (int, error) {
+	if err := wd.checkRecv(); err != nil {
+		return 0, err
+	}
+	if len(packets) == 0 {
+		return 0, nil
+	}
+	if len(packets) > WinDivertBatchMax {
+		packets = packets[:WinDivertBatchMax]
+	}
+
+	addrBuffer := addrBatchPool.Get().(*[WinDivertBatchMax * WinDivertAddressSizeV2]byte)
+	defer addrBatchPool.Put(addrBuffer)
+
+	var recvLen uint
+	var addrCount int
+	var err error
+
+	if wd.abi == ABIVersion1 {
+		recvLen, err = divertRecv(wd.handle, buffer, addrBuffer[:WinDivertAddressSizeV1], wd.abi)
+		addrCount = 1
+	} else {
+		var addrLen uint
+		recvLen, addrLen, err = divertRecvEx(wd.handle, buffer, addrBuffer[:len(packets)*WinDivertAddressSizeV2])
+		addrCount = int(addrLen) / WinDivertAddressSizeV2
+	}
+	if err != nil {
+		wd.observeRecv(nil, err)
+		return 0, err
+	}
+
+	n, err := decodeBatch(buffer[:recvLen], addrBuffer[:], addrCount, wd.abi, packets)
+	for _, packet := range packets[:n] {
+		wd.observeRecv(packet, nil)
+	}
+	if err != nil {
+		wd.observeRecv(nil, err)
+	}
+	return n, err
+}
+
+// Splits the packets of a received batch and decodes the addrCount addresses of addrBuffer
+// Returns the number of packets having an address, see RecvBatch
+func decodeBatch(buffer, addrBuffer []byte, addrCount int, abi ABIVersion, packets []*Packet) (int, error) {
+	// The packets found before a malformed one and having an address are still returned
+	found, splitErr := SplitBatch(buffer, packets)
+	n := found
+	if n > addrCount {
+		n = addrCount
+	}
+
+	size := abi.AddressSize()
+	for i, packet := range packets[:n] {
+		if packet.Addr == nil {
+			packet.Addr = &packet.addr
+		}
+		if err := packet.Addr.UnmarshalABI(addrBuffer[i*size:(i+1)*size], abi); err != nil {
+			return 0, err
+		}
+	}
+	// Reused packets must not keep the address of a previous batch
+	for _, packet := range packets[n:found] {
+		packet.Addr = nil
+	}
+
+	switch {
+	case splitErr != nil:
+		return n, splitErr
+	case found > addrCount:
+		return n, &MissingAddressError{Missing: found - addrCount}
+	case found < addrCount:
+		return n, fmt.Errorf("received %d packets but %d addresses", found, addrCount)
+	}
+	return n, nil
+}
+
+// Inject the packets on the Network Stack in a single call to WinDivertSendEx
+// Modified packets get a new checksum like with Packet.Send
+// Returns the number of bytes injected
+// With WinDivert 1.x, the packets are sent one by one
+// https://reqrypt.org/windivert-doc.html#divert_send_ex
+func (wd *WinDivertHandle) SendBatch(packets []*Packet) (uint, error) {
+	if err := wd.checkSend(); err != nil {
+		return 0, err
+	}
+	if len(packets) > WinDivertBatchMax {
+		return 0, fmt.Errorf("can't send more than %d packets at once", WinDivertBatchMax)
+	}
+
+	for _, packet := range packets {
+		if packet.needNewChecksum() {
+			wd.HelperCalcChecksum(packet)
+		}
+	}
+
+	if wd.abi == ABIVersion1 {
+		var sent uint
+		for _, packet := range packets {
+			sendLen, err := wd.Send(packet)
+			sent += sendLen
+			if err != nil {
+				return sent, err
+			}
+		}
+		return sent, nil
+	}
+
+	addrBuffer := addrBatchPool.Get().(*[WinDivertBatchMax * WinDivertAddressSizeV2]byte)
+	defer addrBatchPool.Put(addrBuffer)
+
+	bufferPtr := sendBatchPool.Get().(*[]byte)
+	buffer := (*bufferPtr)[:0]
+	defer func() {
+		// The buffers grown by large batches are left to the garbage collector
+		if cap(buffer) <= maxPooledSendBuffer {
+			*bufferPtr = buffer
+			sendBatchPool.Put(bufferPtr)
+		}
+	}()
+
+	for i, packet := range packets {
+		buffer = append(buffer, packet.Raw[:packet.PacketLen]...)
+
+		addr := WinDivertAddress{}
+		if packet.Addr != nil {
+			addr = *packet.Addr
+		}
+		slot := addrBuffer[i*WinDivertAddressSizeV2 : (i+1)*WinDivertAddressSizeV2]
+		if err := addr.encode(slot, wd.abi); err != nil {
+			return 0, err
+		}
+	}
+
+	sent, err := divertSendEx(wd.handle, buffer, addrBuffer[:len(packets)*WinDivertAddressSizeV2])
+	for _, packet := range packets {
+		wd.observeSend(packet, err)
+	}
+	return sent, err
+}
@@ -0,0 +1,149 @@
+package godivert
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+func TestSplitBatch(t *testing.T) {
+	syn := testpacket.SYN()
+
+	ipv6 := make([]byte, 40+8)
+	ipv6[0] = 0x60
+	ipv6[5] = 8
+	ipv6[6] = 17
+
+	concat := func(packets ...[]byte) []byte {
+		return bytes.Join(packets, nil)
+	}
+
+	tests := []struct {
+		name    string
+		buffer  []byte
+		slots   int
+		want    [][]byte
+		wantErr bool
+	}{
+		{"empty", nil, 4, nil, false},
+		{"single", syn, 4, [][]byte{syn}, false},
+		{"ipv4 and ipv6", concat(syn, ipv6, syn), 4, [][]byte{syn, ipv6, syn}, false},
+		{"exact slots", concat(syn, ipv6), 2, [][]byte{syn, ipv6}, false},
+		{"too many packets", concat(syn, ipv6, syn), 2, [][]byte{syn, ipv6}, true},
+		{"truncated last packet", concat(syn, ipv6[:30]), 4, [][]byte{syn}, true},
+		{"invalid version", concat(syn, []byte{0x50, 0, 0, 20}), 4, [][]byte{syn}, true},
+		{"zero length", concat(syn, []byte{0x45, 0, 0, 0}), 4, [][]byte{syn}, true},
+		{"truncated ipv4 length", concat(syn, []byte{0x45, 0}), 4, [][]byte{syn}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packets := make([]*Packet, test.slots)
+			n, err := SplitBatch(test.buffer, packets)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("SplitBatch() error = %v, want error %v", err, test.wantErr)
+			}
+			if n != len(test.want) {
+				t.Fatalf("SplitBatch() = %d, want %d", n, len(test.want))
+			}
+
+			for i, want := range test.want {
+				packet := packets[i]
+				if !bytes.Equal(packet.Raw, want) || packet.PacketLen != uint(len(want)) {
+					t.Errorf("packet %d = %x (length %d), want %x", i, packet.Raw, packet.PacketLen, want)
+				}
+				if cap(packet.Raw) != len(want) {
+					t.Errorf("packet %d capacity %d, the packet could grow over the next one", i, cap(packet.Raw))
+				}
+				if err := packet.VerifyParsed(); err != nil {
+					t.Errorf("packet %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitBatchReuse(t *testing.T) {
+	syn := testpacket.SYN()
+	udp := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 1234, nil)
+
+	packets := make([]*Packet, 2)
+	if _, err := SplitBatch(append(append([]byte(nil), syn...), syn...), packets); err != nil {
+		t.Fatal(err)
+	}
+	first := packets[0]
+	if port, _ := first.DstPort(); port != 80 {
+		t.Fatalf("DstPort() = %d, want 80", port)
+	}
+
+	if _, err := SplitBatch(udp, packets); err != nil {
+		t.Fatal(err)
+	}
+	if packets[0] != first {
+		t.Error("the packet hasn't been reused")
+	}
+	if port, _ := packets[0].DstPort(); port != 1234 {
+		t.Errorf("DstPort() = %d after reuse, want 1234", port)
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	syn := testpacket.SYN()
+	udp := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 1234, nil)
+	buffer := bytes.Join([][]byte{syn, udp, syn}, nil)
+
+	// Addresses with the timestamps 1, 2 and 3
+	var addrBuffer []byte
+	for i := 1; i <= 3; i++ {
+		addrBuffer = append(addrBuffer, abiAddress(ABIVersion2, uint64(i))...)
+	}
+
+	tests := []struct {
+		name        string
+		buffer      []byte
+		addrCount   int
+		want        int
+		wantMissing int
+		wantErr     bool
+	}{
+		{"consistent", buffer, 3, 3, 0, false},
+		{"missing address", buffer, 2, 2, 1, true},
+		{"missing packet", buffer[:len(syn)+len(udp)], 3, 2, 0, true},
+		{"truncated packet", buffer[:len(buffer)-1], 3, 2, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The packets of a previous batch are reused
+			packets := make([]*Packet, 4)
+			for i := range packets {
+				packets[i] = &Packet{Addr: &WinDivertAddress{Timestamp: 42}}
+			}
+
+			n, err := decodeBatch(test.buffer, addrBuffer, test.addrCount, ABIVersion2, packets)
+			if n != test.want || (err != nil) != test.wantErr {
+				t.Fatalf("decodeBatch() = %d, %v, want %d and error %v", n, err, test.want, test.wantErr)
+			}
+			for i, packet := range packets[:n] {
+				if packet.Addr == nil || packet.Addr.Timestamp != int64(i+1) {
+					t.Errorf("packet %d address = %+v, want timestamp %d", i, packet.Addr, i+1)
+				}
+			}
+
+			var missingErr *MissingAddressError
+			if errors.As(err, &missingErr) != (test.wantMissing > 0) {
+				t.Fatalf("decodeBatch() error = %v, want a MissingAddressError %v", err, test.wantMissing > 0)
+			}
+			if missingErr != nil && missingErr.Missing != test.wantMissing {
+				t.Errorf("Missing = %d, want %d", missingErr.Missing, test.wantMissing)
+			}
+			for _, packet := range packets[n : n+test.wantMissing] {
+				if packet.Addr != nil || len(packet.Raw) == 0 {
+					t.Errorf("packet without address = %x with address %+v, want the packet with a nil address", packet.Raw, packet.Addr)
+				}
+			}
+		})
+	}
+}
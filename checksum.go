@@ -0,0 +1,88 @@
+package godivert
+
+import (
+	"encoding/binary"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// Calculates the IPv4 header checksum and the TCP, UDP, ICMPv4 or ICMPv6 checksum of the packet in Go
+// Unlike HelperCalcChecksum it doesn't need the DLL, so it can be used with packets read from files on any OS
+// The pseudo checksum flags of the packet's address are cleared
+func (p *Packet) CalcChecksums() {
+	p.VerifyParsed()
+
+	p.calcIPChecksum()
+	p.calcTransportChecksum()
+
+	if p.Addr != nil {
+		p.Addr.SetPseudoIPChecksum(false)
+		p.Addr.SetPseudoTCPChecksum(false)
+		p.Addr.SetPseudoUDPChecksum(false)
+	}
+}
+
+// Calculates the checksum of the IPv4 header, IPv6 headers have none
+func (p *Packet) calcIPChecksum() {
+	ipv4, ok := p.IpHdr.(*header.IPv4Header)
+	if !ok {
+		return
+	}
+
+	ipv4.Raw[10], ipv4.Raw[11] = 0, 0
+	binary.BigEndian.PutUint16(ipv4.Raw[10:12], header.Checksum(ipv4.Raw, 0))
+}
+
+// Calculates the checksum of the TCP, UDP or ICMP header and its payload
+func (p *Packet) calcTransportChecksum() {
+	if p.NextHeader == nil || p.laterFragment() {
+		return
+	}
+
+	var offset int
+	switch p.nextHeaderType {
+	case header.TCP:
+		offset = 16
+	case header.UDP:
+		offset = 6
+	case header.ICMPv4, header.ICMPv6:
+		offset = 2
+	default:
+		return
+	}
+
+	segment := p.data()[p.hdrLen:]
+	if len(segment) < offset+2 {
+		return
+	}
+	segment[offset], segment[offset+1] = 0, 0
+
+	// ICMPv4 is the only one without pseudo header
+	var sum uint32
+	if p.nextHeaderType != header.ICMPv4 {
+		sum = p.pseudoHeaderSum(len(segment))
+	}
+
+	checksum := header.Checksum(segment, sum)
+	if checksum == 0 && p.nextHeaderType == header.UDP {
+		// 0 means no checksum for UDP
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[offset:], checksum)
+}
+
+// Returns the sum of the pseudo header covered by the transport checksum
+// https://datatracker.ietf.org/doc/html/rfc793#section-3.1 and https://datatracker.ietf.org/doc/html/rfc8200#section-8.1
+func (p *Packet) pseudoHeaderSum(length int) uint32 {
+	var pseudo []byte
+	if p.ipVersion == 4 {
+		pseudo = append(pseudo, p.Raw[12:20]...)
+		pseudo = append(pseudo, 0, p.nextHeaderType)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(length))
+	} else {
+		pseudo = append(pseudo, p.Raw[8:40]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(length))
+		pseudo = append(pseudo, 0, 0, 0, p.nextHeaderType)
+	}
+	return header.Sum(pseudo, 0)
+}
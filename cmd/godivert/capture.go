@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/pcap"
+)
+
+// Prints the packets until the end of the file, the count or Ctrl-C
+func runCapture(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	sourceFlags := addSourceFlags(fs)
+	asJSON := fs.Bool("json", false, "print one JSON object per packet")
+	raw := fs.Bool("x", false, "print the bytes of the packets in hex, ignored with -json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	src, err := sourceFlags.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+
+	for {
+		packet, err := src.next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		t := src.time(packet)
+		if *asJSON {
+			if err := encoder.Encode(&packetRecord{Time: t, Packet: packet}); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintln(out, formatPacket(packet, t))
+			if *raw {
+				fmt.Fprintln(out, hexDump(packet))
+			}
+		}
+
+		// Live packets are printed as soon as they are captured
+		if sourceFlags.file == "" {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Implemented by pcap.Writer and pcap.NgWriter
+type packetWriter interface {
+	WritePacket(packet *godivert.Packet) error
+}
+
+// Saves the packets until the end of the file, the count or Ctrl-C
+func runWrite(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	sourceFlags := addSourceFlags(fs)
+	output := fs.String("w", "", "write the packets to `file`")
+	ng := fs.Bool("ng", false, "use the pcapng format, it keeps the interfaces and directions")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if *output == "" {
+		fs.Usage()
+		return errors.New("the output file is required")
+	}
+
+	src, err := sourceFlags.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+
+	var writer packetWriter
+	if *ng {
+		w, err := pcap.NewNgWriter(buffered)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Clock = src.clock
+		writer = w
+	} else {
+		w, err := pcap.NewWriter(buffered, pcap.LinkTypeRaw)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Clock = src.clock
+		writer = w
+	}
+
+	written := 0
+	err = func() error {
+		for {
+			packet, err := src.next(ctx)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := writer.WritePacket(packet); err != nil {
+				return err
+			}
+			written++
+		}
+	}()
+
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	fmt.Fprintf(os.Stderr, "%d packets written to %s\n", written, *output)
+	return err
+}
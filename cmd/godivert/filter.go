@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Descriptions of the fields of the Network layer filters
+// See https://reqrypt.org/windivert-doc.html#filter_language
+var filterFields = map[string]string{
+	"true":      "always matches",
+	"false":     "never matches",
+	"zero":      "the value 0",
+	"inbound":   "the packet is inbound",
+	"outbound":  "the packet is outbound",
+	"fragment":  "the packet is an IP fragment",
+	"loopback":  "the packet is on the loopback interface",
+	"impostor":  "the packet was injected by another handle",
+	"ifidx":     "index of the interface",
+	"subifidx":  "index of the sub-interface",
+	"length":    "length of the packet",
+	"timestamp": "performance counter value of the capture",
+	"random8":   "random 8 bits value",
+	"random16":  "random 16 bits value",
+	"random32":  "random 32 bits value",
+	"packet":    "byte of the packet at the index",
+	"packet16":  "16 bits word of the packet at the index",
+	"packet32":  "32 bits word of the packet at the index",
+
+	"ip":           "the packet is IPv4",
+	"ip.hdrlength": "IPv4 header length in 32 bits words",
+	"ip.tos":       "IPv4 type of service",
+	"ip.length":    "IPv4 total length",
+	"ip.id":        "IPv4 identification",
+	"ip.df":        "IPv4 don't fragment flag",
+	"ip.mf":        "IPv4 more fragments flag",
+	"ip.fragoff":   "IPv4 fragment offset",
+	"ip.ttl":       "IPv4 time to live",
+	"ip.protocol":  "IPv4 protocol",
+	"ip.checksum":  "IPv4 header checksum",
+	"ip.srcaddr":   "IPv4 source address",
+	"ip.dstaddr":   "IPv4 destination address",
+
+	"ipv6":              "the packet is IPv6",
+	"ipv6.trafficclass": "IPv6 traffic class",
+	"ipv6.flowlabel":    "IPv6 flow label",
+	"ipv6.length":       "IPv6 payload length",
+	"ipv6.nexthdr":      "IPv6 next header",
+	"ipv6.hoplimit":     "IPv6 hop limit",
+	"ipv6.srcaddr":      "IPv6 source address",
+	"ipv6.dstaddr":      "IPv6 destination address",
+
+	"icmp":          "the packet is ICMP",
+	"icmp.type":     "ICMP type",
+	"icmp.code":     "ICMP code",
+	"icmp.checksum": "ICMP checksum",
+	"icmp.body":     "ICMP rest of header",
+
+	"icmpv6":          "the packet is ICMPv6",
+	"icmpv6.type":     "ICMPv6 type",
+	"icmpv6.code":     "ICMPv6 code",
+	"icmpv6.checksum": "ICMPv6 checksum",
+	"icmpv6.body":     "ICMPv6 rest of header",
+
+	"tcp":               "the packet is TCP",
+	"tcp.srcport":       "TCP source port",
+	"tcp.dstport":       "TCP destination port",
+	"tcp.seqnum":        "TCP sequence number",
+	"tcp.acknum":        "TCP acknowledgement number",
+	"tcp.hdrlength":     "TCP header length in 32 bits words",
+	"tcp.urg":           "TCP URG flag",
+	"tcp.ack":           "TCP ACK flag",
+	"tcp.psh":           "TCP PSH flag",
+	"tcp.rst":           "TCP RST flag",
+	"tcp.syn":           "TCP SYN flag",
+	"tcp.fin":           "TCP FIN flag",
+	"tcp.window":        "TCP window size",
+	"tcp.checksum":      "TCP checksum",
+	"tcp.urgptr":        "TCP urgent pointer",
+	"tcp.payloadlength": "length of the TCP payload",
+	"tcp.payload":       "byte of the TCP payload at the index",
+	"tcp.payload16":     "16 bits word of the TCP payload at the index",
+	"tcp.payload32":     "32 bits word of the TCP payload at the index",
+
+	"udp":               "the packet is UDP",
+	"udp.srcport":       "UDP source port",
+	"udp.dstport":       "UDP destination port",
+	"udp.length":        "UDP length",
+	"udp.checksum":      "UDP checksum",
+	"udp.payloadlength": "length of the UDP payload",
+	"udp.payload":       "byte of the UDP payload at the index",
+	"udp.payload16":     "16 bits word of the UDP payload at the index",
+	"udp.payload32":     "32 bits word of the UDP payload at the index",
+}
+
+// Operators and keywords that aren't fields
+var filterKeywords = map[string]bool{"and": true, "or": true, "not": true}
+
+// Returns the names of the fields used by the filter, in order of appearance and without duplicates
+func filterFieldNames(filter string) []string {
+	isIdent := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) || i > 0 && isIdent(runes[i-1]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && isIdent(runes[i]) {
+			i++
+		}
+		// IPv6 addresses such as fe80::1 start with letters
+		if i < len(runes) && runes[i] == ':' {
+			continue
+		}
+
+		name := string(runes[start:i])
+		lower := strings.ToLower(name)
+		if filterKeywords[lower] || seen[lower] {
+			continue
+		}
+		seen[lower] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// Validates the filter with the DLL and describes its fields
+func runCheckFilter(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	layerName := fs.String("layer", "network", "`layer` the filter is checked for, network or forward")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("the filter is required")
+	}
+	layer, err := parseLayer(*layerName)
+	if err != nil {
+		return err
+	}
+	filter := strings.Join(fs.Args(), " ")
+
+	fmt.Printf("filter:    %s\n", filter)
+
+	var invalid error
+	abi, err := godivert.DetectABIVersion()
+	checked := err == nil
+	if !checked {
+		fmt.Printf("validity:  not checked, %v\n", err)
+	} else if ok, pos, msg := godivert.HelperCheckFilterLayer(filter, layer); !ok {
+		// Point at the error under the filter
+		fmt.Printf("           %s^\n", strings.Repeat(" ", len([]rune(filter[:min(pos, len(filter))]))))
+		fmt.Printf("validity:  invalid at position %d, %s\n", pos, msg)
+		invalid = fmt.Errorf("invalid filter at position %d: %s", pos, msg)
+	} else {
+		fmt.Printf("validity:  valid for the %v layer of WinDivert %d.x\n", layer, abi)
+		if canonical, err := godivert.HelperFormatFilter(filter, layer); err == nil {
+			fmt.Printf("canonical: %s\n", canonical)
+		}
+	}
+
+	var unknown []string
+	names := filterFieldNames(filter)
+	if len(names) > 0 {
+		fmt.Println("fields:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, name := range names {
+			description, ok := filterFields[strings.ToLower(name)]
+			if !ok {
+				unknown = append(unknown, name)
+				description = "unknown field"
+				if suggestion := suggestField(name); suggestion != "" {
+					description += ", did you mean " + suggestion + "?"
+				}
+			}
+			fmt.Fprintf(w, "  %s\t%s\n", name, description)
+		}
+		w.Flush()
+	}
+
+	// Without the DLL the unknown fields are the only errors found
+	if !checked && len(unknown) > 0 {
+		return fmt.Errorf("unknown field %s", strings.Join(unknown, ", "))
+	}
+	return invalid
+}
+
+// Returns the known field starting like the given one, empty if there are none or several
+func suggestField(name string) string {
+	lower := strings.ToLower(name)
+	var matches []string
+	for field := range filterFields {
+		if strings.HasPrefix(field, lower) {
+			matches = append(matches, field)
+		}
+	}
+	if len(matches) != 1 {
+		return ""
+	}
+	return matches[0]
+}
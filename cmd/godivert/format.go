@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Returns a tcpdump-style line describing the packet, prefixed with its time, direction and interface
+//
+//	12:04:05.123456 out if 7.0 IP 10.0.0.2.51234 > 1.1.1.1.443: Flags [S], seq 1234, win 64240, length 0
+func formatPacket(packet *godivert.Packet, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(t.Format("15:04:05.000000"))
+
+	if addr := packet.Addr; addr != nil {
+		if addr.Direction() == godivert.WinDivertDirectionInbound {
+			b.WriteString(" in")
+		} else {
+			b.WriteString(" out")
+		}
+		fmt.Fprintf(&b, " if %d.%d", addr.IfIdx, addr.SubIfIdx)
+		if addr.Loopback() {
+			b.WriteString(" loopback")
+		}
+		if addr.Impostor() {
+			b.WriteString(" impostor")
+		}
+	}
+
+	fmt.Fprintf(&b, " %v", packet)
+	return b.String()
+}
+
+// Returns an indented hex dump of the packet
+func hexDump(packet *godivert.Packet) string {
+	return "\t" + strings.ReplaceAll(fmt.Sprintf("%x", packet), "\n", "\n\t")
+}
+
+// Represents a packet printed as a JSON line
+type packetRecord struct {
+	Time   time.Time        `json:"time"`
+	Packet *godivert.Packet `json:"packet"`
+}
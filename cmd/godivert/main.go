@@ -0,0 +1,102 @@
+// Command godivert captures, filters, saves and replays packets.
+//
+// Packets are captured live with the WinDivert DLL on Windows, or read from a
+// pcap or pcapng file with -r on every OS:
+//
+//	godivert capture -f "tcp.DstPort == 443" -c 10
+//	godivert capture -r capture.pcapng -json
+//	godivert write -f "udp" -w dns.pcapng -ng
+//	godivert check-filter "outbound and tcp.Syn"
+//	godivert replay capture.pcap -speed 2
+//	godivert stats -r capture.pcap -top 5
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// Represents a subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"capture", "capture [-r file] [-f filter] [-layer layer] [-c count] [-json | -x]", "print packets tcpdump-style or as JSON lines", runCapture},
+	{"write", "write -w file [-ng] [-r file] [-f filter] [-layer layer] [-c count]", "save packets to a pcap or pcapng file", runWrite},
+	{"check-filter", "check-filter [-layer layer] filter", "validate a filter and explain its fields", runCheckFilter},
+	{"replay", "replay [-speed factor] [-c count] [-f filter] [-if index] file", "inject the packets of a pcap file (Windows only)", runReplay},
+	{"stats", "stats [-r file] [-f filter] [-layer layer] [-c count] [-top n]", "count packets by protocol, direction and flow", runStats},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: godivert <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun godivert <command> -h for the arguments of a command\n")
+}
+
+// Returns a FlagSet printing the usage of the command on error
+func newFlagSet(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: godivert %s\n\n%s\n\n", c.usage, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Returned by the commands when the arguments are invalid, the usage has already been printed
+var errUsage = errors.New("invalid arguments")
+
+// Parses the arguments of the command, the flag package prints the errors and the usage
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	return nil
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	c := findCommand(os.Args[1])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "godivert: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	// Ctrl-C stops the capture, the packets already received are still handled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := c.run(ctx, newFlagSet(c), os.Args[2:])
+	if err == errUsage {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "godivert %s: %v\n", c.name, err)
+		os.Exit(1)
+	}
+}
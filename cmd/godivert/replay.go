@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Injects the packets of a file with their original timing
+func runReplay(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	filter := fs.String("f", "", "WinDivert `filter` of the packets to inject")
+	count := fs.Int("c", 0, "stop after `count` packets, 0 for no limit")
+	speed := fs.Float64("speed", 1, "speed `factor` of the replay, 0 injects the packets as fast as possible")
+	ifIdx := fs.Int("if", -1, "inject the packets on the interface `index` instead of their original one")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a single file is required")
+	}
+	if *speed < 0 {
+		return errors.New("the speed can't be negative")
+	}
+
+	abi, err := godivert.DetectABIVersion()
+	if err != nil {
+		if errors.Is(err, godivert.ErrNotSupported) {
+			return errors.New("replay requires WinDivert on Windows")
+		}
+		return err
+	}
+
+	src, err := openFile(fs.Arg(0), *filter, *count)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	var options godivert.HandleOptions
+	if abi != godivert.ABIVersion1 {
+		options.Flags = godivert.WinDivertFlagSendOnly
+	}
+	wd, err := godivert.NewWinDivertHandleWithOptions("false", options)
+	if err != nil {
+		return err
+	}
+	defer wd.Close()
+
+	var first, start time.Time
+	sent := 0
+	defer func() {
+		fmt.Fprintf(os.Stderr, "%d packets injected\n", sent)
+	}()
+
+	for {
+		packet, err := src.next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Wait until the packet is due relative to the first one
+		t := src.time(packet)
+		if first.IsZero() {
+			first, start = t, time.Now()
+		} else if *speed > 0 {
+			due := start.Add(time.Duration(float64(t.Sub(first)) / *speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		if *ifIdx >= 0 && packet.Addr != nil {
+			packet.Addr.IfIdx = uint32(*ifIdx)
+			packet.Addr.SubIfIdx = 0
+		}
+
+		// Captured packets often have offloaded checksums
+		wd.HelperCalcChecksum(packet)
+		if _, err := wd.Send(packet); err != nil {
+			return err
+		}
+		sent++
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/pcap"
+)
+
+// Represents the flags selecting the packets of a command
+type sourceFlags struct {
+	file   string
+	filter string
+	layer  string
+	count  int
+}
+
+func addSourceFlags(fs *flag.FlagSet) *sourceFlags {
+	s := &sourceFlags{}
+	fs.StringVar(&s.file, "r", "", "read the packets from a pcap or pcapng `file` instead of capturing them")
+	fs.StringVar(&s.filter, "f", "", "WinDivert `filter` of the packets, files are filtered with the DLL")
+	fs.StringVar(&s.layer, "layer", "network", "`layer` of the capture, network or forward")
+	fs.IntVar(&s.count, "c", 0, "stop after `count` packets, 0 for no limit")
+	return s
+}
+
+// Returns the layer named by the -layer flag
+func parseLayer(name string) (godivert.Layer, error) {
+	switch strings.ToLower(name) {
+	case "network", "":
+		return godivert.WinDivertLayerNetwork, nil
+	case "forward", "networkforward", "network_forward":
+		return godivert.WinDivertLayerNetworkForward, nil
+	}
+	return 0, fmt.Errorf("unknown layer %q, expected network or forward", name)
+}
+
+// Produces the packets of a capture or a file
+type source struct {
+	recv  func(ctx context.Context) (*godivert.Packet, error)
+	close func() error
+	// Packets of files are filtered with EvalFilter, the handle filters the live packets
+	filter string
+	// Converts the timestamps of the packets
+	clock pcap.Clock
+
+	count int
+	read  int
+}
+
+// Opens the file given with -r, or a sniffing handle on Windows
+func (s *sourceFlags) open() (*source, error) {
+	layer, err := parseLayer(s.layer)
+	if err != nil {
+		return nil, err
+	}
+	if s.file != "" {
+		return openFile(s.file, s.filter, s.count)
+	}
+	return openCapture(s.filter, layer, s.count)
+}
+
+// Opens a pcap or pcapng file, the packets are timestamped with their capture time
+func openFile(path, filter string, count int) (*source, error) {
+	if filter != "" {
+		if _, err := godivert.DetectABIVersion(); err != nil {
+			return nil, fmt.Errorf("filtering a file requires the WinDivert DLL: %v", err)
+		}
+		if ok, pos, msg := godivert.HelperCheckFilterLayer(filter, godivert.WinDivertLayerNetwork); !ok {
+			return nil, fmt.Errorf("invalid filter at position %d: %s", pos, msg)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := pcap.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &source{
+		recv: func(ctx context.Context) (*godivert.Packet, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return reader.Recv()
+		},
+		close:  file.Close,
+		filter: filter,
+		clock:  pcap.EpochClock(pcap.DefaultCounterFrequency),
+		count:  count,
+	}, nil
+}
+
+// Opens a sniffing handle, the packets keep going through the network stack
+func openCapture(filter string, layer godivert.Layer, count int) (*source, error) {
+	if _, err := godivert.DetectABIVersion(); err != nil {
+		if errors.Is(err, godivert.ErrNotSupported) {
+			return nil, errors.New("live capture requires WinDivert on Windows, read a file with -r")
+		}
+		return nil, err
+	}
+	if filter == "" {
+		filter = "true"
+	}
+
+	wd, err := godivert.NewWinDivertHandleWithOptions(filter, godivert.HandleOptions{
+		Layer: layer,
+		Flags: godivert.WinDivertFlagSniff,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clock := pcap.NewClock(pcap.DefaultCounterFrequency)
+	if frequency, boot, err := godivert.CounterReference(); err == nil {
+		clock = func(timestamp int64) time.Time {
+			return boot.Add(godivert.CounterDuration(timestamp, frequency))
+		}
+	}
+
+	return &source{
+		recv:  wd.RecvContext,
+		close: wd.Close,
+		clock: clock,
+		count: count,
+	}, nil
+}
+
+// Returns the next packet, io.EOF at the end of the file, once count packets
+// have been returned or when ctx is done
+func (s *source) next(ctx context.Context) (*godivert.Packet, error) {
+	if s.count > 0 && s.read >= s.count {
+		return nil, io.EOF
+	}
+
+	for {
+		packet, err := s.recv(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		// Packets with a truncated transport header are still printed and counted
+		if packet.ParseHeaders() != nil && packet.IpHdr == nil {
+			continue
+		}
+
+		if s.filter != "" {
+			match, err := packet.EvalFilter(s.filter)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+		}
+
+		s.read++
+		return packet, nil
+	}
+}
+
+// Returns the capture time of the packet
+func (s *source) time(packet *godivert.Packet) time.Time {
+	if packet.Addr == nil {
+		return time.Now()
+	}
+	return s.clock(packet.Addr.Timestamp)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+)
+
+// Represents the packets and bytes of a category
+type counter struct {
+	packets uint64
+	bytes   uint64
+}
+
+func (c *counter) add(packet *godivert.Packet) {
+	c.packets++
+	c.bytes += uint64(packet.PacketLen)
+}
+
+// Counts the packets until the end of the file, the count or Ctrl-C and prints a summary
+func runStats(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	sourceFlags := addSourceFlags(fs)
+	top := fs.Int("top", 10, "number of flows to print, ordered by bytes")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	src, err := sourceFlags.open()
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	var (
+		total       counter
+		first, last time.Time
+		protocols   = make(map[string]*counter)
+		directions  = make(map[string]*counter)
+		flows       = make(map[godivert.FlowKey]*counter)
+	)
+	count := func(counters map[string]*counter, name string, packet *godivert.Packet) {
+		c, ok := counters[name]
+		if !ok {
+			c = &counter{}
+			counters[name] = c
+		}
+		c.add(packet)
+	}
+
+	for {
+		packet, err := src.next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		t := src.time(packet)
+		if first.IsZero() {
+			first = t
+		}
+		last = t
+
+		total.add(packet)
+		count(protocols, fmt.Sprintf("IPv%d/%s", packet.IpVersion(), header.ProtocolName(packet.NextHeaderType())), packet)
+		if packet.Addr != nil {
+			count(directions, packet.Addr.Direction().String(), packet)
+		}
+
+		// Both directions of a connection are counted together
+		key := packet.FlowKey().Canonical()
+		flow, ok := flows[key]
+		if !ok {
+			flow = &counter{}
+			flows[key] = flow
+		}
+		flow.add(packet)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	duration := last.Sub(first)
+	fmt.Fprintf(w, "packets\t%d\n", total.packets)
+	fmt.Fprintf(w, "bytes\t%d\n", total.bytes)
+	fmt.Fprintf(w, "duration\t%v\n", duration.Round(time.Millisecond))
+	if seconds := duration.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "rate\t%.1f pkt/s\t%.0f B/s\n", float64(total.packets)/seconds, float64(total.bytes)/seconds)
+	}
+	fmt.Fprintf(w, "flows\t%d\n", len(flows))
+
+	printCounters(w, "protocol", protocols)
+	printCounters(w, "direction", directions)
+
+	keys := make([]godivert.FlowKey, 0, len(flows))
+	for key := range flows {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return flows[keys[i]].bytes > flows[keys[j]].bytes
+	})
+	if *top >= 0 && len(keys) > *top {
+		keys = keys[:*top]
+	}
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "\nflow\tpackets\tbytes\n")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", key, flows[key].packets, flows[key].bytes)
+		}
+	}
+	return nil
+}
+
+// Prints the counters sorted by name
+func printCounters(w io.Writer, title string, counters map[string]*counter) {
+	if len(counters) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "\n%s\tpackets\tbytes\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", name, counters[name].packets, counters[name].bytes)
+	}
+}
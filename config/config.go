@@ -0,0 +1,398 @@
+// Package config declares WinDivert handles and the rules applied to their
+// packets in a JSON file, instead of Go code.
+//
+// Each handle is opened with its filter, layer, priority and flags, and runs its
+// packets through ordered rules. A rule applies its action to the packets matching
+// its WinDivert filter: accept, drop, rewrite, redirect, shape or log.
+// Rewrite and log let the next rules see the packet, the other actions are final
+// and the packets matching no final rule are accepted:
+//
+//	{
+//		"handles": [{
+//			"name": "web",
+//			"filter": "outbound and tcp.DstPort == 80",
+//			"priority": 10,
+//			"rules": [
+//				{"name": "blocked", "filter": "ip.DstAddr == 1.1.1.1", "action": "drop"},
+//				{"name": "proxy", "filter": "ip.DstAddr == 10.0.0.1", "action": "redirect", "redirect": {"port": 8080}},
+//				{"name": "slow", "action": "shape", "shape": {"rate": 125000, "key": "flow"}}
+//			]
+//		}]
+//	}
+//
+// The configuration is validated when it is loaded and the errors point to the line and
+// column of the faulty value. A Runtime applies a configuration and reloads it without
+// closing the handles whose filter and options haven't changed.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/pipeline"
+	"github.com/williamfhe/godivert/shaper"
+)
+
+// Represents a configuration file
+type Config struct {
+	Handles []HandleConfig `json:"handles"`
+}
+
+// Represents a WinDivert handle and the rules applied to its packets
+type HandleConfig struct {
+	// Unique name of the handle, used to match the handles when reloading
+	Name   string `json:"name"`
+	Filter string `json:"filter"`
+	// "network" (default) or "networkForward"
+	Layer    string `json:"layer,omitempty"`
+	Priority int16  `json:"priority,omitempty"`
+	// Names of the WinDivert flags such as "sniff" or "fragments"
+	Flags []string `json:"flags,omitempty"`
+
+	// Zero values keep the default value of the driver
+	QueueLen uint64 `json:"queueLen,omitempty"`
+	// Duration such as "500ms"
+	QueueTime string `json:"queueTime,omitempty"`
+	QueueSize uint64 `json:"queueSize,omitempty"`
+
+	// Number of goroutines processing the packets, the packets of a flow stay in order
+	Workers int `json:"workers,omitempty"`
+	// Verdict applied when a rule fails, "accept" (default) or "drop"
+	OnError string `json:"onError,omitempty"`
+
+	Rules []RuleConfig `json:"rules"`
+}
+
+// Represents a rule of a handle
+type RuleConfig struct {
+	Name string `json:"name,omitempty"`
+	// WinDivert filter selecting the packets, every packet matches an empty filter
+	Filter string `json:"filter,omitempty"`
+	// "accept", "drop", "rewrite", "redirect", "shape" or "log"
+	Action string `json:"action"`
+
+	Rewrite  *RewriteConfig  `json:"rewrite,omitempty"`
+	Redirect *RedirectConfig `json:"redirect,omitempty"`
+	Shape    *ShapeConfig    `json:"shape,omitempty"`
+}
+
+// Represents the fields changed by the rewrite action, the fields not set are kept
+// IPs are only rewritten in the packets of the same IP version
+type RewriteConfig struct {
+	SrcIP   string  `json:"srcIP,omitempty"`
+	DstIP   string  `json:"dstIP,omitempty"`
+	SrcPort *uint16 `json:"srcPort,omitempty"`
+	DstPort *uint16 `json:"dstPort,omitempty"`
+	TTL     *uint8  `json:"ttl,omitempty"`
+}
+
+// Represents the local proxy the redirect action sends outbound TCP connections to
+// See godivert.Redirector
+type RedirectConfig struct {
+	Port uint16 `json:"port"`
+}
+
+// Represents the traffic class of the shape action, see shaper.Class
+type ShapeConfig struct {
+	// Bytes per second
+	Rate       int64 `json:"rate"`
+	Ceil       int64 `json:"ceil,omitempty"`
+	Burst      int64 `json:"burst,omitempty"`
+	QueueLimit int   `json:"queueLimit,omitempty"`
+	// Splits the class per "flow", "srcIP", "dstIP", "remoteIP", "srcPort" or "dstPort"
+	Key string `json:"key,omitempty"`
+}
+
+// Names of the actions
+const (
+	ActionAccept   = "accept"
+	ActionDrop     = "drop"
+	ActionRewrite  = "rewrite"
+	ActionRedirect = "redirect"
+	ActionShape    = "shape"
+	ActionLog      = "log"
+)
+
+var flagNames = map[string]godivert.Flags{
+	"sniff":     godivert.WinDivertFlagSniff,
+	"drop":      godivert.WinDivertFlagDrop,
+	"recvonly":  godivert.WinDivertFlagRecvOnly,
+	"sendonly":  godivert.WinDivertFlagSendOnly,
+	"noinstall": godivert.WinDivertFlagNoInstall,
+	"fragments": godivert.WinDivertFlagFragments,
+}
+
+var layerNames = map[string]godivert.Layer{
+	"":               godivert.WinDivertLayerNetwork,
+	"network":        godivert.WinDivertLayerNetwork,
+	"networkforward": godivert.WinDivertLayerNetworkForward,
+}
+
+var shapeKeys = map[string]shaper.KeyFunc{
+	"":         nil,
+	"flow":     shaper.KeyFlow,
+	"srcip":    shaper.KeySrcIP,
+	"dstip":    shaper.KeyDstIP,
+	"remoteip": shaper.KeyRemoteIP,
+	"srcport":  shaper.KeySrcPort,
+	"dstport":  shaper.KeyDstPort,
+}
+
+// Returned with a valid configuration whose filters couldn't be compiled because the WinDivert DLL
+// can't be loaded, the filters are checked again when the handles are opened
+var ErrFiltersNotChecked = errors.New("the filters haven't been checked, the WinDivert DLL can't be loaded")
+
+// Read and validate the configuration file
+// The returned *Error holds the name of the file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := Parse(data)
+	if configErr, ok := err.(*Error); ok {
+		configErr.File = path
+	}
+	return config, err
+}
+
+// Decode and validate a configuration
+// Unknown fields are errors, the filters are compiled if the WinDivert DLL can be loaded
+// and the configuration is returned with ErrFiltersNotChecked otherwise
+// The other errors are *Error locating the faulty value
+func Parse(data []byte) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		return nil, decodeError(data, err)
+	}
+	if decoder.More() {
+		return nil, locate(data, &Error{Err: errors.New("unexpected data after the configuration")}, decoder.InputOffset())
+	}
+
+	if err := config.Validate(); err != nil {
+		if err == ErrFiltersNotChecked {
+			return &config, err
+		}
+		if configErr, ok := err.(*Error); ok {
+			return nil, configErr.locate(data)
+		}
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Check the configuration, the returned *Error holds the path of the faulty value but no position
+// Returns ErrFiltersNotChecked if the configuration is valid but the WinDivert DLL can't be loaded to compile the filters
+func (c *Config) Validate() error {
+	abi, abiErr := godivert.DetectABIVersion()
+	if abiErr != nil {
+		abi = godivert.ABIVersion2
+	}
+	checkFilter := func(path, filter string, layer godivert.Layer) error {
+		if abiErr != nil {
+			// Can't compile the filter without the DLL
+			return nil
+		}
+		if ok, pos, msg := godivert.HelperCheckFilterLayer(filter, layer); !ok {
+			return &Error{Path: path, Offset: pos, Err: fmt.Errorf("invalid filter: %s", msg)}
+		}
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Handles {
+		h := &c.Handles[i]
+		path := fmt.Sprintf("handles[%d]", i)
+
+		if h.Name == "" {
+			return &Error{Path: path, Err: errors.New("the handle has no name")}
+		}
+		if names[h.Name] {
+			return &Error{Path: path + ".name", Err: fmt.Errorf("duplicate handle name %q", h.Name)}
+		}
+		names[h.Name] = true
+
+		options, field, err := h.options()
+		if err != nil {
+			return &Error{Path: path + "." + field, Err: err}
+		}
+		if err := abi.CheckFlags(options.Flags, options.Layer); err != nil {
+			return &Error{Path: path + ".flags", Err: err}
+		}
+		if options.Flags&(godivert.WinDivertFlagDrop|godivert.WinDivertFlagSendOnly) != 0 {
+			return &Error{Path: path + ".flags", Err: errors.New("the handle must receive packets")}
+		}
+		if lowest, highest := abi.PriorityRange(); int(h.Priority) < lowest || int(h.Priority) > highest {
+			return &Error{Path: path + ".priority", Err: fmt.Errorf("the priority must be between %d and %d", lowest, highest)}
+		}
+		for _, param := range []struct {
+			field string
+			param godivert.Param
+			value uint64
+		}{
+			{"queueLen", godivert.WinDivertParamQueueLen, options.QueueLen},
+			{"queueTime", godivert.WinDivertParamQueueTime, uint64(options.QueueTime / time.Millisecond)},
+			{"queueSize", godivert.WinDivertParamQueueSize, options.QueueSize},
+		} {
+			if param.value == 0 {
+				continue
+			}
+			if err := abi.CheckParam(param.param, param.value); err != nil {
+				return &Error{Path: path + "." + param.field, Err: err}
+			}
+		}
+		if h.Workers < 0 {
+			return &Error{Path: path + ".workers", Err: errors.New("the number of workers can't be negative")}
+		}
+		if _, err := h.errorVerdict(); err != nil {
+			return &Error{Path: path + ".onError", Err: err}
+		}
+
+		if h.Filter == "" {
+			return &Error{Path: path, Err: errors.New("the handle has no filter")}
+		}
+		if err := checkFilter(path+".filter", h.Filter, options.Layer); err != nil {
+			return err
+		}
+
+		for j := range h.Rules {
+			rulePath := fmt.Sprintf("%s.rules[%d]", path, j)
+			if err := h.Rules[j].validate(rulePath, options.Layer); err != nil {
+				return err
+			}
+			if h.Rules[j].Filter != "" {
+				if err := checkFilter(rulePath+".filter", h.Rules[j].Filter, options.Layer); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if abiErr != nil {
+		return ErrFiltersNotChecked
+	}
+	return nil
+}
+
+// Returns the options the handle is opened with
+func (h *HandleConfig) Options() (godivert.HandleOptions, error) {
+	options, _, err := h.options()
+	return options, err
+}
+
+// Returns the options the handle is opened with, or the field in error
+func (h *HandleConfig) options() (godivert.HandleOptions, string, error) {
+	options := godivert.HandleOptions{
+		Priority:  h.Priority,
+		QueueLen:  h.QueueLen,
+		QueueSize: h.QueueSize,
+	}
+
+	layer, ok := layerNames[strings.ToLower(h.Layer)]
+	if !ok {
+		return options, "layer", fmt.Errorf("unsupported layer %q, only the network layers carry packets", h.Layer)
+	}
+	options.Layer = layer
+
+	for i, name := range h.Flags {
+		flag, ok := flagNames[strings.ToLower(name)]
+		if !ok {
+			return options, fmt.Sprintf("flags[%d]", i), fmt.Errorf("unknown flag %q", name)
+		}
+		options.Flags |= flag
+	}
+
+	if h.QueueTime != "" {
+		queueTime, err := time.ParseDuration(h.QueueTime)
+		if err != nil || queueTime < 0 {
+			return options, "queueTime", fmt.Errorf("invalid duration %q", h.QueueTime)
+		}
+		options.QueueTime = queueTime
+	}
+
+	return options, "", nil
+}
+
+// Returns the verdict applied when a rule fails
+func (h *HandleConfig) errorVerdict() (pipeline.Verdict, error) {
+	switch strings.ToLower(h.OnError) {
+	case "", ActionAccept:
+		return pipeline.Accept, nil
+	case ActionDrop:
+		return pipeline.Drop, nil
+	default:
+		return pipeline.Accept, fmt.Errorf("onError must be %q or %q, got %q", ActionAccept, ActionDrop, h.OnError)
+	}
+}
+
+// Check the action of the rule and its parameters
+func (r *RuleConfig) validate(path string, layer godivert.Layer) error {
+	sections := map[string]bool{
+		ActionRewrite:  r.Rewrite != nil,
+		ActionRedirect: r.Redirect != nil,
+		ActionShape:    r.Shape != nil,
+	}
+
+	action := strings.ToLower(r.Action)
+	switch action {
+	case ActionAccept, ActionDrop, ActionLog:
+	case ActionRewrite, ActionRedirect, ActionShape:
+		if !sections[action] {
+			return &Error{Path: path, Err: fmt.Errorf("the %s action needs a %q object", action, action)}
+		}
+	case "":
+		return &Error{Path: path, Err: errors.New("the rule has no action")}
+	default:
+		return &Error{Path: path + ".action", Err: fmt.Errorf("unknown action %q", r.Action)}
+	}
+	for section, set := range sections {
+		if set && section != action {
+			return &Error{Path: path + "." + section, Err: fmt.Errorf("%q is only used by the %s action", section, section)}
+		}
+	}
+
+	switch action {
+	case ActionRewrite:
+		for _, ip := range []struct{ field, value string }{{"srcIP", r.Rewrite.SrcIP}, {"dstIP", r.Rewrite.DstIP}} {
+			if ip.value != "" && net.ParseIP(ip.value) == nil {
+				return &Error{Path: path + ".rewrite." + ip.field, Err: fmt.Errorf("invalid IP %q", ip.value)}
+			}
+		}
+	case ActionRedirect:
+		if layer != godivert.WinDivertLayerNetwork {
+			return &Error{Path: path + ".action", Err: errors.New("the redirect action needs the network layer")}
+		}
+		if r.Redirect.Port == 0 {
+			return &Error{Path: path + ".redirect.port", Err: errors.New("the proxy port can't be 0")}
+		}
+	case ActionShape:
+		if r.Shape.Rate <= 0 {
+			return &Error{Path: path + ".shape.rate", Err: errors.New("the rate must be positive")}
+		}
+		if r.Shape.Ceil < 0 || r.Shape.Ceil > 0 && r.Shape.Ceil < r.Shape.Rate {
+			return &Error{Path: path + ".shape.ceil", Err: errors.New("the ceil can't be lower than the rate")}
+		}
+		if r.Shape.Burst < 0 {
+			return &Error{Path: path + ".shape.burst", Err: errors.New("the burst can't be negative")}
+		}
+		if r.Shape.QueueLimit < 0 {
+			return &Error{Path: path + ".shape.queueLimit", Err: errors.New("the queue limit can't be negative")}
+		}
+		if _, ok := shapeKeys[strings.ToLower(r.Shape.Key)]; !ok {
+			return &Error{Path: path + ".shape.key", Err: fmt.Errorf("unknown key %q", r.Shape.Key)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/williamfhe/godivert"
+)
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		wantPath   string
+		wantLine   int
+		wantColumn int
+	}{
+		{
+			name: "syntax error",
+			data: `{"handles": [
+  {"name": "web",, "filter": "tcp", "rules": []}
+]}`,
+			wantLine: 2, wantColumn: 18,
+		},
+		{
+			name: "bad value type",
+			data: `{"handles": [
+  {"name": "web", "filter": "tcp",
+   "priority": "high", "rules": []}
+]}`,
+			wantPath: "handles[0].priority", wantLine: 3, wantColumn: 16,
+		},
+		{
+			name: "unknown action",
+			data: `{"handles": [
+  {"name": "web", "filter": "tcp", "rules": [
+    {"action": "explode"}
+  ]}
+]}`,
+			wantPath: "handles[0].rules[0].action", wantLine: 3, wantColumn: 16,
+		},
+		{
+			name: "key in another case",
+			data: `{"handles": [
+  {"Name": "web", "Filter": "tcp", "Rules": [
+    {"Action": "explode"}
+  ]}
+]}`,
+			wantPath: "handles[0].rules[0].action", wantLine: 3, wantColumn: 16,
+		},
+		{
+			name: "unknown field",
+			data: `{"handles": [
+  {"name": "web", "filter": "tcp", "rules": [], "priorty": 1}
+]}`,
+			wantPath: "handles[0].priorty", wantLine: 2, wantColumn: 60,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.data))
+			var configErr *Error
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Parse() = %v, want an *Error", err)
+			}
+			if configErr.Path != test.wantPath || configErr.Line != test.wantLine || configErr.Column != test.wantColumn {
+				t.Errorf("Parse() = %q at %d:%d, want %q at %d:%d", configErr.Path, configErr.Line, configErr.Column,
+					test.wantPath, test.wantLine, test.wantColumn)
+			}
+		})
+	}
+}
+
+func TestValidateFiltersNotChecked(t *testing.T) {
+	config, err := Parse([]byte(`{"handles": [{"name": "web", "filter": "tcp", "rules": [{"action": "drop"}]}]}`))
+
+	if _, abiErr := godivert.DetectABIVersion(); abiErr == nil {
+		t.Skip("the WinDivert DLL is available, the filters are checked")
+	}
+	if err != ErrFiltersNotChecked {
+		t.Fatalf("Parse() = %v, want ErrFiltersNotChecked", err)
+	}
+	if config == nil || len(config.Handles) != 1 {
+		t.Errorf("Parse() = %+v, want the configuration", config)
+	}
+}
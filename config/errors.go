@@ -0,0 +1,229 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Represents an invalid configuration
+type Error struct {
+	// Name of the file, empty if the configuration wasn't loaded from a file
+	File string
+	// Position of the faulty value, starting at 1, 0 if unknown
+	Line   int
+	Column int
+	// Path of the faulty value such as handles[0].rules[2].filter
+	Path string
+	// Position of the error in the faulty string, such as the position returned by HelperCheckFilter
+	Offset int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", e.Line, e.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Sets the line and column of the error from its path
+// The closest parent is used when the value is missing
+func (e *Error) locate(data []byte) *Error {
+	positions := indexPositions(data)
+
+	path := e.Path
+	for {
+		if offset, ok := position(positions, path); ok {
+			if path == e.Path && e.Offset > 0 && offset < int64(len(data)) && data[offset] == '"' {
+				// Skip the opening quote
+				offset += 1 + int64(e.Offset)
+			}
+			return locate(data, e, offset)
+		}
+		if path == "" {
+			return e
+		}
+		path = parentPath(path)
+	}
+}
+
+// Sets the line and column of the error from an offset in data
+func locate(data []byte, e *Error, offset int64) *Error {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	before := data[:offset]
+	e.Line = bytes.Count(before, []byte{'\n'}) + 1
+	e.Column = int(offset) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return e
+}
+
+// Returns the position of the value at path
+// The keys are matched case-insensitively like encoding/json does, an exact match is preferred
+func position(positions map[string]int64, path string) (int64, bool) {
+	if offset, ok := positions[path]; ok {
+		return offset, true
+	}
+	for p, offset := range positions {
+		if strings.EqualFold(p, path) {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the path of the object or array holding the value
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// Turns an error of json.Decoder into an *Error
+func decodeError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return locate(data, &Error{Err: errors.New("empty configuration")}, 0)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return locate(data, &Error{Err: errors.New("unexpected end of the configuration")}, int64(len(data)))
+	case errors.As(err, &syntaxErr):
+		// The offset is the one of the byte after the error
+		offset := syntaxErr.Offset - 1
+		if offset < 0 {
+			offset = 0
+		}
+		return locate(data, &Error{Err: errors.New(strings.TrimPrefix(syntaxErr.Error(), "json: "))}, offset)
+	case errors.As(err, &typeErr):
+		path, offset := valueAt(indexPositions(data), typeErr.Offset)
+		e := &Error{Path: path, Err: fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+		return locate(data, e, offset)
+	}
+
+	// DisallowUnknownFields doesn't give the position of the field
+	const unknownField = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknownField) {
+		field, unquoteErr := strconv.Unquote(strings.TrimPrefix(msg, unknownField))
+		if unquoteErr == nil {
+			e := &Error{Path: field, Err: fmt.Errorf("unknown field %q", field)}
+			if path, offset, ok := findField(indexPositions(data), field); ok {
+				e.Path = path
+				return locate(data, e, offset)
+			}
+			return e
+		}
+	}
+
+	return &Error{Err: err}
+}
+
+// Returns the path and the position of the innermost value starting before offset
+func valueAt(positions map[string]int64, offset int64) (string, int64) {
+	var path string
+	var start int64 = -1
+	for p, s := range positions {
+		if s < offset && (s > start || s == start && len(p) > len(path)) {
+			path, start = p, s
+		}
+	}
+	if start < 0 {
+		return "", 0
+	}
+	return path, start
+}
+
+// Returns the first value named field
+func findField(positions map[string]int64, field string) (string, int64, bool) {
+	var path string
+	var start int64 = -1
+	for p, s := range positions {
+		if (p == field || strings.HasSuffix(p, "."+field)) && (start < 0 || s < start) {
+			path, start = p, s
+		}
+	}
+	return path, start, start >= 0
+}
+
+// Returns the position of every value of the JSON document by path
+// The root is "", the fields of an object are joined with "." and the items of an array are indexed with []
+func indexPositions(data []byte) map[string]int64 {
+	positions := make(map[string]int64)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	indexValue(decoder, data, "", positions)
+	return positions
+}
+
+func indexValue(decoder *json.Decoder, data []byte, path string, positions map[string]int64) error {
+	positions[path] = valueStart(data, decoder.InputOffset())
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			field := fmt.Sprint(key)
+			if path != "" {
+				field = path + "." + field
+			}
+			if err := indexValue(decoder, data, field, positions); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			if err := indexValue(decoder, data, fmt.Sprintf("%s[%d]", path, i), positions); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+	}
+	return err
+}
+
+// Returns the position of the value following offset, skipping the spaces and separators
+func valueStart(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ':', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
@@ -0,0 +1,351 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/pipeline"
+	"github.com/williamfhe/godivert/shaper"
+)
+
+// Operations of a WinDivertHandle used by a running handle
+type divertHandle interface {
+	godivert.Sender
+	CanSend() bool
+	PacketsContext(ctx context.Context) (chan *godivert.Packet, error)
+	Err() error
+	Shutdown(how godivert.Shutdown) error
+	Close() error
+}
+
+// Represents a running handle
+type handle struct {
+	name    string
+	workers int
+	runtime *Runtime
+	// Only used by the Runtime, under its lock
+	config HandleConfig
+
+	wd       divertHandle
+	pipeline *pipeline.Pipeline
+	rules    atomic.Pointer[ruleSet]
+	// Redirectors by proxy port, kept across reloads so that the redirected connections survive
+	redirectors map[uint16]*godivert.Redirector
+	// Completes the packets deferred by the shape rules
+	shaped *deferredSender
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Represents the compiled rules of a handle
+type ruleSet struct {
+	rules   []*rule
+	shapers []*shaper.Shaper
+}
+
+// Send the packets still queued by the shapers
+func (s *ruleSet) close() {
+	for _, sh := range s.shapers {
+		sh.Close()
+	}
+}
+
+type rule struct {
+	name   string
+	action string
+	match  func(packet *godivert.Packet) bool
+
+	rewrite    *rewrite
+	redirector *godivert.Redirector
+	proxyPort  uint16
+	shaper     *shaper.Shaper
+}
+
+type rewrite struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort *uint16
+	ttl              *uint8
+}
+
+// Sender completing the packets deferred by the shape rules when the shaper releases them
+type deferredSender struct {
+	// deferredPacket by packet
+	contexts sync.Map
+}
+
+// Represents a packet held by a shaper
+type deferredPacket struct {
+	ctx *pipeline.Context
+	// Verdict of the rules applied before the shape rule, Modify if the packet was rewritten
+	verdict pipeline.Verdict
+}
+
+// Completes the packet with the verdict of its rules
+// The packet belongs to the pipeline once completed, which reports the errors of its sender
+func (s *deferredSender) Send(packet *godivert.Packet) (uint, error) {
+	deferred, ok := s.contexts.LoadAndDelete(packet)
+	if !ok {
+		return 0, errors.New("the packet isn't held by a shaper")
+	}
+	d := deferred.(deferredPacket)
+	d.ctx.Complete(d.verdict)
+	return packet.PacketLen, nil
+}
+
+// Completes a packet dropped by a shaper with the Drop verdict
+func (s *deferredSender) Drop(packet *godivert.Packet) {
+	deferred, ok := s.contexts.LoadAndDelete(packet)
+	if !ok {
+		packet.Release()
+		return
+	}
+	deferred.(deferredPacket).ctx.Complete(pipeline.Drop)
+}
+
+// Sender of the sniffing handles, their packets have already been accepted
+type discardSender struct{}
+
+func (discardSender) Send(packet *godivert.Packet) (uint, error) {
+	return packet.PacketLen, nil
+}
+
+// Open the handle of the configuration, its packets aren't received until run is called
+func (r *Runtime) open(config HandleConfig) (*handle, error) {
+	options, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+	errorVerdict, err := config.errorVerdict()
+	if err != nil {
+		return nil, err
+	}
+
+	wd, err := r.openHandle(handleFilter(config), options)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &handle{
+		name:        config.Name,
+		workers:     config.Workers,
+		config:      config,
+		runtime:     r,
+		wd:          wd,
+		redirectors: make(map[uint16]*godivert.Redirector),
+		shaped:      &deferredSender{},
+		done:        make(chan struct{}),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+
+	var sender godivert.Sender = wd
+	if !wd.CanSend() {
+		sender = discardSender{}
+	}
+
+	h.pipeline = pipeline.New(sender)
+	h.pipeline.ErrorVerdict = errorVerdict
+	h.pipeline.OnError = func(ctx *pipeline.Context, err error) {
+		r.fail(h.name, err)
+	}
+	h.pipeline.HandleFunc("", h.handle)
+
+	return h, nil
+}
+
+// Compile the rules of the handle, the shapers are started
+func (h *handle) compile(configs []RuleConfig) (*ruleSet, error) {
+	set := &ruleSet{}
+
+	for i, config := range configs {
+		r := &rule{
+			name:   config.Name,
+			action: strings.ToLower(config.Action),
+		}
+		if r.name == "" {
+			r.name = fmt.Sprintf("rules[%d]", i)
+		}
+		if config.Filter != "" {
+			filter := config.Filter
+			r.match = func(packet *godivert.Packet) bool {
+				match, err := packet.EvalFilter(filter)
+				return err == nil && match
+			}
+		}
+
+		switch r.action {
+		case ActionRewrite:
+			r.rewrite = &rewrite{
+				srcIP:   net.ParseIP(config.Rewrite.SrcIP),
+				dstIP:   net.ParseIP(config.Rewrite.DstIP),
+				srcPort: config.Rewrite.SrcPort,
+				dstPort: config.Rewrite.DstPort,
+				ttl:     config.Rewrite.TTL,
+			}
+		case ActionRedirect:
+			port := config.Redirect.Port
+			redirector, ok := h.redirectors[port]
+			if !ok {
+				wd, ok := h.wd.(*godivert.WinDivertHandle)
+				if !ok {
+					set.close()
+					return nil, fmt.Errorf("%s: the redirect action needs a WinDivert handle", r.name)
+				}
+				var err error
+				if redirector, err = godivert.NewRedirectorWithHandle(wd, port); err != nil {
+					set.close()
+					return nil, fmt.Errorf("%s: %v", r.name, err)
+				}
+				h.redirectors[port] = redirector
+			}
+			r.redirector = redirector
+			r.proxyPort = port
+		case ActionShape:
+			class := &shaper.Class{
+				Name:       r.name,
+				Rate:       config.Shape.Rate,
+				Ceil:       config.Shape.Ceil,
+				Burst:      config.Shape.Burst,
+				QueueLimit: config.Shape.QueueLimit,
+				Key:        shapeKeys[strings.ToLower(config.Shape.Key)],
+			}
+			r.shaper = shaper.NewShaper(h.shaped, func(*godivert.Packet) *shaper.Class { return class })
+			go r.shaper.Run()
+			set.shapers = append(set.shapers, r.shaper)
+		}
+
+		set.rules = append(set.rules, r)
+	}
+
+	return set, nil
+}
+
+// Returns true if the rule applies to the packet
+func (r *rule) matches(packet *godivert.Packet) bool {
+	if r.proxyPort != 0 && packet.Direction() == godivert.WinDivertDirectionOutbound {
+		// The packets sent by the proxy go back to the clients
+		if port, err := packet.SrcPort(); err == nil && port == r.proxyPort && packet.NextHeaderType() == header.TCP {
+			return true
+		}
+	}
+	return r.match == nil || r.match(packet)
+}
+
+// Applies the rules to the packet, the first final rule decides
+func (h *handle) handle(ctx *pipeline.Context) (pipeline.Verdict, error) {
+	packet := ctx.Packet
+	verdict := pipeline.Accept
+
+	for _, r := range h.rules.Load().rules {
+		if !r.matches(packet) {
+			continue
+		}
+
+		switch r.action {
+		case ActionAccept:
+			return verdict, nil
+		case ActionDrop:
+			return pipeline.Drop, nil
+		case ActionLog:
+			h.runtime.log(h.name, r.name, packet)
+		case ActionRewrite:
+			r.rewrite.apply(packet)
+			verdict = pipeline.Modify
+		case ActionRedirect:
+			if r.redirector.Redirect(packet) {
+				return pipeline.Modify, nil
+			}
+		case ActionShape:
+			return h.shape(ctx, r.shaper, verdict)
+		}
+	}
+
+	return verdict, nil
+}
+
+// Hands the packet to the shaper, the packet is completed with verdict when the shaper sends it
+// or with Drop when the shaper drops it
+func (h *handle) shape(ctx *pipeline.Context, s *shaper.Shaper, verdict pipeline.Verdict) (pipeline.Verdict, error) {
+	h.shaped.contexts.Store(ctx.Packet, deferredPacket{ctx: ctx, verdict: verdict})
+
+	if _, err := s.Enqueue(ctx.Packet); err != nil {
+		// The shaper has been replaced by a reload, let the packet through
+		h.shaped.contexts.Delete(ctx.Packet)
+		return verdict, nil
+	}
+	// A packet dropped by the shaper has already been completed with Drop
+	return pipeline.Defer, nil
+}
+
+// Rewrite the fields of the packet
+func (rw *rewrite) apply(packet *godivert.Packet) {
+	ipv4 := packet.IpVersion() == 4
+
+	if rw.srcIP != nil && (rw.srcIP.To4() != nil) == ipv4 {
+		packet.SetSrcIP(rw.srcIP)
+	}
+	if rw.dstIP != nil && (rw.dstIP.To4() != nil) == ipv4 {
+		packet.SetDstIP(rw.dstIP)
+	}
+	if rw.srcPort != nil {
+		packet.SetSrcPort(*rw.srcPort)
+	}
+	if rw.dstPort != nil {
+		packet.SetDstPort(*rw.dstPort)
+	}
+	if rw.ttl != nil {
+		switch ipHdr := packet.IpHdr.(type) {
+		case *header.IPv4Header:
+			ipHdr.SetTTL(*rw.ttl)
+		case *header.IPv6Header:
+			ipHdr.SetHopLimit(*rw.ttl)
+		}
+	}
+}
+
+// Process the packets of the handle until it is stopped
+func (h *handle) run() {
+	defer close(h.done)
+
+	packets, err := h.wd.PacketsContext(h.ctx)
+	if err != nil {
+		h.runtime.fail(h.name, err)
+		return
+	}
+
+	if h.workers > 1 {
+		dispatcher := pipeline.NewDispatcher(h.workers, 0, h.pipeline.Process)
+		dispatcher.Run(packets)
+		dispatcher.Close()
+	} else {
+		h.pipeline.Run(packets)
+	}
+
+	if err := h.wd.Err(); err != nil {
+		h.runtime.fail(h.name, err)
+	}
+}
+
+// Stop receiving packets, process the packets already received and close the handle
+func (h *handle) stop() {
+	// With WinDivert 2.x the packets queued in the driver are received before the channel is closed
+	if h.wd.Shutdown(godivert.WinDivertShutdownRecv) != nil {
+		h.cancel()
+	}
+	<-h.done
+	h.cancel()
+
+	if set := h.rules.Load(); set != nil {
+		set.close()
+	}
+	h.pipeline.Close()
+	h.wd.Close()
+}
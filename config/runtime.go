@@ -0,0 +1,283 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/pipeline"
+)
+
+// Applies a configuration: opens its handles and runs their packets through the rules
+// Applying a new configuration keeps the handles whose filter and options haven't changed
+// and swaps their rules without losing a packet
+type Runtime struct {
+	// Called with the errors of the handles, such as a packet that can't be sent
+	OnError func(handle string, err error)
+	// Called for the packets matching a log rule, the packets are logged with the log package if nil
+	OnLog func(handle, rule string, packet *godivert.Packet)
+
+	// Opens the WinDivert handles, replaced by the tests
+	openHandle func(filter string, options godivert.HandleOptions) (divertHandle, error)
+
+	mu      sync.Mutex
+	config  *Config
+	handles map[string]*handle
+	closed  bool
+}
+
+// Create a new Runtime without handles, see Apply
+func NewRuntime() *Runtime {
+	return &Runtime{
+		openHandle: openWinDivert,
+		handles:    make(map[string]*handle),
+	}
+}
+
+func openWinDivert(filter string, options godivert.HandleOptions) (divertHandle, error) {
+	wd, err := godivert.NewWinDivertHandleWithOptions(filter, options)
+	if err != nil {
+		return nil, err
+	}
+	return wd, nil
+}
+
+// Returns the configuration applied last, nil before the first Apply
+func (r *Runtime) Config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// Returns true if both handles are opened the same way, only their rules may differ
+func sameHandle(a, b HandleConfig) bool {
+	if handleFilter(a) != handleFilter(b) {
+		return false
+	}
+	a.Rules, b.Rules = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// Apply the configuration
+// The new and changed handles are opened before the old ones are closed so that no packet escapes the rules,
+// the packets already received by a closed handle are processed before it is closed
+// If a handle can't be opened, the previous configuration stays in place
+// The filters not checked by Validate are checked when the handles are opened
+func (r *Runtime) Apply(config *Config) error {
+	if err := config.Validate(); err != nil && err != ErrFiltersNotChecked {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("the runtime is closed")
+	}
+
+	handles := make(map[string]*handle, len(config.Handles))
+	rules := make(map[string]*ruleSet, len(config.Handles))
+	var opened []*handle
+
+	abort := func(err error) error {
+		for _, set := range rules {
+			set.close()
+		}
+		for _, h := range opened {
+			h.wd.Close()
+		}
+		return err
+	}
+
+	for _, handleConfig := range config.Handles {
+		h, ok := r.handles[handleConfig.Name]
+		if !ok || !sameHandle(h.config, handleConfig) {
+			var err error
+			if h, err = r.open(handleConfig); err != nil {
+				return abort(fmt.Errorf("handle %q: %v", handleConfig.Name, err))
+			}
+			opened = append(opened, h)
+		}
+
+		set, err := h.compile(handleConfig.Rules)
+		if err != nil {
+			return abort(fmt.Errorf("handle %q: %v", handleConfig.Name, err))
+		}
+		handles[handleConfig.Name] = h
+		rules[handleConfig.Name] = set
+	}
+
+	// Everything is ready, switch to the new configuration
+	for name, h := range handles {
+		old := h.rules.Swap(rules[name])
+		if old != nil {
+			old.close()
+		}
+		h.config = handleConfigByName(config, name)
+	}
+	for _, h := range opened {
+		go h.run()
+	}
+
+	var stopping sync.WaitGroup
+	for name, h := range r.handles {
+		if handles[name] != h {
+			stopping.Add(1)
+			go func(h *handle) {
+				defer stopping.Done()
+				h.stop()
+			}(h)
+		}
+	}
+	stopping.Wait()
+
+	r.handles = handles
+	r.config = config
+	return nil
+}
+
+func handleConfigByName(config *Config, name string) HandleConfig {
+	for _, h := range config.Handles {
+		if h.Name == name {
+			return h
+		}
+	}
+	return HandleConfig{}
+}
+
+// Load the configuration file and apply it
+func (r *Runtime) Reload(path string) error {
+	config, err := Load(path)
+	if err != nil {
+		return err
+	}
+	return r.Apply(config)
+}
+
+// Reload the configuration file every time it changes until ctx is done
+// The file is checked at the interval, a configuration that can't be loaded
+// or applied is reported to OnError and the running one is kept
+func (r *Runtime) Watch(ctx context.Context, path string, interval time.Duration) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	lastMod, lastSize := info.ModTime(), info.Size()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			r.fail("", err)
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+
+		if err := r.Reload(path); err != nil {
+			r.fail("", err)
+		}
+	}
+}
+
+// Returns the names of the running handles
+func (r *Runtime) Handles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.handles))
+	for name := range r.handles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the counters of the pipeline of each handle
+func (r *Runtime) Stats() map[string]pipeline.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make(map[string]pipeline.Stats, len(r.handles))
+	for name, h := range r.handles {
+		stats[name] = h.pipeline.Stats()
+	}
+	return stats
+}
+
+// Stop every handle after processing the packets already received
+func (r *Runtime) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("the runtime is already closed")
+	}
+	r.closed = true
+
+	var stopping sync.WaitGroup
+	for _, h := range r.handles {
+		stopping.Add(1)
+		go func(h *handle) {
+			defer stopping.Done()
+			h.stop()
+		}(h)
+	}
+	stopping.Wait()
+
+	r.handles = nil
+	return nil
+}
+
+func (r *Runtime) fail(handle string, err error) {
+	if r.OnError != nil {
+		r.OnError(handle, err)
+		return
+	}
+	if handle != "" {
+		log.Printf("config: handle %q: %v", handle, err)
+		return
+	}
+	log.Printf("config: %v", err)
+}
+
+func (r *Runtime) log(handle, rule string, packet *godivert.Packet) {
+	if r.OnLog != nil {
+		r.OnLog(handle, rule, packet)
+		return
+	}
+	log.Printf("config: handle %q: rule %q: %s", handle, rule, packet.FlowKey())
+}
+
+// Returns the filter the handle is opened with
+// The packets sent by the proxies of the redirect rules are diverted as well
+func handleFilter(config HandleConfig) string {
+	var ports []string
+	for _, rule := range config.Rules {
+		if strings.ToLower(rule.Action) == ActionRedirect && rule.Redirect != nil {
+			ports = append(ports, fmt.Sprintf("tcp.SrcPort == %d", rule.Redirect.Port))
+		}
+	}
+	if len(ports) == 0 {
+		return config.Filter
+	}
+	return fmt.Sprintf("(%s) or (outbound and (%s))", config.Filter, strings.Join(ports, " or "))
+}
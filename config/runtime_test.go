@@ -0,0 +1,207 @@
+package config
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Handle receiving the packets given by the test and recording the packets sent
+type fakeHandle struct {
+	filter  string
+	packets chan *godivert.Packet
+	sent    chan *godivert.Packet
+
+	shutdown sync.Once
+	closed   atomic.Bool
+}
+
+func newFakeHandle(filter string) *fakeHandle {
+	return &fakeHandle{
+		filter:  filter,
+		packets: make(chan *godivert.Packet, 16),
+		sent:    make(chan *godivert.Packet, 16),
+	}
+}
+
+func (f *fakeHandle) Send(packet *godivert.Packet) (uint, error) {
+	f.sent <- packet
+	return packet.PacketLen, nil
+}
+
+func (f *fakeHandle) CanSend() bool {
+	return true
+}
+
+func (f *fakeHandle) PacketsContext(ctx context.Context) (chan *godivert.Packet, error) {
+	return f.packets, nil
+}
+
+func (f *fakeHandle) Err() error {
+	return nil
+}
+
+// The packets already given are still received, like WinDivert 2.x does
+func (f *fakeHandle) Shutdown(how godivert.Shutdown) error {
+	f.shutdown.Do(func() { close(f.packets) })
+	return nil
+}
+
+func (f *fakeHandle) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+// Waits up to a second for n packets to be sent
+func (f *fakeHandle) waitSent(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("%d packets sent, want %d", i, n)
+		}
+	}
+}
+
+// Returns a Runtime opening fake handles, and the handles it opened
+func newTestRuntime(t *testing.T) (*Runtime, *[]*fakeHandle) {
+	opened := &[]*fakeHandle{}
+	r := NewRuntime()
+	r.OnError = func(handle string, err error) {
+		t.Errorf("handle %q: %v", handle, err)
+	}
+	r.openHandle = func(filter string, options godivert.HandleOptions) (divertHandle, error) {
+		f := newFakeHandle(filter)
+		*opened = append(*opened, f)
+		return f, nil
+	}
+	return r, opened
+}
+
+func testConfig(filter string, rules ...RuleConfig) *Config {
+	return &Config{Handles: []HandleConfig{{Name: "web", Filter: filter, Rules: rules}}}
+}
+
+func newTestPacket() *godivert.Packet {
+	raw := testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagACK)
+	packet := &godivert.Packet{Raw: raw, PacketLen: uint(len(raw)), Addr: &godivert.WinDivertAddress{}}
+	packet.Addr.SetDirection(godivert.WinDivertDirectionOutbound)
+	return packet
+}
+
+// Waits until the handle has processed n packets
+func waitProcessed(t *testing.T, r *Runtime, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for r.Stats()["web"].Processed < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets processed, want %d", r.Stats()["web"].Processed, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	r, opened := newTestRuntime(t)
+	defer r.Close()
+
+	if err := r.Apply(testConfig("tcp", RuleConfig{Action: ActionDrop})); err != nil {
+		t.Fatal(err)
+	}
+	handle := (*opened)[0]
+	handle.packets <- newTestPacket()
+	waitProcessed(t, r, 1)
+	if stats := r.Stats()["web"]; stats.Dropped != 1 || len(handle.sent) != 0 {
+		t.Fatalf("Stats() = %+v, want the packet dropped", stats)
+	}
+
+	// Only the rules change, the handle stays open
+	if err := r.Apply(testConfig("tcp", RuleConfig{Action: ActionAccept})); err != nil {
+		t.Fatal(err)
+	}
+	if len(*opened) != 1 || handle.closed.Load() {
+		t.Fatalf("%d handles opened, closed %v, want the handle kept", len(*opened), handle.closed.Load())
+	}
+	handle.packets <- newTestPacket()
+	handle.waitSent(t, 1)
+}
+
+func TestApplyHandle(t *testing.T) {
+	r, opened := newTestRuntime(t)
+	defer r.Close()
+
+	if err := r.Apply(testConfig("tcp", RuleConfig{Action: ActionAccept})); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Apply(testConfig("udp", RuleConfig{Action: ActionAccept})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The handle is reopened with the new filter and the old one closed
+	if len(*opened) != 2 || (*opened)[1].filter != "udp" {
+		t.Fatalf("%d handles opened, want the handle reopened with the new filter", len(*opened))
+	}
+	if !(*opened)[0].closed.Load() || (*opened)[1].closed.Load() {
+		t.Error("only the old handle must be closed")
+	}
+	if names := r.Handles(); len(names) != 1 || names[0] != "web" {
+		t.Errorf("Handles() = %v, want [web]", names)
+	}
+
+	(*opened)[1].packets <- newTestPacket()
+	(*opened)[1].waitSent(t, 1)
+}
+
+func TestApplyShaped(t *testing.T) {
+	// One byte per second, the packets after the first one stay in the queue
+	shape := RuleConfig{Action: ActionShape, Shape: &ShapeConfig{Rate: 1, Burst: 1}}
+
+	tests := []struct {
+		name         string
+		reload       *Config
+		wantReopened bool
+	}{
+		{"rules changed", testConfig("tcp", RuleConfig{Action: ActionAccept}), false},
+		{"handle changed", testConfig("udp", RuleConfig{Action: ActionAccept}), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, opened := newTestRuntime(t)
+			defer r.Close()
+
+			if err := r.Apply(testConfig("tcp", shape)); err != nil {
+				t.Fatal(err)
+			}
+			handle := (*opened)[0]
+			for i := 0; i < 3; i++ {
+				handle.packets <- newTestPacket()
+			}
+			waitProcessed(t, r, 3)
+			if deferred := r.Stats()["web"].Deferred; deferred == 0 {
+				t.Fatal("no packet held by the shaper")
+			}
+
+			// The packets held by the shaper are sent by their handle, not lost
+			if err := r.Apply(test.reload); err != nil {
+				t.Fatal(err)
+			}
+			handle.waitSent(t, 3)
+			if handle.closed.Load() != test.wantReopened {
+				t.Errorf("handle closed %v, want %v", handle.closed.Load(), test.wantReopened)
+			}
+			for name, stats := range r.Stats() {
+				if stats.Deferred != 0 {
+					t.Errorf("handle %q: %d packets still deferred", name, stats.Deferred)
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,22 @@ package godivert
 
 type Direction bool
 
+// Represents a WinDivert layer
+// See https://reqrypt.org/windivert-doc.html#divert_open
+type Layer uint8
+
+// Represents the event that produced a WinDivertAddress (WinDivert 2.x)
+type Event uint8
+
+// Represents the version of the WinDivert ABI used by the DLL
+type ABIVersion int
+
+// Represents the way a handle is shut down (WinDivert 2.x)
+// See https://reqrypt.org/windivert-doc.html#divert_shutdown
+type Shutdown uint8
+
 const (
+	// Deprecated: packets up to MaxPacketSize bytes are received
 	PacketBufferSize   = 1500
 	PacketChanCapacity = 256
 
@@ -11,9 +26,54 @@ const (
 )
 
 const (
-	WinDivertFlagSniff uint8 = 1 << iota
-	WinDivertFlagDrop  uint8 = 1 << iota
-	WinDivertFlagDebug uint8 = 1 << iota
+	// Packets to and from the local machine
+	WinDivertLayerNetwork Layer = iota
+	// Packets passing through the local machine
+	WinDivertLayerNetworkForward
+	// Established and deleted network flows (WinDivert 2.x)
+	WinDivertLayerFlow
+	// Socket operations (WinDivert 2.x)
+	WinDivertLayerSocket
+	// Opened and closed WinDivert handles (WinDivert 2.x)
+	WinDivertLayerReflect
+)
+
+const (
+	WinDivertEventNetworkPacket Event = iota
+	WinDivertEventFlowEstablished
+	WinDivertEventFlowDeleted
+	WinDivertEventSocketBind
+	WinDivertEventSocketConnect
+	WinDivertEventSocketListen
+	WinDivertEventSocketAccept
+	WinDivertEventSocketClose
+	WinDivertEventReflectOpen
+	WinDivertEventReflectClose
+)
+
+const (
+	WinDivertShutdownRecv Shutdown = 1 << iota
+	WinDivertShutdownSend
+	WinDivertShutdownBoth = WinDivertShutdownRecv | WinDivertShutdownSend
+)
+
+const (
+	WinDivertPriorityHighest = 30000
+	WinDivertPriorityLowest  = -30000
+
+	WinDivertPriorityHighestV1 = 1000
+	WinDivertPriorityLowestV1  = -1000
+)
+
+const (
+	// WinDivert 1.x
+	ABIVersion1 ABIVersion = 1
+	// WinDivert 2.x
+	ABIVersion2 ABIVersion = 2
+
+	// Size of the WINDIVERT_ADDRESS struct in bytes
+	WinDivertAddressSizeV1 = 24
+	WinDivertAddressSizeV2 = 80
 )
 
 func (d Direction) String() string {
@@ -22,3 +82,71 @@ func (d Direction) String() string {
 	}
 	return "Outbound"
 }
+
+func (l Layer) String() string {
+	switch l {
+	case WinDivertLayerNetwork:
+		return "Network"
+	case WinDivertLayerNetworkForward:
+		return "NetworkForward"
+	case WinDivertLayerFlow:
+		return "Flow"
+	case WinDivertLayerSocket:
+		return "Socket"
+	case WinDivertLayerReflect:
+		return "Reflect"
+	default:
+		return "Unknown Layer"
+	}
+}
+
+func (e Event) String() string {
+	switch e {
+	case WinDivertEventNetworkPacket:
+		return "Packet"
+	case WinDivertEventFlowEstablished:
+		return "FlowEstablished"
+	case WinDivertEventFlowDeleted:
+		return "FlowDeleted"
+	case WinDivertEventSocketBind:
+		return "SocketBind"
+	case WinDivertEventSocketConnect:
+		return "SocketConnect"
+	case WinDivertEventSocketListen:
+		return "SocketListen"
+	case WinDivertEventSocketAccept:
+		return "SocketAccept"
+	case WinDivertEventSocketClose:
+		return "SocketClose"
+	case WinDivertEventReflectOpen:
+		return "ReflectOpen"
+	case WinDivertEventReflectClose:
+		return "ReflectClose"
+	default:
+		return "Unknown Event"
+	}
+}
+
+// Returns the size of the WINDIVERT_ADDRESS struct of this ABI
+func (v ABIVersion) AddressSize() int {
+	if v == ABIVersion1 {
+		return WinDivertAddressSizeV1
+	}
+	return WinDivertAddressSizeV2
+}
+
+// Returns the priority range accepted by WinDivertOpen for this ABI
+func (v ABIVersion) PriorityRange() (lowest, highest int) {
+	if v == ABIVersion1 {
+		return WinDivertPriorityLowestV1, WinDivertPriorityHighestV1
+	}
+	return WinDivertPriorityLowest, WinDivertPriorityHighest
+}
+
+// Returns true if the layer exists in this ABI
+func (v ABIVersion) SupportsLayer(layer Layer) bool {
+	if v == ABIVersion1 {
+		return layer == WinDivertLayerNetwork || layer == WinDivertLayerNetworkForward
+	}
+	return layer <= WinDivertLayerReflect
+}
@@ -0,0 +1,72 @@
+//go:build !windows
+
+package godivert
+
+// WinDivert only exists on Windows, on other systems every call to the DLL
+// returns ErrNotSupported so that the packet processing code can still be
+// built and run against offline sources such as pcap files.
+
+// LoadDLL does nothing as WinDivert is only available on Windows.
+func LoadDLL(path64, path32 string) {}
+
+func divertABI() (ABIVersion, error) {
+	return 0, ErrNotSupported
+}
+
+func divertOpen(filter string, layer Layer, priority int16, flags uint64) (uintptr, error) {
+	return 0, ErrNotSupported
+}
+
+func divertClose(handle uintptr) error {
+	return ErrNotSupported
+}
+
+func divertSetParam(handle uintptr, param Param, value uint64) error {
+	return ErrNotSupported
+}
+
+func divertGetParam(handle uintptr, param Param) (uint64, error) {
+	return 0, ErrNotSupported
+}
+
+func divertRecv(handle uintptr, buffer []byte, addr []byte, abi ABIVersion) (uint, error) {
+	return 0, ErrNotSupported
+}
+
+func divertSend(handle uintptr, packet []byte, addr []byte, abi ABIVersion) (uint, error) {
+	return 0, ErrNotSupported
+}
+
+func divertRecvEx(handle uintptr, buffer []byte, addrs []byte) (uint, uint, error) {
+	return 0, 0, ErrNotSupported
+}
+
+func divertSendEx(handle uintptr, packets []byte, addrs []byte) (uint, error) {
+	return 0, ErrNotSupported
+}
+
+func divertRecvCancel(handle uintptr, buffer []byte, addr []byte, abi ABIVersion, cancel <-chan struct{}) (uint, error) {
+	return 0, ErrNotSupported
+}
+
+func divertShutdown(handle uintptr, how Shutdown) error {
+	return ErrNotSupported
+}
+
+func divertCalcChecksums(packet []byte, addr []byte) {}
+
+func divertCheckFilter(filter string, layer Layer, abi ABIVersion) (bool, int, string) {
+	return false, 0, ErrNotSupported.Error()
+}
+
+func divertFormatFilter(filter string, layer Layer) (string, error) {
+	return "", ErrNotSupported
+}
+
+func divertEvalFilter(filter string, packet []byte, addr []byte, abi ABIVersion) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func queryPerformanceCounter() (int64, int64, error) {
+	return 0, 0, ErrNotSupported
+}
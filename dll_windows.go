@@ -0,0 +1,498 @@
+//go:build windows
+
+package godivert
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	winDivertDLL *syscall.LazyDLL
+
+	winDivertOpen                *syscall.LazyProc
+	winDivertClose               *syscall.LazyProc
+	winDivertRecv                *syscall.LazyProc
+	winDivertSend                *syscall.LazyProc
+	winDivertRecvEx              *syscall.LazyProc
+	winDivertSendEx              *syscall.LazyProc
+	winDivertHelperCalcChecksums *syscall.LazyProc
+	winDivertHelperEvalFilter    *syscall.LazyProc
+	winDivertHelperCheckFilter   *syscall.LazyProc
+	winDivertHelperCompileFilter *syscall.LazyProc
+	winDivertHelperFormatFilter  *syscall.LazyProc
+	winDivertSetParam            *syscall.LazyProc
+	winDivertGetParam            *syscall.LazyProc
+	winDivertShutdown            *syscall.LazyProc
+
+	kernel32                = syscall.NewLazyDLL("kernel32.dll")
+	procCreateEventW        = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+
+	procQueryPerformanceFrequency = kernel32.NewProc("QueryPerformanceFrequency")
+	procQueryPerformanceCounter   = kernel32.NewProc("QueryPerformanceCounter")
+
+	abiMutex    sync.Mutex
+	detectedABI ABIVersion
+)
+
+func init() {
+	LoadDLL("WinDivert.dll", "WinDivert.dll")
+}
+
+// LoadDLL loads the WinDivert DLL depending the OS (x64 or x86) and the given DLL path.
+// The path can be a relative path (from the .exe folder) or absolute path.
+func LoadDLL(path64, path32 string) {
+	var dllPath string
+
+	if runtime.GOARCH == "amd64" {
+		dllPath = path64
+	} else {
+		dllPath = path32
+	}
+
+	abiMutex.Lock()
+	defer abiMutex.Unlock()
+	detectedABI = 0
+
+	winDivertDLL = syscall.NewLazyDLL(dllPath)
+
+	winDivertOpen = winDivertDLL.NewProc("WinDivertOpen")
+	winDivertClose = winDivertDLL.NewProc("WinDivertClose")
+	winDivertRecv = winDivertDLL.NewProc("WinDivertRecv")
+	winDivertSend = winDivertDLL.NewProc("WinDivertSend")
+	winDivertRecvEx = winDivertDLL.NewProc("WinDivertRecvEx")
+	winDivertSendEx = winDivertDLL.NewProc("WinDivertSendEx")
+	winDivertHelperCalcChecksums = winDivertDLL.NewProc("WinDivertHelperCalcChecksums")
+	winDivertHelperEvalFilter = winDivertDLL.NewProc("WinDivertHelperEvalFilter")
+	winDivertHelperCheckFilter = winDivertDLL.NewProc("WinDivertHelperCheckFilter")
+	winDivertHelperCompileFilter = winDivertDLL.NewProc("WinDivertHelperCompileFilter")
+	winDivertHelperFormatFilter = winDivertDLL.NewProc("WinDivertHelperFormatFilter")
+	winDivertSetParam = winDivertDLL.NewProc("WinDivertSetParam")
+	winDivertGetParam = winDivertDLL.NewProc("WinDivertGetParam")
+	winDivertShutdown = winDivertDLL.NewProc("WinDivertShutdown")
+}
+
+// Returns the ABI of the loaded DLL
+// WinDivertHelperCompileFilter only exists in WinDivert 2.x
+func divertABI() (ABIVersion, error) {
+	abiMutex.Lock()
+	defer abiMutex.Unlock()
+
+	if detectedABI != 0 {
+		return detectedABI, nil
+	}
+
+	if err := winDivertOpen.Find(); err != nil {
+		return 0, err
+	}
+
+	if winDivertHelperCompileFilter.Find() == nil {
+		detectedABI = ABIVersion2
+	} else {
+		detectedABI = ABIVersion1
+	}
+	return detectedABI, nil
+}
+
+// Returns true on 32 bits systems, where a UINT64 argument takes two words
+func is32Bit() bool {
+	return unsafe.Sizeof(uintptr(0)) == 4
+}
+
+// Returns a pointer to the first byte of b or nil if b is empty
+// The pointer must be converted to uintptr in the argument list of the call
+// so that b is kept alive during the call
+func bytesPtr(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+// Returns the Go string of a NUL terminated C string
+func goString(p *byte) string {
+	if p == nil {
+		return ""
+	}
+
+	var b []byte
+	for ptr := unsafe.Pointer(p); *(*byte)(ptr) != 0; ptr = unsafe.Add(ptr, 1) {
+		b = append(b, *(*byte)(ptr))
+	}
+	return string(b)
+}
+
+// Calls WinDivertOpen and returns the handle
+func divertOpen(filter string, layer Layer, priority int16, flags uint64) (uintptr, error) {
+	filterBytePtr, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var handle uintptr
+	if is32Bit() {
+		handle, _, err = winDivertOpen.Call(uintptr(unsafe.Pointer(filterBytePtr)), uintptr(layer), uintptr(priority),
+			uintptr(flags), uintptr(flags>>32))
+	} else {
+		handle, _, err = winDivertOpen.Call(uintptr(unsafe.Pointer(filterBytePtr)), uintptr(layer), uintptr(priority),
+			uintptr(flags))
+	}
+
+	if handle == uintptr(syscall.InvalidHandle) {
+		return 0, err
+	}
+
+	return handle, nil
+}
+
+// Calls WinDivertClose
+func divertClose(handle uintptr) error {
+	success, _, err := winDivertClose.Call(handle)
+	if success == 0 {
+		return err
+	}
+	return nil
+}
+
+// Calls WinDivertSetParam
+func divertSetParam(handle uintptr, param Param, value uint64) error {
+	var success uintptr
+	var err error
+	if is32Bit() {
+		success, _, err = winDivertSetParam.Call(handle, uintptr(param), uintptr(value), uintptr(value>>32))
+	} else {
+		success, _, err = winDivertSetParam.Call(handle, uintptr(param), uintptr(value))
+	}
+	if success == 0 {
+		return err
+	}
+	return nil
+}
+
+// Calls WinDivertGetParam
+func divertGetParam(handle uintptr, param Param) (uint64, error) {
+	var value uint64
+	success, _, err := winDivertGetParam.Call(handle, uintptr(param), uintptr(unsafe.Pointer(&value)))
+	if success == 0 {
+		return 0, err
+	}
+	return value, nil
+}
+
+// Calls WinDivertRecv and returns the length of the packet written in the buffer
+// addr receives the WINDIVERT_ADDRESS struct of the ABI
+func divertRecv(handle uintptr, buffer []byte, addr []byte, abi ABIVersion) (uint, error) {
+	var packetLen uint32
+	var success uintptr
+	var err error
+
+	if abi == ABIVersion1 {
+		success, _, err = syscall.SyscallN(winDivertRecv.Addr(), handle,
+			uintptr(bytesPtr(buffer)),
+			uintptr(len(buffer)),
+			uintptr(bytesPtr(addr)),
+			uintptr(unsafe.Pointer(&packetLen)))
+	} else {
+		success, _, err = syscall.SyscallN(winDivertRecv.Addr(), handle,
+			uintptr(bytesPtr(buffer)),
+			uintptr(len(buffer)),
+			uintptr(unsafe.Pointer(&packetLen)),
+			uintptr(bytesPtr(addr)))
+	}
+
+	if success == 0 {
+		return 0, err
+	}
+
+	return uint(packetLen), nil
+}
+
+// Calls WinDivertSend and returns the number of bytes injected
+func divertSend(handle uintptr, packet []byte, addr []byte, abi ABIVersion) (uint, error) {
+	var sendLen uint32
+	var success uintptr
+	var err error
+
+	if abi == ABIVersion1 {
+		success, _, err = syscall.SyscallN(winDivertSend.Addr(), handle,
+			uintptr(bytesPtr(packet)),
+			uintptr(len(packet)),
+			uintptr(bytesPtr(addr)),
+			uintptr(unsafe.Pointer(&sendLen)))
+	} else {
+		success, _, err = syscall.SyscallN(winDivertSend.Addr(), handle,
+			uintptr(bytesPtr(packet)),
+			uintptr(len(packet)),
+			uintptr(unsafe.Pointer(&sendLen)),
+			uintptr(bytesPtr(addr)))
+	}
+
+	if success == 0 {
+		return 0, err
+	}
+
+	return uint(sendLen), nil
+}
+
+// Calls the 2.x WinDivertRecvEx with an array of addresses
+// Returns the number of bytes of packets and addresses received
+func divertRecvEx(handle uintptr, buffer []byte, addrs []byte) (uint, uint, error) {
+	var recvLen uint32
+	addrLen := uint32(len(addrs))
+
+	// The flags are always 0, they are passed as two words on 32-bit systems
+	var success uintptr
+	var err error
+	if is32Bit() {
+		success, _, err = winDivertRecvEx.Call(handle,
+			uintptr(bytesPtr(buffer)), uintptr(len(buffer)), uintptr(unsafe.Pointer(&recvLen)),
+			0, 0,
+			uintptr(bytesPtr(addrs)), uintptr(unsafe.Pointer(&addrLen)), 0)
+	} else {
+		success, _, err = winDivertRecvEx.Call(handle,
+			uintptr(bytesPtr(buffer)), uintptr(len(buffer)), uintptr(unsafe.Pointer(&recvLen)),
+			0,
+			uintptr(bytesPtr(addrs)), uintptr(unsafe.Pointer(&addrLen)), 0)
+	}
+	if success == 0 {
+		return 0, 0, err
+	}
+
+	return uint(recvLen), uint(addrLen), nil
+}
+
+// Calls the 2.x WinDivertSendEx with an array of addresses
+func divertSendEx(handle uintptr, packets []byte, addrs []byte) (uint, error) {
+	var sendLen uint32
+
+	// The flags are always 0, they are passed as two words on 32-bit systems
+	var success uintptr
+	var err error
+	if is32Bit() {
+		success, _, err = winDivertSendEx.Call(handle,
+			uintptr(bytesPtr(packets)), uintptr(len(packets)), uintptr(unsafe.Pointer(&sendLen)),
+			0, 0,
+			uintptr(bytesPtr(addrs)), uintptr(len(addrs)), 0)
+	} else {
+		success, _, err = winDivertSendEx.Call(handle,
+			uintptr(bytesPtr(packets)), uintptr(len(packets)), uintptr(unsafe.Pointer(&sendLen)),
+			0,
+			uintptr(bytesPtr(addrs)), uintptr(len(addrs)), 0)
+	}
+	if success == 0 {
+		return 0, err
+	}
+
+	return uint(sendLen), nil
+}
+
+// Calls WinDivertRecvEx with an overlapped struct and waits for the packet
+// The pending receive is cancelled with CancelIoEx once cancel is closed
+func divertRecvCancel(handle uintptr, buffer []byte, addr []byte, abi ABIVersion, cancel <-chan struct{}) (uint, error) {
+	event, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if event == 0 {
+		return 0, err
+	}
+	defer syscall.CloseHandle(syscall.Handle(event))
+
+	// The driver writes the lengths once the receive completes, after the call returns,
+	// they are allocated on the heap and kept alive until GetOverlappedResult returns
+	overlapped := &syscall.Overlapped{HEvent: syscall.Handle(event)}
+	recvLen := new(uint32)
+	addrLen := new(uint32)
+	*addrLen = uint32(len(addr))
+
+	// The flags are always 0, they are passed as two words on 32-bit systems
+	var success uintptr
+	switch {
+	case abi == ABIVersion1 && is32Bit():
+		success, _, err = winDivertRecvEx.Call(handle, uintptr(bytesPtr(buffer)), uintptr(len(buffer)), 0, 0,
+			uintptr(bytesPtr(addr)), uintptr(unsafe.Pointer(recvLen)), uintptr(unsafe.Pointer(overlapped)))
+	case abi == ABIVersion1:
+		success, _, err = winDivertRecvEx.Call(handle, uintptr(bytesPtr(buffer)), uintptr(len(buffer)), 0,
+			uintptr(bytesPtr(addr)), uintptr(unsafe.Pointer(recvLen)), uintptr(unsafe.Pointer(overlapped)))
+	case is32Bit():
+		success, _, err = winDivertRecvEx.Call(handle, uintptr(bytesPtr(buffer)), uintptr(len(buffer)), uintptr(unsafe.Pointer(recvLen)), 0, 0,
+			uintptr(bytesPtr(addr)), uintptr(unsafe.Pointer(addrLen)), uintptr(unsafe.Pointer(overlapped)))
+	default:
+		success, _, err = winDivertRecvEx.Call(handle, uintptr(bytesPtr(buffer)), uintptr(len(buffer)), uintptr(unsafe.Pointer(recvLen)), 0,
+			uintptr(bytesPtr(addr)), uintptr(unsafe.Pointer(addrLen)), uintptr(unsafe.Pointer(overlapped)))
+	}
+	if success == 0 && err != syscall.ERROR_IO_PENDING {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-cancel:
+			syscall.CancelIoEx(syscall.Handle(handle), overlapped)
+		case <-done:
+		}
+	}()
+
+	// Even when WinDivertRecvEx succeeds right away the result is read from the overlapped struct
+	var transferred uint32
+	success, _, err = procGetOverlappedResult.Call(handle,
+		uintptr(unsafe.Pointer(overlapped)),
+		uintptr(unsafe.Pointer(&transferred)),
+		1)
+	close(done)
+	wg.Wait()
+
+	runtime.KeepAlive(buffer)
+	runtime.KeepAlive(addr)
+	runtime.KeepAlive(recvLen)
+	runtime.KeepAlive(addrLen)
+	runtime.KeepAlive(overlapped)
+
+	if success == 0 {
+		return 0, err
+	}
+
+	return uint(transferred), nil
+}
+
+func divertShutdown(handle uintptr, how Shutdown) error {
+	success, _, err := winDivertShutdown.Call(handle, uintptr(how))
+	if success == 0 {
+		return err
+	}
+	return nil
+}
+
+// Calls WinDivertHelperCalcChecksums, addr can be nil
+// The flags are always 0, they are passed as two words on 32-bit systems
+func divertCalcChecksums(packet []byte, addr []byte) {
+	proc := winDivertHelperCalcChecksums.Addr()
+	if is32Bit() {
+		syscall.SyscallN(proc, uintptr(bytesPtr(packet)), uintptr(len(packet)), uintptr(bytesPtr(addr)), 0, 0)
+		return
+	}
+	syscall.SyscallN(proc, uintptr(bytesPtr(packet)), uintptr(len(packet)), uintptr(bytesPtr(addr)), 0)
+}
+
+// Calls WinDivertHelperCheckFilter (1.x) or WinDivertHelperCompileFilter (2.x)
+// Returns the error message and its position if the filter is invalid
+func divertCheckFilter(filter string, layer Layer, abi ABIVersion) (bool, int, string) {
+	var errorStr *byte
+	var errorPos uint32
+
+	filterBytePtr, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return false, 0, err.Error()
+	}
+
+	var success uintptr
+	if abi == ABIVersion1 {
+		success, _, _ = winDivertHelperCheckFilter.Call(
+			uintptr(unsafe.Pointer(filterBytePtr)),
+			uintptr(layer),
+			uintptr(unsafe.Pointer(&errorStr)),
+			uintptr(unsafe.Pointer(&errorPos)))
+	} else {
+		success, _, _ = winDivertHelperCompileFilter.Call(
+			uintptr(unsafe.Pointer(filterBytePtr)),
+			uintptr(layer),
+			uintptr(0),
+			uintptr(0),
+			uintptr(unsafe.Pointer(&errorStr)),
+			uintptr(unsafe.Pointer(&errorPos)))
+	}
+
+	if success != 0 {
+		return true, -1, ""
+	}
+	return false, int(errorPos), goString(errorStr)
+}
+
+// Compiles the filter and formats it back in its canonical form (WinDivert 2.x)
+func divertFormatFilter(filter string, layer Layer) (string, error) {
+	filterBytePtr, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return "", err
+	}
+
+	var errorStr *byte
+	var errorPos uint32
+	var object [8192]byte
+	success, _, _ := winDivertHelperCompileFilter.Call(
+		uintptr(unsafe.Pointer(filterBytePtr)),
+		uintptr(layer),
+		uintptr(unsafe.Pointer(&object[0])),
+		uintptr(len(object)),
+		uintptr(unsafe.Pointer(&errorStr)),
+		uintptr(unsafe.Pointer(&errorPos)))
+	if success == 0 {
+		return "", fmt.Errorf("invalid filter at position %d: %s", errorPos, goString(errorStr))
+	}
+
+	var buffer [8192]byte
+	success, _, err = winDivertHelperFormatFilter.Call(
+		uintptr(unsafe.Pointer(&object[0])),
+		uintptr(layer),
+		uintptr(unsafe.Pointer(&buffer[0])),
+		uintptr(len(buffer)))
+	if success == 0 {
+		return "", err
+	}
+	return goString(&buffer[0]), nil
+}
+
+// Calls WinDivertHelperEvalFilter on a Network layer packet
+func divertEvalFilter(filter string, packet []byte, addr []byte, abi ABIVersion) (bool, error) {
+	filterBytePtr, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return false, err
+	}
+
+	var success uintptr
+	if abi == ABIVersion1 {
+		success, _, err = winDivertHelperEvalFilter.Call(
+			uintptr(unsafe.Pointer(filterBytePtr)),
+			uintptr(WinDivertLayerNetwork),
+			uintptr(bytesPtr(packet)),
+			uintptr(len(packet)),
+			uintptr(bytesPtr(addr)))
+	} else {
+		success, _, err = winDivertHelperEvalFilter.Call(
+			uintptr(unsafe.Pointer(filterBytePtr)),
+			uintptr(bytesPtr(packet)),
+			uintptr(len(packet)),
+			uintptr(bytesPtr(addr)))
+	}
+
+	if success == 0 {
+		if errno, ok := err.(syscall.Errno); ok && errno == 0 {
+			// The packet doesn't match the filter
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Returns the frequency and the current value of the performance counter
+func queryPerformanceCounter() (int64, int64, error) {
+	var frequency, counter int64
+
+	success, _, err := procQueryPerformanceFrequency.Call(uintptr(unsafe.Pointer(&frequency)))
+	if success == 0 {
+		return 0, 0, err
+	}
+
+	success, _, err = procQueryPerformanceCounter.Call(uintptr(unsafe.Pointer(&counter)))
+	if success == 0 {
+		return 0, 0, err
+	}
+
+	return frequency, counter, nil
+}
@@ -0,0 +1,263 @@
+package godivert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// Represents the endpoint data shared by the WINDIVERT_DATA_FLOW and WINDIVERT_DATA_SOCKET structs
+type EndpointData struct {
+	EndpointID       uint64
+	ParentEndpointID uint64
+	ProcessID        uint32
+	LocalIP          net.IP
+	RemoteIP         net.IP
+	LocalPort        uint16
+	RemotePort       uint16
+	Protocol         uint8
+}
+
+// Represents a Flow layer event: a network flow has been established or deleted
+type FlowEvent struct {
+	Event     Event
+	Timestamp int64
+	// Outbound if the flow has been initiated by the local machine
+	Direction Direction
+	Loopback  bool
+
+	EndpointData
+}
+
+// Represents a Socket layer event: bind, connect, listen, accept or close
+type SocketEvent struct {
+	Event     Event
+	Timestamp int64
+	Loopback  bool
+
+	EndpointData
+}
+
+func (e *FlowEvent) String() string {
+	return fmt.Sprintf("%v pid=%d %s %s", e.Event, e.ProcessID, e.Direction, e.EndpointData.String())
+}
+
+func (e *SocketEvent) String() string {
+	return fmt.Sprintf("%v pid=%d %s", e.Event, e.ProcessID, e.EndpointData.String())
+}
+
+func (d *EndpointData) String() string {
+	return fmt.Sprintf("%s %s <-> %s", header.ProtocolName(d.Protocol),
+		net.JoinHostPort(d.LocalIP.String(), fmt.Sprint(d.LocalPort)),
+		net.JoinHostPort(d.RemoteIP.String(), fmt.Sprint(d.RemotePort)))
+}
+
+// Returns the flow key of the packets sent by the local endpoint
+func (d *EndpointData) FlowKey() FlowKey {
+	key := FlowKey{
+		Protocol: d.Protocol,
+		SrcPort:  d.LocalPort,
+		DstPort:  d.RemotePort,
+	}
+	copy(key.SrcIP[:], d.LocalIP.To16())
+	copy(key.DstIP[:], d.RemoteIP.To16())
+	return key
+}
+
+// Decodes the endpoint data of a Flow or Socket layer address
+func decodeEndpointData(b []byte) EndpointData {
+	return EndpointData{
+		EndpointID:       binary.LittleEndian.Uint64(b[0:8]),
+		ParentEndpointID: binary.LittleEndian.Uint64(b[8:16]),
+		ProcessID:        binary.LittleEndian.Uint32(b[16:20]),
+		LocalIP:          decodeEndpointIP(b[20:36]),
+		RemoteIP:         decodeEndpointIP(b[36:52]),
+		LocalPort:        binary.LittleEndian.Uint16(b[52:54]),
+		RemotePort:       binary.LittleEndian.Uint16(b[54:56]),
+		Protocol:         b[56],
+	}
+}
+
+// WinDivert stores the addresses as UINT32[4] in host byte order with the least
+// significant word first, IPv4 addresses are IPv4-mapped IPv6 addresses
+func decodeEndpointIP(b []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for i := range ip {
+		ip[i] = b[net.IPv6len-1-i]
+	}
+	return ip
+}
+
+// Returns the event of a Flow layer address
+func (w *WinDivertAddress) Flow() (*FlowEvent, error) {
+	if w.Layer != WinDivertLayerFlow {
+		return nil, fmt.Errorf("can't read flow data of a %v layer address", w.Layer)
+	}
+
+	return &FlowEvent{
+		Event:        w.Event,
+		Timestamp:    w.Timestamp,
+		Direction:    w.Direction(),
+		Loopback:     w.Loopback(),
+		EndpointData: decodeEndpointData(w.LayerData[:]),
+	}, nil
+}
+
+// Returns the event of a Socket layer address
+func (w *WinDivertAddress) Socket() (*SocketEvent, error) {
+	if w.Layer != WinDivertLayerSocket {
+		return nil, fmt.Errorf("can't read socket data of a %v layer address", w.Layer)
+	}
+
+	return &SocketEvent{
+		Event:        w.Event,
+		Timestamp:    w.Timestamp,
+		Loopback:     w.Loopback(),
+		EndpointData: decodeEndpointData(w.LayerData[:]),
+	}, nil
+}
+
+// Receive the next event of a Flow layer handle
+func (wd *WinDivertHandle) RecvFlowEvent() (*FlowEvent, error) {
+	packet, err := wd.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return packet.Addr.Flow()
+}
+
+// Receive the next event of a Socket layer handle
+func (wd *WinDivertHandle) RecvSocketEvent() (*SocketEvent, error) {
+	packet, err := wd.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return packet.Addr.Socket()
+}
+
+// Identifies a local socket
+type socketKey struct {
+	protocol uint8
+	ip       [16]byte
+	port     uint16
+}
+
+// ProcessTable attributes Network layer packets to the process owning them
+// It is fed with Flow and Socket layer events, see Track
+type ProcessTable struct {
+	mu      sync.RWMutex
+	flows   map[FlowKey]uint32
+	sockets map[socketKey]uint32
+}
+
+// Create a new empty ProcessTable
+func NewProcessTable() *ProcessTable {
+	return &ProcessTable{
+		flows:   make(map[FlowKey]uint32),
+		sockets: make(map[socketKey]uint32),
+	}
+}
+
+// Add or remove the flow of the event
+func (t *ProcessTable) AddFlowEvent(event *FlowEvent) {
+	key := event.FlowKey()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch event.Event {
+	case WinDivertEventFlowEstablished:
+		t.flows[key] = event.ProcessID
+	case WinDivertEventFlowDeleted:
+		delete(t.flows, key)
+	}
+}
+
+// Add or remove the socket of the event
+func (t *ProcessTable) AddSocketEvent(event *SocketEvent) {
+	local := socketKey{protocol: event.Protocol, port: event.LocalPort}
+	copy(local.ip[:], event.LocalIP.To16())
+	flow := event.FlowKey()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch event.Event {
+	case WinDivertEventSocketBind, WinDivertEventSocketListen:
+		t.sockets[local] = event.ProcessID
+	case WinDivertEventSocketConnect, WinDivertEventSocketAccept:
+		t.sockets[local] = event.ProcessID
+		t.flows[flow] = event.ProcessID
+	case WinDivertEventSocketClose:
+		delete(t.sockets, local)
+		delete(t.flows, flow)
+	}
+}
+
+// Returns the ID of the process owning the packet
+// The flow of the packet is looked up first, then the local socket it is sent from or to
+func (t *ProcessTable) Lookup(packet *Packet) (uint32, bool) {
+	key := packet.FlowKey()
+	// Packets without address, such as the ones built by hand, are considered outbound
+	if packet.Addr != nil && packet.Direction() == WinDivertDirectionInbound {
+		key = key.Reverse()
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if pid, ok := t.flows[key]; ok {
+		return pid, true
+	}
+
+	local := socketKey{protocol: key.Protocol, ip: key.SrcIP, port: key.SrcPort}
+	if pid, ok := t.sockets[local]; ok {
+		return pid, true
+	}
+
+	// Sockets bound to the unspecified address
+	local.ip = [16]byte{}
+	if pid, ok := t.sockets[local]; ok {
+		return pid, true
+	}
+	copy(local.ip[:], net.IPv4zero.To16())
+	pid, ok := t.sockets[local]
+	return pid, ok
+}
+
+// Returns the number of tracked flows and sockets
+func (t *ProcessTable) Len() (flows, sockets int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.flows), len(t.sockets)
+}
+
+// Add the events received on a Flow or Socket layer handle until Recv fails
+func (t *ProcessTable) Track(wd *WinDivertHandle) error {
+	for {
+		packet, err := wd.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch packet.Addr.Layer {
+		case WinDivertLayerFlow:
+			event, err := packet.Addr.Flow()
+			if err != nil {
+				return err
+			}
+			t.AddFlowEvent(event)
+		case WinDivertLayerSocket:
+			event, err := packet.Addr.Socket()
+			if err != nil {
+				return err
+			}
+			t.AddSocketEvent(event)
+		default:
+			return fmt.Errorf("can't track processes with a %v layer handle", packet.Addr.Layer)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package godivert
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Returns a WINDIVERT_DATA_FLOW or WINDIVERT_DATA_SOCKET struct
+// The addresses are UINT32[4] with the least significant word first
+func endpointData(endpoint, parent uint64, pid uint32, local, remote [4]uint32, localPort, remotePort uint16, protocol uint8) []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint64(b, endpoint)
+	b = binary.LittleEndian.AppendUint64(b, parent)
+	b = binary.LittleEndian.AppendUint32(b, pid)
+	b = append(b, words(local[:]...)...)
+	b = append(b, words(remote[:]...)...)
+	b = binary.LittleEndian.AppendUint16(b, localPort)
+	b = binary.LittleEndian.AppendUint16(b, remotePort)
+	return append(b, protocol)
+}
+
+// Returns the 2.x address of a Flow or Socket layer event
+func eventAddress(t *testing.T, bits uint32, data []byte) *WinDivertAddress {
+	t.Helper()
+	var addr WinDivertAddress
+	if err := addr.UnmarshalABI(abiAddress(ABIVersion2, 42, append(words(bits, 0), data...)...), ABIVersion2); err != nil {
+		t.Fatal(err)
+	}
+	return &addr
+}
+
+var (
+	// 10.0.0.1 and 93.184.216.34 as IPv4-mapped IPv6 addresses
+	localV4  = [4]uint32{0x0a000001, 0x0000ffff, 0, 0}
+	remoteV4 = [4]uint32{0x5db8d822, 0x0000ffff, 0, 0}
+	// 2001:db8::1 and 2001:db8::2
+	localV6  = [4]uint32{1, 0, 0, 0x20010db8}
+	remoteV6 = [4]uint32{2, 0, 0, 0x20010db8}
+)
+
+func TestFlowEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		// Layer:8, Event:8, Sniffed:1, Outbound:1, Loopback:1
+		bits uint32
+		data []byte
+		want FlowEvent
+	}{
+		{
+			name: "ipv4 established outbound",
+			bits: 0x00020102,
+			data: endpointData(7, 3, 1234, localV4, remoteV4, 49368, 443, header.TCP),
+			want: FlowEvent{Event: WinDivertEventFlowEstablished, Timestamp: 42, Direction: WinDivertDirectionOutbound,
+				EndpointData: EndpointData{EndpointID: 7, ParentEndpointID: 3, ProcessID: 1234,
+					LocalIP: net.ParseIP("10.0.0.1"), RemoteIP: net.ParseIP("93.184.216.34"),
+					LocalPort: 49368, RemotePort: 443, Protocol: header.TCP}},
+		},
+		{
+			name: "ipv6 deleted inbound loopback",
+			bits: 0x00040202,
+			data: endpointData(8, 0, 99, localV6, remoteV6, 53, 5353, header.UDP),
+			want: FlowEvent{Event: WinDivertEventFlowDeleted, Timestamp: 42, Direction: WinDivertDirectionInbound, Loopback: true,
+				EndpointData: EndpointData{EndpointID: 8, ProcessID: 99,
+					LocalIP: net.ParseIP("2001:db8::1"), RemoteIP: net.ParseIP("2001:db8::2"),
+					LocalPort: 53, RemotePort: 5353, Protocol: header.UDP}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := eventAddress(t, test.bits, test.data).Flow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*event, test.want) {
+				t.Errorf("Flow() = %+v, want %+v", event, test.want)
+			}
+		})
+	}
+
+	if _, err := eventAddress(t, 0x00040103, nil).Flow(); err == nil {
+		t.Error("Flow() of a Socket layer address succeeded")
+	}
+}
+
+func TestSocketEvent(t *testing.T) {
+	event, err := eventAddress(t, 0x00000403, endpointData(9, 0, 4321, localV6, remoteV6, 50000, 443, header.TCP)).Socket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SocketConnect pid=4321 TCP [2001:db8::1]:50000 <-> [2001:db8::2]:443"
+	if event.Event != WinDivertEventSocketConnect || event.EndpointID != 9 || event.String() != want {
+		t.Errorf("Socket() = %v, want %s", event, want)
+	}
+
+	if _, err := eventAddress(t, 0x00020102, nil).Socket(); err == nil {
+		t.Error("Socket() of a Flow layer address succeeded")
+	}
+}
+
+func TestProcessTable(t *testing.T) {
+	table := NewProcessTable()
+
+	flow, err := eventAddress(t, 0x00020102, endpointData(7, 0, 1234, localV4, remoteV4, 49368, 443, header.TCP)).Flow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.AddFlowEvent(flow)
+	bind, err := eventAddress(t, 0x00000303, endpointData(8, 0, 99, [4]uint32{}, [4]uint32{}, 53, 0, header.UDP)).Socket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.AddSocketEvent(bind)
+
+	inbound := &WinDivertAddress{}
+	inbound.SetDirection(WinDivertDirectionInbound)
+
+	tests := []struct {
+		name   string
+		raw    []byte
+		addr   *WinDivertAddress
+		want   uint32
+		wantOk bool
+	}{
+		{"outbound flow", testpacket.TCP("10.0.0.1", 49368, "93.184.216.34", 443, header.TCPFlagACK), &WinDivertAddress{}, 1234, true},
+		{"inbound flow", testpacket.TCP("93.184.216.34", 443, "10.0.0.1", 49368, header.TCPFlagACK), inbound, 1234, true},
+		{"without address", testpacket.TCP("10.0.0.1", 49368, "93.184.216.34", 443, header.TCPFlagACK), nil, 1234, true},
+		{"unspecified socket", testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 5000, nil), nil, 99, true},
+		{"unknown", testpacket.UDP("10.0.0.1", 54, "10.0.0.2", 5000, nil), nil, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := &Packet{Raw: test.raw, PacketLen: uint(len(test.raw)), Addr: test.addr}
+			if pid, ok := table.Lookup(packet); pid != test.want || ok != test.wantOk {
+				t.Errorf("Lookup() = %d, %v, want %d, %v", pid, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
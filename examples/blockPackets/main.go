@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"time"
+
 	"github.com/williamfhe/godivert"
 )
 
@@ -12,12 +13,16 @@ func checkPacket(wd *godivert.WinDivertHandle, packetChan <-chan *godivert.Packe
 	for packet := range packetChan {
 		if !packet.DstIP().Equal(cloudflareDNS) {
 			packet.Send(wd)
+			continue
 		}
+
+		// Tell the sender right away instead of letting it wait for a timeout
+		wd.Reject(packet, godivert.RejectOptions{Code: godivert.RejectAdminProhibited})
 	}
 }
 
 func main() {
-	winDivert, err := godivert.NewWinDivertHandle("icmp")
+	winDivert, err := godivert.NewWinDivertHandle("outbound and ip.DstAddr == 1.1.1.1")
 	if err != nil {
 		panic(err)
 	}
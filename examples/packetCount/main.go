@@ -4,19 +4,18 @@ import (
 	"fmt"
 	"github.com/williamfhe/godivert"
 	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/pipeline"
+	"sync"
 	"time"
 )
 
 var icmpv4, icmpv6, udp, tcp, unknown, served uint
-
-func checkPacket(wd *godivert.WinDivertHandle, packetChan <-chan *godivert.Packet) {
-	for packet := range packetChan {
-		countPacket(packet)
-		wd.Send(packet)
-	}
-}
+var countMutex sync.Mutex
 
 func countPacket(packet *godivert.Packet) {
+	countMutex.Lock()
+	defer countMutex.Unlock()
+
 	served++
 	switch packet.NextHeaderType() {
 	case header.ICMPv4:
@@ -46,15 +45,21 @@ func main() {
 	}
 	defer winDivert.Close()
 
-	n := 50
-	for i := 0; i < n; i++ {
-		go checkPacket(winDivert, packetChan)
-	}
+	// The packets of a connection are always handled by the same worker and stay in order
+	dispatcher := pipeline.NewDispatcher(8, 0, func(packet *godivert.Packet) error {
+		countPacket(packet)
+		_, err := winDivert.Send(packet)
+		return err
+	})
+	go dispatcher.Run(packetChan)
 
 	time.Sleep(15 * time.Second)
 
 	fmt.Println("Stopping...")
 
+	countMutex.Lock()
+	defer countMutex.Unlock()
+
 	fmt.Printf("Served: %d packets\n", served)
 
 	fmt.Printf("ICMPv4=%d ICMPv6=%d UDP=%d TCP=%d Unknown=%d", icmpv4, icmpv6, udp, tcp, unknown)
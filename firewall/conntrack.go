@@ -0,0 +1,325 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+)
+
+// Represents the state of a packet with regard to the connections already seen
+// States can be combined to match several of them in a Rule
+type State uint8
+
+const (
+	// First packet of a connection, or packet of a connection not answered yet
+	StateNew State = 1 << iota
+	// Packet of a connection which has been answered
+	StateEstablished
+	// ICMP error about a tracked connection
+	StateRelated
+	// Packet belonging to no connection, such as a TCP segment without SYN or an unexpected ICMP error,
+	// or packet whose headers can't be parsed
+	StateInvalid
+
+	StateAll = StateNew | StateEstablished | StateRelated | StateInvalid
+)
+
+func (s State) String() string {
+	if s == 0 {
+		return "Any"
+	}
+
+	var names []string
+	for _, state := range []struct {
+		state State
+		name  string
+	}{
+		{StateNew, "New"},
+		{StateEstablished, "Established"},
+		{StateRelated, "Related"},
+		{StateInvalid, "Invalid"},
+	} {
+		if s&state.state != 0 {
+			names = append(names, state.name)
+		}
+	}
+	if s&^StateAll != 0 {
+		names = append(names, "Unknown State")
+	}
+	return strings.Join(names, "|")
+}
+
+// Default maximum number of tracked connections
+const DefaultMaxConnections = 65536
+
+// Represents how long an idle connection is remembered
+type Timeouts struct {
+	// TCP connection answered and not closed
+	TCPEstablished time.Duration
+	// TCP connection being opened or closed
+	TCPTransient time.Duration
+	UDP          time.Duration
+	// ICMP and the other protocols
+	Other time.Duration
+}
+
+// Timeouts used by NewConntrack
+var DefaultTimeouts = Timeouts{
+	TCPEstablished: 2 * time.Hour,
+	TCPTransient:   2 * time.Minute,
+	UDP:            time.Minute,
+	Other:          30 * time.Second,
+}
+
+// Represents a tracked connection
+type connection struct {
+	// Flow of the first packet of the connection
+	origin   godivert.FlowKey
+	replied  bool
+	finSeen  [2]bool
+	lastSeen time.Time
+	expires  time.Time
+}
+
+// Tracks the connections going through the firewall to give a State to each packet
+// Only the packets accepted by the firewall are tracked
+type Conntrack struct {
+	Timeouts Timeouts
+	// Maximum number of tracked connections, new connections aren't tracked beyond it
+	MaxConnections int
+	// Don't pick up TCP connections opened before the firewall, their packets are Invalid
+	StrictTCP bool
+
+	mu          sync.Mutex
+	connections map[godivert.FlowKey]*connection
+	lastPurge   time.Time
+}
+
+// Create a new Conntrack with the DefaultTimeouts
+func NewConntrack() *Conntrack {
+	return &Conntrack{
+		Timeouts:       DefaultTimeouts,
+		MaxConnections: DefaultMaxConnections,
+		connections:    make(map[godivert.FlowKey]*connection),
+	}
+}
+
+// Returns true if the ICMP packet is an error message carrying the beginning of another packet
+func isICMPError(packet *godivert.Packet) bool {
+	switch icmpHdr := packet.NextHeader.(type) {
+	case *header.ICMPv4Header:
+		switch icmpHdr.Type() {
+		// Destination Unreachable, Source Quench, Redirect, Time Exceeded and Parameter Problem
+		case 3, 4, 5, 11, 12:
+			return true
+		}
+	case *header.ICMPv6Header:
+		return icmpHdr.Type() < 128
+	}
+	return false
+}
+
+// Returns the flow of the packet embedded in an ICMP error, false if it is truncated
+func embeddedFlow(packet *godivert.Packet) (godivert.FlowKey, bool) {
+	start := int(packet.IpHdr.HeaderLen()) + packet.NextHeader.HeaderLen()
+	if start >= int(packet.PacketLen) {
+		return godivert.FlowKey{}, false
+	}
+	inner := packet.Raw[start:packet.PacketLen]
+
+	// The IP header and the first 8 bytes of the transport header are needed,
+	// the embedded packet is too short to be parsed as a Packet
+	var key godivert.FlowKey
+	var hdrLen int
+	switch inner[0] >> 4 {
+	case header.IPv4:
+		hdrLen = int(inner[0]&0xf) << 2
+		if hdrLen < header.IPv4HeaderLen || len(inner) < hdrLen+8 {
+			return godivert.FlowKey{}, false
+		}
+		key.Protocol = inner[9]
+		copy(key.SrcIP[:], net.IP(inner[12:16]).To16())
+		copy(key.DstIP[:], net.IP(inner[16:20]).To16())
+	case header.IPv6:
+		hdrLen = header.IPv6HeaderLen
+		if len(inner) < hdrLen+8 {
+			return godivert.FlowKey{}, false
+		}
+		key.Protocol = inner[6]
+		copy(key.SrcIP[:], inner[8:24])
+		copy(key.DstIP[:], inner[24:40])
+	default:
+		return godivert.FlowKey{}, false
+	}
+
+	if key.Protocol == header.TCP || key.Protocol == header.UDP {
+		key.SrcPort = binary.BigEndian.Uint16(inner[hdrLen : hdrLen+2])
+		key.DstPort = binary.BigEndian.Uint16(inner[hdrLen+2 : hdrLen+4])
+	}
+	return key, true
+}
+
+// Returns the timeout of the connection after the packet
+func (c *Conntrack) timeout(conn *connection, protocol uint8) time.Duration {
+	switch protocol {
+	case header.TCP:
+		if conn.replied && !(conn.finSeen[0] && conn.finSeen[1]) {
+			return c.Timeouts.TCPEstablished
+		}
+		return c.Timeouts.TCPTransient
+	case header.UDP:
+		return c.Timeouts.UDP
+	default:
+		return c.Timeouts.Other
+	}
+}
+
+// Returns the live connection of the flow, must be called with c.mu held
+func (c *Conntrack) lookup(key godivert.FlowKey, now time.Time) *connection {
+	canonical := key.Canonical()
+	conn, ok := c.connections[canonical]
+	if !ok {
+		return nil
+	}
+	if now.After(conn.expires) {
+		delete(c.connections, canonical)
+		return nil
+	}
+	return conn
+}
+
+// Returns the state of the packet without tracking it
+func (c *Conntrack) State(packet *godivert.Packet, now time.Time) State {
+	packet.VerifyParsed()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state(packet, now)
+}
+
+// Packets without IP header or with a truncated transport header are Invalid
+// Must be called with c.mu held
+func (c *Conntrack) state(packet *godivert.Packet, now time.Time) State {
+	if packet.IpHdr == nil || packet.VerifyParsed() != nil {
+		return StateInvalid
+	}
+
+	if isICMPError(packet) {
+		key, ok := embeddedFlow(packet)
+		if ok && c.lookup(key, now) != nil {
+			return StateRelated
+		}
+		return StateInvalid
+	}
+
+	key := packet.FlowKey()
+	tcpHdr, isTCP := packet.NextHeader.(*header.TCPHeader)
+
+	conn := c.lookup(key, now)
+	if conn == nil {
+		if isTCP {
+			if tcpHdr.RST() {
+				return StateInvalid
+			}
+			if !(tcpHdr.SYN() && !tcpHdr.ACK()) && c.StrictTCP {
+				return StateInvalid
+			}
+		}
+		return StateNew
+	}
+
+	if key != conn.origin || conn.replied {
+		return StateEstablished
+	}
+	return StateNew
+}
+
+// Records the packet as accepted and returns its state
+func (c *Conntrack) Track(packet *godivert.Packet, now time.Time) State {
+	packet.VerifyParsed()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.state(packet, now)
+	c.track(packet, state, now)
+	return state
+}
+
+// Must be called with c.mu held
+func (c *Conntrack) track(packet *godivert.Packet, state State, now time.Time) {
+	if state&(StateRelated|StateInvalid) != 0 {
+		return
+	}
+
+	if now.Sub(c.lastPurge) > c.Timeouts.Other {
+		c.purge(now)
+	}
+
+	key := packet.FlowKey()
+	canonical := key.Canonical()
+
+	conn := c.lookup(key, now)
+	if conn == nil {
+		if c.MaxConnections > 0 && len(c.connections) >= c.MaxConnections {
+			return
+		}
+		conn = &connection{origin: key}
+		c.connections[canonical] = conn
+	}
+
+	reply := key != conn.origin
+	if reply {
+		conn.replied = true
+	}
+
+	if tcpHdr, ok := packet.NextHeader.(*header.TCPHeader); ok {
+		if tcpHdr.RST() {
+			delete(c.connections, canonical)
+			return
+		}
+		if tcpHdr.FIN() {
+			if reply {
+				conn.finSeen[1] = true
+			} else {
+				conn.finSeen[0] = true
+			}
+		}
+	}
+
+	conn.lastSeen = now
+	conn.expires = now.Add(c.timeout(conn, key.Protocol))
+}
+
+// Forget the expired connections and returns how many there were
+func (c *Conntrack) Purge(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.purge(now)
+}
+
+// Must be called with c.mu held
+func (c *Conntrack) purge(now time.Time) int {
+	c.lastPurge = now
+
+	purged := 0
+	for key, conn := range c.connections {
+		if now.After(conn.expires) {
+			delete(c.connections, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Returns the number of tracked connections, including the expired ones not purged yet
+func (c *Conntrack) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.connections)
+}
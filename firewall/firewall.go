@@ -0,0 +1,257 @@
+// Package firewall is a stateful host firewall evaluating ordered rules
+// against the packets diverted by a broad WinDivert filter.
+//
+// Rules match on direction, interface, networks, ports, protocol, TCP flags
+// and connection tracking state. The first rule with a final action decides,
+// Log rules report the packet and let the next rules see it:
+//
+//	fw, err := firewall.NewFirewall(winDivert, firewall.Drop, []firewall.Rule{
+//		{Name: "established", States: firewall.StateEstablished | firewall.StateRelated, Action: firewall.Accept},
+//		{Name: "ssh", Direction: firewall.Inbound, Protocols: []uint8{header.TCP},
+//			DstPorts: []firewall.PortRange{{From: 22, To: 22}}, Action: firewall.RateLimit, Rate: 5},
+//		{Name: "outbound", Direction: firewall.Outbound, Action: firewall.Accept},
+//	})
+//	fw.Run(packetChan)
+//
+// A Firewall is also a pipeline.Handler.
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/pipeline"
+)
+
+// Implemented by senders able to answer a packet with a TCP reset or an ICMP message, such as WinDivertHandle
+type Rejecter interface {
+	Reject(packet *godivert.Packet, options godivert.RejectOptions) error
+}
+
+// Represents the outcome of the evaluation of a packet
+type Decision struct {
+	// Accept, Drop or Reject
+	Action Action
+	// Index of the deciding rule, -1 for the default policy
+	Rule  int
+	State State
+	// Answer to send for the Reject action
+	Reject godivert.RejectOptions
+}
+
+// Counters of a Firewall
+type Stats struct {
+	Rules  []RuleStats
+	Policy RuleStats
+	// Number of tracked connections
+	Connections int
+}
+
+// Evaluates ordered rules against each packet and applies the decision
+type Firewall struct {
+	sender    godivert.Sender
+	conntrack *Conntrack
+
+	// Called for the packets matching a Log rule, the packets are logged with the log package if nil
+	OnLog func(rule *Rule, packet *godivert.Packet, state State)
+	// Called when the answer to a rejected packet can't be sent by Handle,
+	// the error is logged with the log package if nil
+	OnRejectError func(packet *godivert.Packet, err error)
+
+	mu     sync.RWMutex
+	rules  []*compiledRule
+	policy *compiledRule
+}
+
+// Create a new Firewall sending the accepted packets with the sender
+// The policy is the action applied to the packets matching no final rule, Accept, Drop or Reject
+func NewFirewall(sender godivert.Sender, policy Action, rules []Rule) (*Firewall, error) {
+	f := &Firewall{
+		sender:    sender,
+		conntrack: NewConntrack(),
+	}
+	if err := f.SetRules(policy, rules); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Replace the rules and the policy, the counters start over
+// The tracked connections are kept
+func (f *Firewall) SetRules(policy Action, rules []Rule) error {
+	switch policy {
+	case Accept, Drop, Reject:
+	default:
+		return errors.New("the policy must be Accept, Drop or Reject")
+	}
+
+	compiled := make([]*compiledRule, len(rules))
+	for i, rule := range rules {
+		c, err := compileRule(rule)
+		if err != nil {
+			if rule.Name != "" {
+				return fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		compiled[i] = c
+	}
+
+	policyRule, _ := compileRule(Rule{Name: "policy", Action: policy})
+
+	f.mu.Lock()
+	f.rules = compiled
+	f.policy = policyRule
+	f.mu.Unlock()
+	return nil
+}
+
+// Returns the connection tracker of the firewall, its timeouts and limits can be changed before processing packets
+func (f *Firewall) Conntrack() *Conntrack {
+	return f.conntrack
+}
+
+// Returns the decision of the rules about the packet
+// The counters are updated and the connection is tracked if the packet is accepted
+func (f *Firewall) Evaluate(packet *godivert.Packet) Decision {
+	packet.VerifyParsed()
+	now := time.Now()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	c := f.conntrack
+	c.mu.Lock()
+	state := c.state(packet, now)
+	c.mu.Unlock()
+
+	decision := Decision{Rule: -1, State: state}
+	deciding := f.policy
+
+	for i, rule := range f.rules {
+		if !rule.match(packet, state) {
+			continue
+		}
+		rule.count(packet)
+
+		if rule.Action == Log {
+			f.log(&rule.Rule, packet, state)
+			continue
+		}
+
+		decision.Rule = i
+		deciding = rule
+		break
+	}
+
+	if decision.Rule < 0 {
+		f.policy.count(packet)
+	}
+
+	switch deciding.Action {
+	case RateLimit:
+		decision.Action = Accept
+		if !deciding.allow(now) {
+			decision.Action = Drop
+		}
+	default:
+		decision.Action = deciding.Action
+	}
+	decision.Reject = deciding.Reject
+
+	if decision.Action == Accept {
+		c.mu.Lock()
+		c.track(packet, state, now)
+		c.mu.Unlock()
+	}
+
+	return decision
+}
+
+func (f *Firewall) log(rule *Rule, packet *godivert.Packet, state State) {
+	if f.OnLog != nil {
+		f.OnLog(rule, packet, state)
+		return
+	}
+	log.Printf("firewall: rule %q: %s %s", rule.Name, state, packet.FlowKey())
+}
+
+// Evaluate the packet and apply the decision
+// Accepted packets are sent and belong to the sender from then on, the sender releases them if needed
+// Rejected packets are answered, and the dropped and rejected packets are released
+func (f *Firewall) Process(packet *godivert.Packet) error {
+	decision := f.Evaluate(packet)
+	switch decision.Action {
+	case Accept:
+		_, err := f.sender.Send(packet)
+		return err
+	case Reject:
+		defer packet.Release()
+		return f.reject(packet, decision.Reject)
+	default:
+		packet.Release()
+		return nil
+	}
+}
+
+func (f *Firewall) reject(packet *godivert.Packet, options godivert.RejectOptions) error {
+	rejecter, ok := f.sender.(Rejecter)
+	if !ok {
+		return errors.New("the sender can't reject packets")
+	}
+	return rejecter.Reject(packet, options)
+}
+
+func (f *Firewall) rejectError(packet *godivert.Packet, err error) {
+	if f.OnRejectError != nil {
+		f.OnRejectError(packet, err)
+		return
+	}
+	log.Printf("firewall: can't reject %s: %v", packet.FlowKey(), err)
+}
+
+// Process the packets of the channel until it is closed
+func (f *Firewall) Run(packets <-chan *godivert.Packet) {
+	for packet := range packets {
+		f.Process(packet)
+	}
+}
+
+// Evaluate the packet as a pipeline handler
+// Rejected packets are answered with the sender of the firewall and dropped,
+// even if the answer can't be sent so that the pipeline doesn't fail open: the error
+// is reported to OnRejectError instead
+func (f *Firewall) Handle(ctx *pipeline.Context) (pipeline.Verdict, error) {
+	decision := f.Evaluate(ctx.Packet)
+	switch decision.Action {
+	case Accept:
+		return pipeline.Accept, nil
+	case Reject:
+		if err := f.reject(ctx.Packet, decision.Reject); err != nil {
+			f.rejectError(ctx.Packet, err)
+		}
+		return pipeline.Drop, nil
+	default:
+		return pipeline.Drop, nil
+	}
+}
+
+// Returns a copy of the counters
+func (f *Firewall) Stats() Stats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	stats := Stats{
+		Rules:       make([]RuleStats, len(f.rules)),
+		Policy:      f.policy.Stats(),
+		Connections: f.conntrack.Len(),
+	}
+	for i, rule := range f.rules {
+		stats.Rules[i] = rule.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,240 @@
+package firewall
+
+import (
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+	"github.com/williamfhe/godivert/pipeline"
+)
+
+// Sender unable to reject packets, recording the packets sent
+type discardSender struct {
+	sent []*godivert.Packet
+}
+
+func (s *discardSender) Send(packet *godivert.Packet) (uint, error) {
+	s.sent = append(s.sent, packet)
+	return packet.PacketLen, nil
+}
+
+// Returns a packet of raw with the given direction
+func newPacket(raw []byte, direction godivert.Direction) *godivert.Packet {
+	packet := &godivert.Packet{Raw: raw, PacketLen: uint(len(raw)), Addr: &godivert.WinDivertAddress{}}
+	packet.Addr.SetDirection(direction)
+	return packet
+}
+
+func outbound(raw []byte) *godivert.Packet {
+	return newPacket(raw, godivert.WinDivertDirectionOutbound)
+}
+
+func inbound(raw []byte) *godivert.Packet {
+	return newPacket(raw, godivert.WinDivertDirectionInbound)
+}
+
+func TestHandleRejectError(t *testing.T) {
+	f, err := NewFirewall(&discardSender{}, Reject, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rejectErr error
+	f.OnRejectError = func(packet *godivert.Packet, err error) {
+		rejectErr = err
+	}
+
+	raw := testpacket.SYN()
+	verdict, err := f.Handle(&pipeline.Context{Packet: &godivert.Packet{Raw: raw, PacketLen: uint(len(raw))}})
+	if verdict != pipeline.Drop || err != nil {
+		t.Errorf("Handle() = %v, %v, want Drop without error", verdict, err)
+	}
+	if rejectErr == nil {
+		t.Error("OnRejectError wasn't called")
+	}
+}
+
+func TestStateMalformed(t *testing.T) {
+	raw := testpacket.SYN()
+
+	tests := []struct {
+		name   string
+		packet *godivert.Packet
+		want   State
+	}{
+		{"syn", &godivert.Packet{Raw: raw, PacketLen: uint(len(raw))}, StateNew},
+		{"flow event", &godivert.Packet{Addr: &godivert.WinDivertAddress{Layer: godivert.WinDivertLayerFlow}}, StateInvalid},
+		{"truncated ip header", &godivert.Packet{Raw: raw[:12], PacketLen: 12}, StateInvalid},
+		{"truncated tcp header", &godivert.Packet{Raw: raw[:24], PacketLen: 24}, StateInvalid},
+	}
+
+	now := time.Now()
+	for _, test := range tests {
+		c := NewConntrack()
+		if got := c.Track(test.packet, now); got != test.want {
+			t.Errorf("%s: Track() = %v, want %v", test.name, got, test.want)
+		}
+		if test.want == StateInvalid && c.Len() != 0 {
+			t.Errorf("%s: %d tracked connections, want 0", test.name, c.Len())
+		}
+	}
+}
+
+func TestEvaluateOrder(t *testing.T) {
+	var logged []string
+	f, err := NewFirewall(&discardSender{}, Drop, []Rule{
+		{Name: "log inbound", Direction: Inbound, Action: Log},
+		{Name: "web", Direction: Inbound, Protocols: []uint8{header.TCP}, DstPorts: []PortRange{{From: 80, To: 80}}, Action: Accept},
+		{Name: "block lan", Src: []string{"10.0.0.0/8"}, Action: Reject},
+		{Name: "lan web", Src: []string{"10.0.0.0/8"}, DstPorts: []PortRange{{From: 80, To: 80}}, Action: Accept},
+		{Name: "dns", Protocols: []uint8{header.UDP}, DstPorts: []PortRange{{From: 53, To: 53}}, Action: Accept},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.OnLog = func(rule *Rule, packet *godivert.Packet, state State) {
+		logged = append(logged, rule.Name)
+	}
+
+	tests := []struct {
+		name       string
+		packet     *godivert.Packet
+		wantRule   int
+		wantAction Action
+		wantLogged bool
+	}{
+		{"inbound web", inbound(testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN)), 1, Accept, true},
+		// The first final rule decides, even if a later rule matches too
+		{"outbound lan web", outbound(testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN)), 2, Reject, false},
+		{"inbound dns", inbound(testpacket.UDP("192.168.0.1", 5353, "192.168.0.2", 53, nil)), 4, Accept, true},
+		{"policy", outbound(testpacket.UDP("192.168.0.1", 5353, "192.168.0.2", 123, nil)), -1, Drop, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logged = nil
+			decision := f.Evaluate(test.packet)
+			if decision.Rule != test.wantRule || decision.Action != test.wantAction {
+				t.Errorf("Evaluate() = rule %d %v, want rule %d %v", decision.Rule, decision.Action, test.wantRule, test.wantAction)
+			}
+			if (len(logged) == 1) != test.wantLogged {
+				t.Errorf("logged %v, want logged %v", logged, test.wantLogged)
+			}
+		})
+	}
+
+	stats := f.Stats()
+	want := []uint64{2, 1, 1, 0, 1}
+	for i, rule := range stats.Rules {
+		if rule.Packets != want[i] {
+			t.Errorf("rule %q matched %d packets, want %d", rule.Name, rule.Packets, want[i])
+		}
+	}
+	if stats.Policy.Packets != 1 {
+		t.Errorf("policy applied to %d packets, want 1", stats.Policy.Packets)
+	}
+}
+
+func TestConntrack(t *testing.T) {
+	client := func(flags uint8) *godivert.Packet {
+		return outbound(testpacket.TCP("10.0.0.1", 49368, "93.184.216.34", 443, flags))
+	}
+	server := func(flags uint8) *godivert.Packet {
+		return inbound(testpacket.TCP("93.184.216.34", 443, "10.0.0.1", 49368, flags))
+	}
+
+	c := NewConntrack()
+	now := time.Now()
+	steps := []struct {
+		name   string
+		packet *godivert.Packet
+		after  time.Duration
+		want   State
+	}{
+		{"syn", client(header.TCPFlagSYN), 0, StateNew},
+		{"syn retransmitted", client(header.TCPFlagSYN), time.Second, StateNew},
+		{"syn ack", server(header.TCPFlagSYN | header.TCPFlagACK), 0, StateEstablished},
+		{"ack", client(header.TCPFlagACK), 0, StateEstablished},
+		{"idle but established", client(header.TCPFlagACK), time.Hour, StateEstablished},
+		{"fin", client(header.TCPFlagFIN | header.TCPFlagACK), 0, StateEstablished},
+		{"fin ack", server(header.TCPFlagFIN | header.TCPFlagACK), 0, StateEstablished},
+		{"last ack", client(header.TCPFlagACK), 0, StateEstablished},
+		// Closed connections only last TCPTransient
+		{"after close", client(header.TCPFlagACK), DefaultTimeouts.TCPTransient + time.Second, StateNew},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.after)
+		if got := c.Track(step.packet, now); got != step.want {
+			t.Errorf("%s: Track() = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// A reset forgets the connection at once
+	c = NewConntrack()
+	c.StrictTCP = true
+	c.Track(client(header.TCPFlagSYN), now)
+	c.Track(server(header.TCPFlagSYN|header.TCPFlagACK), now)
+	if got := c.Track(server(header.TCPFlagRST), now); got != StateEstablished {
+		t.Errorf("reset: Track() = %v, want Established", got)
+	}
+	if c.Len() != 0 {
+		t.Errorf("%d tracked connections after a reset, want 0", c.Len())
+	}
+	if got := c.State(client(header.TCPFlagACK), now); got != StateInvalid {
+		t.Errorf("after reset: State() = %v, want Invalid", got)
+	}
+}
+
+func TestConntrackRelated(t *testing.T) {
+	request := testpacket.UDP("10.0.0.1", 5353, "10.0.0.2", 53, []byte("query"))
+	unreachable := func(embedded []byte) *godivert.Packet {
+		return inbound(testpacket.Build(testpacket.Spec{Src: "10.0.0.2", Dst: "10.0.0.1", Protocol: header.ICMPv4,
+			Type: header.ICMPv4TypeDestUnreachable, Code: header.ICMPv4CodePortUnreachable, Payload: embedded}))
+	}
+
+	c := NewConntrack()
+	now := time.Now()
+	if got := c.State(unreachable(request), now); got != StateInvalid {
+		t.Errorf("error about an unknown flow: State() = %v, want Invalid", got)
+	}
+
+	c.Track(outbound(request), now)
+	if got := c.State(unreachable(request), now); got != StateRelated {
+		t.Errorf("error about a tracked flow: State() = %v, want Related", got)
+	}
+	if got := c.State(unreachable(request[:24]), now); got != StateInvalid {
+		t.Errorf("truncated error: State() = %v, want Invalid", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	sender := &discardSender{}
+	f, err := NewFirewall(sender, Drop, []Rule{
+		{Name: "ping", Protocols: []uint8{header.ICMPv4}, Action: RateLimit, Rate: 1, Burst: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ping := testpacket.Build(testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.ICMPv4, Type: 8})
+	for i := 0; i < 5; i++ {
+		if err := f.Process(outbound(ping)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The burst goes through and the next packets are dropped
+	if len(sender.sent) != 3 {
+		t.Errorf("%d packets sent, want 3", len(sender.sent))
+	}
+	if stats := f.Stats(); stats.Rules[0].Packets != 5 {
+		t.Errorf("rule matched %d packets, want 5", stats.Rules[0].Packets)
+	}
+
+	if _, err := NewFirewall(sender, Drop, []Rule{{Action: RateLimit}}); err == nil {
+		t.Error("NewFirewall() accepted a RateLimit rule without rate")
+	}
+}
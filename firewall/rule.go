@@ -0,0 +1,371 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/shaper"
+)
+
+// Represents what the firewall does with a packet matching a rule
+type Action int
+
+const (
+	// Reinject the packet
+	Accept Action = iota
+	// Drop the packet silently
+	Drop
+	// Drop the packet and answer it with a TCP reset or an ICMP Destination Unreachable message
+	Reject
+	// Report the packet with OnLog and go on with the next rules
+	Log
+	// Accept the packets within the rate of the rule and drop the others
+	RateLimit
+)
+
+func (a Action) String() string {
+	switch a {
+	case Accept:
+		return "Accept"
+	case Drop:
+		return "Drop"
+	case Reject:
+		return "Reject"
+	case Log:
+		return "Log"
+	case RateLimit:
+		return "RateLimit"
+	default:
+		return "Unknown Action"
+	}
+}
+
+// Returns the action named s, the names are those returned by String and are case insensitive
+func ParseAction(s string) (Action, error) {
+	for a := Accept; a <= RateLimit; a++ {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// Represents the direction matched by a rule
+type Direction int
+
+const (
+	AnyDirection Direction = iota
+	Inbound
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case AnyDirection:
+		return "Any"
+	case Inbound:
+		return "Inbound"
+	case Outbound:
+		return "Outbound"
+	default:
+		return "Unknown Direction"
+	}
+}
+
+// Represents an inclusive range of ports
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Returns the range described by s, either a single port such as "80" or a range such as "1024-65535"
+func ParsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	fromPort, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	toPort, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+
+	r := PortRange{From: uint16(fromPort), To: uint16(toPort)}
+	if r.From > r.To {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %d is greater than %d", s, r.From, r.To)
+	}
+	return r, nil
+}
+
+// Returns true if the port is in the range
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(int(r.From))
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Represents a firewall rule
+// A packet matches the rule if it matches every criterion set, the empty criteria match every packet
+// Within a criterion holding several values, matching one of them is enough
+type Rule struct {
+	Name string
+
+	Direction Direction
+	// Indexes of the network interfaces, see WinDivertAddress.IfIdx
+	Interfaces []uint32
+	// Source and destination networks in CIDR notation, or single IPs
+	Src []string
+	Dst []string
+	// Protocol numbers, see the header package
+	Protocols []uint8
+	SrcPorts  []PortRange
+	DstPorts  []PortRange
+
+	// The TCP flags of the packet selected by TCPFlagsMask must be equal to TCPFlags
+	// If TCPFlagsMask is 0, the TCPFlags must all be set
+	// Only TCP packets match a rule with TCP flags
+	TCPFlags     uint8
+	TCPFlagsMask uint8
+
+	// Connection tracking states, 0 matches every state
+	States State
+
+	Action Action
+
+	// Packets per second and burst of the RateLimit action, a Burst of 0 means Rate
+	Rate  int64
+	Burst int64
+
+	// Answer sent by the Reject action
+	Reject godivert.RejectOptions
+}
+
+// Represents a rule ready to be evaluated
+type compiledRule struct {
+	Rule
+
+	src, dst []*net.IPNet
+
+	mu     sync.Mutex
+	bucket *shaper.TokenBucket
+
+	stats RuleStats
+}
+
+// Counters of a rule, or of the default policy
+type RuleStats struct {
+	Name    string
+	Action  Action
+	Packets uint64
+	Bytes   uint64
+}
+
+// Returns the networks described by the CIDRs or IPs
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	parsed := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", network)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", network)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// Check the rule and prepare it to be evaluated
+func compileRule(rule Rule) (*compiledRule, error) {
+	if rule.Action < Accept || rule.Action > RateLimit {
+		return nil, errors.New("unknown action")
+	}
+	if rule.Direction < AnyDirection || rule.Direction > Outbound {
+		return nil, errors.New("unknown direction")
+	}
+	if rule.States&^StateAll != 0 {
+		return nil, errors.New("unknown connection state")
+	}
+	for _, ranges := range [][]PortRange{rule.SrcPorts, rule.DstPorts} {
+		for _, ports := range ranges {
+			if ports.From > ports.To {
+				return nil, fmt.Errorf("invalid port range %d-%d", ports.From, ports.To)
+			}
+		}
+	}
+
+	c := &compiledRule{Rule: rule}
+	c.stats.Name = rule.Name
+	c.stats.Action = rule.Action
+
+	var err error
+	if c.src, err = parseNetworks(rule.Src); err != nil {
+		return nil, err
+	}
+	if c.dst, err = parseNetworks(rule.Dst); err != nil {
+		return nil, err
+	}
+
+	if rule.Action == RateLimit {
+		if rule.Rate <= 0 {
+			return nil, errors.New("the rate of a RateLimit rule must be positive")
+		}
+		burst := rule.Burst
+		if burst <= 0 {
+			burst = rule.Rate
+		}
+		c.bucket = shaper.NewTokenBucket(rule.Rate, burst)
+	}
+
+	return c, nil
+}
+
+// Returns true if the packet matches every criterion of the rule
+func (c *compiledRule) match(packet *godivert.Packet, state State) bool {
+	if c.States != 0 && c.States&state == 0 {
+		return false
+	}
+
+	if c.Direction != AnyDirection {
+		if packet.Addr == nil {
+			return false
+		}
+		inbound := packet.Direction() == godivert.WinDivertDirectionInbound
+		if inbound != (c.Direction == Inbound) {
+			return false
+		}
+	}
+
+	if len(c.Interfaces) > 0 {
+		if packet.Addr == nil || !containsUint32(c.Interfaces, packet.Addr.IfIdx) {
+			return false
+		}
+	}
+
+	if len(c.Protocols) > 0 && !containsUint8(c.Protocols, packet.NextHeaderType()) {
+		return false
+	}
+
+	if len(c.src) > 0 && !containsIP(c.src, packet.SrcIP()) {
+		return false
+	}
+	if len(c.dst) > 0 && !containsIP(c.dst, packet.DstIP()) {
+		return false
+	}
+
+	if len(c.SrcPorts) > 0 {
+		port, err := packet.SrcPort()
+		if err != nil || !containsPort(c.SrcPorts, port) {
+			return false
+		}
+	}
+	if len(c.DstPorts) > 0 {
+		port, err := packet.DstPort()
+		if err != nil || !containsPort(c.DstPorts, port) {
+			return false
+		}
+	}
+
+	if c.TCPFlags != 0 || c.TCPFlagsMask != 0 {
+		tcpHdr, ok := packet.NextHeader.(*header.TCPHeader)
+		if !ok {
+			return false
+		}
+		mask := c.TCPFlagsMask
+		if mask == 0 {
+			mask = c.TCPFlags
+		}
+		if tcpHdr.Flags()&mask != c.TCPFlags {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Takes a token from the bucket of a RateLimit rule
+// Returns false if the packet exceeds the rate
+func (c *compiledRule) allow(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bucket.Allow(1, now)
+}
+
+// Adds the packet to the counters of the rule
+func (c *compiledRule) count(packet *godivert.Packet) {
+	c.mu.Lock()
+	c.stats.Packets++
+	c.stats.Bytes += uint64(packet.PacketLen)
+	c.mu.Unlock()
+}
+
+// Returns a copy of the counters of the rule
+func (c *compiledRule) Stats() RuleStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func containsUint32(values []uint32, v uint32) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint8(values []uint8, v uint8) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ranges []PortRange, port uint16) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
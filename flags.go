@@ -0,0 +1,135 @@
+package godivert
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Represents the flags a handle is opened with
+// See https://reqrypt.org/windivert-doc.html#divert_open
+type Flags uint64
+
+const (
+	// Receive copies of the packets, the original packets are not diverted
+	WinDivertFlagSniff Flags = 0x1
+	// Drop the packets matching the filter, they can't be received
+	WinDivertFlagDrop Flags = 0x2
+	// Use the debug driver (WinDivert 1.x)
+	WinDivertFlagDebug Flags = 0x4
+	// The handle can only receive packets (WinDivert 2.x)
+	WinDivertFlagRecvOnly Flags = 0x4
+	// The handle can only send packets (WinDivert 2.x)
+	WinDivertFlagSendOnly Flags = 0x8
+	// Fail instead of installing the driver (WinDivert 2.x)
+	WinDivertFlagNoInstall Flags = 0x10
+	// Receive IP fragments instead of reassembled packets (WinDivert 2.x)
+	WinDivertFlagFragments Flags = 0x20
+)
+
+const (
+	flagsAllV1 = WinDivertFlagSniff | WinDivertFlagDrop | WinDivertFlagDebug
+	flagsAllV2 = WinDivertFlagSniff | WinDivertFlagDrop | WinDivertFlagRecvOnly |
+		WinDivertFlagSendOnly | WinDivertFlagNoInstall | WinDivertFlagFragments
+)
+
+// Returns the names of the set flags separated by |
+// 0x4 is named RecvOnly, it is Debug with WinDivert 1.x
+func (f Flags) String() string {
+	if f == 0 {
+		return "0"
+	}
+
+	names := []struct {
+		flag Flags
+		name string
+	}{
+		{WinDivertFlagSniff, "Sniff"},
+		{WinDivertFlagDrop, "Drop"},
+		{WinDivertFlagRecvOnly, "RecvOnly"},
+		{WinDivertFlagSendOnly, "SendOnly"},
+		{WinDivertFlagNoInstall, "NoInstall"},
+		{WinDivertFlagFragments, "Fragments"},
+	}
+
+	var set []string
+	for _, n := range names {
+		if f&n.flag != 0 {
+			set = append(set, n.name)
+			f &^= n.flag
+		}
+	}
+	if f != 0 {
+		set = append(set, fmt.Sprintf("%#x", uint64(f)))
+	}
+	return strings.Join(set, "|")
+}
+
+// Returns an error if the flags can't be used to open a handle on the layer with this ABI
+func (v ABIVersion) CheckFlags(flags Flags, layer Layer) error {
+	all := flagsAllV2
+	if v == ABIVersion1 {
+		all = flagsAllV1
+	}
+	if unknown := flags &^ all; unknown != 0 {
+		return fmt.Errorf("the %v flags aren't supported by WinDivert %d.x", unknown, v)
+	}
+
+	if flags&WinDivertFlagSniff != 0 && flags&WinDivertFlagDrop != 0 {
+		return fmt.Errorf("the Sniff and Drop flags can't be used together")
+	}
+	if v == ABIVersion1 {
+		return nil
+	}
+
+	if flags&WinDivertFlagRecvOnly != 0 && flags&WinDivertFlagSendOnly != 0 {
+		return fmt.Errorf("the RecvOnly and SendOnly flags can't be used together")
+	}
+	if flags&WinDivertFlagDrop != 0 && flags&WinDivertFlagSendOnly != 0 {
+		return fmt.Errorf("the Drop and SendOnly flags can't be used together")
+	}
+
+	switch layer {
+	case WinDivertLayerFlow, WinDivertLayerReflect:
+		if flags&(WinDivertFlagSniff|WinDivertFlagRecvOnly) != WinDivertFlagSniff|WinDivertFlagRecvOnly {
+			return fmt.Errorf("the %v layer requires the Sniff and RecvOnly flags", layer)
+		}
+	case WinDivertLayerSocket:
+		if flags&WinDivertFlagRecvOnly == 0 {
+			return fmt.Errorf("the %v layer requires the RecvOnly flag", layer)
+		}
+	}
+
+	return nil
+}
+
+// Returned when an operation contradicts the flags the handle has been opened with
+type ModeError struct {
+	Op    string
+	Flags Flags
+}
+
+func (e *ModeError) Error() string {
+	return fmt.Sprintf("can't %s with a handle opened with the %v flags", e.Op, e.Flags)
+}
+
+// Returns the flags the handle has been opened with
+func (wd *WinDivertHandle) Flags() Flags {
+	return wd.flags
+}
+
+// Returns true if the flags of the handle allow receiving packets
+func (wd *WinDivertHandle) CanRecv() bool {
+	if wd.abi == ABIVersion1 {
+		return wd.flags&WinDivertFlagDrop == 0
+	}
+	return wd.flags&(WinDivertFlagDrop|WinDivertFlagSendOnly) == 0
+}
+
+// Returns true if the flags of the handle allow sending packets
+// Sniffed packets have already been accepted, sending them again would duplicate them
+func (wd *WinDivertHandle) CanSend() bool {
+	if wd.abi == ABIVersion1 {
+		return wd.flags&WinDivertFlagSniff == 0
+	}
+	return wd.flags&(WinDivertFlagSniff|WinDivertFlagRecvOnly) == 0
+}
@@ -0,0 +1,99 @@
+package godivert
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		abi     ABIVersion
+		flags   Flags
+		layer   Layer
+		wantErr bool
+	}{
+		{"no flags", ABIVersion2, 0, WinDivertLayerNetwork, false},
+		{"sniff", ABIVersion2, WinDivertFlagSniff, WinDivertLayerNetwork, false},
+		{"sniff and drop", ABIVersion2, WinDivertFlagSniff | WinDivertFlagDrop, WinDivertLayerNetwork, true},
+		{"1.x sniff and drop", ABIVersion1, WinDivertFlagSniff | WinDivertFlagDrop, WinDivertLayerNetwork, true},
+		{"recv only and send only", ABIVersion2, WinDivertFlagRecvOnly | WinDivertFlagSendOnly, WinDivertLayerNetwork, true},
+		{"drop and send only", ABIVersion2, WinDivertFlagDrop | WinDivertFlagSendOnly, WinDivertLayerNetwork, true},
+		{"sniff and recv only", ABIVersion2, WinDivertFlagSniff | WinDivertFlagRecvOnly, WinDivertLayerNetwork, false},
+		{"1.x debug", ABIVersion1, WinDivertFlagDebug, WinDivertLayerNetwork, false},
+		{"1.x send only", ABIVersion1, WinDivertFlagSendOnly, WinDivertLayerNetwork, true},
+		{"unknown flag", ABIVersion2, 0x40, WinDivertLayerNetwork, true},
+		{"flow", ABIVersion2, WinDivertFlagSniff | WinDivertFlagRecvOnly, WinDivertLayerFlow, false},
+		{"flow without recv only", ABIVersion2, WinDivertFlagSniff, WinDivertLayerFlow, true},
+		{"reflect without sniff", ABIVersion2, WinDivertFlagRecvOnly, WinDivertLayerReflect, true},
+		{"socket recv only", ABIVersion2, WinDivertFlagRecvOnly, WinDivertLayerSocket, false},
+		{"socket without recv only", ABIVersion2, WinDivertFlagSniff, WinDivertLayerSocket, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.abi.CheckFlags(test.flags, test.layer)
+			if (err != nil) != test.wantErr {
+				t.Errorf("CheckFlags(%v, %v) = %v, want error %v", test.flags, test.layer, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		abi      ABIVersion
+		flags    Flags
+		wantRecv bool
+		wantSend bool
+	}{
+		{"default", ABIVersion2, 0, true, true},
+		{"sniff", ABIVersion2, WinDivertFlagSniff, true, false},
+		{"drop", ABIVersion2, WinDivertFlagDrop, false, true},
+		{"recv only", ABIVersion2, WinDivertFlagRecvOnly, true, false},
+		{"send only", ABIVersion2, WinDivertFlagSendOnly, false, true},
+		// 0x4 is the debug flag of WinDivert 1.x
+		{"1.x debug", ABIVersion1, WinDivertFlagDebug, true, true},
+		{"1.x sniff", ABIVersion1, WinDivertFlagSniff, true, false},
+		{"1.x drop", ABIVersion1, WinDivertFlagDrop, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wd := &WinDivertHandle{abi: test.abi, flags: test.flags}
+			if got := wd.CanRecv(); got != test.wantRecv {
+				t.Errorf("CanRecv() = %v, want %v", got, test.wantRecv)
+			}
+			if got := wd.CanSend(); got != test.wantSend {
+				t.Errorf("CanSend() = %v, want %v", got, test.wantSend)
+			}
+
+			// The operations forbidden by the flags fail with a ModeError
+			var modeErr *ModeError
+			if err := wd.checkRecv(); err != nil && !errors.As(err, &modeErr) || (err == nil) != test.wantRecv {
+				t.Errorf("checkRecv() = %v", err)
+			}
+			if err := wd.checkSend(); err != nil && !errors.As(err, &modeErr) || (err == nil) != test.wantSend {
+				t.Errorf("checkSend() = %v", err)
+			}
+		})
+	}
+}
+
+func TestFlagsString(t *testing.T) {
+	tests := []struct {
+		flags Flags
+		want  string
+	}{
+		{0, "0"},
+		{WinDivertFlagSniff | WinDivertFlagRecvOnly, "Sniff|RecvOnly"},
+		{WinDivertFlagFragments | 0x100, "Fragments|0x100"},
+	}
+
+	for _, test := range tests {
+		if got := test.flags.String(); got != test.want {
+			t.Errorf("String() = %q, want %q", got, test.want)
+		}
+	}
+}
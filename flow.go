@@ -0,0 +1,91 @@
+package godivert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// Represents the 5-tuple identifying the flow of a packet
+// Ports are 0 for protocols without ports
+type FlowKey struct {
+	Protocol uint8
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// Returns the 5-tuple of the packet
+func (p *Packet) FlowKey() FlowKey {
+	p.VerifyParsed()
+
+	key := FlowKey{Protocol: p.nextHeaderType}
+	copy(key.SrcIP[:], p.SrcIP().To16())
+	copy(key.DstIP[:], p.DstIP().To16())
+
+	if p.NextHeader != nil {
+		key.SrcPort, _ = p.NextHeader.SrcPort()
+		key.DstPort, _ = p.NextHeader.DstPort()
+	}
+
+	return key
+}
+
+// Returns the key of the flow going the other way
+func (k FlowKey) Reverse() FlowKey {
+	return FlowKey{
+		Protocol: k.Protocol,
+		SrcIP:    k.DstIP,
+		DstIP:    k.SrcIP,
+		SrcPort:  k.DstPort,
+		DstPort:  k.SrcPort,
+	}
+}
+
+// Returns the key with the lowest endpoint as source
+// Both directions of a connection have the same canonical key
+func (k FlowKey) Canonical() FlowKey {
+	cmp := bytes.Compare(k.SrcIP[:], k.DstIP[:])
+	if cmp > 0 || cmp == 0 && k.SrcPort > k.DstPort {
+		return k.Reverse()
+	}
+	return k
+}
+
+// Returns a FNV-1a hash of the canonical key
+// Both directions of a connection have the same hash
+func (k FlowKey) Hash() uint64 {
+	c := k.Canonical()
+
+	var buf [37]byte
+	buf[0] = c.Protocol
+	copy(buf[1:17], c.SrcIP[:])
+	copy(buf[17:33], c.DstIP[:])
+	binary.BigEndian.PutUint16(buf[33:35], c.SrcPort)
+	binary.BigEndian.PutUint16(buf[35:37], c.DstPort)
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// Returns the source IP of the flow
+func (k FlowKey) Src() net.IP {
+	return net.IP(k.SrcIP[:])
+}
+
+// Returns the destination IP of the flow
+func (k FlowKey) Dst() net.IP {
+	return net.IP(k.DstIP[:])
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%s %s > %s", header.ProtocolName(k.Protocol),
+		net.JoinHostPort(k.Src().String(), fmt.Sprint(k.SrcPort)),
+		net.JoinHostPort(k.Dst().String(), fmt.Sprint(k.DstPort)))
+}
@@ -0,0 +1,94 @@
+package godivert
+
+import (
+	"net"
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Returns a FlowKey of the given endpoints
+func flowKey(protocol uint8, src string, srcPort uint16, dst string, dstPort uint16) FlowKey {
+	key := FlowKey{Protocol: protocol, SrcPort: srcPort, DstPort: dstPort}
+	copy(key.SrcIP[:], net.ParseIP(src).To16())
+	copy(key.DstIP[:], net.ParseIP(dst).To16())
+	return key
+}
+
+func TestPacketFlowKey(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want FlowKey
+	}{
+		{"tcp", testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN),
+			flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.2", 80)},
+		{"udp ipv6", testpacket.UDP("2001:db8::1", 53, "2001:db8::2", 1234, nil),
+			flowKey(header.UDP, "2001:db8::1", 53, "2001:db8::2", 1234)},
+		{"icmp without ports", testpacket.Build(testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.ICMPv4, Type: 8}),
+			flowKey(header.ICMPv4, "10.0.0.1", 0, "10.0.0.2", 0)},
+		{"later fragment without ports", testpacket.Build(testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.UDP,
+			FragOffset: 1, Payload: make([]byte, 8)}),
+			flowKey(header.UDP, "10.0.0.1", 0, "10.0.0.2", 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := &Packet{Raw: test.raw, PacketLen: uint(len(test.raw))}
+			if got := packet.FlowKey(); got != test.want {
+				t.Errorf("FlowKey() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlowKeyCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		key  FlowKey
+		want FlowKey
+	}{
+		{"lowest ip first", flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.2", 80),
+			flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.2", 80)},
+		{"highest ip first", flowKey(header.TCP, "10.0.0.2", 80, "10.0.0.1", 49368),
+			flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.2", 80)},
+		{"same ip", flowKey(header.UDP, "127.0.0.1", 5000, "127.0.0.1", 53),
+			flowKey(header.UDP, "127.0.0.1", 53, "127.0.0.1", 5000)},
+		{"ipv6", flowKey(header.UDP, "2001:db8::2", 1234, "2001:db8::1", 53),
+			flowKey(header.UDP, "2001:db8::1", 53, "2001:db8::2", 1234)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.key.Canonical(); got != test.want {
+				t.Errorf("Canonical() = %v, want %v", got, test.want)
+			}
+			if got := test.key.Reverse().Canonical(); got != test.want {
+				t.Errorf("Canonical() of the reverse key = %v, want %v", got, test.want)
+			}
+			if test.key.Hash() != test.key.Reverse().Hash() {
+				t.Error("both directions have different hashes")
+			}
+		})
+	}
+}
+
+func TestFlowKeyHash(t *testing.T) {
+	key := flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.2", 80)
+	others := []FlowKey{
+		flowKey(header.UDP, "10.0.0.1", 49368, "10.0.0.2", 80),
+		flowKey(header.TCP, "10.0.0.1", 49369, "10.0.0.2", 80),
+		flowKey(header.TCP, "10.0.0.1", 49368, "10.0.0.3", 80),
+		flowKey(header.TCP, "10.0.0.1", 80, "10.0.0.2", 49368),
+	}
+
+	if key.Hash() != key.Hash() {
+		t.Error("Hash() isn't stable")
+	}
+	for _, other := range others {
+		if other.Hash() == key.Hash() {
+			t.Errorf("%v and %v have the same hash", other, key)
+		}
+	}
+}
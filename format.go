@@ -0,0 +1,341 @@
+package godivert
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// Returns a tcpdump-like one-line summary of the packet
+func (p *Packet) String() string {
+	var b strings.Builder
+	p.writeSummary(&b)
+	return b.String()
+}
+
+// Implements fmt.Formatter
+//
+//	%v, %s  one-line summary: IP 10.0.0.1.443 > 10.0.0.2.51234: Flags [S.], seq 1, ack 2, win 64240, length 0
+//	%+v     indented dissection of the address and of each header
+//	%x, %X  offset, hex and ASCII dump of the packet
+//	%q      quoted one-line summary
+func (p *Packet) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if f.Flag('+') || f.Flag('#') {
+			var b strings.Builder
+			p.writeDissection(&b)
+			io.WriteString(f, strings.TrimSuffix(b.String(), "\n"))
+			return
+		}
+		p.writeSummary(f)
+	case 's':
+		p.writeSummary(f)
+	case 'q':
+		fmt.Fprintf(f, "%q", p.String())
+	case 'x':
+		writeHexDump(f, p.data(), false)
+	case 'X':
+		writeHexDump(f, p.data(), true)
+	default:
+		fmt.Fprintf(f, "%%!%c(*godivert.Packet=%s)", verb, p.String())
+	}
+}
+
+// Returns the bytes of the packet
+func (p *Packet) data() []byte {
+	if p.PacketLen == 0 || int(p.PacketLen) > len(p.Raw) {
+		return p.Raw
+	}
+	return p.Raw[:p.PacketLen]
+}
+
+// Returns true if the packet is an IPv4 fragment other than the first one, it has no transport header
+func (p *Packet) laterFragment() bool {
+	ipv4, ok := p.IpHdr.(*header.IPv4Header)
+	return ok && ipv4.FragOff() != 0
+}
+
+// Writes the one-line summary of the packet
+func (p *Packet) writeSummary(w io.Writer) {
+	if len(p.data()) == 0 {
+		io.WriteString(w, "empty packet")
+		return
+	}
+	err := p.VerifyParsed()
+	if p.IpHdr == nil {
+		fmt.Fprintf(w, "invalid packet: %v, length %d", err, len(p.data()))
+		return
+	}
+
+	if p.ipVersion == 6 {
+		io.WriteString(w, "IP6 ")
+	} else {
+		io.WriteString(w, "IP ")
+	}
+
+	if p.laterFragment() {
+		ipv4 := p.IpHdr.(*header.IPv4Header)
+		fmt.Fprintf(w, "%s > %s: %s, frag offset %d, length %d",
+			p.SrcIP(), p.DstIP(), protocolLabel(p.nextHeaderType), int(ipv4.FragOff())*8, len(p.data())-p.hdrLen)
+		return
+	}
+
+	switch hdr := p.NextHeader.(type) {
+	case *header.TCPHeader:
+		srcPort, _ := hdr.SrcPort()
+		dstPort, _ := hdr.DstPort()
+		fmt.Fprintf(w, "%s > %s: Flags [%s], seq %d", endpoint(p.SrcIP(), srcPort), endpoint(p.DstIP(), dstPort),
+			tcpFlagLetters(hdr.Flags()), hdr.SeqNum())
+		if hdr.ACK() {
+			fmt.Fprintf(w, ", ack %d", hdr.AckNum())
+		}
+		fmt.Fprintf(w, ", win %d, length %d", hdr.Window(), len(p.Payload()))
+	case *header.UDPHeader:
+		srcPort, _ := hdr.SrcPort()
+		dstPort, _ := hdr.DstPort()
+		fmt.Fprintf(w, "%s > %s: UDP, length %d", endpoint(p.SrcIP(), srcPort), endpoint(p.DstIP(), dstPort), len(p.Payload()))
+	case *header.ICMPv4Header:
+		fmt.Fprintf(w, "%s > %s: ICMP %s, length %d", p.SrcIP(), p.DstIP(),
+			icmpLabel(header.ICMPv4TypeName(hdr.Type()), hdr.Type(), hdr.Code(), hdr.Body(), 0, 8), len(p.data())-p.hdrLen)
+	case *header.ICMPv6Header:
+		fmt.Fprintf(w, "%s > %s: ICMP6 %s, length %d", p.SrcIP(), p.DstIP(),
+			icmpLabel(header.ICMPv6TypeName(hdr.Type()), hdr.Type(), hdr.Code(), hdr.Body(), 129, 128), len(p.data())-p.hdrLen)
+	default:
+		fmt.Fprintf(w, "%s > %s: %s, length %d", p.SrcIP(), p.DstIP(), protocolLabel(p.nextHeaderType), len(p.data())-p.hdrLen)
+		if err != nil {
+			io.WriteString(w, " [truncated]")
+		}
+	}
+}
+
+// Returns the address and the port joined with a dot like tcpdump
+func endpoint(ip net.IP, port uint16) string {
+	return ip.String() + "." + strconv.Itoa(int(port))
+}
+
+// Returns the name of the protocol, ip-proto-N for the unsupported ones
+func protocolLabel(protocol uint8) string {
+	switch protocol {
+	case header.TCP, header.UDP, header.ICMPv4, header.ICMPv6:
+		return header.ProtocolName(protocol)
+	}
+	return fmt.Sprintf("ip-proto-%d", protocol)
+}
+
+// Returns the name of the ICMP message, with the id and sequence number of the echo messages
+func icmpLabel(name string, icmpType, code uint8, body uint32, echoReply, echoRequest uint8) string {
+	if name == "" {
+		return fmt.Sprintf("type %d code %d", icmpType, code)
+	}
+	if icmpType == echoReply || icmpType == echoRequest {
+		return fmt.Sprintf("%s, id %d, seq %d", name, body>>16, body&0xffff)
+	}
+	if code != 0 {
+		return fmt.Sprintf("%s code %d", name, code)
+	}
+	return name
+}
+
+// Returns the TCP flags in the tcpdump notation, ACK is a dot
+func tcpFlagLetters(flags uint8) string {
+	letters := []struct {
+		flag   uint8
+		letter byte
+	}{
+		{header.TCPFlagSYN, 'S'},
+		{header.TCPFlagFIN, 'F'},
+		{header.TCPFlagPSH, 'P'},
+		{header.TCPFlagRST, 'R'},
+		{header.TCPFlagURG, 'U'},
+		{header.TCPFlagECE, 'E'},
+		{header.TCPFlagCWR, 'W'},
+		{header.TCPFlagACK, '.'},
+	}
+
+	var b []byte
+	for _, l := range letters {
+		if flags&l.flag != 0 {
+			b = append(b, l.letter)
+		}
+	}
+	if len(b) == 0 {
+		return "none"
+	}
+	return string(b)
+}
+
+// Writes the address and the headers of the packet as an indented tree, like the Wireshark details pane
+func (p *Packet) writeDissection(w io.Writer) {
+	data := p.data()
+	fmt.Fprintf(w, "Packet: %d bytes\n", len(data))
+	if len(data) == 0 {
+		return
+	}
+	err := p.VerifyParsed()
+
+	field := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, "    "+format+"\n", args...)
+	}
+
+	if addr := p.Addr; addr != nil {
+		fmt.Fprintf(w, "WinDivert Address, %v, Interface: %d.%d\n", addr.Direction(), addr.IfIdx, addr.SubIfIdx)
+		field("Timestamp: %d", addr.Timestamp)
+		field("Layer: %v", addr.Layer)
+		field("Event: %v", addr.Event)
+		field("Interface: %d.%d", addr.IfIdx, addr.SubIfIdx)
+		field("Direction: %v", addr.Direction())
+		field("Loopback: %t", addr.Loopback())
+		field("Impostor: %t", addr.Impostor())
+		field("Sniffed: %t", addr.Sniffed())
+	}
+
+	switch ipHdr := p.IpHdr.(type) {
+	case *header.IPv4Header:
+		checksum, _ := ipHdr.Checksum()
+		fmt.Fprintf(w, "Internet Protocol Version 4, Src: %s, Dst: %s\n", ipHdr.SrcIP(), ipHdr.DstIP())
+		field("Version: 4")
+		field("Header Length: %d bytes", ipHdr.HeaderLen())
+		field("Type of Service: %#02x", ipHdr.TOS())
+		field("Total Length: %d", ipHdr.TotalLen())
+		field("Identification: %#04x (%d)", ipHdr.ID(), ipHdr.ID())
+		field("Flags: %#x%s", ipHdr.Flags(), ipv4FlagNames(ipHdr.Flags()))
+		field("Fragment Offset: %d", int(ipHdr.FragOff())*8)
+		field("Time to Live: %d", ipHdr.TTL())
+		field("Protocol: %s (%d)", protocolLabel(ipHdr.NextHeader()), ipHdr.NextHeader())
+		field("Header Checksum: %#04x", checksum)
+		field("Source Address: %s", ipHdr.SrcIP())
+		field("Destination Address: %s", ipHdr.DstIP())
+		if options := ipHdr.Options(); len(options) > 0 {
+			field("Options: %d bytes", len(options))
+		}
+	case *header.IPv6Header:
+		fmt.Fprintf(w, "Internet Protocol Version 6, Src: %s, Dst: %s\n", ipHdr.SrcIP(), ipHdr.DstIP())
+		field("Version: 6")
+		field("Traffic Class: %#02x", ipHdr.TrafficClass())
+		field("Flow Label: %#05x", ipHdr.FlowLabel())
+		field("Payload Length: %d", ipHdr.PayloadLen())
+		field("Next Header: %s (%d)", protocolLabel(ipHdr.NextHeader()), ipHdr.NextHeader())
+		field("Hop Limit: %d", ipHdr.HopLimit())
+		field("Source Address: %s", ipHdr.SrcIP())
+		field("Destination Address: %s", ipHdr.DstIP())
+	}
+
+	if p.laterFragment() {
+		fmt.Fprintf(w, "Fragment (%d bytes)\n", len(data)-p.hdrLen)
+		return
+	}
+
+	switch hdr := p.NextHeader.(type) {
+	case *header.TCPHeader:
+		srcPort, _ := hdr.SrcPort()
+		dstPort, _ := hdr.DstPort()
+		fmt.Fprintf(w, "Transmission Control Protocol, Src Port: %d, Dst Port: %d, Seq: %d, Ack: %d, Len: %d\n",
+			srcPort, dstPort, hdr.SeqNum(), hdr.AckNum(), len(p.Payload()))
+		field("Source Port: %d", srcPort)
+		field("Destination Port: %d", dstPort)
+		field("Sequence Number: %d", hdr.SeqNum())
+		field("Acknowledgment Number: %d", hdr.AckNum())
+		field("Header Length: %d bytes", hdr.HeaderLen())
+		field("Flags: %#03x (%s)", hdr.Flags(), strings.Join(header.TCPFlagNames(hdr.Flags()), ", "))
+		field("Window: %d", hdr.Window())
+		field("Checksum: %#04x", hdr.Checksum())
+		field("Urgent Pointer: %d", hdr.UrgPtr())
+		if options := hdr.Options(); len(options) > 0 {
+			field("Options: %d bytes", len(options))
+		}
+	case *header.UDPHeader:
+		srcPort, _ := hdr.SrcPort()
+		dstPort, _ := hdr.DstPort()
+		fmt.Fprintf(w, "User Datagram Protocol, Src Port: %d, Dst Port: %d\n", srcPort, dstPort)
+		field("Source Port: %d", srcPort)
+		field("Destination Port: %d", dstPort)
+		field("Length: %d", hdr.Len())
+		field("Checksum: %#04x", hdr.Checksum())
+	case *header.ICMPv4Header:
+		fmt.Fprintf(w, "Internet Control Message Protocol, %s\n", icmpLabel(header.ICMPv4TypeName(hdr.Type()), hdr.Type(), hdr.Code(), hdr.Body(), 0, 8))
+		field("Type: %d", hdr.Type())
+		field("Code: %d", hdr.Code())
+		field("Checksum: %#04x", hdr.Checksum())
+		field("Rest of Header: %#08x", hdr.Body())
+	case *header.ICMPv6Header:
+		fmt.Fprintf(w, "Internet Control Message Protocol v6, %s\n", icmpLabel(header.ICMPv6TypeName(hdr.Type()), hdr.Type(), hdr.Code(), hdr.Body(), 129, 128))
+		field("Type: %d", hdr.Type())
+		field("Code: %d", hdr.Code())
+		field("Checksum: %#04x", hdr.Checksum())
+		field("Rest of Header: %#08x", hdr.Body())
+	default:
+		fmt.Fprintf(w, "Data (%d bytes)\n", len(data)-p.hdrLen)
+		if err != nil {
+			fmt.Fprintf(w, "Malformed: %v\n", err)
+		}
+		return
+	}
+
+	if payload := p.Payload(); len(payload) > 0 {
+		fmt.Fprintf(w, "Data (%d bytes)\n", len(payload))
+	}
+}
+
+// Returns the names of the set IPv4 flags preceded by a comma
+func ipv4FlagNames(flags uint8) string {
+	var names string
+	if flags&0x2 != 0 {
+		names += ", Don't fragment"
+	}
+	if flags&0x1 != 0 {
+		names += ", More fragments"
+	}
+	return names
+}
+
+// Writes the offset, the hex bytes and the ASCII characters of data, 16 bytes per line
+//
+//	0000  45 00 00 28 00 00 40 00  40 06 00 00 0a 00 00 02   E..(..@.@.......
+func writeHexDump(w io.Writer, data []byte, upper bool) {
+	digits := "0123456789abcdef"
+	if upper {
+		digits = "0123456789ABCDEF"
+	}
+
+	line := make([]byte, 0, 80)
+	for offset := 0; offset < len(data); offset += 16 {
+		end := offset + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[offset:end]
+
+		line = line[:0]
+		if upper {
+			line = append(line, fmt.Sprintf("%04X  ", offset)...)
+		} else {
+			line = append(line, fmt.Sprintf("%04x  ", offset)...)
+		}
+		for i := 0; i < 16; i++ {
+			if i == 8 {
+				line = append(line, ' ')
+			}
+			if i < len(chunk) {
+				line = append(line, digits[chunk[i]>>4], digits[chunk[i]&0xf], ' ')
+			} else {
+				line = append(line, "   "...)
+			}
+		}
+		line = append(line, "  "...)
+		for _, c := range chunk {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			line = append(line, c)
+		}
+		if end < len(data) {
+			line = append(line, '\n')
+		}
+		w.Write(line)
+	}
+}
@@ -0,0 +1,35 @@
+package godivert
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+func TestPacketString(t *testing.T) {
+	syn := testpacket.SYN()
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"tcp", syn, "IP 172.16.0.1.49368 > 172.16.0.10.80: Flags [S], seq 2055969626, win 64240, length 0"},
+		{"empty", nil, "empty packet"},
+		{"truncated ipv4 header", syn[:16], "invalid packet: truncated IPv4 header, 16 bytes instead of 20, length 16"},
+		{"not ip", []byte{1, 2, 3}, "invalid packet: unknown IP version 0, length 3"},
+		{"truncated tcp header", syn[:24], "IP 172.16.0.1 > 172.16.0.10: TCP, length 4 [truncated]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Packet{Raw: test.raw, PacketLen: uint(len(test.raw))}
+			if got := p.String(); got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+			// The dissection and the hex dump must not panic either
+			_ = fmt.Sprintf("%+v %x", p, p)
+		})
+	}
+}
@@ -18,3 +18,69 @@ const (
 	IPv4 = 4
 	IPv6 = 6
 )
+
+// TCP flags, see TCPHeader.Flags
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagPSH = 0x08
+	TCPFlagACK = 0x10
+	TCPFlagURG = 0x20
+	TCPFlagECE = 0x40
+	TCPFlagCWR = 0x80
+)
+
+// ICMP Destination Unreachable types and codes
+// https://www.iana.org/assignments/icmp-parameters
+const (
+	ICMPv4TypeDestUnreachable = 3
+
+	ICMPv4CodeNetUnreachable      = 0
+	ICMPv4CodeHostUnreachable     = 1
+	ICMPv4CodeProtocolUnreachable = 2
+	ICMPv4CodePortUnreachable     = 3
+	ICMPv4CodeAdminProhibited     = 13
+
+	ICMPv6TypeDestUnreachable = 1
+
+	ICMPv6CodeNoRoute            = 0
+	ICMPv6CodeAdminProhibited    = 1
+	ICMPv6CodeAddressUnreachable = 3
+	ICMPv6CodePortUnreachable    = 4
+)
+
+// Names of the ICMP message types
+var (
+	icmpv4TypeNames = map[uint8]string{
+		0:  "echo reply",
+		3:  "destination unreachable",
+		5:  "redirect",
+		8:  "echo request",
+		11: "time exceeded",
+		12: "parameter problem",
+	}
+	icmpv6TypeNames = map[uint8]string{
+		1:   "destination unreachable",
+		2:   "packet too big",
+		3:   "time exceeded",
+		4:   "parameter problem",
+		128: "echo request",
+		129: "echo reply",
+		133: "router solicitation",
+		134: "router advertisement",
+		135: "neighbor solicitation",
+		136: "neighbor advertisement",
+		137: "redirect",
+	}
+)
+
+// Returns the name of the ICMPv4 message type, empty if unknown
+func ICMPv4TypeName(icmpType uint8) string {
+	return icmpv4TypeNames[icmpType]
+}
+
+// Returns the name of the ICMPv6 message type, empty if unknown
+func ICMPv6TypeName(icmpType uint8) string {
+	return icmpv6TypeNames[icmpType]
+}
@@ -1,6 +1,9 @@
 package header
 
-import "net"
+import (
+	"encoding/binary"
+	"net"
+)
 
 // Represents a IPv4 or IPv6 Header
 type IPHeader interface {
@@ -47,3 +50,25 @@ func ProtocolName(protocol uint8) string {
 		return "Unimplemented Protocol"
 	}
 }
+
+// Returns the one's complement sum of data added to sum, folded to 16 bits
+// Used to compute the checksums of the headers, see Checksum
+func Sum(data []byte, sum uint32) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
+
+// Returns the Internet checksum of data, starting from the sum of a pseudo header if any
+// https://datatracker.ietf.org/doc/html/rfc1071
+func Checksum(data []byte, sum uint32) uint16 {
+	return ^uint16(Sum(data, sum))
+}
@@ -17,9 +17,15 @@ type ICMPv4Header struct {
 }
 
 func NewICMPv4Header(raw []byte) *ICMPv4Header {
-	return &ICMPv4Header{
-		Raw: raw,
-	}
+	h := &ICMPv4Header{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the ICMPv4 header to new raw bytes so it can be reused without allocating
+func (h *ICMPv4Header) Reset(raw []byte) {
+	h.Raw = raw
+	h.Modified = false
 }
 
 func (h *ICMPv4Header) String() string {
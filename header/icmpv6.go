@@ -17,9 +17,15 @@ type ICMPv6Header struct {
 }
 
 func NewICMPv6Header(raw []byte) *ICMPv6Header {
-	return &ICMPv6Header{
-		Raw: raw,
-	}
+	h := &ICMPv6Header{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the ICMPv6 header to new raw bytes so it can be reused without allocating
+func (h *ICMPv6Header) Reset(raw []byte) {
+	h.Raw = raw
+	h.Modified = false
 }
 
 func (h *ICMPv6Header) String() string {
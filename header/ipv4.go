@@ -14,10 +14,16 @@ type IPv4Header struct {
 }
 
 func NewIPv4Header(raw []byte) *IPv4Header {
+	h := &IPv4Header{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the IPv4 header to new raw bytes so it can be reused without allocating
+func (h *IPv4Header) Reset(raw []byte) {
 	hdrLen := (raw[0] & 0xf) << 2
-	return &IPv4Header{
-		Raw: raw[:hdrLen],
-	}
+	h.Raw = raw[:hdrLen]
+	h.Modified = false
 }
 
 func (h *IPv4Header) String() string {
@@ -76,7 +82,7 @@ func (h *IPv4Header) Flags() uint8 {
 
 // Reads the header's bytes and returns the Fragment Offset
 func (h *IPv4Header) FragOff() uint16 {
-	return binary.BigEndian.Uint16(h.Raw[6:8]) & 0x7f
+	return binary.BigEndian.Uint16(h.Raw[6:8]) & 0x1fff
 }
 
 // Reads the header's bytes and returns the Time To Live of the packet
@@ -126,6 +132,24 @@ func (h *IPv4Header) SetDstIP(ip net.IP) {
 	copy(h.Raw[16:20], ip[12:16])
 }
 
+// Sets the total length of the packet
+func (h *IPv4Header) SetTotalLen(length uint16) {
+	h.Modified = true
+	binary.BigEndian.PutUint16(h.Raw[2:4], length)
+}
+
+// Sets the ID
+func (h *IPv4Header) SetID(id uint16) {
+	h.Modified = true
+	binary.BigEndian.PutUint16(h.Raw[4:6], id)
+}
+
+// Sets the Time To Live of the packet
+func (h *IPv4Header) SetTTL(ttl uint8) {
+	h.Modified = true
+	h.Raw[8] = ttl
+}
+
 // Returns true if the header has been modified
 func (h *IPv4Header) NeedNewChecksum() bool {
 	return h.Modified
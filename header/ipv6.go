@@ -15,9 +15,15 @@ type IPv6Header struct {
 }
 
 func NewIPv6Header(raw []byte) *IPv6Header {
-	return &IPv6Header{
-		Raw: raw[:IPv6HeaderLen],
-	}
+	h := &IPv6Header{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the IPv6 header to new raw bytes so it can be reused without allocating
+func (h *IPv6Header) Reset(raw []byte) {
+	h.Raw = raw[:IPv6HeaderLen]
+	h.Modified = false
 }
 
 func (h *IPv6Header) String() string {
@@ -100,12 +106,25 @@ func (h *IPv6Header) SetDstIP(ip net.IP) {
 	copy(h.Raw[24:40], ip)
 }
 
+// Sets the length of the payload
+func (h *IPv6Header) SetPayloadLen(length uint16) {
+	h.Modified = true
+	binary.BigEndian.PutUint16(h.Raw[4:6], length)
+}
+
+// Sets the hop limit
+func (h *IPv6Header) SetHopLimit(hopLimit uint8) {
+	h.Modified = true
+	h.Raw[7] = hopLimit
+}
+
 // Always returns 0 and an error as IPv6 has no checksum
 func (h *IPv6Header) Checksum() (uint16, error) {
 	return 0, errors.New("IPv6 has no checksum field")
 }
 
-// Always returns false as IPv6 has no checksum
+// Returns true if the header has been modified
+// IPv6 has no checksum but the checksum of the next header covers the addresses and the payload length
 func (h *IPv6Header) NeedNewChecksum() bool {
-	return false
+	return h.Modified
 }
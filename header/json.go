@@ -0,0 +1,610 @@
+package header
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Represents bytes encoded as a hex string in JSON
+// Spaces and colons are ignored when decoding so that hand-written values can be grouped
+type HexBytes []byte
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	s = strings.NewReplacer(" ", "", ":", "").Replace(s)
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("invalid hex string: %v", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Returns the names of the set TCP flags, from FIN to CWR
+func TCPFlagNames(flags uint8) []string {
+	names := []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+	var set []string
+	for i, name := range names {
+		if flags&(1<<i) != 0 {
+			set = append(set, name)
+		}
+	}
+	return set
+}
+
+// Returns the TCP flags of the names, case insensitive
+func parseTCPFlags(names []string) (uint8, error) {
+	var flags uint8
+	for _, name := range names {
+		found := false
+		for i, flag := range []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"} {
+			if strings.EqualFold(name, flag) {
+				flags |= 1 << i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown TCP flag %q", name)
+		}
+	}
+	return flags, nil
+}
+
+// JSON form of an IPv4 header
+type ipv4JSON struct {
+	Version       int      `json:"version"`
+	HeaderLen     *uint8   `json:"headerLen,omitempty"`
+	TOS           uint8    `json:"tos"`
+	TotalLen      *uint16  `json:"totalLen,omitempty"`
+	ID            uint16   `json:"id"`
+	DontFragment  bool     `json:"dontFragment"`
+	MoreFragments bool     `json:"moreFragments"`
+	FragOff       uint16   `json:"fragOff"`
+	TTL           uint8    `json:"ttl"`
+	Protocol      uint8    `json:"protocol"`
+	ProtocolName  string   `json:"protocolName,omitempty"`
+	Checksum      *uint16  `json:"checksum,omitempty"`
+	SrcIP         net.IP   `json:"srcIP"`
+	DstIP         net.IP   `json:"dstIP"`
+	Options       HexBytes `json:"options,omitempty"`
+}
+
+// Returns the name of the protocol for the JSON forms, empty if not implemented
+func jsonProtocolName(protocol uint8) string {
+	switch protocol {
+	case ICMPv4, TCP, UDP, ICMPv6:
+		return ProtocolName(protocol)
+	}
+	return ""
+}
+
+func (h *IPv4Header) MarshalJSON() ([]byte, error) {
+	headerLen, totalLen := h.HeaderLen(), h.TotalLen()
+	checksum, _ := h.Checksum()
+	flags := h.Flags()
+
+	return json.Marshal(&ipv4JSON{
+		Version:       IPv4,
+		HeaderLen:     &headerLen,
+		TOS:           h.TOS(),
+		TotalLen:      &totalLen,
+		ID:            h.ID(),
+		DontFragment:  flags&0x2 != 0,
+		MoreFragments: flags&0x1 != 0,
+		FragOff:       h.FragOff(),
+		TTL:           h.TTL(),
+		Protocol:      h.NextHeader(),
+		ProtocolName:  jsonProtocolName(h.NextHeader()),
+		Checksum:      &checksum,
+		SrcIP:         h.SrcIP(),
+		DstIP:         h.DstIP(),
+		Options:       h.Options(),
+	})
+}
+
+// Builds the header from its JSON form
+// The header length is deduced from the options, the total length defaults to the header length
+// and the checksum is calculated when they are omitted
+func (h *IPv4Header) UnmarshalJSON(data []byte) error {
+	var j ipv4JSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	if j.Version != 0 && j.Version != IPv4 {
+		return fmt.Errorf("invalid IPv4 version %d", j.Version)
+	}
+	if len(j.Options)%4 != 0 || len(j.Options) > MaxIPv4HeaderLen-IPv4HeaderLen {
+		return errors.New("the IPv4 options must be a multiple of 4 bytes, up to 40 bytes")
+	}
+	hdrLen := IPv4HeaderLen + len(j.Options)
+	if j.HeaderLen != nil && int(*j.HeaderLen) != hdrLen {
+		return fmt.Errorf("the IPv4 header length is %d but the options make it %d", *j.HeaderLen, hdrLen)
+	}
+	if j.FragOff > 0x1fff {
+		return errors.New("the IPv4 fragment offset is 13 bits")
+	}
+	src, dst := j.SrcIP.To4(), j.DstIP.To4()
+	if src == nil || dst == nil {
+		return errors.New("the IPv4 srcIP and dstIP are required")
+	}
+
+	raw := make([]byte, hdrLen)
+	raw[0] = IPv4<<4 | uint8(hdrLen/4)
+	raw[1] = j.TOS
+	totalLen := uint16(hdrLen)
+	if j.TotalLen != nil {
+		totalLen = *j.TotalLen
+	}
+	binary.BigEndian.PutUint16(raw[2:4], totalLen)
+	binary.BigEndian.PutUint16(raw[4:6], j.ID)
+	fragment := j.FragOff
+	if j.DontFragment {
+		fragment |= 0x4000
+	}
+	if j.MoreFragments {
+		fragment |= 0x2000
+	}
+	binary.BigEndian.PutUint16(raw[6:8], fragment)
+	raw[8] = j.TTL
+	raw[9] = j.Protocol
+	copy(raw[12:16], src)
+	copy(raw[16:20], dst)
+	copy(raw[IPv4HeaderLen:], j.Options)
+
+	if j.Checksum != nil {
+		binary.BigEndian.PutUint16(raw[10:12], *j.Checksum)
+	} else {
+		binary.BigEndian.PutUint16(raw[10:12], Checksum(raw, 0))
+	}
+
+	h.Reset(raw)
+	return nil
+}
+
+// JSON form of an IPv6 header
+type ipv6JSON struct {
+	Version        int     `json:"version"`
+	TrafficClass   uint8   `json:"trafficClass"`
+	FlowLabel      uint32  `json:"flowLabel"`
+	PayloadLen     *uint16 `json:"payloadLen,omitempty"`
+	NextHeader     uint8   `json:"nextHeader"`
+	NextHeaderName string  `json:"nextHeaderName,omitempty"`
+	HopLimit       uint8   `json:"hopLimit"`
+	SrcIP          net.IP  `json:"srcIP"`
+	DstIP          net.IP  `json:"dstIP"`
+}
+
+func (h *IPv6Header) MarshalJSON() ([]byte, error) {
+	payloadLen := h.PayloadLen()
+
+	return json.Marshal(&ipv6JSON{
+		Version:        IPv6,
+		TrafficClass:   h.TrafficClass(),
+		FlowLabel:      h.FlowLabel(),
+		PayloadLen:     &payloadLen,
+		NextHeader:     h.NextHeader(),
+		NextHeaderName: jsonProtocolName(h.NextHeader()),
+		HopLimit:       h.HopLimit(),
+		SrcIP:          h.SrcIP(),
+		DstIP:          h.DstIP(),
+	})
+}
+
+// Builds the header from its JSON form, the payload length defaults to 0
+func (h *IPv6Header) UnmarshalJSON(data []byte) error {
+	var j ipv6JSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	if j.Version != 0 && j.Version != IPv6 {
+		return fmt.Errorf("invalid IPv6 version %d", j.Version)
+	}
+	if j.FlowLabel > 0xfffff {
+		return errors.New("the IPv6 flow label is 20 bits")
+	}
+	src, dst := j.SrcIP.To16(), j.DstIP.To16()
+	if src == nil || dst == nil {
+		return errors.New("the IPv6 srcIP and dstIP are required")
+	}
+
+	raw := make([]byte, IPv6HeaderLen)
+	binary.BigEndian.PutUint32(raw[0:4], uint32(IPv6)<<28|uint32(j.TrafficClass)<<20|j.FlowLabel)
+	if j.PayloadLen != nil {
+		binary.BigEndian.PutUint16(raw[4:6], *j.PayloadLen)
+	}
+	raw[6] = j.NextHeader
+	raw[7] = j.HopLimit
+	copy(raw[8:24], src)
+	copy(raw[24:40], dst)
+
+	h.Reset(raw)
+	return nil
+}
+
+// TCP option kinds
+const (
+	TCPOptionEOL           = 0
+	TCPOptionNOP           = 1
+	TCPOptionMSS           = 2
+	TCPOptionWindowScale   = 3
+	TCPOptionSACKPermitted = 4
+	TCPOptionSACK          = 5
+	TCPOptionTimestamps    = 8
+)
+
+var tcpOptionNames = map[uint8]string{
+	TCPOptionEOL:           "EOL",
+	TCPOptionNOP:           "NOP",
+	TCPOptionMSS:           "MSS",
+	TCPOptionWindowScale:   "WindowScale",
+	TCPOptionSACKPermitted: "SACKPermitted",
+	TCPOptionSACK:          "SACK",
+	TCPOptionTimestamps:    "Timestamps",
+}
+
+// JSON form of a TCP option
+// The known options are decoded, the data of the others is kept in hex
+// When decoding, the name can be given instead of the kind
+type tcpOptionJSON struct {
+	Kind   *uint8      `json:"kind,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Value  *uint32     `json:"value,omitempty"`
+	TSVal  *uint32     `json:"tsval,omitempty"`
+	TSEcr  *uint32     `json:"tsecr,omitempty"`
+	Blocks [][2]uint32 `json:"blocks,omitempty"`
+	Data   HexBytes    `json:"data,omitempty"`
+}
+
+// Decodes the TCP options, the padding after the End of Option List isn't returned
+func decodeTCPOptions(b []byte) []tcpOptionJSON {
+	var options []tcpOptionJSON
+	u32 := func(v uint32) *uint32 { return &v }
+
+	for len(b) > 0 {
+		kind := b[0]
+		option := tcpOptionJSON{Kind: &kind, Name: tcpOptionNames[kind]}
+
+		if kind == TCPOptionEOL {
+			return options
+		}
+		if kind == TCPOptionNOP {
+			options = append(options, option)
+			b = b[1:]
+			continue
+		}
+
+		// Malformed length, the rest is kept as data
+		if len(b) < 2 || int(b[1]) < 2 || int(b[1]) > len(b) {
+			option.Data = b[1:]
+			return append(options, option)
+		}
+		value := b[2:b[1]]
+		b = b[b[1]:]
+
+		switch {
+		case kind == TCPOptionMSS && len(value) == 2:
+			option.Value = u32(uint32(binary.BigEndian.Uint16(value)))
+		case kind == TCPOptionWindowScale && len(value) == 1:
+			option.Value = u32(uint32(value[0]))
+		case kind == TCPOptionSACKPermitted && len(value) == 0:
+		case kind == TCPOptionSACK && len(value)%8 == 0:
+			for i := 0; i < len(value); i += 8 {
+				option.Blocks = append(option.Blocks, [2]uint32{
+					binary.BigEndian.Uint32(value[i:]),
+					binary.BigEndian.Uint32(value[i+4:]),
+				})
+			}
+		case kind == TCPOptionTimestamps && len(value) == 8:
+			option.TSVal = u32(binary.BigEndian.Uint32(value[0:4]))
+			option.TSEcr = u32(binary.BigEndian.Uint32(value[4:8]))
+		default:
+			option.Data = value
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+// Encodes the TCP options, padded with End of Option List to a multiple of 4 bytes
+func encodeTCPOptions(options []tcpOptionJSON) ([]byte, error) {
+	var b []byte
+
+	for _, option := range options {
+		var kind uint8
+		switch {
+		case option.Kind != nil:
+			kind = *option.Kind
+		case option.Name != "":
+			found := false
+			for k, name := range tcpOptionNames {
+				if strings.EqualFold(name, option.Name) {
+					kind, found = k, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unknown TCP option %q, use its kind", option.Name)
+			}
+		default:
+			return nil, errors.New("a TCP option needs a kind or a name")
+		}
+
+		var value []byte
+		switch {
+		case kind == TCPOptionEOL || kind == TCPOptionNOP:
+			b = append(b, kind)
+			continue
+		case option.Data != nil:
+			value = option.Data
+		case kind == TCPOptionMSS && option.Value != nil:
+			value = binary.BigEndian.AppendUint16(nil, uint16(*option.Value))
+		case kind == TCPOptionWindowScale && option.Value != nil:
+			value = []byte{uint8(*option.Value)}
+		case kind == TCPOptionSACK:
+			for _, block := range option.Blocks {
+				value = binary.BigEndian.AppendUint32(value, block[0])
+				value = binary.BigEndian.AppendUint32(value, block[1])
+			}
+		case kind == TCPOptionTimestamps && option.TSVal != nil:
+			value = binary.BigEndian.AppendUint32(nil, *option.TSVal)
+			var tsecr uint32
+			if option.TSEcr != nil {
+				tsecr = *option.TSEcr
+			}
+			value = binary.BigEndian.AppendUint32(value, tsecr)
+		case kind == TCPOptionMSS || kind == TCPOptionWindowScale || kind == TCPOptionTimestamps:
+			return nil, fmt.Errorf("the %s TCP option needs a value", tcpOptionNames[kind])
+		}
+
+		if len(value) > 253 {
+			return nil, fmt.Errorf("the TCP option %d is too long", kind)
+		}
+		b = append(b, kind, uint8(2+len(value)))
+		b = append(b, value...)
+	}
+
+	for len(b)%4 != 0 {
+		b = append(b, TCPOptionEOL)
+	}
+	if len(b) > MaxTCPHeaderLen-TCPHeaderLen {
+		return nil, errors.New("the TCP options are longer than 40 bytes")
+	}
+	return b, nil
+}
+
+// JSON form of a TCP header
+type tcpJSON struct {
+	SrcPort   uint16          `json:"srcPort"`
+	DstPort   uint16          `json:"dstPort"`
+	Seq       uint32          `json:"seq"`
+	Ack       uint32          `json:"ack"`
+	HeaderLen *int            `json:"headerLen,omitempty"`
+	Flags     []string        `json:"flags"`
+	Window    uint16          `json:"window"`
+	Checksum  *uint16         `json:"checksum,omitempty"`
+	UrgPtr    uint16          `json:"urgPtr"`
+	Options   []tcpOptionJSON `json:"options,omitempty"`
+}
+
+func (h *TCPHeader) MarshalJSON() ([]byte, error) {
+	srcPort, _ := h.SrcPort()
+	dstPort, _ := h.DstPort()
+	headerLen, checksum := h.HeaderLen(), h.Checksum()
+
+	flags := TCPFlagNames(h.Flags())
+	if flags == nil {
+		flags = []string{}
+	}
+
+	return json.Marshal(&tcpJSON{
+		SrcPort:   srcPort,
+		DstPort:   dstPort,
+		Seq:       h.SeqNum(),
+		Ack:       h.AckNum(),
+		HeaderLen: &headerLen,
+		Flags:     flags,
+		Window:    h.Window(),
+		Checksum:  &checksum,
+		UrgPtr:    h.UrgPtr(),
+		Options:   decodeTCPOptions(h.Options()),
+	})
+}
+
+// Builds the header from its JSON form
+// The header length is deduced from the options, the checksum is 0 when omitted
+// as it covers the pseudo header and the payload
+func (h *TCPHeader) UnmarshalJSON(data []byte) error {
+	var j tcpJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	flags, err := parseTCPFlags(j.Flags)
+	if err != nil {
+		return err
+	}
+	options, err := encodeTCPOptions(j.Options)
+	if err != nil {
+		return err
+	}
+	hdrLen := TCPHeaderLen + len(options)
+	if j.HeaderLen != nil && *j.HeaderLen != hdrLen {
+		return fmt.Errorf("the TCP header length is %d but the options make it %d", *j.HeaderLen, hdrLen)
+	}
+
+	raw := make([]byte, hdrLen)
+	binary.BigEndian.PutUint16(raw[0:2], j.SrcPort)
+	binary.BigEndian.PutUint16(raw[2:4], j.DstPort)
+	binary.BigEndian.PutUint32(raw[4:8], j.Seq)
+	binary.BigEndian.PutUint32(raw[8:12], j.Ack)
+	raw[12] = uint8(hdrLen/4) << 4
+	raw[13] = flags
+	binary.BigEndian.PutUint16(raw[14:16], j.Window)
+	if j.Checksum != nil {
+		binary.BigEndian.PutUint16(raw[16:18], *j.Checksum)
+	}
+	binary.BigEndian.PutUint16(raw[18:20], j.UrgPtr)
+	copy(raw[TCPHeaderLen:], options)
+
+	h.Reset(raw)
+	return nil
+}
+
+// JSON form of a UDP header
+type udpJSON struct {
+	SrcPort  uint16  `json:"srcPort"`
+	DstPort  uint16  `json:"dstPort"`
+	Length   *uint16 `json:"length,omitempty"`
+	Checksum *uint16 `json:"checksum,omitempty"`
+}
+
+func (h *UDPHeader) MarshalJSON() ([]byte, error) {
+	srcPort, _ := h.SrcPort()
+	dstPort, _ := h.DstPort()
+	length, checksum := h.Len(), h.Checksum()
+
+	return json.Marshal(&udpJSON{
+		SrcPort:  srcPort,
+		DstPort:  dstPort,
+		Length:   &length,
+		Checksum: &checksum,
+	})
+}
+
+// Builds the header from its JSON form
+// The length defaults to the header length and the checksum to 0
+func (h *UDPHeader) UnmarshalJSON(data []byte) error {
+	var j udpJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	raw := make([]byte, UDPHeaderLen)
+	binary.BigEndian.PutUint16(raw[0:2], j.SrcPort)
+	binary.BigEndian.PutUint16(raw[2:4], j.DstPort)
+	length := uint16(UDPHeaderLen)
+	if j.Length != nil {
+		length = *j.Length
+	}
+	binary.BigEndian.PutUint16(raw[4:6], length)
+	if j.Checksum != nil {
+		binary.BigEndian.PutUint16(raw[6:8], *j.Checksum)
+	}
+
+	h.Reset(raw)
+	return nil
+}
+
+// JSON form of an ICMPv4 or ICMPv6 header
+// The identifier and the sequence number of the echo messages are part of the body
+type icmpJSON struct {
+	Type     *uint8  `json:"type,omitempty"`
+	TypeName string  `json:"typeName,omitempty"`
+	Code     uint8   `json:"code"`
+	Checksum *uint16 `json:"checksum,omitempty"`
+	Body     uint32  `json:"body"`
+	ID       *uint16 `json:"id,omitempty"`
+	Seq      *uint16 `json:"seq,omitempty"`
+}
+
+func marshalICMP(raw []byte, names map[uint8]string, echoRequest, echoReply uint8) ([]byte, error) {
+	icmpType := raw[0]
+	checksum := binary.BigEndian.Uint16(raw[2:4])
+	j := &icmpJSON{
+		Type:     &icmpType,
+		TypeName: names[icmpType],
+		Code:     raw[1],
+		Checksum: &checksum,
+		Body:     binary.BigEndian.Uint32(raw[4:8]),
+	}
+	if icmpType == echoRequest || icmpType == echoReply {
+		id, seq := uint16(j.Body>>16), uint16(j.Body)
+		j.ID, j.Seq = &id, &seq
+	}
+	return json.Marshal(j)
+}
+
+func unmarshalICMP(data []byte, names map[uint8]string) ([]byte, error) {
+	var j icmpJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, ICMPv4HeaderLen)
+	switch {
+	case j.Type != nil:
+		raw[0] = *j.Type
+	case j.TypeName != "":
+		found := false
+		for icmpType, name := range names {
+			if strings.EqualFold(name, j.TypeName) {
+				raw[0], found = icmpType, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown ICMP type %q, use its number", j.TypeName)
+		}
+	default:
+		return nil, errors.New("the ICMP type is required")
+	}
+	raw[1] = j.Code
+	if j.Checksum != nil {
+		binary.BigEndian.PutUint16(raw[2:4], *j.Checksum)
+	}
+
+	body := j.Body
+	if j.ID != nil {
+		body = body&0xffff | uint32(*j.ID)<<16
+	}
+	if j.Seq != nil {
+		body = body&0xffff0000 | uint32(*j.Seq)
+	}
+	binary.BigEndian.PutUint32(raw[4:8], body)
+	return raw, nil
+}
+
+func (h *ICMPv4Header) MarshalJSON() ([]byte, error) {
+	return marshalICMP(h.Raw, icmpv4TypeNames, 8, 0)
+}
+
+// Builds the header from its JSON form, the type can be given by name and the checksum is 0 when omitted
+func (h *ICMPv4Header) UnmarshalJSON(data []byte) error {
+	raw, err := unmarshalICMP(data, icmpv4TypeNames)
+	if err != nil {
+		return err
+	}
+	h.Reset(raw)
+	return nil
+}
+
+func (h *ICMPv6Header) MarshalJSON() ([]byte, error) {
+	return marshalICMP(h.Raw, icmpv6TypeNames, 128, 129)
+}
+
+// Builds the header from its JSON form, the type can be given by name and the checksum is 0 when omitted
+func (h *ICMPv6Header) UnmarshalJSON(data []byte) error {
+	raw, err := unmarshalICMP(data, icmpv6TypeNames)
+	if err != nil {
+		return err
+	}
+	h.Reset(raw)
+	return nil
+}
@@ -13,10 +13,16 @@ type TCPHeader struct {
 }
 
 func NewTCPHeader(raw []byte) *TCPHeader {
+	h := &TCPHeader{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the TCP header to new raw bytes so it can be reused without allocating
+func (h *TCPHeader) Reset(raw []byte) {
 	hdrLen := (raw[12] >> 4) * 4
-	return &TCPHeader{
-		Raw: raw[:hdrLen],
-	}
+	h.Raw = raw[:hdrLen]
+	h.Modified = false
 }
 
 func (h *TCPHeader) String() string {
@@ -80,6 +86,18 @@ func (h *TCPHeader) AckNum() uint32 {
 	return binary.BigEndian.Uint32(h.Raw[8:12])
 }
 
+// Sets the sequence number
+func (h *TCPHeader) SetSeqNum(seqNum uint32) {
+	h.Modified = true
+	binary.BigEndian.PutUint32(h.Raw[4:8], seqNum)
+}
+
+// Sets the acknowledgment number
+func (h *TCPHeader) SetAckNum(ackNum uint32) {
+	h.Modified = true
+	binary.BigEndian.PutUint32(h.Raw[8:12], ackNum)
+}
+
 // Reads the header's bytes and returns the length of the header in bytes
 func (h *TCPHeader) HeaderLen() int {
 	return int(h.DataOffset()) * 4
@@ -143,6 +161,18 @@ func (h *TCPHeader) FIN() bool {
 	return h.Raw[13]&0x1 == 1
 }
 
+// Reads the header's bytes and returns the CWR, ECE, URG, ACK, PSH, RST, SYN and FIN flags
+// See the TCPFlag constants
+func (h *TCPHeader) Flags() uint8 {
+	return h.Raw[13]
+}
+
+// Sets the CWR, ECE, URG, ACK, PSH, RST, SYN and FIN flags
+func (h *TCPHeader) SetFlags(flags uint8) {
+	h.Modified = true
+	h.Raw[13] = flags
+}
+
 // END FLAGS
 
 // Reads the header's bytes and returns the window size
@@ -150,6 +180,12 @@ func (h *TCPHeader) Window() uint16 {
 	return binary.BigEndian.Uint16(h.Raw[14:16])
 }
 
+// Sets the window size
+func (h *TCPHeader) SetWindow(window uint16) {
+	h.Modified = true
+	binary.BigEndian.PutUint16(h.Raw[14:16], window)
+}
+
 // Reads the header's bytes and returns the checksum
 func (h *TCPHeader) Checksum() uint16 {
 	return binary.BigEndian.Uint16(h.Raw[16:18])
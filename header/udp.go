@@ -13,9 +13,15 @@ type UDPHeader struct {
 }
 
 func NewUDPHeader(raw []byte) *UDPHeader {
-	return &UDPHeader{
-		Raw: raw,
-	}
+	h := &UDPHeader{}
+	h.Reset(raw)
+	return h
+}
+
+// Points the UDP header to new raw bytes so it can be reused without allocating
+func (h *UDPHeader) Reset(raw []byte) {
+	h.Raw = raw
+	h.Modified = false
 }
 
 func (h *UDPHeader) String() string {
@@ -72,6 +78,12 @@ func (h *UDPHeader) Len() uint16 {
 	return binary.BigEndian.Uint16(h.Raw[4:6])
 }
 
+// Sets the length of UDP header and UDP data in bytes
+func (h *UDPHeader) SetLen(length uint16) {
+	h.Modified = true
+	binary.BigEndian.PutUint16(h.Raw[4:6], length)
+}
+
 // Reads the header's bytes and returns the checksum
 func (h *UDPHeader) Checksum() uint16 {
 	return binary.BigEndian.Uint16(h.Raw[6:8])
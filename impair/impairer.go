@@ -0,0 +1,267 @@
+// Package impair emulates bad networks by delaying, dropping, duplicating,
+// reordering and corrupting diverted packets before they are reinjected.
+//
+// An Impairer sits between Recv and Send:
+//
+//	im := impair.NewImpairer(winDivert, 42, &impair.Profile{Delay: 100 * time.Millisecond, Loss: 0.01})
+//	go im.Run()
+//	for packet := range packetChan {
+//		im.Process(packet)
+//	}
+//
+// Every random decision comes from a single RNG seeded by the caller,
+// so a run processing the same packets in the same order is reproducible.
+package impair
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Represents a packet waiting to be sent
+type scheduledPacket struct {
+	packet *godivert.Packet
+	at     time.Time
+	seq    uint64
+}
+
+// Min-heap of scheduled packets ordered by sending time then arrival order
+type packetQueue []*scheduledPacket
+
+func (q packetQueue) Len() int { return len(q) }
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q packetQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(*scheduledPacket)) }
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// Counters of an Impairer
+type Stats struct {
+	Processed  uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+	Corrupted  uint64
+	Sent       uint64
+	SendErrors uint64
+}
+
+// Impairer applies the first matching Profile to each processed packet
+// and sends the surviving packets once their delay has elapsed
+type Impairer struct {
+	sender godivert.Sender
+	states []*profileState
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	queue  packetQueue
+	seq    uint64
+	stats  Stats
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// Create a new Impairer sending packets with the sender
+// The seed initializes the RNG used for every random decision
+func NewImpairer(sender godivert.Sender, seed int64, profiles ...*Profile) *Impairer {
+	states := make([]*profileState, len(profiles))
+	for i, profile := range profiles {
+		states[i] = &profileState{profile: profile}
+	}
+
+	return &Impairer{
+		sender: sender,
+		states: states,
+		rng:    rand.New(rand.NewSource(seed)),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// Apply the matching profile to the packet and schedule it
+// Packets matching no profile are scheduled to be sent immediately,
+// dropped packets are released to their pool
+func (im *Impairer) Process(packet *godivert.Packet) error {
+	state := im.match(packet)
+	now := time.Now()
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	if im.closed {
+		return errors.New("the impairer is closed")
+	}
+
+	im.stats.Processed++
+
+	if state == nil {
+		im.schedule(packet, now)
+		return nil
+	}
+
+	if state.lost(im.rng) {
+		im.stats.Dropped++
+		packet.Release()
+		return nil
+	}
+
+	copies := []*godivert.Packet{packet}
+	if chance(im.rng, state.profile.Duplicate) {
+		im.stats.Duplicated++
+		copies = append(copies, packet.Clone())
+	}
+
+	for _, p := range copies {
+		if chance(im.rng, state.profile.Corrupt) && corrupt(im.rng, p) {
+			im.stats.Corrupted++
+		}
+
+		ready := now
+		if chance(im.rng, state.profile.Reorder) {
+			im.stats.Reordered++
+		} else {
+			ready = ready.Add(state.delay(im.rng))
+		}
+
+		im.schedule(p, state.transmit(ready, len(p.Raw)))
+	}
+
+	return nil
+}
+
+// Returns the state of the first profile matching the packet or nil
+func (im *Impairer) match(packet *godivert.Packet) *profileState {
+	for _, state := range im.states {
+		if state.profile.Match == nil || state.profile.Match(packet) {
+			return state
+		}
+	}
+	return nil
+}
+
+// Must be called with im.mu held
+func (im *Impairer) schedule(packet *godivert.Packet, at time.Time) {
+	im.seq++
+	heap.Push(&im.queue, &scheduledPacket{packet: packet, at: at, seq: im.seq})
+
+	select {
+	case im.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Send the scheduled packets when their time has come until Close is called
+func (im *Impairer) Run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		im.mu.Lock()
+		ready, wait := im.popReady(time.Now())
+		im.mu.Unlock()
+
+		for _, scheduled := range ready {
+			im.send(scheduled.packet)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-im.done:
+			return
+		case <-im.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// Pops the packets to send at the given time
+// and returns how long to wait for the next one
+// Must be called with im.mu held
+func (im *Impairer) popReady(now time.Time) ([]*scheduledPacket, time.Duration) {
+	var ready []*scheduledPacket
+	for im.queue.Len() > 0 {
+		next := im.queue[0]
+		if next.at.After(now) {
+			return ready, next.at.Sub(now)
+		}
+		ready = append(ready, heap.Pop(&im.queue).(*scheduledPacket))
+	}
+	return ready, time.Hour
+}
+
+func (im *Impairer) send(packet *godivert.Packet) {
+	_, err := im.sender.Send(packet)
+
+	im.mu.Lock()
+	if err != nil {
+		im.stats.SendErrors++
+	} else {
+		im.stats.Sent++
+	}
+	im.mu.Unlock()
+}
+
+// Returns the number of packets waiting to be sent
+func (im *Impairer) Pending() int {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.queue.Len()
+}
+
+// Returns a copy of the counters
+func (im *Impairer) Stats() Stats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.stats
+}
+
+// Stop Run and send the pending packets immediately
+// so that no packet is lost
+func (im *Impairer) Close() error {
+	im.mu.Lock()
+	if im.closed {
+		im.mu.Unlock()
+		return errors.New("the impairer is already closed")
+	}
+	im.closed = true
+	pending := make([]*scheduledPacket, 0, im.queue.Len())
+	for im.queue.Len() > 0 {
+		pending = append(pending, heap.Pop(&im.queue).(*scheduledPacket))
+	}
+	im.mu.Unlock()
+
+	close(im.done)
+
+	for _, scheduled := range pending {
+		im.send(scheduled.packet)
+	}
+	return nil
+}
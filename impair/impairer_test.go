@@ -0,0 +1,174 @@
+package impair
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Sender recording the packets sent
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []*godivert.Packet
+}
+
+func (s *fakeSender) Send(packet *godivert.Packet) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, packet)
+	return packet.PacketLen, nil
+}
+
+// Returns a UDP datagram whose first payload byte is id
+func udpPacket(t *testing.T, id byte) *godivert.Packet {
+	t.Helper()
+	data := `{"ipv4": {"ttl": 64, "srcIP": "10.0.0.1", "dstIP": "10.0.0.2"},
+		"udp": {"srcPort": 53, "dstPort": 1234}, "payload": "0068656c6c6f"}`
+
+	var packet godivert.Packet
+	if err := json.Unmarshal([]byte(data), &packet); err != nil {
+		t.Fatal(err)
+	}
+	packet.Payload()[0] = id
+	return &packet
+}
+
+// Processes n packets and closes the impairer, returning the ids of the packets sent in order
+func run(t *testing.T, seed int64, n int, profiles ...*Profile) ([]byte, Stats) {
+	t.Helper()
+	sender := &fakeSender{}
+	im := NewImpairer(sender, seed, profiles...)
+	for i := 0; i < n; i++ {
+		if err := im.Process(udpPacket(t, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []byte
+	for _, packet := range sender.sent {
+		ids = append(ids, packet.Payload()[0])
+	}
+	return ids, im.Stats()
+}
+
+func TestImpairer(t *testing.T) {
+	tests := []struct {
+		name      string
+		profile   *Profile
+		wantIDs   []byte
+		wantStats Stats
+	}{
+		{
+			name:      "no impairment",
+			profile:   &Profile{},
+			wantIDs:   []byte{0, 1, 2, 3},
+			wantStats: Stats{Processed: 4, Sent: 4},
+		},
+		{
+			name:      "loss",
+			profile:   &Profile{Loss: 1},
+			wantStats: Stats{Processed: 4, Dropped: 4},
+		},
+		{
+			name:      "duplicate",
+			profile:   &Profile{Duplicate: 1},
+			wantIDs:   []byte{0, 0, 1, 1, 2, 2, 3, 3},
+			wantStats: Stats{Processed: 4, Duplicated: 4, Sent: 8},
+		},
+		{
+			name:      "reorder overtakes the delayed packets",
+			profile:   &Profile{Delay: time.Hour, Reorder: 1},
+			wantIDs:   []byte{0, 1, 2, 3},
+			wantStats: Stats{Processed: 4, Reordered: 4, Sent: 4},
+		},
+		{
+			name: "delay only applies to the matching packets",
+			profile: &Profile{Delay: time.Hour, Match: func(packet *godivert.Packet) bool {
+				return packet.Payload()[0]%2 == 0
+			}},
+			wantIDs:   []byte{1, 3, 0, 2},
+			wantStats: Stats{Processed: 4, Sent: 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids, stats := run(t, 1, 4, test.profile)
+			if !bytes.Equal(ids, test.wantIDs) {
+				t.Errorf("sent %v, want %v", ids, test.wantIDs)
+			}
+			if stats != test.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", stats, test.wantStats)
+			}
+		})
+	}
+}
+
+func TestImpairerSeed(t *testing.T) {
+	profile := &Profile{Loss: 0.3, Duplicate: 0.2, Reorder: 0.2, Delay: time.Hour, Jitter: time.Minute}
+
+	first, firstStats := run(t, 42, 100, profile)
+	second, secondStats := run(t, 42, 100, profile)
+	if !bytes.Equal(first, second) || firstStats != secondStats {
+		t.Errorf("two runs with the same seed differ:\n%v %+v\n%v %+v", first, firstStats, second, secondStats)
+	}
+
+	if firstStats.Dropped == 0 || firstStats.Duplicated == 0 || firstStats.Reordered == 0 {
+		t.Errorf("Stats() = %+v, want drops, duplicates and reorders", firstStats)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	original := udpPacket(t, 0)
+	sender := &fakeSender{}
+	im := NewImpairer(sender, 7, &Profile{Corrupt: 1})
+	for i := 0; i < 50; i++ {
+		if err := im.Process(udpPacket(t, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	im.Close()
+
+	headerLen := len(original.Raw) - len(original.Payload())
+	for _, packet := range sender.sent {
+		if !bytes.Equal(packet.Raw[:headerLen], original.Raw[:headerLen]) {
+			t.Fatalf("headers corrupted: %x, want %x", packet.Raw[:headerLen], original.Raw[:headerLen])
+		}
+
+		flipped := 0
+		for i, b := range packet.Payload() {
+			for x := b ^ original.Payload()[i]; x != 0; x &= x - 1 {
+				flipped++
+			}
+		}
+		if flipped != 1 {
+			t.Errorf("%d bits flipped in %x, want 1", flipped, packet.Payload())
+		}
+	}
+
+	if stats := im.Stats(); stats.Corrupted != 50 {
+		t.Errorf("Corrupted = %d, want 50", stats.Corrupted)
+	}
+
+	// A packet without payload is left intact
+	empty := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 1234, nil)
+	packet := &godivert.Packet{Raw: append([]byte(nil), empty...), PacketLen: uint(len(empty))}
+	sender = &fakeSender{}
+	im = NewImpairer(sender, 7, &Profile{Corrupt: 1})
+	im.Process(packet)
+	im.Close()
+	if !bytes.Equal(packet.Raw, empty) {
+		t.Errorf("packet without payload corrupted: %x, want %x", packet.Raw, empty)
+	}
+	if stats := im.Stats(); stats.Corrupted != 0 {
+		t.Errorf("Corrupted = %d for a packet without payload, want 0", stats.Corrupted)
+	}
+}
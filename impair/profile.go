@@ -0,0 +1,134 @@
+package impair
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Represents the impairments applied to the packets matching a profile
+// Probabilities are between 0 and 1, a zero value disables the impairment
+type Profile struct {
+	// Returns true if the profile applies to the packet, nil matches every packet
+	// See FilterMatch to use a WinDivert filter
+	Match func(packet *godivert.Packet) bool
+
+	// Fixed delay added to every packet
+	Delay time.Duration
+	// Maximum random variation added to or removed from Delay
+	Jitter time.Duration
+
+	// Probability for a packet to be dropped
+	Loss float64
+	// Burst loss model, used in addition to Loss if not nil
+	Burst *GilbertElliott
+
+	// Probability for a packet to be sent twice
+	Duplicate float64
+	// Probability for a packet to skip Delay and Jitter, overtaking the delayed packets
+	Reorder float64
+	// Probability for a random bit of the packet's payload to be flipped
+	Corrupt float64
+
+	// Bandwidth cap in bytes per second, 0 means unlimited
+	Rate int64
+}
+
+// Represents the Gilbert-Elliott two-states burst loss model
+// https://en.wikipedia.org/wiki/Burst_error#Gilbert%E2%80%93Elliott_model
+type GilbertElliott struct {
+	// Probability to go from the good state to the bad state
+	P float64
+	// Probability to go from the bad state to the good state
+	R float64
+	// Loss probability in the good state
+	LossGood float64
+	// Loss probability in the bad state
+	LossBad float64
+}
+
+// Returns a Match function evaluating the packet with the given WinDivert filter
+// Packets that can't be evaluated don't match
+func FilterMatch(filter string) func(packet *godivert.Packet) bool {
+	return func(packet *godivert.Packet) bool {
+		match, err := packet.EvalFilter(filter)
+		return err == nil && match
+	}
+}
+
+// Represents the mutable state of a profile
+type profileState struct {
+	profile *Profile
+
+	// Gilbert-Elliott state
+	bad bool
+	// Time at which the emulated link is free again
+	nextFree time.Time
+}
+
+// Returns true if the packet has to be dropped
+func (s *profileState) lost(rng *rand.Rand) bool {
+	lost := chance(rng, s.profile.Loss)
+
+	if ge := s.profile.Burst; ge != nil {
+		if s.bad {
+			lost = chance(rng, ge.LossBad) || lost
+			if chance(rng, ge.R) {
+				s.bad = false
+			}
+		} else {
+			lost = chance(rng, ge.LossGood) || lost
+			if chance(rng, ge.P) {
+				s.bad = true
+			}
+		}
+	}
+
+	return lost
+}
+
+// Returns the delay of a packet
+func (s *profileState) delay(rng *rand.Rand) time.Duration {
+	delay := s.profile.Delay
+	if jitter := s.profile.Jitter; jitter > 0 {
+		delay += time.Duration(rng.Int63n(int64(2*jitter)+1)) - jitter
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// Returns the time at which a packet of the given length leaves the emulated link
+// if it is ready to be sent at the given time
+func (s *profileState) transmit(ready time.Time, length int) time.Time {
+	if s.profile.Rate <= 0 {
+		return ready
+	}
+
+	if ready.Before(s.nextFree) {
+		ready = s.nextFree
+	}
+	s.nextFree = ready.Add(time.Duration(int64(length) * int64(time.Second) / s.profile.Rate))
+	return ready
+}
+
+// Flips a random bit of the packet's payload
+// The headers are left intact so that the packet still reaches its destination,
+// packets without payload are not corrupted and false is returned
+func corrupt(rng *rand.Rand, packet *godivert.Packet) bool {
+	data := packet.Payload()
+	if len(data) == 0 {
+		return false
+	}
+
+	i := rng.Intn(len(data))
+	data[i] ^= 1 << uint(rng.Intn(8))
+	return true
+}
+
+func chance(rng *rand.Rand, probability float64) bool {
+	return probability > 0 && rng.Float64() < probability
+}
@@ -0,0 +1,170 @@
+// Package testpacket builds the raw packets used by the tests of godivert and its subpackages
+// It doesn't import godivert so that the tests of the godivert package itself can use it
+package testpacket
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// IPv4 SYN from 172.16.0.1:49368 to 172.16.0.10:80 with MSS, SACK permitted, timestamps and window scale options
+var syn = []byte{
+	0x45, 0x00, 0x00, 0x3c, 0x1c, 0x46, 0x40, 0x00, 0x40, 0x06, 0xb1, 0xe6, 0xac, 0x10, 0x00, 0x01,
+	0xac, 0x10, 0x00, 0x0a, 0xc0, 0xd8, 0x00, 0x50, 0x7a, 0x8b, 0x9b, 0x5a, 0x00, 0x00, 0x00, 0x00,
+	0xa0, 0x02, 0xfa, 0xf0, 0xe9, 0xf7, 0x00, 0x00, 0x02, 0x04, 0x05, 0xb4, 0x04, 0x02, 0x08, 0x0a,
+	0x00, 0x09, 0xf9, 0x4a, 0x00, 0x00, 0x00, 0x00, 0x01, 0x03, 0x03, 0x07,
+}
+
+// Returns a copy of a captured IPv4 SYN from 172.16.0.1:49368 to 172.16.0.10:80
+// Its sequence number is 0x7a8b9b5a and it carries the MSS, SACK permitted, timestamps and window scale options
+func SYN() []byte {
+	return append([]byte(nil), syn...)
+}
+
+// Describes a packet to build
+// The IP version is the one of Src, which must match the one of Dst
+type Spec struct {
+	Src, Dst         string
+	Protocol         uint8
+	SrcPort, DstPort uint16
+
+	// TCP only
+	Seq, Ack uint32
+	Flags    uint8
+
+	// ICMPv4 or ICMPv6 only
+	Type, Code uint8
+
+	// Defaults to 64
+	TTL uint8
+	ID  uint16
+	// Offset of an IPv4 fragment in 8 bytes units
+	// The packet of a fragment with a non zero offset has no transport header
+	FragOffset    uint16
+	MoreFragments bool
+
+	Payload []byte
+}
+
+// Returns the packet described by spec with valid checksums
+func Build(spec Spec) []byte {
+	src, dst := net.ParseIP(spec.Src), net.ParseIP(spec.Dst)
+	if src == nil || dst == nil {
+		panic("testpacket: invalid address " + spec.Src + " or " + spec.Dst)
+	}
+	ttl := spec.TTL
+	if ttl == 0 {
+		ttl = 64
+	}
+
+	var transport []byte
+	if spec.FragOffset == 0 {
+		transport = transportHeader(spec)
+	}
+	segment := append(transport, spec.Payload...)
+
+	var raw []byte
+	if src4 := src.To4(); src4 != nil {
+		raw = make([]byte, header.IPv4HeaderLen, header.IPv4HeaderLen+len(segment))
+		raw[0] = 0x45
+		binary.BigEndian.PutUint16(raw[2:4], uint16(header.IPv4HeaderLen+len(segment)))
+		binary.BigEndian.PutUint16(raw[4:6], spec.ID)
+		fragment := spec.FragOffset & 0x1fff
+		if spec.MoreFragments {
+			fragment |= 0x2000
+		}
+		binary.BigEndian.PutUint16(raw[6:8], fragment)
+		raw[8] = ttl
+		raw[9] = spec.Protocol
+		copy(raw[12:16], src4)
+		copy(raw[16:20], dst.To4())
+		binary.BigEndian.PutUint16(raw[10:12], header.Checksum(raw, 0))
+	} else {
+		raw = make([]byte, header.IPv6HeaderLen, header.IPv6HeaderLen+len(segment))
+		raw[0] = 0x60
+		binary.BigEndian.PutUint16(raw[4:6], uint16(len(segment)))
+		raw[6] = spec.Protocol
+		raw[7] = ttl
+		copy(raw[8:24], src.To16())
+		copy(raw[24:40], dst.To16())
+	}
+	raw = append(raw, segment...)
+
+	if len(transport) > 0 {
+		offset, pseudo := checksumOffset(spec.Protocol), uint32(0)
+		if spec.Protocol != header.ICMPv4 {
+			pseudo = pseudoHeaderSum(raw, spec.Protocol, len(segment))
+		}
+		checksum := header.Checksum(raw[len(raw)-len(segment):], pseudo)
+		if checksum == 0 && spec.Protocol == header.UDP {
+			checksum = 0xffff
+		}
+		binary.BigEndian.PutUint16(raw[len(raw)-len(segment)+offset:], checksum)
+	}
+	return raw
+}
+
+// Returns an IPv4 or IPv6 TCP segment with the given flags
+func TCP(src string, srcPort uint16, dst string, dstPort uint16, flags uint8) []byte {
+	return Build(Spec{Src: src, Dst: dst, Protocol: header.TCP, SrcPort: srcPort, DstPort: dstPort, Flags: flags})
+}
+
+// Returns an IPv4 or IPv6 UDP datagram carrying payload
+func UDP(src string, srcPort uint16, dst string, dstPort uint16, payload []byte) []byte {
+	return Build(Spec{Src: src, Dst: dst, Protocol: header.UDP, SrcPort: srcPort, DstPort: dstPort, Payload: payload})
+}
+
+// Returns the transport header of spec with a zero checksum
+func transportHeader(spec Spec) []byte {
+	switch spec.Protocol {
+	case header.TCP:
+		tcp := make([]byte, header.TCPHeaderLen)
+		binary.BigEndian.PutUint16(tcp[0:2], spec.SrcPort)
+		binary.BigEndian.PutUint16(tcp[2:4], spec.DstPort)
+		binary.BigEndian.PutUint32(tcp[4:8], spec.Seq)
+		binary.BigEndian.PutUint32(tcp[8:12], spec.Ack)
+		tcp[12] = header.TCPHeaderLen / 4 << 4
+		tcp[13] = spec.Flags
+		binary.BigEndian.PutUint16(tcp[14:16], 64240)
+		return tcp
+	case header.UDP:
+		udp := make([]byte, header.UDPHeaderLen)
+		binary.BigEndian.PutUint16(udp[0:2], spec.SrcPort)
+		binary.BigEndian.PutUint16(udp[2:4], spec.DstPort)
+		binary.BigEndian.PutUint16(udp[4:6], uint16(header.UDPHeaderLen+len(spec.Payload)))
+		return udp
+	case header.ICMPv4, header.ICMPv6:
+		return []byte{spec.Type, spec.Code, 0, 0, 0, 0, 0, 0}
+	default:
+		return nil
+	}
+}
+
+// Returns the offset of the checksum in the transport header of protocol
+func checksumOffset(protocol uint8) int {
+	switch protocol {
+	case header.TCP:
+		return 16
+	case header.UDP:
+		return 6
+	default:
+		return 2
+	}
+}
+
+// Returns the sum of the pseudo header covered by the transport checksum
+func pseudoHeaderSum(raw []byte, protocol uint8, length int) uint32 {
+	var pseudo []byte
+	if raw[0]>>4 == 4 {
+		pseudo = append(pseudo, raw[12:20]...)
+		pseudo = append(pseudo, 0, protocol)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(length))
+	} else {
+		pseudo = append(pseudo, raw[8:40]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(length))
+		pseudo = append(pseudo, 0, 0, 0, protocol)
+	}
+	return header.Sum(pseudo, 0)
+}
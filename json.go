@@ -0,0 +1,320 @@
+package godivert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// JSON form of a WinDivertAddress
+type addressJSON struct {
+	Timestamp int64  `json:"timestamp"`
+	Layer     string `json:"layer"`
+	Event     string `json:"event"`
+	IfIdx     uint32 `json:"ifIdx"`
+	SubIfIdx  uint32 `json:"subIfIdx"`
+	Direction string `json:"direction"`
+	Loopback  bool   `json:"loopback"`
+	Impostor  bool   `json:"impostor"`
+	Sniffed   bool   `json:"sniffed"`
+	IPv6      bool   `json:"ipv6"`
+
+	PseudoIPChecksum  bool `json:"pseudoIPChecksum"`
+	PseudoTCPChecksum bool `json:"pseudoTCPChecksum"`
+	PseudoUDPChecksum bool `json:"pseudoUDPChecksum"`
+	ValidIPChecksum   bool `json:"validIPChecksum"`
+	ValidTCPChecksum  bool `json:"validTCPChecksum"`
+	ValidUDPChecksum  bool `json:"validUDPChecksum"`
+
+	// Data of the Flow, Socket and Reflect layers
+	LayerData header.HexBytes `json:"layerData,omitempty"`
+}
+
+func (w *WinDivertAddress) MarshalJSON() ([]byte, error) {
+	j := &addressJSON{
+		Timestamp:         w.Timestamp,
+		Layer:             w.Layer.String(),
+		Event:             w.Event.String(),
+		IfIdx:             w.IfIdx,
+		SubIfIdx:          w.SubIfIdx,
+		Direction:         strings.ToLower(w.Direction().String()),
+		Loopback:          w.Loopback(),
+		Impostor:          w.Impostor(),
+		Sniffed:           w.Sniffed(),
+		IPv6:              w.IPv6(),
+		PseudoIPChecksum:  w.PseudoIPChecksum(),
+		PseudoTCPChecksum: w.PseudoTCPChecksum(),
+		PseudoUDPChecksum: w.PseudoUDPChecksum(),
+		ValidIPChecksum:   w.ValidIPChecksum(),
+		ValidTCPChecksum:  w.ValidTCPChecksum(),
+		ValidUDPChecksum:  w.ValidUDPChecksum(),
+	}
+	if w.Layer != WinDivertLayerNetwork && w.Layer != WinDivertLayerNetworkForward {
+		j.LayerData = w.LayerData[:]
+	}
+	return json.Marshal(j)
+}
+
+// Builds the address from its JSON form
+// The layer, the event and the direction default to Network, Packet and outbound
+func (w *WinDivertAddress) UnmarshalJSON(data []byte) error {
+	var j addressJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	addr := WinDivertAddress{
+		Timestamp: j.Timestamp,
+		IfIdx:     j.IfIdx,
+		SubIfIdx:  j.SubIfIdx,
+	}
+
+	if j.Layer != "" {
+		found := false
+		for layer := WinDivertLayerNetwork; layer <= WinDivertLayerReflect; layer++ {
+			if strings.EqualFold(layer.String(), j.Layer) {
+				addr.Layer, found = layer, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown layer %q", j.Layer)
+		}
+	}
+
+	if j.Event != "" {
+		found := false
+		for event := WinDivertEventNetworkPacket; event <= WinDivertEventReflectClose; event++ {
+			if strings.EqualFold(event.String(), j.Event) {
+				addr.Event, found = event, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown event %q", j.Event)
+		}
+	}
+
+	switch strings.ToLower(j.Direction) {
+	case "", "outbound":
+		addr.SetDirection(WinDivertDirectionOutbound)
+	case "inbound":
+		addr.SetDirection(WinDivertDirectionInbound)
+	default:
+		return fmt.Errorf("unknown direction %q, expected inbound or outbound", j.Direction)
+	}
+
+	if len(j.LayerData) > len(addr.LayerData) {
+		return fmt.Errorf("the layer data is longer than %d bytes", len(addr.LayerData))
+	}
+	copy(addr.LayerData[:], j.LayerData)
+
+	addr.SetLoopback(j.Loopback)
+	addr.SetImpostor(j.Impostor)
+	addr.SetSniffed(j.Sniffed)
+	addr.SetIPv6(j.IPv6)
+	addr.SetPseudoIPChecksum(j.PseudoIPChecksum)
+	addr.SetPseudoTCPChecksum(j.PseudoTCPChecksum)
+	addr.SetPseudoUDPChecksum(j.PseudoUDPChecksum)
+	addr.SetValidIPChecksum(j.ValidIPChecksum)
+	addr.SetValidTCPChecksum(j.ValidTCPChecksum)
+	addr.SetValidUDPChecksum(j.ValidUDPChecksum)
+
+	*w = addr
+	return nil
+}
+
+// JSON form of a Packet
+// Only one of the IP headers and at most one of the transport headers are set
+type packetJSON struct {
+	Address *WinDivertAddress `json:"address,omitempty"`
+	// Length of the packet, ignored when decoding
+	Length uint `json:"length"`
+
+	IPv4 *header.IPv4Header `json:"ipv4,omitempty"`
+	IPv6 *header.IPv6Header `json:"ipv6,omitempty"`
+
+	TCP    *header.TCPHeader    `json:"tcp,omitempty"`
+	UDP    *header.UDPHeader    `json:"udp,omitempty"`
+	ICMPv4 *header.ICMPv4Header `json:"icmpv4,omitempty"`
+	ICMPv6 *header.ICMPv6Header `json:"icmpv6,omitempty"`
+
+	// Data following the transport header, or the IP header for the other protocols and the IPv4 fragments
+	Payload header.HexBytes `json:"payload,omitempty"`
+}
+
+// Fields present in the JSON form of each header
+type packetFieldsJSON struct {
+	IPv4   map[string]json.RawMessage `json:"ipv4"`
+	IPv6   map[string]json.RawMessage `json:"ipv6"`
+	TCP    map[string]json.RawMessage `json:"tcp"`
+	UDP    map[string]json.RawMessage `json:"udp"`
+	ICMPv4 map[string]json.RawMessage `json:"icmpv4"`
+	ICMPv6 map[string]json.RawMessage `json:"icmpv6"`
+}
+
+// Returns true if the field is set, the names are matched case-insensitively like encoding/json does
+func has(fields map[string]json.RawMessage, name string) bool {
+	if _, ok := fields[name]; ok {
+		return true
+	}
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the packet as a JSON object with an object per header
+//
+//	{"address": {...}, "length": 45, "ipv4": {...}, "tcp": {...}, "payload": "68656c6c6f"}
+func (p *Packet) MarshalJSON() ([]byte, error) {
+	data := p.data()
+	if len(data) == 0 {
+		return nil, errors.New("can't encode an empty packet")
+	}
+	if err := p.VerifyParsed(); err != nil && p.IpHdr == nil {
+		return nil, err
+	}
+
+	j := &packetJSON{
+		Address: p.Addr,
+		Length:  uint(len(data)),
+	}
+
+	switch ipHdr := p.IpHdr.(type) {
+	case *header.IPv4Header:
+		j.IPv4 = ipHdr
+	case *header.IPv6Header:
+		j.IPv6 = ipHdr
+	}
+
+	if p.laterFragment() || p.NextHeader == nil {
+		if p.hdrLen < len(data) {
+			j.Payload = data[p.hdrLen:]
+		}
+		return json.Marshal(j)
+	}
+
+	switch hdr := p.NextHeader.(type) {
+	case *header.TCPHeader:
+		j.TCP = hdr
+	case *header.UDPHeader:
+		j.UDP = hdr
+	case *header.ICMPv4Header:
+		j.ICMPv4 = hdr
+	case *header.ICMPv6Header:
+		j.ICMPv6 = hdr
+	}
+	j.Payload = p.Payload()
+
+	return json.Marshal(j)
+}
+
+// Builds the packet from its JSON form, so that fixtures can be written by hand
+// The omitted protocol, lengths and checksums are calculated from the headers and the payload
+func (p *Packet) UnmarshalJSON(data []byte) error {
+	var j packetJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	var fields packetFieldsJSON
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	var transport []byte
+	var protocol uint8
+	var checksumSet bool
+	transports := 0
+	if j.TCP != nil {
+		transport, protocol, checksumSet = j.TCP.Raw, header.TCP, has(fields.TCP, "checksum")
+		transports++
+	}
+	if j.UDP != nil {
+		transport, protocol, checksumSet = j.UDP.Raw, header.UDP, has(fields.UDP, "checksum")
+		transports++
+	}
+	if j.ICMPv4 != nil {
+		transport, protocol, checksumSet = j.ICMPv4.Raw, header.ICMPv4, has(fields.ICMPv4, "checksum")
+		transports++
+	}
+	if j.ICMPv6 != nil {
+		transport, protocol, checksumSet = j.ICMPv6.Raw, header.ICMPv6, has(fields.ICMPv6, "checksum")
+		transports++
+	}
+	if transports > 1 {
+		return errors.New("a packet has at most one transport header")
+	}
+	hasTransport := transports == 1
+
+	var raw []byte
+	switch {
+	case j.IPv4 != nil && j.IPv6 != nil:
+		return errors.New("a packet has either an ipv4 or an ipv6 header")
+	case j.IPv4 != nil:
+		raw = append(raw, j.IPv4.Raw...)
+	case j.IPv6 != nil:
+		raw = append(raw, j.IPv6.Raw...)
+	default:
+		return errors.New("the ipv4 or ipv6 header is required")
+	}
+	hdrLen := len(raw)
+	raw = append(raw, transport...)
+	raw = append(raw, j.Payload...)
+
+	if j.IPv4 != nil {
+		if err := fillProtocol(raw, 9, "ipv4.protocol", has(fields.IPv4, "protocol"), hasTransport, protocol); err != nil {
+			return err
+		}
+		ipv4 := header.NewIPv4Header(raw)
+		if !has(fields.IPv4, "totalLen") {
+			ipv4.SetTotalLen(uint16(len(raw)))
+		}
+	} else {
+		if err := fillProtocol(raw, 6, "ipv6.nextHeader", has(fields.IPv6, "nextHeader"), hasTransport, protocol); err != nil {
+			return err
+		}
+		if !has(fields.IPv6, "payloadLen") {
+			header.NewIPv6Header(raw).SetPayloadLen(uint16(len(raw) - hdrLen))
+		}
+	}
+	if j.UDP != nil && !has(fields.UDP, "length") {
+		header.NewUDPHeader(raw[hdrLen:]).SetLen(uint16(len(raw) - hdrLen))
+	}
+
+	p.reset(raw)
+	p.Addr = nil
+	if j.Address != nil {
+		p.addr = *j.Address
+		p.Addr = &p.addr
+	}
+	if err := p.ParseHeaders(); err != nil {
+		return err
+	}
+
+	if j.IPv4 != nil && !has(fields.IPv4, "checksum") {
+		p.calcIPChecksum()
+	}
+	if hasTransport && !checksumSet {
+		p.calcTransportChecksum()
+	}
+	return nil
+}
+
+// Sets the protocol field of the IP header from the transport header when it is omitted
+func fillProtocol(raw []byte, offset int, field string, set, hasTransport bool, protocol uint8) error {
+	switch {
+	case !set && !hasTransport:
+		return fmt.Errorf("%s is required without a transport header", field)
+	case !set:
+		raw[offset] = protocol
+	case hasTransport && raw[offset] != protocol:
+		return fmt.Errorf("%s is %d but the transport header is %s", field, raw[offset], header.ProtocolName(protocol))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package godivert
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+func TestUnmarshalJSONFieldCase(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantTotalLen uint16
+		wantChecksum uint16
+	}{
+		{"calculated", `{"ipv4": {"srcIP": "10.0.0.1", "dstIP": "10.0.0.2"}, "udp": {"srcPort": 53, "dstPort": 1234}}`, 28, 0xa6cf},
+		{"set", `{"ipv4": {"totalLen": 1000, "checksum": 1, "srcIP": "10.0.0.1", "dstIP": "10.0.0.2"}, "udp": {"srcPort": 53, "dstPort": 1234}}`, 1000, 1},
+		{"set with another case", `{"IPv4": {"TotalLen": 1000, "CHECKSUM": 1, "srcIP": "10.0.0.1", "dstIP": "10.0.0.2"}, "udp": {"srcPort": 53, "dstPort": 1234}}`, 1000, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var packet Packet
+			if err := json.Unmarshal([]byte(test.data), &packet); err != nil {
+				t.Fatal(err)
+			}
+
+			ipHdr, ok := packet.IpHdr.(*header.IPv4Header)
+			if !ok {
+				t.Fatalf("IpHdr = %T, want *header.IPv4Header", packet.IpHdr)
+			}
+			if got := ipHdr.TotalLen(); got != test.wantTotalLen {
+				t.Errorf("TotalLen() = %d, want %d", got, test.wantTotalLen)
+			}
+			if got, _ := ipHdr.Checksum(); got != test.wantChecksum {
+				t.Errorf("Checksum() = %#x, want %#x", got, test.wantChecksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Package metrics counts the packets of handles and pipelines and serves the counters
+// in the Prometheus text exposition format, without external dependencies.
+//
+// The handles report their packets through HandleOptions.Observer, the pipelines
+// through their OnComplete and OnError callbacks:
+//
+//	m := metrics.New()
+//	winDivert, err := godivert.NewWinDivertHandleWithOptions("tcp", godivert.HandleOptions{
+//		Observer: m.Observer("web"),
+//	})
+//	m.WatchQueue("web", winDivert)
+//
+//	p := pipeline.New(winDivert)
+//	m.InstrumentPipeline("web", p)
+//
+//	http.Handle("/metrics", m)
+//	go http.ListenAndServe("localhost:9100", nil)
+//
+// Registry can also be used on its own to expose other counters.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/pipeline"
+)
+
+// Built-in metrics of the handles, pipelines and dispatchers
+type Metrics struct {
+	// Registry of the built-in metrics, other metrics can be added to it
+	Registry *Registry
+
+	received      *Counter
+	receivedBytes *Counter
+	recvErrors    *Counter
+	sent          *Counter
+	sentBytes     *Counter
+	sendErrors    *Counter
+	queued        *Gauge
+
+	verdicts       *Counter
+	pipelineErrors *Counter
+	processing     *Histogram
+
+	backlog *Gauge
+}
+
+// Create a new Metrics with its own Registry
+func New() *Metrics {
+	return NewWithRegistry(NewRegistry())
+}
+
+// Create a new Metrics registering the built-in metrics in registry
+func NewWithRegistry(registry *Registry) *Metrics {
+	packetLabels := []string{"handle", "protocol", "direction"}
+
+	return &Metrics{
+		Registry: registry,
+
+		received:      registry.NewCounter("godivert_packets_received_total", "Packets received by the handle.", packetLabels...),
+		receivedBytes: registry.NewCounter("godivert_received_bytes_total", "Bytes received by the handle.", packetLabels...),
+		recvErrors:    registry.NewCounter("godivert_recv_errors_total", "Failed receives by Windows error code.", "handle", "code"),
+		sent:          registry.NewCounter("godivert_packets_sent_total", "Packets sent by the handle.", packetLabels...),
+		sentBytes:     registry.NewCounter("godivert_sent_bytes_total", "Bytes sent by the handle.", packetLabels...),
+		sendErrors:    registry.NewCounter("godivert_send_errors_total", "Failed sends by Windows error code.", "handle", "code"),
+		queued:        registry.NewGauge("godivert_queue_depth", "Packets waiting for the consumer of the Packets channel.", "handle"),
+
+		verdicts:       registry.NewCounter("godivert_pipeline_verdicts_total", "Packets completed by the pipeline by verdict.", "pipeline", "verdict", "protocol", "direction"),
+		pipelineErrors: registry.NewCounter("godivert_pipeline_errors_total", "Handler failures, panics and send errors of the pipeline.", "pipeline"),
+		processing:     registry.NewHistogram("godivert_pipeline_processing_seconds", "Time from Process to the reinjection or drop of the packet.", nil, "pipeline"),
+
+		backlog: registry.NewGauge("godivert_dispatcher_backlog", "Packets waiting in the queue of the dispatcher worker.", "dispatcher", "worker"),
+	}
+}
+
+// Serves the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.Registry.ServeHTTP(w, req)
+}
+
+// Returns an Observer counting the packets of the handle called name, see HandleOptions.Observer
+func (m *Metrics) Observer(name string) godivert.Observer {
+	return &handleObserver{metrics: m, name: name}
+}
+
+// Counts the packets of a handle
+type handleObserver struct {
+	metrics *Metrics
+	name    string
+}
+
+func (o *handleObserver) ObserveRecv(packet *godivert.Packet, err error) {
+	if err != nil {
+		o.metrics.recvErrors.Inc(o.name, errorCode(err))
+		return
+	}
+
+	protocol, direction := packetLabels(packet)
+	o.metrics.received.Inc(o.name, protocol, direction)
+	o.metrics.receivedBytes.Add(float64(packet.PacketLen), o.name, protocol, direction)
+}
+
+func (o *handleObserver) ObserveSend(packet *godivert.Packet, err error) {
+	if err != nil {
+		o.metrics.sendErrors.Inc(o.name, errorCode(err))
+		return
+	}
+
+	protocol, direction := packetLabels(packet)
+	o.metrics.sent.Inc(o.name, protocol, direction)
+	o.metrics.sentBytes.Add(float64(packet.PacketLen), o.name, protocol, direction)
+}
+
+// Reports the number of packets waiting in the Packets channel of the handle when the metrics are collected
+func (m *Metrics) WatchQueue(name string, wd *godivert.WinDivertHandle) {
+	m.Registry.OnCollect(func() {
+		m.queued.Set(float64(wd.PacketsStats().Queued), name)
+	})
+}
+
+// Counts the verdicts and the processing time of the pipeline called name
+// The OnComplete and OnError callbacks already set are still called
+func (m *Metrics) InstrumentPipeline(name string, p *pipeline.Pipeline) {
+	onComplete := p.OnComplete
+	p.OnComplete = func(ctx *pipeline.Context, verdict pipeline.Verdict, elapsed time.Duration) {
+		protocol, direction := packetLabels(ctx.Packet)
+		m.verdicts.Inc(name, strings.ToLower(verdict.String()), protocol, direction)
+		m.processing.Observe(elapsed.Seconds(), name)
+
+		if onComplete != nil {
+			onComplete(ctx, verdict, elapsed)
+		}
+	}
+
+	onError := p.OnError
+	p.OnError = func(ctx *pipeline.Context, err error) {
+		m.pipelineErrors.Inc(name)
+
+		if onError != nil {
+			onError(ctx, err)
+		}
+	}
+}
+
+// Reports the backlog of each worker of the dispatcher called name when the metrics are collected
+func (m *Metrics) WatchDispatcher(name string, d *pipeline.Dispatcher) {
+	m.Registry.OnCollect(func() {
+		for i, stats := range d.Stats() {
+			m.backlog.Set(float64(stats.Backlog), name, strconv.Itoa(i))
+		}
+	})
+}
+
+// Returns the protocol and direction labels of the packet
+// Packets without IP header, such as the ones of the Flow and Socket layers, have the "none" protocol
+func packetLabels(packet *godivert.Packet) (protocol, direction string) {
+	protocol = "none"
+	raw := packet.Raw
+	if len(raw) >= 20 && raw[0]>>4 == 4 {
+		protocol = header.ProtocolName(raw[9])
+	} else if len(raw) >= 40 && raw[0]>>4 == 6 {
+		protocol = header.ProtocolName(raw[6])
+	}
+
+	direction = "unknown"
+	if packet.Addr != nil {
+		direction = strings.ToLower(packet.Addr.Direction().String())
+	}
+	return protocol, direction
+}
+
+// Returns the Windows error code of err, "other" if it isn't a system error
+func errorCode(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return strconv.FormatUint(uint64(errno), 10)
+	}
+	return "other"
+}
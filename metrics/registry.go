@@ -0,0 +1,430 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default buckets of the histograms, in seconds, from 10µs to 1s
+var DefaultBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.1, 1}
+
+// Implemented by Counter, Gauge and Histogram
+type metric interface {
+	desc() *family
+	// Writes the samples of the metric, the label values of each series are sorted
+	writeSamples(w *bufio.Writer)
+}
+
+// Name, help and label names shared by the series of a metric
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f *family) desc() *family {
+	return f
+}
+
+// Returns the key of the series with these label values
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// Holds the metrics and serves them in the Prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]metric
+	collectors []func()
+}
+
+// Create a new empty Registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Panics if the name or the labels aren't valid or if the name is already registered
+func (r *Registry) register(m metric) {
+	f := m.desc()
+	if !validName(f.name) {
+		panic(fmt.Sprintf("invalid metric name %q", f.name))
+	}
+	for _, label := range f.labels {
+		if !validName(label) || strings.Contains(label, ":") || label == "le" {
+			panic(fmt.Sprintf("invalid label name %q for metric %s", label, f.name))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[f.name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", f.name))
+	}
+	r.metrics[f.name] = m
+}
+
+// Register a function called before the metrics are written, to set gauges for example
+func (r *Registry) OnCollect(collect func()) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, collect)
+	r.mu.Unlock()
+}
+
+// Create and register a new Counter
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		family: family{name: name, help: help, kind: "counter", labels: labels},
+		series: make(map[string]*series),
+	}
+	r.register(c)
+	return c
+}
+
+// Create and register a new Gauge
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		family: family{name: name, help: help, kind: "gauge", labels: labels},
+		series: make(map[string]*series),
+	}
+	r.register(g)
+	return g
+}
+
+// Create and register a new Histogram with the upper bounds of its buckets
+// nil buckets use DefaultBuckets, the +Inf bucket is implicit
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("the buckets of metric %s aren't sorted", name))
+	}
+
+	h := &Histogram{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Writes every metric in the text exposition format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].desc().name < metrics[j].desc().name
+	})
+
+	counter := &countingWriter{w: w}
+	buffer := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		f := m.desc()
+		if f.help != "" {
+			fmt.Fprintf(buffer, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		}
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", f.name, f.kind)
+		m.writeSamples(buffer)
+	}
+	err := buffer.Flush()
+	return counter.n, err
+}
+
+// Serves the metrics, an http.Handler to register on the /metrics path for example
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	if req.Method == http.MethodHead {
+		return
+	}
+	r.WriteTo(w)
+}
+
+// Represents the value of a series and its label values
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+// Represents a value that only goes up, such as a number of packets
+type Counter struct {
+	family
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// Add 1 to the series with these label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add delta to the series with these label values, panics if delta is negative
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s can't decrease", c.name))
+	}
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	getSeries(c.series, key, labelValues).value += delta
+	c.mu.Unlock()
+}
+
+// Returns the value of the series with these label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *Counter) writeSamples(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeSeries(w, &c.family, c.series)
+}
+
+// Represents a value that goes up and down, such as a queue length
+type Gauge struct {
+	family
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// Set the series with these label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	getSeries(g.series, key, labelValues).value = value
+	g.mu.Unlock()
+}
+
+// Add delta, which can be negative, to the series with these label values
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	getSeries(g.series, key, labelValues).value += delta
+	g.mu.Unlock()
+}
+
+// Returns the value of the series with these label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := g.key(labelValues)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s, ok := g.series[key]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (g *Gauge) writeSamples(w *bufio.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeSeries(w, &g.family, g.series)
+}
+
+// Represents the observations of a histogram series
+type histogramSeries struct {
+	labelValues []string
+	// Observations per bucket, not cumulative, the last one is +Inf
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Counts observations, such as durations, in buckets
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// Add an observation to the series with these label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	bucket := sort.SearchFloat64s(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) writeSamples(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatValue(h.buckets[i])
+			}
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", le, float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// Returns the series of the key, created if needed
+func getSeries(all map[string]*series, key string, labelValues []string) *series {
+	s, ok := all[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		all[key] = s
+	}
+	return s
+}
+
+func writeSeries(w *bufio.Writer, f *family, all map[string]*series) {
+	for _, key := range sortedKeys(all) {
+		s := all[key]
+		writeSample(w, f.name, f.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// Writes a sample line, extraName and extraValue add a label such as the le label of the buckets
+//
+//	godivert_packets_received_total{handle="web",protocol="TCP"} 42
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(value))
+	w.WriteByte('\n')
+}
+
+func sortedKeys(all map[string]*series) []string {
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// Returns true if name matches [a-zA-Z_:][a-zA-Z0-9_:]*
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Counts the bytes written for WriteTo
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
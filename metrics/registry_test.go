@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	// Registered out of order, the metrics are written sorted by name
+	queue := r.NewGauge("godivert_queue_length", "")
+	packets := r.NewCounter("godivert_packets_total", "Packets received.\nBy handle \\ protocol", "handle", "protocol")
+	latency := r.NewHistogram("godivert_latency_seconds", "Latency", []float64{0.25, 1}, "handle")
+
+	packets.Add(3, "web", "TCP")
+	packets.Inc("dns", "UDP")
+	packets.Inc("a\"b\\c\n", "TCP")
+	latency.Observe(0.125, "web")
+	latency.Observe(0.5, "web")
+	latency.Observe(2, "web")
+	// The upper bounds are inclusive
+	latency.Observe(0.25, "dns")
+	r.OnCollect(func() { queue.Set(7) })
+
+	want := `# HELP godivert_latency_seconds Latency
+# TYPE godivert_latency_seconds histogram
+godivert_latency_seconds_bucket{handle="dns",le="0.25"} 1
+godivert_latency_seconds_bucket{handle="dns",le="1"} 1
+godivert_latency_seconds_bucket{handle="dns",le="+Inf"} 1
+godivert_latency_seconds_sum{handle="dns"} 0.25
+godivert_latency_seconds_count{handle="dns"} 1
+godivert_latency_seconds_bucket{handle="web",le="0.25"} 1
+godivert_latency_seconds_bucket{handle="web",le="1"} 2
+godivert_latency_seconds_bucket{handle="web",le="+Inf"} 3
+godivert_latency_seconds_sum{handle="web"} 2.625
+godivert_latency_seconds_count{handle="web"} 3
+# HELP godivert_packets_total Packets received.\nBy handle \\ protocol
+# TYPE godivert_packets_total counter
+godivert_packets_total{handle="a\"b\\c\n",protocol="TCP"} 1
+godivert_packets_total{handle="dns",protocol="UDP"} 1
+godivert_packets_total{handle="web",protocol="TCP"} 3
+# TYPE godivert_queue_length gauge
+godivert_queue_length 7
+`
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("WriteTo() wrote\n%s\nwant\n%s", got, want)
+	}
+	if n != int64(b.Len()) {
+		t.Errorf("WriteTo() = %d, want %d bytes", n, b.Len())
+	}
+}
@@ -1,6 +1,7 @@
 package godivert
 
 import (
+	"errors"
 	"fmt"
 	"github.com/williamfhe/godivert/header"
 	"net"
@@ -19,51 +20,114 @@ type Packet struct {
 	hdrLen         int
 	nextHeaderType uint8
 
-	parsed bool
+	parsed   bool
+	parseErr error
+
+	// Headers and address decoded in place, IpHdr, NextHeader and Addr point to them
+	ipv4   header.IPv4Header
+	ipv6   header.IPv6Header
+	tcp    header.TCPHeader
+	udp    header.UDPHeader
+	icmpv4 header.ICMPv4Header
+	icmpv6 header.ICMPv6Header
+	addr   WinDivertAddress
+
+	// Whole buffer and pool of the packets taken from a BufferPool
+	buffer []byte
+	pool   *BufferPool
 }
 
 // Parse the packet's headers
-func (p *Packet) ParseHeaders() {
-	p.ipVersion = int(p.Raw[0] >> 4)
-	if p.ipVersion == 4 {
-		p.hdrLen = int((p.Raw[0] & 0xf) << 2)
-		p.nextHeaderType = p.Raw[9]
-		p.IpHdr = header.NewIPv4Header(p.Raw)
-	} else {
-		p.hdrLen = 40
-		p.nextHeaderType = p.Raw[6]
-		p.IpHdr = header.NewIPv6Header(p.Raw)
+// The headers are decoded in place and parsing again doesn't allocate
+// Returns an error if a header is truncated or invalid: IpHdr and NextHeader are nil if the IP header is,
+// NextHeader is nil if the transport header is
+func (p *Packet) ParseHeaders() error {
+	p.IpHdr = nil
+	p.NextHeader = nil
+	p.hdrLen = 0
+	p.nextHeaderType = 0
+	p.parseErr = p.parseHeaders()
+	p.parsed = true
+	return p.parseErr
+}
+
+func (p *Packet) parseHeaders() error {
+	raw := p.data()
+	if len(raw) == 0 {
+		return errors.New("empty packet")
 	}
 
+	p.ipVersion = int(raw[0] >> 4)
+	switch p.ipVersion {
+	case 4:
+		hdrLen := int(raw[0]&0xf) << 2
+		if hdrLen < header.IPv4HeaderLen {
+			return fmt.Errorf("invalid IPv4 header length %d", hdrLen)
+		}
+		if len(raw) < hdrLen {
+			return fmt.Errorf("truncated IPv4 header, %d bytes instead of %d", len(raw), hdrLen)
+		}
+		p.hdrLen = hdrLen
+		p.nextHeaderType = raw[9]
+		p.ipv4.Reset(raw)
+		p.IpHdr = &p.ipv4
+	case 6:
+		if len(raw) < header.IPv6HeaderLen {
+			return fmt.Errorf("truncated IPv6 header, %d bytes instead of %d", len(raw), header.IPv6HeaderLen)
+		}
+		p.hdrLen = header.IPv6HeaderLen
+		p.nextHeaderType = raw[6]
+		p.ipv6.Reset(raw)
+		p.IpHdr = &p.ipv6
+	default:
+		return fmt.Errorf("unknown IP version %d", p.ipVersion)
+	}
+
+	if p.laterFragment() {
+		// Only the first fragment carries the transport header
+		return nil
+	}
+
+	segment := raw[p.hdrLen:]
+	hdrLen := 0
 	switch p.nextHeaderType {
 	case header.ICMPv4:
-		p.NextHeader = header.NewICMPv4Header(p.Raw[p.hdrLen : p.hdrLen+header.ICMPv4HeaderLen])
+		hdrLen = header.ICMPv4HeaderLen
 	case header.TCP:
-		p.NextHeader = header.NewTCPHeader(p.Raw[p.hdrLen:])
+		hdrLen = header.TCPHeaderLen
+		if len(segment) >= hdrLen {
+			hdrLen = int(segment[12]>>4) * 4
+			if hdrLen < header.TCPHeaderLen {
+				return fmt.Errorf("invalid TCP header length %d", hdrLen)
+			}
+		}
 	case header.UDP:
-		p.NextHeader = header.NewUDPHeader(p.Raw[p.hdrLen : p.hdrLen+header.UDPHeaderLen])
+		hdrLen = header.UDPHeaderLen
 	case header.ICMPv6:
-		p.NextHeader = header.NewICMPv6Header(p.Raw[p.hdrLen : p.hdrLen+header.ICMPv6HeaderLen])
+		hdrLen = header.ICMPv6HeaderLen
 	default:
 		// Protocol not implemented
-		p.NextHeader = nil
+		return nil
+	}
+	if len(segment) < hdrLen {
+		return fmt.Errorf("truncated %s header, %d bytes instead of %d", header.ProtocolName(p.nextHeaderType), len(segment), hdrLen)
 	}
 
-	p.parsed = true
-}
-
-func (p *Packet) String() string {
-	p.VerifyParsed()
-
-	nextHeaderType := p.NextHeaderType()
-	return fmt.Sprintf("Packet {\n"+
-		"\tIPHeader=%v\n"+
-		"\tNextHeaderType=(%d)->%s\n"+
-		"\tNextHeader: %v\n"+
-		"\tWinDivertAddr=%v\n"+
-		"\tRawData=%v\n"+
-		"}",
-		p.IpHdr, nextHeaderType, header.ProtocolName(nextHeaderType), p.NextHeader, p.Addr, p.Raw)
+	switch p.nextHeaderType {
+	case header.ICMPv4:
+		p.icmpv4.Reset(segment[:hdrLen])
+		p.NextHeader = &p.icmpv4
+	case header.TCP:
+		p.tcp.Reset(segment)
+		p.NextHeader = &p.tcp
+	case header.UDP:
+		p.udp.Reset(segment[:hdrLen])
+		p.NextHeader = &p.udp
+	case header.ICMPv6:
+		p.icmpv6.Reset(segment[:hdrLen])
+		p.NextHeader = &p.icmpv6
+	}
+	return nil
 }
 
 // Returns the version of the IP protocol
@@ -80,36 +144,46 @@ func (p *Packet) NextHeaderType() uint8 {
 	return p.nextHeaderType
 }
 
-// Returns the source IP of the packet
+// Returns the source IP of the packet, nil without valid IP header
 // Shortcut for IpHdr.SrcIP()
 func (p *Packet) SrcIP() net.IP {
 	p.VerifyParsed()
 
+	if p.IpHdr == nil {
+		return nil
+	}
 	return p.IpHdr.SrcIP()
 }
 
-// Sets the source IP of the packet
+// Sets the source IP of the packet, does nothing without valid IP header
 // Shortcut for IpHdr.SetSrcIP()
 func (p *Packet) SetSrcIP(ip net.IP) {
 	p.VerifyParsed()
 
-	p.IpHdr.SetSrcIP(ip)
+	if p.IpHdr != nil {
+		p.IpHdr.SetSrcIP(ip)
+	}
 }
 
-// Returns the destination IP of the packet
+// Returns the destination IP of the packet, nil without valid IP header
 // Shortcut for IpHdr.DstIP()
 func (p *Packet) DstIP() net.IP {
 	p.VerifyParsed()
 
+	if p.IpHdr == nil {
+		return nil
+	}
 	return p.IpHdr.DstIP()
 }
 
-// Sets the destination IP of the packet
+// Sets the destination IP of the packet, does nothing without valid IP header
 // Shortcut for IpHdr.SetDstIP()
 func (p *Packet) SetDstIP(ip net.IP) {
 	p.VerifyParsed()
 
-	p.IpHdr.SetDstIP(ip)
+	if p.IpHdr != nil {
+		p.IpHdr.SetDstIP(ip)
+	}
 }
 
 // Returns the source port of the packet
@@ -169,12 +243,27 @@ func (p *Packet) NextHeaderProtocolName() string {
 // Inject the packet on the Network Stack
 // If the packet has been modified calls WinDivertHelperCalcChecksum to get a new checksum
 func (p *Packet) Send(wd *WinDivertHandle) (uint, error) {
-	if p.parsed && (p.IpHdr.NeedNewChecksum() || p.NextHeader != nil && p.NextHeader.NeedNewChecksum()) {
+	if p.needNewChecksum() {
 		wd.HelperCalcChecksum(p)
 	}
 	return wd.Send(p)
 }
 
+// Returns true if the headers have been parsed and modified
+func (p *Packet) needNewChecksum() bool {
+	return p.parsed && p.IpHdr != nil && (p.IpHdr.NeedNewChecksum() || p.NextHeader != nil && p.NextHeader.NeedNewChecksum())
+}
+
+// Reuse the packet for new raw data, the headers are parsed again when needed
+func (p *Packet) reset(raw []byte) {
+	p.Raw = raw
+	p.PacketLen = uint(len(raw))
+	p.IpHdr = nil
+	p.NextHeader = nil
+	p.parsed = false
+	p.parseErr = nil
+}
+
 // Recalculate the packet's checksum
 // Shortcut for WinDivertHelperCalcChecksum
 func (p *Packet) CalcNewChecksum(wd *WinDivertHandle) {
@@ -182,10 +271,12 @@ func (p *Packet) CalcNewChecksum(wd *WinDivertHandle) {
 }
 
 // Check if the headers have already been parsed and call ParseHeaders() if not
-func (p *Packet) VerifyParsed() {
+// Returns the error of ParseHeaders
+func (p *Packet) VerifyParsed() error {
 	if !p.parsed {
-		p.ParseHeaders()
+		return p.ParseHeaders()
 	}
+	return p.parseErr
 }
 
 // Returns the Direction of the packet
@@ -196,6 +287,25 @@ func (p *Packet) Direction() Direction {
 	return p.Addr.Direction()
 }
 
+// Returns a deep copy of the packet
+// The headers of the copy are parsed again when needed and the copy doesn't belong to a BufferPool
+func (p *Packet) Clone() *Packet {
+	raw := make([]byte, len(p.Raw))
+	copy(raw, p.Raw)
+
+	var addr *WinDivertAddress
+	if p.Addr != nil {
+		addrCopy := *p.Addr
+		addr = &addrCopy
+	}
+
+	return &Packet{
+		Raw:       raw,
+		Addr:      addr,
+		PacketLen: p.PacketLen,
+	}
+}
+
 // Check the packet with the filter
 // Returns true if the packet matches the filter
 func (p *Packet) EvalFilter(filter string) (bool, error) {
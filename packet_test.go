@@ -0,0 +1,72 @@
+package godivert
+
+import (
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+func TestParseHeaders(t *testing.T) {
+	syn := testpacket.SYN()
+
+	udp6 := make([]byte, header.IPv6HeaderLen+header.UDPHeaderLen)
+	udp6[0] = 0x60
+	udp6[6] = header.UDP
+
+	fragment := append([]byte(nil), syn[:24]...)
+	fragment[7] = 1
+
+	badTCPOffset := append([]byte(nil), syn...)
+	badTCPOffset[32] = 0x40
+
+	tests := []struct {
+		name       string
+		raw        []byte
+		wantErr    bool
+		wantIP     bool
+		wantNext   bool
+		wantHdrLen int
+	}{
+		{"tcp with options", syn, false, true, true, 40},
+		{"udp over ipv6", udp6, false, true, true, header.UDPHeaderLen},
+		{"empty", nil, true, false, false, 0},
+		{"not ip", []byte{0x00, 0x01, 0x02}, true, false, false, 0},
+		{"truncated ipv4 header", syn[:16], true, false, false, 0},
+		{"ipv4 header length below 20", append([]byte{0x44}, syn[1:]...), true, false, false, 0},
+		{"truncated ipv6 header", udp6[:30], true, false, false, 0},
+		{"tcp header of 4 bytes", syn[:24], true, true, false, 0},
+		{"tcp options cut", syn[:50], true, true, false, 0},
+		{"tcp data offset below 5", badTCPOffset, true, true, false, 0},
+		{"truncated udp header", udp6[:44], true, true, false, 0},
+		{"later fragment", fragment, false, true, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Packet{Raw: test.raw, PacketLen: uint(len(test.raw))}
+			err := p.ParseHeaders()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseHeaders() error = %v, want error %t", err, test.wantErr)
+			}
+			if (p.IpHdr != nil) != test.wantIP {
+				t.Errorf("IpHdr = %v, want set %t", p.IpHdr, test.wantIP)
+			}
+			if (p.NextHeader != nil) != test.wantNext {
+				t.Errorf("NextHeader = %v, want set %t", p.NextHeader, test.wantNext)
+			}
+			if test.wantNext && p.NextHeader.HeaderLen() != test.wantHdrLen {
+				t.Errorf("NextHeader.HeaderLen() = %d, want %d", p.NextHeader.HeaderLen(), test.wantHdrLen)
+			}
+			if verifyErr := p.VerifyParsed(); verifyErr != err {
+				t.Errorf("VerifyParsed() = %v, want %v", verifyErr, err)
+			}
+
+			// None of the accessors may panic on a malformed packet
+			p.FlowKey()
+			p.Payload()
+			p.SrcPort()
+			_ = p.String()
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package godivert
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Represents what happens to a received packet when the consumer of the Packets channel falls behind
+type OverflowPolicy int
+
+const (
+	// Wait for the consumer, the diverted traffic stalls while the queue is full
+	OverflowBlock OverflowPolicy = iota
+	// Drop the packet just received
+	OverflowDropNewest
+	// Drop the oldest queued packet to make room for the packet just received
+	OverflowDropOldest
+	// Reinject the packet just received unmodified without giving it to the consumer
+	OverflowFailOpen
+)
+
+func (o OverflowPolicy) String() string {
+	switch o {
+	case OverflowBlock:
+		return "Block"
+	case OverflowDropNewest:
+		return "DropNewest"
+	case OverflowDropOldest:
+		return "DropOldest"
+	case OverflowFailOpen:
+		return "FailOpen"
+	default:
+		return "Unknown OverflowPolicy"
+	}
+}
+
+// Represents the options of PacketsWithOptions
+// The zero value queues PacketChanCapacity packets and blocks when the queue is full
+type PacketsOptions struct {
+	// Maximum number of packets waiting for the consumer, PacketChanCapacity if 0
+	Capacity int
+	Overflow OverflowPolicy
+	// Packets waiting for the consumer longer than Deadline are reinjected unmodified
+	// The watchdog only covers the packets not delivered yet, the ones taken from the channel belong to the consumer
+	// 0 disables the watchdog
+	Deadline time.Duration
+}
+
+func (o *PacketsOptions) validate() error {
+	if o.Capacity < 0 {
+		return errors.New("the capacity can't be negative")
+	}
+	if o.Overflow < OverflowBlock || o.Overflow > OverflowFailOpen {
+		return errors.New("unknown overflow policy")
+	}
+	if o.Deadline < 0 {
+		return errors.New("the deadline can't be negative")
+	}
+	return nil
+}
+
+// Counters of the packets going through the Packets channel
+type PacketsStats struct {
+	// Packets waiting for the consumer
+	Queued    int
+	Received  uint64
+	Delivered uint64
+	// Dropped by the DropNewest and DropOldest policies
+	Dropped uint64
+	// Reinjected by the FailOpen policy
+	FailedOpen uint64
+	// Reinjected by the watchdog or when the context is done
+	Expired    uint64
+	SendErrors uint64
+}
+
+// Represents a packet waiting for the consumer
+type queuedPacket struct {
+	packet *Packet
+	at     time.Time
+}
+
+// Holds the packets between recvLoop and the consumer of the channel
+type packetQueue struct {
+	// Reinjects the packets not given to the consumer, nil when they are only released
+	sender   Sender
+	capacity int
+	overflow OverflowPolicy
+	deadline time.Duration
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []queuedPacket
+	closed bool
+	stats  PacketsStats
+}
+
+// Sniffed packets have already been accepted, sender is nil for them
+func newPacketQueue(sender Sender, options PacketsOptions) *packetQueue {
+	capacity := options.Capacity
+	if capacity == 0 {
+		capacity = PacketChanCapacity
+	}
+
+	q := &packetQueue{
+		sender:   sender,
+		capacity: capacity,
+		overflow: options.Overflow,
+		deadline: options.Deadline,
+		items:    make([]queuedPacket, 0, capacity),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Queue the packet according to the overflow policy
+// Returns false if ctx is done while waiting for room
+func (q *packetQueue) push(ctx context.Context, packet *Packet) bool {
+	q.mu.Lock()
+	q.stats.Received++
+
+	if len(q.items) >= q.capacity {
+		switch q.overflow {
+		case OverflowDropNewest:
+			q.stats.Dropped++
+			q.mu.Unlock()
+			packet.Release()
+			return true
+		case OverflowDropOldest:
+			oldest := q.pop()
+			q.stats.Dropped++
+			defer oldest.packet.Release()
+		case OverflowFailOpen:
+			q.stats.FailedOpen++
+			q.mu.Unlock()
+			q.reinject(packet)
+			return true
+		default:
+			stop := q.wakeOnDone(ctx)
+			for len(q.items) >= q.capacity && ctx.Err() == nil {
+				q.cond.Wait()
+			}
+			close(stop)
+
+			if ctx.Err() != nil {
+				q.stats.Expired++
+				q.mu.Unlock()
+				q.reinject(packet)
+				return false
+			}
+		}
+	}
+
+	q.items = append(q.items, queuedPacket{packet: packet, at: time.Now()})
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	return true
+}
+
+// Wakes up the waiters of cond when ctx is done, until stop is closed
+func (q *packetQueue) wakeOnDone(ctx context.Context) chan struct{} {
+	stop := make(chan struct{})
+	if ctx.Done() == nil {
+		return stop
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+// Removes the oldest packet, must be called with q.mu held and a non empty queue
+func (q *packetQueue) pop() queuedPacket {
+	item := q.items[0]
+	q.items[0] = queuedPacket{}
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+	return item
+}
+
+// Stop queuing packets, the queued ones are still forwarded
+func (q *packetQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Sends the packet back on the Network Stack as it was received
+func (q *packetQueue) reinject(packet *Packet) {
+	if q.sender == nil {
+		packet.Release()
+		return
+	}
+
+	_, err := q.sender.Send(packet)
+	packet.Release()
+
+	if err != nil {
+		q.mu.Lock()
+		q.stats.SendErrors++
+		q.mu.Unlock()
+	}
+}
+
+// Gives the queued packets to the consumer until the queue is closed and empty
+// Packets waiting longer than the deadline, or still queued when ctx is done, are reinjected
+// recvLoop closes the queue when ctx is done
+func (q *packetQueue) forward(ctx context.Context, packetChan chan<- *Packet) {
+	defer close(packetChan)
+
+	var timer *time.Timer
+	if q.deadline > 0 {
+		timer = time.NewTimer(q.deadline)
+		defer timer.Stop()
+	}
+
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		item := q.pop()
+		q.mu.Unlock()
+
+		if ctx.Err() != nil {
+			q.expire(item.packet)
+			continue
+		}
+
+		var expired <-chan time.Time
+		if timer != nil {
+			wait := time.Until(item.at.Add(q.deadline))
+			if wait <= 0 {
+				q.expire(item.packet)
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			expired = timer.C
+		}
+
+		select {
+		case packetChan <- item.packet:
+			q.mu.Lock()
+			q.stats.Delivered++
+			q.mu.Unlock()
+		case <-expired:
+			q.expire(item.packet)
+		case <-ctx.Done():
+			q.expire(item.packet)
+		}
+	}
+}
+
+func (q *packetQueue) expire(packet *Packet) {
+	q.mu.Lock()
+	q.stats.Expired++
+	q.mu.Unlock()
+
+	q.reinject(packet)
+}
+
+// Returns a copy of the counters
+func (q *packetQueue) Stats() PacketsStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := q.stats
+	stats.Queued = len(q.items)
+	return stats
+}
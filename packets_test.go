@@ -0,0 +1,240 @@
+package godivert
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the packets reinjected by a packetQueue
+type stubSender struct {
+	mu   sync.Mutex
+	sent []*Packet
+}
+
+func (s *stubSender) Send(packet *Packet) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, packet)
+	return packet.PacketLen, nil
+}
+
+func (s *stubSender) packets() []*Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Packet(nil), s.sent...)
+}
+
+// Returns n packets of a pool, so that released packets can be told apart
+func pooledPackets(n int) []*Packet {
+	pool := NewBufferPool(0)
+	packets := make([]*Packet, n)
+	for i := range packets {
+		packets[i] = pool.Get()
+	}
+	return packets
+}
+
+func released(packet *Packet) bool {
+	return packet.pool == nil
+}
+
+// Pushes the packets like recvLoop does with the packets it receives
+func fill(ctx context.Context, q *packetQueue, packets []*Packet) {
+	for _, packet := range packets {
+		if !q.push(ctx, packet) {
+			return
+		}
+	}
+}
+
+// Returns the packets given to the consumer until the channel is closed
+func consume(packetChan <-chan *Packet) []*Packet {
+	var delivered []*Packet
+	for packet := range packetChan {
+		delivered = append(delivered, packet)
+	}
+	return delivered
+}
+
+func samePackets(got, want []*Packet) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPacketQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name         string
+		overflow     OverflowPolicy
+		wantDeliver  []int
+		wantDropped  []int
+		wantReinject []int
+		wantStats    PacketsStats
+	}{
+		{"drop newest", OverflowDropNewest, []int{0, 1}, []int{2, 3}, nil,
+			PacketsStats{Received: 4, Delivered: 2, Dropped: 2}},
+		{"drop oldest", OverflowDropOldest, []int{2, 3}, []int{0, 1}, nil,
+			PacketsStats{Received: 4, Delivered: 2, Dropped: 2}},
+		{"fail open", OverflowFailOpen, []int{0, 1}, nil, []int{2, 3},
+			PacketsStats{Received: 4, Delivered: 2, FailedOpen: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := &stubSender{}
+			q := newPacketQueue(sender, PacketsOptions{Capacity: 2, Overflow: test.overflow})
+			packets := pooledPackets(4)
+
+			// The consumer only starts once the queue is full
+			fill(context.Background(), q, packets)
+			q.close()
+			packetChan := make(chan *Packet)
+			go q.forward(context.Background(), packetChan)
+			delivered := consume(packetChan)
+
+			var wantDeliver, wantReinject []*Packet
+			for _, i := range test.wantDeliver {
+				wantDeliver = append(wantDeliver, packets[i])
+			}
+			for _, i := range test.wantReinject {
+				wantReinject = append(wantReinject, packets[i])
+			}
+			if !samePackets(delivered, wantDeliver) {
+				t.Errorf("delivered %v, want packets %v", delivered, test.wantDeliver)
+			}
+			if !samePackets(sender.packets(), wantReinject) {
+				t.Errorf("reinjected %v, want packets %v", sender.packets(), test.wantReinject)
+			}
+			for _, i := range test.wantDropped {
+				if !released(packets[i]) {
+					t.Errorf("dropped packet %d isn't released", i)
+				}
+			}
+			for _, packet := range delivered {
+				if released(packet) {
+					t.Error("delivered packet released")
+				}
+			}
+			if got := q.Stats(); got != test.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", got, test.wantStats)
+			}
+		})
+	}
+}
+
+func TestPacketQueueBlock(t *testing.T) {
+	sender := &stubSender{}
+	q := newPacketQueue(sender, PacketsOptions{Capacity: 1})
+	packets := pooledPackets(3)
+
+	filled := make(chan struct{})
+	go func() {
+		fill(context.Background(), q, packets)
+		q.close()
+		close(filled)
+	}()
+
+	// The source waits for room instead of dropping the second packet
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-filled:
+		t.Fatal("the source didn't wait for the consumer")
+	default:
+	}
+	if stats := q.Stats(); stats.Queued != 1 || stats.Received != 2 {
+		t.Errorf("Stats() = %+v, want 1 queued and 2 received", stats)
+	}
+
+	packetChan := make(chan *Packet)
+	go q.forward(context.Background(), packetChan)
+	if delivered := consume(packetChan); !samePackets(delivered, packets) {
+		t.Errorf("delivered %v, want %v", delivered, packets)
+	}
+	<-filled
+
+	want := PacketsStats{Received: 3, Delivered: 3}
+	if got := q.Stats(); got != want || len(sender.packets()) != 0 {
+		t.Errorf("Stats() = %+v with %d reinjected, want %+v", got, len(sender.packets()), want)
+	}
+}
+
+func TestPacketQueueBlockCancel(t *testing.T) {
+	sender := &stubSender{}
+	q := newPacketQueue(sender, PacketsOptions{Capacity: 1})
+	packets := pooledPackets(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	filled := make(chan struct{})
+	go func() {
+		fill(ctx, q, packets)
+		close(filled)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-filled
+
+	// The packet waiting for room is reinjected, the queued one is still waiting for the consumer
+	if sent := sender.packets(); !samePackets(sent, packets[1:]) {
+		t.Errorf("reinjected %v, want %v", sent, packets[1:])
+	}
+	if stats := q.Stats(); stats.Expired != 1 || stats.Queued != 1 {
+		t.Errorf("Stats() = %+v, want 1 expired and 1 queued", stats)
+	}
+}
+
+func TestPacketQueueWatchdog(t *testing.T) {
+	sender := &stubSender{}
+	q := newPacketQueue(sender, PacketsOptions{Deadline: 20 * time.Millisecond})
+	packets := pooledPackets(3)
+
+	packetChan := make(chan *Packet)
+	go q.forward(context.Background(), packetChan)
+
+	// A delivered packet belongs to the consumer, the watchdog ignores it
+	fill(context.Background(), q, packets[:1])
+	if got := <-packetChan; got != packets[0] {
+		t.Fatalf("delivered %v, want %v", got, packets[0])
+	}
+
+	// The packets the consumer doesn't take in time are reinjected
+	fill(context.Background(), q, packets[1:])
+	time.Sleep(100 * time.Millisecond)
+	q.close()
+	if delivered := consume(packetChan); len(delivered) != 0 {
+		t.Errorf("delivered %v after the deadline", delivered)
+	}
+
+	if sent := sender.packets(); !samePackets(sent, packets[1:]) {
+		t.Errorf("reinjected %v, want %v", sent, packets[1:])
+	}
+	if released(packets[0]) || !released(packets[1]) || !released(packets[2]) {
+		t.Error("only the reinjected packets must be released")
+	}
+	want := PacketsStats{Received: 3, Delivered: 1, Expired: 2}
+	if got := q.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPacketQueueSniffed(t *testing.T) {
+	// Without sender, the packets that would be reinjected are only released
+	q := newPacketQueue(nil, PacketsOptions{Capacity: 1, Overflow: OverflowFailOpen})
+	packets := pooledPackets(2)
+
+	fill(context.Background(), q, packets)
+	if !released(packets[1]) || released(packets[0]) {
+		t.Error("only the packet failed open must be released")
+	}
+	if stats := q.Stats(); stats.FailedOpen != 1 || stats.SendErrors != 0 {
+		t.Errorf("Stats() = %+v, want 1 failed open", stats)
+	}
+}
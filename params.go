@@ -0,0 +1,220 @@
+package godivert
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Represents a WinDivert handle parameter
+// See https://reqrypt.org/windivert-doc.html#divert_set_param
+type Param int
+
+const (
+	// Maximum number of packets in the packet queue
+	WinDivertParamQueueLen Param = iota
+	// Maximum time in milliseconds a packet can stay in the packet queue
+	WinDivertParamQueueTime
+	// Maximum number of bytes in the packet queue
+	WinDivertParamQueueSize
+	// Major version of the driver (2.x, read only)
+	WinDivertParamVersionMajor
+	// Minor version of the driver (2.x, read only)
+	WinDivertParamVersionMinor
+)
+
+// Represents the range of values accepted by a parameter
+type paramRange struct {
+	min, def, max uint64
+}
+
+var paramRangesV1 = map[Param]paramRange{
+	WinDivertParamQueueLen:  {min: 1, def: 512, max: 8192},
+	WinDivertParamQueueTime: {min: 128, def: 512, max: 2048},
+	WinDivertParamQueueSize: {min: 65535, def: 4194304, max: 33554432},
+}
+
+var paramRangesV2 = map[Param]paramRange{
+	WinDivertParamQueueLen:  {min: 32, def: 4096, max: 16384},
+	WinDivertParamQueueTime: {min: 100, def: 2000, max: 16000},
+	WinDivertParamQueueSize: {min: 65535, def: 4194304, max: 33554432},
+}
+
+func (p Param) String() string {
+	switch p {
+	case WinDivertParamQueueLen:
+		return "QueueLen"
+	case WinDivertParamQueueTime:
+		return "QueueTime"
+	case WinDivertParamQueueSize:
+		return "QueueSize"
+	case WinDivertParamVersionMajor:
+		return "VersionMajor"
+	case WinDivertParamVersionMinor:
+		return "VersionMinor"
+	default:
+		return "Unknown Param"
+	}
+}
+
+// Returns the minimum, default and maximum values of a writable parameter for this ABI
+func (v ABIVersion) ParamRange(param Param) (min, def, max uint64, err error) {
+	ranges := paramRangesV2
+	if v == ABIVersion1 {
+		ranges = paramRangesV1
+	}
+
+	r, ok := ranges[param]
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("the %v parameter can't be set", param)
+	}
+	return r.min, r.def, r.max, nil
+}
+
+// Returns an error if the value isn't accepted by the parameter for this ABI
+func (v ABIVersion) CheckParam(param Param, value uint64) error {
+	min, _, max, err := v.ParamRange(param)
+	if err != nil {
+		return err
+	}
+
+	if value < min || value > max {
+		return fmt.Errorf("the %v parameter must be between %d and %d, got %d", param, min, max, value)
+	}
+	return nil
+}
+
+// Sets a parameter of the handle after checking its value
+// https://reqrypt.org/windivert-doc.html#divert_set_param
+func (wd *WinDivertHandle) SetParam(param Param, value uint64) error {
+	if err := wd.abi.CheckParam(param, value); err != nil {
+		return err
+	}
+
+	return divertSetParam(wd.handle, param, value)
+}
+
+// Returns a parameter of the handle
+// https://reqrypt.org/windivert-doc.html#divert_get_param
+func (wd *WinDivertHandle) GetParam(param Param) (uint64, error) {
+	if wd.abi == ABIVersion1 && param > WinDivertParamQueueSize {
+		return 0, fmt.Errorf("the %v parameter requires WinDivert 2.x", param)
+	}
+
+	return divertGetParam(wd.handle, param)
+}
+
+// Returns the maximum number of packets in the packet queue
+func (wd *WinDivertHandle) QueueLen() (uint64, error) {
+	return wd.GetParam(WinDivertParamQueueLen)
+}
+
+// Sets the maximum number of packets in the packet queue
+func (wd *WinDivertHandle) SetQueueLen(length uint64) error {
+	return wd.SetParam(WinDivertParamQueueLen, length)
+}
+
+// Returns the maximum time a packet can stay in the packet queue before being dropped
+func (wd *WinDivertHandle) QueueTime() (time.Duration, error) {
+	ms, err := wd.GetParam(WinDivertParamQueueTime)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// Sets the maximum time a packet can stay in the packet queue before being dropped
+// The duration is rounded down to the millisecond
+func (wd *WinDivertHandle) SetQueueTime(d time.Duration) error {
+	if d < 0 {
+		return errors.New("the queue time can't be negative")
+	}
+	return wd.SetParam(WinDivertParamQueueTime, uint64(d/time.Millisecond))
+}
+
+// Returns the maximum number of bytes in the packet queue
+func (wd *WinDivertHandle) QueueSize() (uint64, error) {
+	return wd.GetParam(WinDivertParamQueueSize)
+}
+
+// Sets the maximum number of bytes in the packet queue
+func (wd *WinDivertHandle) SetQueueSize(size uint64) error {
+	return wd.SetParam(WinDivertParamQueueSize, size)
+}
+
+// Returns the version of the driver (WinDivert 2.x only)
+func (wd *WinDivertHandle) Version() (major, minor int, err error) {
+	majorValue, err := wd.GetParam(WinDivertParamVersionMajor)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	minorValue, err := wd.GetParam(WinDivertParamVersionMinor)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(majorValue), int(minorValue), nil
+}
+
+// Represents the options of a new WinDivertHandle
+// The zero value opens a Network layer handle with the default priority, flags and parameters
+type HandleOptions struct {
+	Layer    Layer
+	Priority int16
+	Flags    Flags
+
+	// Zero values keep the default value of the driver
+	QueueLen  uint64
+	QueueTime time.Duration
+	QueueSize uint64
+
+	// Pool of the received packets, they have to be given back with Packet.Release
+	// Without pool every packet is allocated
+	BufferPool *BufferPool
+	// Notified of every packet received and sent with the handle
+	Observer Observer
+}
+
+// Returns an error if the options aren't valid for the ABI
+func (o *HandleOptions) validate(abi ABIVersion) error {
+	if !abi.SupportsLayer(o.Layer) {
+		return fmt.Errorf("the %v layer isn't supported by WinDivert %d.x", o.Layer, abi)
+	}
+
+	if err := abi.CheckFlags(o.Flags, o.Layer); err != nil {
+		return err
+	}
+
+	lowest, highest := abi.PriorityRange()
+	if int(o.Priority) < lowest || int(o.Priority) > highest {
+		return fmt.Errorf("the priority must be between %d and %d", lowest, highest)
+	}
+
+	for _, param := range o.params() {
+		if err := abi.CheckParam(param.param, param.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Represents a parameter to set after opening a handle
+type paramValue struct {
+	param Param
+	value uint64
+}
+
+// Returns the parameters to set after opening the handle
+func (o *HandleOptions) params() []paramValue {
+	var params []paramValue
+
+	add := func(param Param, value uint64) {
+		if value != 0 {
+			params = append(params, paramValue{param, value})
+		}
+	}
+	add(WinDivertParamQueueLen, o.QueueLen)
+	add(WinDivertParamQueueTime, uint64(o.QueueTime/time.Millisecond))
+	add(WinDivertParamQueueSize, o.QueueSize)
+
+	return params
+}
@@ -0,0 +1,66 @@
+package godivert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		abi     ABIVersion
+		param   Param
+		value   uint64
+		wantErr bool
+	}{
+		{"1.x queue length minimum", ABIVersion1, WinDivertParamQueueLen, 1, false},
+		{"1.x queue length maximum", ABIVersion1, WinDivertParamQueueLen, 8192, false},
+		{"1.x queue length over maximum", ABIVersion1, WinDivertParamQueueLen, 8193, true},
+		{"1.x queue time under minimum", ABIVersion1, WinDivertParamQueueTime, 127, true},
+		{"1.x queue time over maximum", ABIVersion1, WinDivertParamQueueTime, 2049, true},
+		{"2.x queue length under minimum", ABIVersion2, WinDivertParamQueueLen, 31, true},
+		{"2.x queue length maximum", ABIVersion2, WinDivertParamQueueLen, 16384, false},
+		{"2.x queue time maximum", ABIVersion2, WinDivertParamQueueTime, 16000, false},
+		{"2.x queue time over maximum", ABIVersion2, WinDivertParamQueueTime, 16001, true},
+		{"queue size under minimum", ABIVersion2, WinDivertParamQueueSize, 65534, true},
+		{"queue size over maximum", ABIVersion2, WinDivertParamQueueSize, 33554433, true},
+		{"read only", ABIVersion2, WinDivertParamVersionMajor, 2, true},
+		{"unknown", ABIVersion2, Param(42), 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.abi.CheckParam(test.param, test.value)
+			if (err != nil) != test.wantErr {
+				t.Errorf("CheckParam(%v, %d) = %v, want error %v", test.param, test.value, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		abi     ABIVersion
+		options HandleOptions
+		wantErr bool
+	}{
+		{"zero value", ABIVersion2, HandleOptions{}, false},
+		{"parameters", ABIVersion2, HandleOptions{QueueLen: 8192, QueueTime: 4 * time.Second, QueueSize: 1 << 24}, false},
+		{"queue time rounded down under minimum", ABIVersion2, HandleOptions{QueueTime: 99900 * time.Microsecond}, true},
+		{"queue length over 1.x maximum", ABIVersion1, HandleOptions{QueueLen: 16384}, true},
+		{"queue size over maximum", ABIVersion2, HandleOptions{QueueSize: 1 << 26}, true},
+		{"priority over maximum", ABIVersion1, HandleOptions{Priority: 1001}, true},
+		{"layer unsupported by 1.x", ABIVersion1, HandleOptions{Layer: WinDivertLayerFlow, Flags: WinDivertFlagSniff}, true},
+		{"invalid flags", ABIVersion2, HandleOptions{Flags: WinDivertFlagSniff | WinDivertFlagDrop}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.options.validate(test.abi)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
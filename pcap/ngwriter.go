@@ -0,0 +1,184 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// pcapng block types, option codes and flags
+const (
+	blockSectionHeader    = 0x0A0D0D0A
+	blockInterface        = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1A2B3C4D
+	optEndOfOpt           = 0
+	optComment            = 1
+	optShbUserAppl        = 4
+	optIfName             = 2
+	optIfDescription      = 3
+	optIfTsResol          = 9
+	optEpbFlags           = 2
+	epbFlagsInbound       = 0x1
+	epbFlagsOutbound      = 0x2
+	nanosecondsResolution = 9
+)
+
+// Identifies a WinDivert interface
+type ifaceKey struct {
+	ifIdx    uint32
+	subIfIdx uint32
+}
+
+// NgWriter saves packets in the pcapng format
+// An interface block is written for each IfIdx/SubIfIdx pair, the direction is saved in
+// the packet flags and the loopback and impostor flags in the packet comment
+type NgWriter struct {
+	w      io.Writer
+	ifaces map[ifaceKey]uint32
+
+	// Converts the packets' timestamps, defaults to NewClock(DefaultCounterFrequency)
+	Clock Clock
+
+	buf []byte
+}
+
+// Create a new NgWriter and write the section header block
+func NewNgWriter(w io.Writer) (*NgWriter, error) {
+	ngw := &NgWriter{
+		w:      w,
+		ifaces: make(map[ifaceKey]uint32),
+		Clock:  NewClock(DefaultCounterFrequency),
+	}
+
+	body := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	// Unknown section length
+	body = binary.LittleEndian.AppendUint64(body, 0xFFFFFFFFFFFFFFFF)
+	body = appendOption(body, optShbUserAppl, []byte("godivert"))
+	body = appendOption(body, optEndOfOpt, nil)
+
+	if err := ngw.writeBlock(blockSectionHeader, body); err != nil {
+		return nil, err
+	}
+	return ngw, nil
+}
+
+// Write the packet using the timestamp of its WinDivertAddress
+// or the current time if it has none
+func (w *NgWriter) WritePacket(packet *godivert.Packet) error {
+	if err := checkLinkType(LinkTypeRaw, packet); err != nil {
+		return err
+	}
+
+	var key ifaceKey
+	ts := time.Now()
+	if packet.Addr != nil {
+		key = ifaceKey{packet.Addr.IfIdx, packet.Addr.SubIfIdx}
+		ts = w.Clock(packet.Addr.Timestamp)
+	}
+
+	ifaceID, err := w.iface(key)
+	if err != nil {
+		return err
+	}
+
+	data := packetData(packet)
+	origLen := len(packet.Raw)
+	if packet.PacketLen != 0 {
+		origLen = int(packet.PacketLen)
+	}
+
+	nanos := uint64(ts.UnixNano())
+	body := binary.LittleEndian.AppendUint32(w.buf[:0], ifaceID)
+	body = binary.LittleEndian.AppendUint32(body, uint32(nanos>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(nanos))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(origLen))
+	body = appendPadded(body, data)
+
+	if packet.Addr != nil {
+		flags := uint32(epbFlagsOutbound)
+		if packet.Addr.Direction() == godivert.WinDivertDirectionInbound {
+			flags = epbFlagsInbound
+		}
+		body = appendOption(body, optEpbFlags, binary.LittleEndian.AppendUint32(nil, flags))
+
+		var comments []string
+		if packet.Addr.Loopback() {
+			comments = append(comments, "loopback")
+		}
+		if packet.Addr.Impostor() {
+			comments = append(comments, "impostor")
+		}
+		if len(comments) > 0 {
+			body = appendOption(body, optComment, []byte(strings.Join(comments, ",")))
+		}
+		body = appendOption(body, optEndOfOpt, nil)
+	}
+
+	w.buf = body
+	return w.writeBlock(blockEnhancedPacket, body)
+}
+
+// Returns the ID of the interface block of the given interface, writing it if needed
+func (w *NgWriter) iface(key ifaceKey) (uint32, error) {
+	if id, ok := w.ifaces[key]; ok {
+		return id, nil
+	}
+
+	body := binary.LittleEndian.AppendUint16(nil, uint16(LinkTypeRaw))
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, SnapLen)
+	body = appendOption(body, optIfName, []byte(fmt.Sprintf("%d.%d", key.ifIdx, key.subIfIdx)))
+	body = appendOption(body, optIfDescription, []byte(fmt.Sprintf("WinDivert IfIdx=%d SubIfIdx=%d", key.ifIdx, key.subIfIdx)))
+	body = appendOption(body, optIfTsResol, []byte{nanosecondsResolution})
+	body = appendOption(body, optEndOfOpt, nil)
+
+	if err := w.writeBlock(blockInterface, body); err != nil {
+		return 0, err
+	}
+
+	id := uint32(len(w.ifaces))
+	w.ifaces[key] = id
+	return id, nil
+}
+
+// Writes a block: type, total length, body and total length again
+func (w *NgWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], blockType)
+	binary.LittleEndian.PutUint32(hdr[4:8], total)
+
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(body); err != nil {
+		return err
+	}
+	_, err := w.w.Write(hdr[4:8])
+	return err
+}
+
+// Appends an option: code, length and value padded to 32 bits
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPadded(b, value)
+}
+
+// Appends the data padded to 32 bits
+func appendPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	for i := len(data); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
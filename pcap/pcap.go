@@ -0,0 +1,94 @@
+// Package pcap saves diverted packets in the pcap and pcapng file formats
+// so that they can be opened with Wireshark or tcpdump.
+//
+// See https://www.tcpdump.org/manpages/pcap-savefile.5.html
+// and https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+package pcap
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Represents a link-layer header type
+// See https://www.tcpdump.org/linktypes.html
+type LinkType uint32
+
+const (
+	// Raw IP, the packet begins with an IPv4 or IPv6 header
+	LinkTypeRaw LinkType = 101
+	// Raw IPv4 only
+	LinkTypeIPv4 LinkType = 228
+	// Raw IPv6 only
+	LinkTypeIPv6 LinkType = 229
+)
+
+const (
+	// Maximum length of a captured packet
+	SnapLen = 0xFFFF + 40
+
+	// Frequency of the performance counter used by WinDivert timestamps on Windows 10 and later
+	DefaultCounterFrequency = 10000000
+)
+
+// Converts a WinDivertAddress Timestamp to a time
+type Clock func(timestamp int64) time.Time
+
+// Returns a Clock for a performance counter running at frequency Hz
+// The first converted timestamp is mapped to the current time,
+// the following ones are relative to it
+func NewClock(frequency int64) Clock {
+	var (
+		once      sync.Once
+		reference int64
+		start     time.Time
+	)
+
+	return func(timestamp int64) time.Time {
+		once.Do(func() {
+			reference = timestamp
+			start = time.Now()
+		})
+
+		return start.Add(godivert.CounterDuration(timestamp-reference, frequency))
+	}
+}
+
+// Returns a Clock for timestamps counting ticks at frequency Hz since the Unix epoch
+// Use it to write the packets produced by a Reader with their original time
+func EpochClock(frequency int64) Clock {
+	return func(timestamp int64) time.Time {
+		return time.Unix(0, 0).Add(godivert.CounterDuration(timestamp, frequency))
+	}
+}
+
+// Returns an error if the packet can't be saved with the given link type
+func checkLinkType(linkType LinkType, packet *godivert.Packet) error {
+	if len(packet.Raw) == 0 {
+		return errors.New("can't write an empty packet")
+	}
+
+	version := packet.Raw[0] >> 4
+	switch {
+	case linkType == LinkTypeIPv4 && version != 4:
+		return errors.New("can't write a non IPv4 packet with LinkTypeIPv4")
+	case linkType == LinkTypeIPv6 && version != 6:
+		return errors.New("can't write a non IPv6 packet with LinkTypeIPv6")
+	}
+	return nil
+}
+
+// Returns the captured bytes of the packet
+func packetData(packet *godivert.Packet) []byte {
+	data := packet.Raw
+	if packet.PacketLen != 0 && int(packet.PacketLen) < len(data) {
+		data = data[:packet.PacketLen]
+	}
+	if len(data) > SnapLen {
+		data = data[:SnapLen]
+	}
+	return data
+}
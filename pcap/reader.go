@@ -0,0 +1,545 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Link types only understood by the Reader
+const (
+	// BSD loopback, a 4 bytes address family in host byte order precedes the IP header
+	LinkTypeNull LinkType = 0
+	// Ethernet, VLAN tags are stripped
+	LinkTypeEthernet LinkType = 1
+	// OpenBSD loopback, a 4 bytes address family in network byte order precedes the IP header
+	LinkTypeLoop LinkType = 108
+)
+
+// pcap magic number, pcapng block and option codes
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapngMagic    = blockSectionHeader
+
+	blockSimplePacket = 0x00000003
+	optIfTsOffset     = 14
+)
+
+// Ethernet types
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86DD
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88A8
+	etherTypeQinQ2 = 0x9100
+)
+
+// Represents an interface described by a pcapng interface block
+type ngIface struct {
+	linkType LinkType
+	ifIdx    uint32
+	subIfIdx uint32
+	// Number of timestamp units per second
+	units    uint64
+	tsOffset int64
+}
+
+// Reader reads packets from a pcap or pcapng file and returns them as *godivert.Packet
+// with a synthesized WinDivertAddress, so that the processing code used on a live
+// WinDivertHandle can run against files on any OS
+//
+// The synthesized address contains:
+//   - the capture time as Timestamp, in DefaultCounterFrequency ticks since the Unix epoch (see EpochClock)
+//   - the IfIdx and SubIfIdx of the pcapng interface when written by NgWriter, or the interface number
+//   - the direction from the pcapng packet flags, outbound if unknown
+//   - the loopback and impostor flags from the pcapng packet comment
+type Reader struct {
+	r         *bufio.Reader
+	ng        bool
+	byteOrder binary.ByteOrder
+
+	// pcap
+	linkType LinkType
+	units    uint64
+
+	// pcapng
+	ifaces []ngIface
+
+	// Number of records skipped because the capture truncated them
+	truncated atomic.Uint64
+
+	mu      sync.Mutex
+	err     error
+	started bool
+}
+
+// Create a new Reader, the format is detected from the file header
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+
+	magic, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		reader.ng = true
+		return reader, nil
+	}
+
+	return reader, reader.readHeader()
+}
+
+// Reads the pcap global header
+func (r *Reader) readHeader() error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return err
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagicMicro:
+			r.units = 1e6
+		case pcapMagicNano:
+			r.units = 1e9
+		default:
+			continue
+		}
+
+		r.byteOrder = order
+		r.linkType = LinkType(order.Uint32(hdr[20:24]) & 0xFFFF)
+		return checkReadLinkType(r.linkType)
+	}
+
+	return errors.New("not a pcap or pcapng file")
+}
+
+func checkReadLinkType(linkType LinkType) error {
+	switch linkType {
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6, LinkTypeEthernet, LinkTypeNull, LinkTypeLoop:
+		return nil
+	}
+	return fmt.Errorf("unsupported link type %d", linkType)
+}
+
+// Returns the number of packets skipped because the capture truncated their headers or their payload
+// Such packets can't be parsed or reinjected, capture with a larger snapshot length to keep them
+func (r *Reader) Truncated() uint64 {
+	return r.truncated.Load()
+}
+
+// Returns the next IP packet of the file
+// Frames that don't contain an IPv4 or IPv6 packet are skipped, and so are the packets
+// truncated by the capture, see Truncated
+// Returns io.EOF at the end of the file
+func (r *Reader) Recv() (*godivert.Packet, error) {
+	for {
+		var (
+			packet *godivert.Packet
+			err    error
+		)
+
+		if r.ng {
+			packet, err = r.readBlock()
+		} else {
+			packet, err = r.readRecord()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		if packet != nil {
+			return packet, nil
+		}
+	}
+}
+
+// Reads a pcap record, returns nil if it isn't an IP packet
+func (r *Reader) readRecord() (*godivert.Packet, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	sec := uint64(r.byteOrder.Uint32(hdr[0:4]))
+	frac := uint64(r.byteOrder.Uint32(hdr[4:8]))
+	capLen := r.byteOrder.Uint32(hdr[8:12])
+
+	data, err := r.readData(capLen)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := time.Unix(int64(sec), int64(frac*uint64(time.Second)/r.units))
+	addr := &godivert.WinDivertAddress{Timestamp: timestamp(ts)}
+	return r.newPacket(r.linkType, data, addr), nil
+}
+
+// Reads a pcapng block, returns nil if it isn't a packet block containing an IP packet
+func (r *Reader) readBlock() (*godivert.Packet, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(hdr[0:4]) == blockSectionHeader {
+		// The byte order of a section is given by its header
+		magic, err := r.r.Peek(4)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == byteOrderMagic:
+			r.byteOrder = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == byteOrderMagic:
+			r.byteOrder = binary.BigEndian
+		default:
+			return nil, errors.New("invalid pcapng byte order magic")
+		}
+		r.ifaces = r.ifaces[:0]
+	}
+
+	if r.byteOrder == nil {
+		return nil, errors.New("pcapng block before the section header")
+	}
+
+	blockType := r.byteOrder.Uint32(hdr[0:4])
+	total := r.byteOrder.Uint32(hdr[4:8])
+	if total < 12 || total%4 != 0 {
+		return nil, fmt.Errorf("invalid pcapng block length %d", total)
+	}
+
+	body, err := r.readData(total - 8)
+	if err != nil {
+		return nil, err
+	}
+	body = body[:len(body)-4]
+
+	switch blockType {
+	case blockInterface:
+		return nil, r.readInterface(body)
+	case blockEnhancedPacket:
+		return r.readEnhancedPacket(body)
+	case blockSimplePacket:
+		return r.readSimplePacket(body)
+	}
+	return nil, nil
+}
+
+func (r *Reader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("truncated pcapng interface block")
+	}
+
+	iface := ngIface{
+		linkType: LinkType(r.byteOrder.Uint16(body[0:2])),
+		ifIdx:    uint32(len(r.ifaces)),
+		units:    1e6,
+	}
+
+	err := r.walkOptions(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case optIfName:
+			var ifIdx, subIfIdx uint32
+			if n, _ := fmt.Sscanf(string(value), "%d.%d", &ifIdx, &subIfIdx); n == 2 {
+				iface.ifIdx, iface.subIfIdx = ifIdx, subIfIdx
+			}
+		case optIfTsResol:
+			if len(value) == 1 {
+				exp := value[0] & 0x7F
+				switch {
+				case value[0]&0x80 == 0 && exp <= 19:
+					iface.units = uint64(math.Pow10(int(exp)))
+				case value[0]&0x80 != 0 && exp <= 63:
+					iface.units = 1 << exp
+				}
+			}
+		case optIfTsOffset:
+			if len(value) == 8 {
+				iface.tsOffset = int64(r.byteOrder.Uint64(value))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	r.ifaces = append(r.ifaces, iface)
+	return nil
+}
+
+func (r *Reader) readEnhancedPacket(body []byte) (*godivert.Packet, error) {
+	if len(body) < 20 {
+		return nil, errors.New("truncated pcapng enhanced packet block")
+	}
+
+	ifaceID := r.byteOrder.Uint32(body[0:4])
+	if int(ifaceID) >= len(r.ifaces) {
+		return nil, fmt.Errorf("unknown pcapng interface %d", ifaceID)
+	}
+	iface := r.ifaces[ifaceID]
+
+	units := uint64(r.byteOrder.Uint32(body[4:8]))<<32 | uint64(r.byteOrder.Uint32(body[8:12]))
+	capLen := int(r.byteOrder.Uint32(body[12:16]))
+	if 20+capLen > len(body) {
+		return nil, errors.New("truncated pcapng packet data")
+	}
+	data := body[20 : 20+capLen]
+
+	sec := units / iface.units
+	frac := units % iface.units
+	ts := time.Unix(int64(sec)+iface.tsOffset, int64(frac*uint64(time.Second)/iface.units))
+
+	addr := &godivert.WinDivertAddress{
+		Timestamp: timestamp(ts),
+		IfIdx:     iface.ifIdx,
+		SubIfIdx:  iface.subIfIdx,
+	}
+
+	padded := (capLen + 3) &^ 3
+	if 20+padded < len(body) {
+		err := r.walkOptions(body[20+padded:], func(code uint16, value []byte) {
+			switch code {
+			case optEpbFlags:
+				if len(value) == 4 && r.byteOrder.Uint32(value)&0x3 == epbFlagsInbound {
+					addr.SetDirection(godivert.WinDivertDirectionInbound)
+				}
+			case optComment:
+				for _, comment := range strings.Split(string(value), ",") {
+					switch strings.TrimSpace(comment) {
+					case "loopback":
+						addr.SetLoopback(true)
+					case "impostor":
+						addr.SetImpostor(true)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r.newPacket(iface.linkType, data, addr), nil
+}
+
+func (r *Reader) readSimplePacket(body []byte) (*godivert.Packet, error) {
+	if len(r.ifaces) == 0 {
+		return nil, errors.New("pcapng simple packet block without interface")
+	}
+	if len(body) < 4 {
+		return nil, errors.New("truncated pcapng simple packet block")
+	}
+
+	iface := r.ifaces[0]
+	origLen := int(r.byteOrder.Uint32(body[0:4]))
+	data := body[4:]
+	if origLen < len(data) {
+		data = data[:origLen]
+	}
+
+	addr := &godivert.WinDivertAddress{
+		IfIdx:    iface.ifIdx,
+		SubIfIdx: iface.subIfIdx,
+	}
+	return r.newPacket(iface.linkType, data, addr), nil
+}
+
+// Calls fn for each option until the end of the options
+func (r *Reader) walkOptions(options []byte, fn func(code uint16, value []byte)) error {
+	for len(options) >= 4 {
+		code := r.byteOrder.Uint16(options[0:2])
+		length := int(r.byteOrder.Uint16(options[2:4]))
+		if code == optEndOfOpt {
+			return nil
+		}
+
+		padded := (length + 3) &^ 3
+		if 4+padded > len(options) {
+			return errors.New("truncated pcapng option")
+		}
+
+		fn(code, options[4:4+length])
+		options = options[4+padded:]
+	}
+	return nil
+}
+
+// Reads n bytes in a new slice
+func (r *Reader) readData(n uint32) ([]byte, error) {
+	if n > 1<<24 {
+		return nil, fmt.Errorf("record of %d bytes is too large", n)
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, unexpected(err)
+	}
+	return data, nil
+}
+
+// Creates a packet from a frame, returns nil if the frame doesn't contain an IP packet
+// or if its headers are truncated, the link layer padding is removed
+func (r *Reader) newPacket(linkType LinkType, frame []byte, addr *godivert.WinDivertAddress) *godivert.Packet {
+	data := stripLinkLayer(linkType, frame)
+	if len(data) == 0 {
+		return nil
+	}
+
+	version := data[0] >> 4
+	if version != 4 && version != 6 {
+		return nil
+	}
+
+	data, ok := trimIPPacket(data)
+	if !ok {
+		r.truncated.Add(1)
+		return nil
+	}
+
+	packet := &godivert.Packet{
+		Raw:       data,
+		Addr:      addr,
+		PacketLen: uint(len(data)),
+	}
+	if packet.ParseHeaders() != nil {
+		r.truncated.Add(1)
+		return nil
+	}
+	return packet
+}
+
+// Returns the IP packet trimmed to the length of its IP header
+// Returns false if the IP header is invalid or if the packet was truncated by the capture
+func trimIPPacket(data []byte) ([]byte, bool) {
+	if data[0]>>4 == 4 {
+		if len(data) < 20 {
+			return nil, false
+		}
+		hdrLen := int(data[0]&0xf) << 2
+		totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if hdrLen < 20 || hdrLen > len(data) {
+			return nil, false
+		}
+		if totalLen == 0 {
+			// Segmentation offload, the length is unknown
+			return data, true
+		}
+		if totalLen < hdrLen || totalLen > len(data) {
+			return nil, false
+		}
+		return data[:totalLen], true
+	}
+
+	if len(data) < 40 {
+		return nil, false
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	if payloadLen == 0 {
+		// Jumbogram or segmentation offload, the length is unknown
+		return data, true
+	}
+	if 40+payloadLen > len(data) {
+		return nil, false
+	}
+	return data[:40+payloadLen], true
+}
+
+// Returns the IP packet contained in the frame or nil
+func stripLinkLayer(linkType LinkType, frame []byte) []byte {
+	switch linkType {
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		return frame
+	case LinkTypeNull, LinkTypeLoop:
+		if len(frame) < 4 {
+			return nil
+		}
+		return frame[4:]
+	case LinkTypeEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQ2 {
+			if len(frame) < 4 {
+				return nil
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return nil
+		}
+		return frame
+	}
+	return nil
+}
+
+// Returns the number of DefaultCounterFrequency ticks since the Unix epoch
+func timestamp(ts time.Time) int64 {
+	return godivert.CounterTicks(ts.Sub(time.Unix(0, 0)), DefaultCounterFrequency)
+}
+
+// Returns io.ErrUnexpectedEOF instead of io.EOF in the middle of a record
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A loop that reads packets by calling Recv and sends them on a channel
+// The channel is closed at the end of the file or on the first error, see Err
+func (r *Reader) recvLoop(packetChan chan<- *godivert.Packet) {
+	defer close(packetChan)
+
+	for {
+		packet, err := r.Recv()
+		if err != nil {
+			r.mu.Lock()
+			if err != io.EOF {
+				r.err = err
+			}
+			r.mu.Unlock()
+			return
+		}
+
+		packetChan <- packet
+	}
+}
+
+// Create a new channel that will be used to pass the packets of the file and returns it
+// The channel is closed at the end of the file or on the first error, see Err
+func (r *Reader) Packets() (chan *godivert.Packet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.started {
+		return nil, errors.New("the packets are already being read")
+	}
+	r.started = true
+
+	packetChan := make(chan *godivert.Packet, godivert.PacketChanCapacity)
+	go r.recvLoop(packetChan)
+	return packetChan, nil
+}
+
+// Returns the error that stopped the channel returned by Packets, nil at the end of the file
+func (r *Reader) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
@@ -0,0 +1,187 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+type packetWriter interface {
+	WritePacket(packet *godivert.Packet) error
+}
+
+// Reads all the packets of the file
+func readAll(t *testing.T, reader *Reader) []*godivert.Packet {
+	t.Helper()
+	var packets []*godivert.Packet
+	for {
+		packet, err := reader.Recv()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestWriterReaderRoundTrip(t *testing.T) {
+	syn := testpacket.SYN()
+	udp := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 1234, nil)
+
+	written := []*godivert.Packet{
+		{Raw: syn, Addr: &godivert.WinDivertAddress{Timestamp: 1}},
+		// Truncated by the snapshot length in the middle of the TCP header
+		{Raw: syn[:24], PacketLen: 24},
+		// Truncated payload
+		{Raw: append(append([]byte(nil), udp...), 0, 0, 0, 0)[:30], PacketLen: 30},
+		{Raw: udp, Addr: &godivert.WinDivertAddress{Timestamp: 2}},
+	}
+	written[2].Raw[3] = 32
+
+	formats := []struct {
+		name   string
+		writer func(w io.Writer) (packetWriter, error)
+	}{
+		{"pcap", func(w io.Writer) (packetWriter, error) {
+			writer, err := NewWriter(w, LinkTypeRaw)
+			if err != nil {
+				return nil, err
+			}
+			writer.Clock = EpochClock(DefaultCounterFrequency)
+			return writer, nil
+		}},
+		{"pcapng", func(w io.Writer) (packetWriter, error) {
+			writer, err := NewNgWriter(w)
+			if err != nil {
+				return nil, err
+			}
+			writer.Clock = EpochClock(DefaultCounterFrequency)
+			return writer, nil
+		}},
+	}
+
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := format.writer(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, packet := range written {
+				if err := writer.WritePacket(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reader, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packets := readAll(t, reader)
+			if len(packets) != 2 {
+				t.Fatalf("read %d packets, want 2", len(packets))
+			}
+			if got := reader.Truncated(); got != 2 {
+				t.Errorf("Truncated() = %d, want 2", got)
+			}
+
+			for i, want := range [][]byte{syn, udp} {
+				packet := packets[i]
+				if !bytes.Equal(packet.Raw, want) {
+					t.Errorf("packet %d = %x, want %x", i, packet.Raw, want)
+				}
+				if packet.PacketLen != uint(len(want)) {
+					t.Errorf("packet %d length = %d, want %d", i, packet.PacketLen, len(want))
+				}
+				if packet.Addr == nil || packet.Addr.Timestamp != int64(i+1) {
+					t.Errorf("packet %d address = %+v, want timestamp %d", i, packet.Addr, i+1)
+				}
+				if err := packet.VerifyParsed(); err != nil {
+					t.Errorf("packet %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+// Returns a pcap file containing the frames
+func pcapFile(linkType LinkType, frames ...[]byte) []byte {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], SnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(linkType))
+
+	file := hdr[:]
+	for _, frame := range frames {
+		file = binary.LittleEndian.AppendUint64(file, 0)
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(frame)))
+		file = binary.LittleEndian.AppendUint32(file, uint32(len(frame)))
+		file = append(file, frame...)
+	}
+	return file
+}
+
+func TestReaderFrames(t *testing.T) {
+	udp := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", 1234, nil)
+	// Destination and source MAC addresses followed by the IPv4 EtherType
+	ethernet := []byte{2, 0, 0, 0, 0, 2, 2, 0, 0, 0, 0, 1, 0x08, 0x00}
+
+	// Ethernet frames are padded to 60 bytes
+	padded := append(append([]byte(nil), ethernet...), udp...)
+	padded = append(padded, make([]byte, 60-len(padded))...)
+
+	badIHL := append([]byte(nil), udp...)
+	badIHL[0] = 0x44
+
+	// The IP header is complete but its total length leaves no room for the UDP header
+	shortUDP := append([]byte(nil), udp[:24]...)
+	shortUDP[3] = 24
+
+	tests := []struct {
+		name          string
+		linkType      LinkType
+		frame         []byte
+		want          []byte
+		wantTruncated uint64
+	}{
+		{"raw", LinkTypeRaw, udp, udp, 0},
+		{"ethernet padding", LinkTypeEthernet, padded, udp, 0},
+		{"not ip", LinkTypeEthernet, append(append([]byte(nil), ethernet[:12]...), 0x08, 0x06), nil, 0},
+		{"ihl < 5", LinkTypeRaw, badIHL, nil, 1},
+		{"truncated ip header", LinkTypeRaw, udp[:16], nil, 1},
+		{"truncated udp header", LinkTypeRaw, udp[:24], nil, 1},
+		{"short udp header", LinkTypeRaw, shortUDP, nil, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := NewReader(bytes.NewReader(pcapFile(test.linkType, test.frame)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			packets := readAll(t, reader)
+
+			if test.want == nil {
+				if len(packets) != 0 {
+					t.Errorf("read %x, want no packet", packets[0].Raw)
+				}
+			} else if len(packets) != 1 || !bytes.Equal(packets[0].Raw, test.want) {
+				t.Errorf("read %d packets, want %x", len(packets), test.want)
+			} else if len(packets[0].Payload()) != 0 {
+				t.Errorf("payload = %x, want none", packets[0].Payload())
+			}
+
+			if got := reader.Truncated(); got != test.wantTruncated {
+				t.Errorf("Truncated() = %d, want %d", got, test.wantTruncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Magic number of pcap files with nanosecond timestamps
+const pcapMagicNano = 0xa1b23c4d
+
+// Writer saves packets in the pcap format with nanosecond timestamps
+type Writer struct {
+	w        io.Writer
+	linkType LinkType
+
+	// Converts the packets' timestamps, defaults to NewClock(DefaultCounterFrequency)
+	Clock Clock
+
+	buf []byte
+}
+
+// Create a new Writer and write the pcap file header
+// linkType must be LinkTypeRaw, LinkTypeIPv4 or LinkTypeIPv6
+func NewWriter(w io.Writer, linkType LinkType) (*Writer, error) {
+	if linkType != LinkTypeRaw && linkType != LinkTypeIPv4 && linkType != LinkTypeIPv6 {
+		return nil, errors.New("unsupported link type")
+	}
+
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	// thiszone and sigfigs are always 0
+	binary.LittleEndian.PutUint32(hdr[16:20], SnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(linkType))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:        w,
+		linkType: linkType,
+		Clock:    NewClock(DefaultCounterFrequency),
+	}, nil
+}
+
+// Write the packet using the timestamp of its WinDivertAddress
+// or the current time if it has none
+func (w *Writer) WritePacket(packet *godivert.Packet) error {
+	if err := checkLinkType(w.linkType, packet); err != nil {
+		return err
+	}
+
+	ts := time.Now()
+	if packet.Addr != nil {
+		ts = w.Clock(packet.Addr.Timestamp)
+	}
+
+	data := packetData(packet)
+	origLen := len(packet.Raw)
+	if packet.PacketLen != 0 {
+		origLen = int(packet.PacketLen)
+	}
+
+	w.buf = w.buf[:0]
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(ts.Unix()))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(ts.Nanosecond()))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(len(data)))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(origLen))
+	w.buf = append(w.buf, data...)
+
+	_, err := w.w.Write(w.buf)
+	return err
+}
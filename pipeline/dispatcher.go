@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Default number of packets waiting in the queue of each worker
+const DefaultQueueDepth = 256
+
+// Counters and backlog of a Dispatcher worker
+type WorkerStats struct {
+	// Packets waiting in the queue
+	Backlog int
+	// Highest backlog seen when dispatching
+	MaxBacklog int
+	// Size of the queue
+	QueueDepth int
+	Processed  uint64
+	Errors     uint64
+}
+
+type worker struct {
+	queue chan *godivert.Packet
+
+	mu         sync.Mutex
+	maxBacklog int
+	processed  uint64
+	errors     uint64
+}
+
+// Spreads packets over workers while preserving the order of the packets of each flow
+// Packets are assigned to a worker with the hash of their canonical 5-tuple,
+// both directions of a flow are handled by the same worker, packets without IP header by the first one
+type Dispatcher struct {
+	workers []*worker
+	handle  func(packet *godivert.Packet) error
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Create a new Dispatcher and start its workers
+// A workers count of 0 uses runtime.NumCPU(), a queueDepth of 0 uses DefaultQueueDepth
+// handle is called by the workers, Pipeline.Process can be used as is
+func NewDispatcher(workers, queueDepth int, handle func(packet *godivert.Packet) error) *Dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueDepth <= 0 {
+		queueDepth = DefaultQueueDepth
+	}
+
+	d := &Dispatcher{
+		workers: make([]*worker, workers),
+		handle:  handle,
+	}
+
+	for i := range d.workers {
+		w := &worker{queue: make(chan *godivert.Packet, queueDepth)}
+		d.workers[i] = w
+
+		d.wg.Add(1)
+		go d.work(w)
+	}
+
+	return d
+}
+
+func (d *Dispatcher) work(w *worker) {
+	defer d.wg.Done()
+
+	for packet := range w.queue {
+		err := d.handle(packet)
+
+		w.mu.Lock()
+		w.processed++
+		if err != nil {
+			w.errors++
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Returns the index of the worker handling the flow of the packet
+// Packets without IP header, such as the events of the Flow and Socket layers, go to the first worker
+func (d *Dispatcher) Worker(packet *godivert.Packet) int {
+	packet.VerifyParsed()
+	if packet.IpHdr == nil {
+		return 0
+	}
+	return int(packet.FlowKey().Hash() % uint64(len(d.workers)))
+}
+
+// Queue the packet on the worker of its flow
+// Blocks while the queue of the worker is full
+func (d *Dispatcher) Dispatch(packet *godivert.Packet) error {
+	w := d.workers[d.Worker(packet)]
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return errors.New("the dispatcher is closed")
+	}
+
+	w.queue <- packet
+
+	backlog := len(w.queue)
+	w.mu.Lock()
+	if backlog > w.maxBacklog {
+		w.maxBacklog = backlog
+	}
+	w.mu.Unlock()
+
+	return nil
+}
+
+// Dispatch the packets of the channel until it is closed
+func (d *Dispatcher) Run(packets <-chan *godivert.Packet) error {
+	for packet := range packets {
+		if err := d.Dispatch(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the stats of each worker
+func (d *Dispatcher) Stats() []WorkerStats {
+	stats := make([]WorkerStats, len(d.workers))
+	for i, w := range d.workers {
+		w.mu.Lock()
+		stats[i] = WorkerStats{
+			Backlog:    len(w.queue),
+			MaxBacklog: w.maxBacklog,
+			QueueDepth: cap(w.queue),
+			Processed:  w.processed,
+			Errors:     w.errors,
+		}
+		w.mu.Unlock()
+	}
+	return stats
+}
+
+// Returns the total number of packets waiting in the queues
+func (d *Dispatcher) Backlog() int {
+	backlog := 0
+	for _, w := range d.workers {
+		backlog += len(w.queue)
+	}
+	return backlog
+}
+
+// Stop accepting packets and wait for the workers to handle the queued ones
+func (d *Dispatcher) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return errors.New("the dispatcher is already closed")
+	}
+	d.closed = true
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+	return nil
+}
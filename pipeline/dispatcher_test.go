@@ -0,0 +1,38 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+func TestDispatcherWorker(t *testing.T) {
+	// 172.16.0.1:49368 > 172.16.0.10:80 and its reply
+	syn := testpacket.TCP("172.16.0.1", 49368, "172.16.0.10", 80, header.TCPFlagSYN)
+	reply := testpacket.TCP("172.16.0.10", 80, "172.16.0.1", 49368, header.TCPFlagSYN|header.TCPFlagACK)
+
+	d := NewDispatcher(8, 1, func(*godivert.Packet) error { return nil })
+	defer d.Close()
+
+	flow := d.Worker(&godivert.Packet{Raw: syn, PacketLen: uint(len(syn))})
+	if got := d.Worker(&godivert.Packet{Raw: reply, PacketLen: uint(len(reply))}); got != flow {
+		t.Errorf("Worker() of the reply = %d, want %d like the request", got, flow)
+	}
+
+	flowEvent := &godivert.Packet{Addr: &godivert.WinDivertAddress{Layer: godivert.WinDivertLayerFlow}}
+	tests := []struct {
+		name   string
+		packet *godivert.Packet
+	}{
+		{"flow event", flowEvent},
+		{"not ip", &godivert.Packet{Raw: []byte{0x00, 0x01, 0x02}, PacketLen: 3}},
+		{"truncated ip header", &godivert.Packet{Raw: syn[:12], PacketLen: 12}},
+	}
+	for _, test := range tests {
+		if got := d.Worker(test.packet); got != 0 {
+			t.Errorf("%s: Worker() = %d, want 0", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package pipeline processes diverted packets with handlers returning a verdict
+// instead of calling Send themselves.
+//
+// Handlers are registered with a WinDivert filter and called in registration order,
+// Accept and Modify let the next matching handler see the packet:
+//
+//	p := pipeline.New(winDivert)
+//	p.Use(logging)
+//	p.HandleFunc("tcp.DstPort == 80", func(ctx *pipeline.Context) (pipeline.Verdict, error) {
+//		return pipeline.Drop, nil
+//	})
+//	p.Run(packetChan)
+//
+// Every packet is reinjected or dropped exactly once: when a handler returns an error
+// or panics, the pipeline's ErrorVerdict is applied to the packet.
+//
+// A Dispatcher processes the packets on several workers without reordering the packets of a flow:
+//
+//	d := pipeline.NewDispatcher(8, 0, p.Process)
+//	d.Run(packetChan)
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Decides what happens to a packet
+type Handler interface {
+	Handle(ctx *Context) (Verdict, error)
+}
+
+// Adapter to use a function as a Handler
+type HandlerFunc func(ctx *Context) (Verdict, error)
+
+func (f HandlerFunc) Handle(ctx *Context) (Verdict, error) {
+	return f(ctx)
+}
+
+// Wraps a handler, to log or measure the packets for example
+type Middleware func(next Handler) Handler
+
+// Implemented by senders able to recalculate the checksums of a packet, such as WinDivertHandle
+type checksumCalculator interface {
+	HelperCalcChecksum(packet *godivert.Packet)
+}
+
+// Counters of a Pipeline
+type Stats struct {
+	Processed  uint64
+	Accepted   uint64
+	Dropped    uint64
+	Modified   uint64
+	Reinjected uint64
+	// Packets deferred by a handler and not completed yet
+	Deferred   uint64
+	Errors     uint64
+	Panics     uint64
+	SendErrors uint64
+}
+
+// Represents a handler and the packets it applies to
+type route struct {
+	match   func(packet *godivert.Packet) bool
+	handler Handler
+}
+
+// Runs the matching handlers on each packet and applies their verdict
+// The handlers and middlewares have to be registered before processing packets
+type Pipeline struct {
+	sender      godivert.Sender
+	routes      []route
+	middlewares []Middleware
+
+	// Verdict applied when a handler fails or panics, Accept (fail open) by default
+	// Only Accept and Drop are allowed
+	ErrorVerdict Verdict
+	// Called when a handler fails or panics, or when a packet can't be sent
+	OnError func(ctx *Context, err error)
+	// Called once the packet is reinjected or dropped, with the verdict applied
+	// and the time elapsed since Process was called
+	OnComplete func(ctx *Context, verdict Verdict, elapsed time.Duration)
+
+	mu       sync.Mutex
+	stats    Stats
+	deferred map[*Context]struct{}
+}
+
+// Create a new Pipeline reinjecting the packets with the sender
+func New(sender godivert.Sender) *Pipeline {
+	return &Pipeline{
+		sender:   sender,
+		deferred: make(map[*Context]struct{}),
+	}
+}
+
+// Add middlewares wrapping the handlers registered after this call
+// The first middleware is the outermost one
+func (p *Pipeline) Use(middlewares ...Middleware) {
+	p.middlewares = append(p.middlewares, middlewares...)
+}
+
+// Register a handler for the packets matching the WinDivert filter
+// An empty filter matches every packet without calling the DLL
+func (p *Pipeline) Handle(filter string, handler Handler) {
+	if filter == "" || filter == "true" {
+		p.HandleMatch(nil, handler)
+		return
+	}
+
+	p.HandleMatch(func(packet *godivert.Packet) bool {
+		match, err := packet.EvalFilter(filter)
+		return err == nil && match
+	}, handler)
+}
+
+// Register a handler function for the packets matching the WinDivert filter
+func (p *Pipeline) HandleFunc(filter string, handler func(ctx *Context) (Verdict, error)) {
+	p.Handle(filter, HandlerFunc(handler))
+}
+
+// Register a handler for the packets for which match returns true, nil matches every packet
+func (p *Pipeline) HandleMatch(match func(packet *godivert.Packet) bool, handler Handler) {
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		handler = p.middlewares[i](handler)
+	}
+	p.routes = append(p.routes, route{match: match, handler: handler})
+}
+
+// Run the matching handlers on the packet and reinject or drop it
+// Packets matching no handler are accepted
+// The returned error is the one of the handler or of the Send call, the packet is completed anyway
+func (p *Pipeline) Process(packet *godivert.Packet) error {
+	ctx := &Context{Packet: packet, pipeline: p, start: time.Now()}
+	p.count(func(s *Stats) { s.Processed++ })
+
+	verdict, err := p.run(ctx)
+	if err != nil {
+		p.count(func(s *Stats) { s.Errors++ })
+		p.fail(ctx, err)
+		if completeErr := ctx.complete(p.errorVerdict()); completeErr != nil && completeErr != ErrCompleted {
+			return completeErr
+		}
+		return err
+	}
+
+	if verdict == Defer {
+		p.mu.Lock()
+		if !ctx.Completed() {
+			p.deferred[ctx] = struct{}{}
+			p.stats.Deferred++
+		}
+		p.mu.Unlock()
+		return nil
+	}
+
+	if err := ctx.complete(verdict); err != nil && err != ErrCompleted {
+		return err
+	}
+	return nil
+}
+
+// Calls the matching handlers until one of them returns a final verdict
+func (p *Pipeline) run(ctx *Context) (Verdict, error) {
+	for _, route := range p.routes {
+		if route.match != nil && !route.match(ctx.Packet) {
+			continue
+		}
+
+		verdict, err := p.call(route.handler, ctx)
+		if err != nil {
+			return verdict, err
+		}
+
+		switch verdict {
+		case Accept:
+		case Modify:
+			ctx.modified = true
+		case Drop, Reinject, Defer:
+			return verdict, nil
+		default:
+			return verdict, fmt.Errorf("unknown verdict %d", verdict)
+		}
+	}
+
+	if ctx.modified {
+		return Modify, nil
+	}
+	return Accept, nil
+}
+
+// Calls the handler and turns a panic into an error
+func (p *Pipeline) call(handler Handler, ctx *Context) (verdict Verdict, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.count(func(s *Stats) { s.Panics++ })
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	return handler.Handle(ctx)
+}
+
+// Reinject or drop the packet of the context
+// Called once per packet by Context.complete
+func (p *Pipeline) apply(ctx *Context, verdict Verdict) error {
+	p.mu.Lock()
+	if _, ok := p.deferred[ctx]; ok {
+		delete(p.deferred, ctx)
+		p.stats.Deferred--
+	}
+	p.mu.Unlock()
+
+	packet := ctx.Packet
+	defer packet.Release()
+	if p.OnComplete != nil {
+		// Called before the packet is released
+		defer func() { p.OnComplete(ctx, verdict, time.Since(ctx.start)) }()
+	}
+
+	sender := p.sender
+	switch verdict {
+	case Drop:
+		p.count(func(s *Stats) { s.Dropped++ })
+		return nil
+	case Reinject:
+		if ctx.Target == nil {
+			// The ErrorVerdict is applied and counted instead
+			err := errors.New("no target to reinject the packet")
+			p.fail(ctx, err)
+			verdict = p.errorVerdict()
+			if verdict == Drop {
+				p.count(func(s *Stats) { s.Dropped++ })
+				return err
+			}
+			p.count(func(s *Stats) { s.Accepted++ })
+			break
+		}
+		sender = ctx.Target
+		p.count(func(s *Stats) { s.Reinjected++ })
+	case Modify:
+		p.count(func(s *Stats) { s.Modified++ })
+	default:
+		p.count(func(s *Stats) { s.Accepted++ })
+	}
+
+	if ctx.modified || verdict == Modify {
+		if calculator, ok := sender.(checksumCalculator); ok {
+			calculator.HelperCalcChecksum(packet)
+		}
+	}
+
+	if _, err := sender.Send(packet); err != nil {
+		p.count(func(s *Stats) { s.SendErrors++ })
+		p.fail(ctx, err)
+		return err
+	}
+	return nil
+}
+
+func (p *Pipeline) errorVerdict() Verdict {
+	if p.ErrorVerdict == Drop {
+		return Drop
+	}
+	return Accept
+}
+
+func (p *Pipeline) fail(ctx *Context, err error) {
+	if p.OnError != nil {
+		p.OnError(ctx, err)
+	}
+}
+
+func (p *Pipeline) count(update func(s *Stats)) {
+	p.mu.Lock()
+	update(&p.stats)
+	p.mu.Unlock()
+}
+
+// Process the packets of the channel until it is closed
+// The deferred packets are left to their handlers, see Close
+func (p *Pipeline) Run(packets <-chan *godivert.Packet) {
+	for packet := range packets {
+		p.Process(packet)
+	}
+}
+
+// Process the packets of the receiver until Recv fails and returns the error
+func (p *Pipeline) Receive(receiver godivert.Receiver) error {
+	for {
+		packet, err := receiver.Recv()
+		if err != nil {
+			return err
+		}
+		p.Process(packet)
+	}
+}
+
+// Returns a copy of the counters
+func (p *Pipeline) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Complete the deferred packets with the ErrorVerdict so that no packet is lost
+// Returns the number of packets completed
+func (p *Pipeline) Close() int {
+	p.mu.Lock()
+	pending := make([]*Context, 0, len(p.deferred))
+	for ctx := range p.deferred {
+		pending = append(pending, ctx)
+	}
+	p.mu.Unlock()
+
+	completed := 0
+	for _, ctx := range pending {
+		if ctx.complete(p.errorVerdict()) != ErrCompleted {
+			completed++
+		}
+	}
+	return completed
+}
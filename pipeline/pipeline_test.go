@@ -0,0 +1,223 @@
+package pipeline
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Records the packets sent
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []*godivert.Packet
+}
+
+func (s *fakeSender) Send(packet *godivert.Packet) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, packet)
+	return packet.PacketLen, nil
+}
+
+func (s *fakeSender) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+// Returns a pipeline sending with sender and recording the verdicts applied
+func newTestPipeline(sender godivert.Sender, errorVerdict Verdict) (*Pipeline, *[]Verdict) {
+	var mu sync.Mutex
+	completed := &[]Verdict{}
+	p := New(sender)
+	p.ErrorVerdict = errorVerdict
+	p.OnComplete = func(ctx *Context, verdict Verdict, elapsed time.Duration) {
+		mu.Lock()
+		*completed = append(*completed, verdict)
+		mu.Unlock()
+	}
+	return p, completed
+}
+
+func newPacket() *godivert.Packet {
+	raw := testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN)
+	return &godivert.Packet{Raw: raw, PacketLen: uint(len(raw))}
+}
+
+func TestProcess(t *testing.T) {
+	failure := errors.New("handler failed")
+	target := &fakeSender{}
+
+	tests := []struct {
+		name         string
+		errorVerdict Verdict
+		handler      func(ctx *Context) (Verdict, error)
+		wantErr      bool
+		wantVerdict  Verdict
+		wantSent     int
+		wantTarget   int
+		wantStats    Stats
+	}{
+		{
+			name:        "accept",
+			handler:     func(ctx *Context) (Verdict, error) { return Accept, nil },
+			wantVerdict: Accept, wantSent: 1,
+			wantStats: Stats{Processed: 1, Accepted: 1},
+		},
+		{
+			name:        "drop",
+			handler:     func(ctx *Context) (Verdict, error) { return Drop, nil },
+			wantVerdict: Drop,
+			wantStats:   Stats{Processed: 1, Dropped: 1},
+		},
+		{
+			name:        "modify",
+			handler:     func(ctx *Context) (Verdict, error) { return Modify, nil },
+			wantVerdict: Modify, wantSent: 1,
+			wantStats: Stats{Processed: 1, Modified: 1},
+		},
+		{
+			name: "reinject",
+			handler: func(ctx *Context) (Verdict, error) {
+				ctx.Target = target
+				return Reinject, nil
+			},
+			wantVerdict: Reinject, wantTarget: 1,
+			wantStats: Stats{Processed: 1, Reinjected: 1},
+		},
+		{
+			name:        "reinject without target accepted",
+			handler:     func(ctx *Context) (Verdict, error) { return Reinject, nil },
+			wantVerdict: Accept, wantSent: 1,
+			wantStats: Stats{Processed: 1, Accepted: 1},
+		},
+		{
+			name:         "reinject without target dropped",
+			errorVerdict: Drop,
+			handler:      func(ctx *Context) (Verdict, error) { return Reinject, nil },
+			wantErr:      true,
+			wantVerdict:  Drop,
+			wantStats:    Stats{Processed: 1, Dropped: 1},
+		},
+		{
+			name:        "error accepted",
+			handler:     func(ctx *Context) (Verdict, error) { return Drop, failure },
+			wantErr:     true,
+			wantVerdict: Accept, wantSent: 1,
+			wantStats: Stats{Processed: 1, Accepted: 1, Errors: 1},
+		},
+		{
+			name:         "error dropped",
+			errorVerdict: Drop,
+			handler:      func(ctx *Context) (Verdict, error) { return Accept, failure },
+			wantErr:      true,
+			wantVerdict:  Drop,
+			wantStats:    Stats{Processed: 1, Dropped: 1, Errors: 1},
+		},
+		{
+			name:        "panic accepted",
+			handler:     func(ctx *Context) (Verdict, error) { panic("boom") },
+			wantErr:     true,
+			wantVerdict: Accept, wantSent: 1,
+			wantStats: Stats{Processed: 1, Accepted: 1, Errors: 1, Panics: 1},
+		},
+		{
+			name:         "panic dropped",
+			errorVerdict: Drop,
+			handler:      func(ctx *Context) (Verdict, error) { panic("boom") },
+			wantErr:      true,
+			wantVerdict:  Drop,
+			wantStats:    Stats{Processed: 1, Dropped: 1, Errors: 1, Panics: 1},
+		},
+		{
+			name: "completed by the handler",
+			handler: func(ctx *Context) (Verdict, error) {
+				return Defer, ctx.Complete(Drop)
+			},
+			wantVerdict: Drop,
+			wantStats:   Stats{Processed: 1, Dropped: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target.sent = nil
+			sender := &fakeSender{}
+			p, completed := newTestPipeline(sender, test.errorVerdict)
+			p.HandleFunc("", test.handler)
+
+			if err := p.Process(newPacket()); (err != nil) != test.wantErr {
+				t.Errorf("Process() = %v, want error %v", err, test.wantErr)
+			}
+			if len(*completed) != 1 || (*completed)[0] != test.wantVerdict {
+				t.Errorf("verdicts applied = %v, want [%v]", *completed, test.wantVerdict)
+			}
+			if got := sender.count(); got != test.wantSent {
+				t.Errorf("%d packets sent, want %d", got, test.wantSent)
+			}
+			if got := target.count(); got != test.wantTarget {
+				t.Errorf("%d packets sent to the target, want %d", got, test.wantTarget)
+			}
+			if got := p.Stats(); got != test.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", got, test.wantStats)
+			}
+		})
+	}
+}
+
+func TestDefer(t *testing.T) {
+	sender := &fakeSender{}
+	p, completed := newTestPipeline(sender, Accept)
+	var held []*Context
+	p.HandleFunc("", func(ctx *Context) (Verdict, error) {
+		held = append(held, ctx)
+		return Defer, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := p.Process(newPacket()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*completed) != 0 || sender.count() != 0 || p.Stats().Deferred != 3 {
+		t.Fatalf("deferred packets completed: %v, %d sent, %+v", *completed, sender.count(), p.Stats())
+	}
+
+	// Complete then complete again
+	if err := held[0].Complete(Modify); err != nil {
+		t.Fatal(err)
+	}
+	if err := held[0].Complete(Drop); err != ErrCompleted {
+		t.Errorf("second Complete() = %v, want ErrCompleted", err)
+	}
+	if err := held[1].Complete(Defer); err == nil {
+		t.Error("Complete(Defer) succeeded")
+	}
+	if len(*completed) != 1 || sender.count() != 1 || p.Stats().Deferred != 2 {
+		t.Fatalf("after Complete: %v, %d sent, %+v", *completed, sender.count(), p.Stats())
+	}
+
+	// Close completes the pending packets with the ErrorVerdict
+	if n := p.Close(); n != 2 {
+		t.Errorf("Close() = %d, want 2", n)
+	}
+	if n := p.Close(); n != 0 {
+		t.Errorf("second Close() = %d, want 0", n)
+	}
+	if err := held[2].Complete(Drop); err != ErrCompleted {
+		t.Errorf("Complete() after Close() = %v, want ErrCompleted", err)
+	}
+
+	want := Stats{Processed: 3, Modified: 1, Accepted: 2}
+	if got := p.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if len(*completed) != 3 || sender.count() != 3 {
+		t.Errorf("verdicts applied = %v and %d packets sent, want 3", *completed, sender.count())
+	}
+}
@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Represents the decision of a handler about a packet
+type Verdict int
+
+const (
+	// Reinject the packet as it is, the next matching handler is called first
+	Accept Verdict = iota
+	// Drop the packet
+	Drop
+	// Reinject the packet with new checksums, the next matching handler is called first
+	Modify
+	// Send the packet with Context.Target instead of the pipeline's sender
+	Reinject
+	// The handler keeps the packet and completes it later with Context.Complete
+	Defer
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Accept:
+		return "Accept"
+	case Drop:
+		return "Drop"
+	case Modify:
+		return "Modify"
+	case Reinject:
+		return "Reinject"
+	case Defer:
+		return "Defer"
+	default:
+		return "Unknown Verdict"
+	}
+}
+
+// Returned by Context.Complete when the packet has already been reinjected or dropped
+var ErrCompleted = errors.New("the packet has already been completed")
+
+// Holds a packet going through the pipeline
+type Context struct {
+	Packet *godivert.Packet
+	// Sender used by the Reinject verdict
+	Target godivert.Sender
+
+	pipeline *Pipeline
+	modified bool
+	done     uint32
+	start    time.Time
+}
+
+// Returns true once the packet has been reinjected or dropped
+func (c *Context) Completed() bool {
+	return atomic.LoadUint32(&c.done) == 1
+}
+
+// Reinject or drop a deferred packet according to the verdict
+// A packet is completed exactly once, the next calls return ErrCompleted
+func (c *Context) Complete(verdict Verdict) error {
+	if verdict == Defer || verdict < Accept || verdict > Defer {
+		return errors.New("a packet can't be completed with the " + verdict.String() + " verdict")
+	}
+	return c.complete(verdict)
+}
+
+func (c *Context) complete(verdict Verdict) error {
+	if !atomic.CompareAndSwapUint32(&c.done, 0, 1) {
+		return ErrCompleted
+	}
+	return c.pipeline.apply(c, verdict)
+}
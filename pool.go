@@ -0,0 +1,63 @@
+package godivert
+
+import "sync"
+
+// Maximum size of a diverted packet
+// Loopback packets and LSO super-packets can be as large as the maximum IPv6 packet
+const MaxPacketSize = 0xffff + 40
+
+// Recycles packets and their buffers so that receiving doesn't allocate
+// Packets are taken from the pool by Recv and given back with Packet.Release
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// Create a new BufferPool of packets holding up to size bytes
+// A size of 0 uses MaxPacketSize
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = MaxPacketSize
+	}
+
+	bp := &BufferPool{size: size}
+	bp.pool.New = func() interface{} {
+		return &Packet{buffer: make([]byte, bp.size)}
+	}
+	return bp
+}
+
+// Returns the size of the buffers of the pool
+func (bp *BufferPool) Size() int {
+	return bp.size
+}
+
+// Returns a packet whose Raw field is a whole buffer of the pool and with a zero address
+// The packet goes back in the pool with Release
+func (bp *BufferPool) Get() *Packet {
+	packet := bp.pool.Get().(*Packet)
+	packet.pool = bp
+	packet.reset(packet.buffer)
+	packet.addr = WinDivertAddress{}
+	packet.Addr = &packet.addr
+	return packet
+}
+
+// Give the packet back to its pool, the packet must not be used anymore
+// Does nothing for packets that don't come from a BufferPool
+func (p *Packet) Release() {
+	pool := p.pool
+	if pool == nil {
+		return
+	}
+
+	p.pool = nil
+	pool.pool.Put(p)
+}
+
+// Scratch buffers of unpooled handles, packets are copied out of them
+var recvBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([MaxPacketSize]byte)
+	},
+}
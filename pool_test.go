@@ -0,0 +1,55 @@
+package godivert
+
+import (
+	"net"
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Receives, parses, rewrites and releases a packet of the pool like a handle with a BufferPool does
+func recvPooled(pool *BufferPool, raw, addr []byte, ip net.IP) {
+	packet := pool.Get()
+	n := copy(packet.buffer, raw)
+	packet.addr.UnmarshalABI(addr, ABIVersion2)
+	packet.reset(packet.buffer[:n])
+
+	if packet.ParseHeaders() != nil {
+		panic("invalid packet")
+	}
+	packet.SetSrcIP(ip)
+	packet.SetDstPort(8080)
+	packet.IpHdr.(*header.IPv4Header).SetTTL(63)
+	packet.NextHeader.(*header.TCPHeader).SetFlags(header.TCPFlagSYN | header.TCPFlagACK)
+	_ = packet.Direction()
+	_ = packet.Payload()
+	packet.Release()
+}
+
+func TestBufferPoolAllocs(t *testing.T) {
+	pool := NewBufferPool(0)
+	raw := testpacket.SYN()
+	addr := abiAddress(ABIVersion2, 1)
+	ip := net.ParseIP("10.0.0.1")
+
+	// Fills the pool
+	recvPooled(pool, raw, addr, ip)
+
+	if allocs := testing.AllocsPerRun(100, func() { recvPooled(pool, raw, addr, ip) }); allocs != 0 {
+		t.Errorf("%v allocations per packet, want 0", allocs)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	pool := NewBufferPool(0)
+	raw := testpacket.SYN()
+	addr := abiAddress(ABIVersion2, 1)
+	ip := net.ParseIP("10.0.0.1")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recvPooled(pool, raw, addr, ip)
+	}
+}
@@ -0,0 +1,291 @@
+package godivert
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+const (
+	// How long a closed connection is remembered, so that its last ACK
+	// and the retransmitted FINs are still redirected
+	redirectTimeWait = 2 * time.Minute
+	// How long a connection whose SYN hasn't been answered by the proxy is remembered
+	redirectSynTimeout = 2 * time.Minute
+	// How long an idle open connection is remembered
+	redirectIdleTimeout = 2 * time.Hour
+	// Interval between the removals of the expired connections
+	redirectSweepInterval = time.Minute
+)
+
+// Represents the original destination of a redirected TCP connection
+type redirectEntry struct {
+	origIP   net.IP
+	origPort uint16
+
+	replied   bool
+	clientFin bool
+	proxyFin  bool
+	closed    bool
+	// Time at which the connection is forgotten, pushed back by every segment until it is closed
+	expires time.Time
+}
+
+// Redirector transparently redirects outbound TCP connections to a local proxy.
+//
+// Outbound packets matching the filter are reflected back to the local machine
+// on the proxy port: the proxy sees a connection coming from the original destination
+// IP with the client's source port. Packets sent by the proxy are reflected back to
+// the client with the original destination port so the application sees
+// the original destination.
+//
+// The proxy can then call OriginalDst with the remote address of an accepted connection
+// to know where the client wanted to connect.
+type Redirector struct {
+	wd        *WinDivertHandle
+	proxyPort uint16
+
+	// Returns the current time, replaced by the tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	conns     map[string]*redirectEntry
+	lastSweep time.Time
+}
+
+// Create a new Redirector redirecting outbound TCP packets matching the filter to proxyPort
+// The filter doesn't have to check for outbound TCP packets, it is done by the Redirector
+// Example: NewRedirector("tcp.DstPort == 80", 8080)
+func NewRedirector(filter string, proxyPort uint16) (*Redirector, error) {
+	if proxyPort == 0 {
+		return nil, errors.New("the proxy port can't be 0")
+	}
+
+	fullFilter := fmt.Sprintf("outbound and tcp and ((%s) or tcp.SrcPort == %d)", filter, proxyPort)
+	wd, err := NewWinDivertHandle(fullFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRedirector(wd, proxyPort), nil
+}
+
+// Create a new Redirector rewriting the packets received on a handle opened by the caller
+// The filter of the handle must match the outbound TCP packets to redirect and the packets
+// sent by the proxy (outbound and tcp.SrcPort == proxyPort), Close closes the handle
+func NewRedirectorWithHandle(wd *WinDivertHandle, proxyPort uint16) (*Redirector, error) {
+	if proxyPort == 0 {
+		return nil, errors.New("the proxy port can't be 0")
+	}
+	return newRedirector(wd, proxyPort), nil
+}
+
+func newRedirector(wd *WinDivertHandle, proxyPort uint16) *Redirector {
+	return &Redirector{
+		wd:        wd,
+		proxyPort: proxyPort,
+		now:       time.Now,
+		conns:     make(map[string]*redirectEntry),
+	}
+}
+
+// Receive, rewrite and reinject packets until the handle is closed
+// Packets that can't be redirected are reinjected unmodified
+// The expired connections are removed every redirectSweepInterval while it runs
+func (r *Redirector) Run() error {
+	done := make(chan struct{})
+	defer close(done)
+	go r.sweepLoop(done)
+
+	for {
+		packet, err := r.wd.Recv()
+		if err != nil {
+			return err
+		}
+
+		r.Redirect(packet)
+
+		if _, err := packet.Send(r.wd); err != nil {
+			return err
+		}
+	}
+}
+
+// Removes the expired connections every redirectSweepInterval until done is closed
+func (r *Redirector) sweepLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(redirectSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.sweep(r.now())
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Close the underlying handle, stopping Run
+func (r *Redirector) Close() error {
+	return r.wd.Close()
+}
+
+// Rewrite an outbound packet so it reaches the proxy or, when sent by the proxy, the client
+// Returns false if the packet isn't a TCP packet that has to be redirected
+func (r *Redirector) Redirect(packet *Packet) bool {
+	if packet.Direction() != WinDivertDirectionOutbound || packet.NextHeaderType() != header.TCP {
+		return false
+	}
+
+	tcpHdr := packet.NextHeader.(*header.TCPHeader)
+	srcPort, _ := tcpHdr.SrcPort()
+	dstPort, _ := tcpHdr.DstPort()
+	srcIP, dstIP := packet.SrcIP(), packet.DstIP()
+
+	if srcPort == r.proxyPort {
+		// PROXY ---> CLIENT
+		// The proxy is replying to dstIP:dstPort which is the original destination
+		// IP and the client's port, restore the original destination port
+		key := redirectKey(dstIP, dstPort)
+
+		r.mu.Lock()
+		entry, ok := r.lookup(key)
+		if ok {
+			entry.replied = true
+			entry.track(tcpHdr, false, r.now())
+		}
+		r.mu.Unlock()
+
+		if !ok {
+			return false
+		}
+
+		tcpHdr.SetSrcPort(entry.origPort)
+	} else {
+		// CLIENT ---> PROXY
+		key := redirectKey(dstIP, srcPort)
+
+		// Only a SYN opens a connection, the other packets of unknown connections
+		// are left alone instead of being tracked forever
+		r.mu.Lock()
+		entry, ok := r.lookup(key)
+		if tcpHdr.SYN() && !tcpHdr.ACK() {
+			entry = &redirectEntry{
+				origIP:   dstIP,
+				origPort: dstPort,
+			}
+			r.conns[key] = entry
+			ok = true
+		}
+		if ok {
+			entry.track(tcpHdr, true, r.now())
+		}
+		r.mu.Unlock()
+
+		if !ok {
+			return false
+		}
+
+		tcpHdr.SetDstPort(r.proxyPort)
+	}
+
+	// Reflect the packet to the local machine
+	packet.SetSrcIP(dstIP)
+	packet.SetDstIP(srcIP)
+	packet.Addr.SetDirection(WinDivertDirectionInbound)
+
+	return true
+}
+
+// Returns the entry of the connection, expired entries are removed
+// Must be called with r.mu held
+func (r *Redirector) lookup(key string) (*redirectEntry, bool) {
+	now := r.now()
+	if now.Sub(r.lastSweep) >= redirectSweepInterval {
+		r.sweep(now)
+	}
+
+	entry, ok := r.conns[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(now) {
+		delete(r.conns, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// Removes the expired connections
+// Must be called with r.mu held
+func (r *Redirector) sweep(now time.Time) {
+	for key, entry := range r.conns {
+		if entry.expired(now) {
+			delete(r.conns, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// Pushes back the expiration of an open connection after a segment
+// and starts its TIME_WAIT once it has been reset or closed by both ends
+// The entry is kept for redirectTimeWait so the last ACK, which can be sent by
+// either end, and the retransmissions are still redirected
+func (e *redirectEntry) track(tcpHdr *header.TCPHeader, fromClient bool, now time.Time) {
+	if e.closed {
+		return
+	}
+
+	if tcpHdr.FIN() {
+		if fromClient {
+			e.clientFin = true
+		} else {
+			e.proxyFin = true
+		}
+	}
+
+	switch {
+	case tcpHdr.RST() || e.clientFin && e.proxyFin:
+		e.closed = true
+		e.expires = now.Add(redirectTimeWait)
+	case e.replied:
+		e.expires = now.Add(redirectIdleTimeout)
+	default:
+		e.expires = now.Add(redirectSynTimeout)
+	}
+}
+
+// Returns true if the connection is closed or idle for longer than its timeout
+func (e *redirectEntry) expired(now time.Time) bool {
+	return now.After(e.expires)
+}
+
+// Returns the original destination of a connection accepted by the proxy
+// addr is the remote address of the accepted connection (net.Conn.RemoteAddr())
+func (r *Redirector) OriginalDst(addr net.Addr) (*net.TCPAddr, error) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("%v isn't a TCP address", addr)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.lookup(redirectKey(tcpAddr.IP, uint16(tcpAddr.Port)))
+	if !ok {
+		return nil, fmt.Errorf("no redirected connection from %v", addr)
+	}
+
+	return &net.TCPAddr{IP: entry.origIP, Port: int(entry.origPort)}, nil
+}
+
+func redirectKey(ip net.IP, port uint16) string {
+	return fmt.Sprintf("%s:%d", ip, port)
+}
@@ -0,0 +1,129 @@
+package godivert
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Returns an outbound TCP segment
+func tcpSegment(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16, flags uint8) *Packet {
+	t.Helper()
+	raw := testpacket.TCP(src, srcPort, dst, dstPort, flags)
+	packet := &Packet{Raw: raw, PacketLen: uint(len(raw)), Addr: &WinDivertAddress{}}
+	packet.Addr.SetDirection(WinDivertDirectionOutbound)
+	if err := packet.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestRedirect(t *testing.T) {
+	const (
+		client = "172.16.0.1"
+		server = "93.184.216.34"
+	)
+	r := newRedirector(nil, 8080)
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { return now }
+	remote := &net.TCPAddr{IP: net.ParseIP(server), Port: 49368}
+
+	steps := []struct {
+		name        string
+		packet      *Packet
+		want        bool
+		wantSrc     string
+		wantSrcPort uint16
+		wantDst     string
+		wantDstPort uint16
+	}{
+		{"ack of unknown connection", tcpSegment(t, client, 49368, server, 80, header.TCPFlagACK), false, client, 49368, server, 80},
+		{"client syn", tcpSegment(t, client, 49368, server, 80, header.TCPFlagSYN), true, server, 49368, client, 8080},
+		{"proxy syn ack", tcpSegment(t, client, 8080, server, 49368, header.TCPFlagSYN|header.TCPFlagACK), true, server, 80, client, 49368},
+		{"proxy fin", tcpSegment(t, client, 8080, server, 49368, header.TCPFlagFIN|header.TCPFlagACK), true, server, 80, client, 49368},
+		{"client fin", tcpSegment(t, client, 49368, server, 80, header.TCPFlagFIN|header.TCPFlagACK), true, server, 49368, client, 8080},
+		{"proxy last ack", tcpSegment(t, client, 8080, server, 49368, header.TCPFlagACK), true, server, 80, client, 49368},
+		{"client retransmitted fin", tcpSegment(t, client, 49368, server, 80, header.TCPFlagFIN|header.TCPFlagACK), true, server, 49368, client, 8080},
+	}
+
+	for _, step := range steps {
+		packet := step.packet
+		if got := r.Redirect(packet); got != step.want {
+			t.Fatalf("%s: Redirect() = %v, want %v", step.name, got, step.want)
+		}
+		if src, dst := packet.SrcIP().String(), packet.DstIP().String(); src != step.wantSrc || dst != step.wantDst {
+			t.Errorf("%s: %s > %s, want %s > %s", step.name, src, dst, step.wantSrc, step.wantDst)
+		}
+		if srcPort, _ := packet.SrcPort(); srcPort != step.wantSrcPort {
+			t.Errorf("%s: source port %d, want %d", step.name, srcPort, step.wantSrcPort)
+		}
+		if dstPort, _ := packet.DstPort(); dstPort != step.wantDstPort {
+			t.Errorf("%s: destination port %d, want %d", step.name, dstPort, step.wantDstPort)
+		}
+	}
+
+	if len(r.conns) != 1 {
+		t.Fatalf("%d tracked connections, want 1", len(r.conns))
+	}
+	origDst, err := r.OriginalDst(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origDst.String() != server+":80" {
+		t.Errorf("OriginalDst() = %v, want %s:80", origDst, server)
+	}
+
+	// End of the TIME_WAIT, the retransmission didn't extend it
+	now = now.Add(redirectTimeWait + time.Second)
+	if r.Redirect(tcpSegment(t, client, 49368, server, 80, header.TCPFlagACK)) {
+		t.Error("the connection is still redirected after its TIME_WAIT")
+	}
+	if len(r.conns) != 0 {
+		t.Errorf("%d tracked connections, want 0", len(r.conns))
+	}
+	if _, err := r.OriginalDst(remote); err == nil {
+		t.Error("OriginalDst() of an expired connection succeeded")
+	}
+}
+
+func TestRedirectIdle(t *testing.T) {
+	const (
+		client = "172.16.0.1"
+		server = "93.184.216.34"
+	)
+	r := newRedirector(nil, 8080)
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { return now }
+
+	// The proxy never answers the first SYN, the second connection is established
+	r.Redirect(tcpSegment(t, client, 49368, server, 80, header.TCPFlagSYN))
+	r.Redirect(tcpSegment(t, client, 49369, server, 80, header.TCPFlagSYN))
+	r.Redirect(tcpSegment(t, client, 8080, server, 49369, header.TCPFlagSYN|header.TCPFlagACK))
+
+	// Every segment pushes back the expiration of the established connection
+	for i := 0; i < 3; i++ {
+		now = now.Add(redirectSynTimeout)
+		if !r.Redirect(tcpSegment(t, client, 49369, server, 80, header.TCPFlagACK)) {
+			t.Fatalf("the established connection isn't redirected after %v", time.Duration(i+1)*redirectSynTimeout)
+		}
+	}
+
+	// The unanswered SYN is removed by the sweep, without looking it up
+	if _, ok := r.conns[redirectKey(net.ParseIP(server), 49368)]; ok {
+		t.Error("the unanswered SYN hasn't expired")
+	}
+	if len(r.conns) != 1 {
+		t.Errorf("%d tracked connections, want 1", len(r.conns))
+	}
+
+	now = now.Add(redirectIdleTimeout + time.Second)
+	r.mu.Lock()
+	r.sweep(now)
+	r.mu.Unlock()
+	if len(r.conns) != 0 {
+		t.Errorf("%d tracked connections after the idle timeout, want 0", len(r.conns))
+	}
+}
@@ -0,0 +1,274 @@
+package godivert
+
+import (
+	"errors"
+	"net"
+
+	"github.com/williamfhe/godivert/header"
+)
+
+// Maximum length of an ICMP error message, the original datagram is truncated to fit
+// 576 bytes for IPv4 (RFC 1812) and the minimum MTU for IPv6 (RFC 4443)
+const (
+	MaxICMPv4ErrorLen = 576
+	MaxICMPv6ErrorLen = 1280
+)
+
+// Represents the reason given by an ICMP Destination Unreachable message
+// The zero value is RejectPortUnreachable
+type RejectCode uint8
+
+const (
+	RejectPortUnreachable RejectCode = iota
+	RejectHostUnreachable
+	RejectNetUnreachable
+	RejectAdminProhibited
+)
+
+func (c RejectCode) String() string {
+	switch c {
+	case RejectPortUnreachable:
+		return "PortUnreachable"
+	case RejectHostUnreachable:
+		return "HostUnreachable"
+	case RejectNetUnreachable:
+		return "NetUnreachable"
+	case RejectAdminProhibited:
+		return "AdminProhibited"
+	default:
+		return "Unknown RejectCode"
+	}
+}
+
+// Returns the ICMPv4 and ICMPv6 codes of the reason
+func (c RejectCode) icmpCodes() (uint8, uint8, error) {
+	switch c {
+	case RejectPortUnreachable:
+		return header.ICMPv4CodePortUnreachable, header.ICMPv6CodePortUnreachable, nil
+	case RejectHostUnreachable:
+		return header.ICMPv4CodeHostUnreachable, header.ICMPv6CodeAddressUnreachable, nil
+	case RejectNetUnreachable:
+		return header.ICMPv4CodeNetUnreachable, header.ICMPv6CodeNoRoute, nil
+	case RejectAdminProhibited:
+		return header.ICMPv4CodeAdminProhibited, header.ICMPv6CodeAdminProhibited, nil
+	default:
+		return 0, 0, errors.New("unknown reject code")
+	}
+}
+
+// Represents the options of Reject
+// The zero value resets TCP connections towards the sender only and answers
+// the other protocols with a Port Unreachable message
+type RejectOptions struct {
+	// Code of the ICMP Destination Unreachable messages
+	Code RejectCode
+	// Also reset the TCP connection on the side of the destination of the packet
+	ResetBoth bool
+	// Answer TCP packets with an ICMP message instead of a reset
+	ICMPForTCP bool
+}
+
+// Returns a TCP reset answering p, ready to be sent
+// The reset acknowledges p so that the sender accepts it and aborts the connection at once
+func NewTCPReset(p *Packet) (*Packet, error) {
+	tcpHdr, err := rejectableTCP(p)
+	if err != nil {
+		return nil, err
+	}
+
+	reset := NewReply(p)
+	resetHdr := reset.NextHeader.(*header.TCPHeader)
+	resetHdr.SetWindow(0)
+
+	if tcpHdr.ACK() {
+		resetHdr.SetFlags(header.TCPFlagRST)
+	} else {
+		// Nothing to take the sequence number from, the acknowledgment makes the reset acceptable
+		resetHdr.SetFlags(header.TCPFlagRST | header.TCPFlagACK)
+	}
+	return reset, nil
+}
+
+// Returns a TCP reset going the same way as p, ready to be sent
+// The destination of p sees the reset in place of p and aborts its side of the connection
+func NewTCPResetForward(p *Packet) (*Packet, error) {
+	tcpHdr, err := rejectableTCP(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reversing a reply of the reply gives back the addresses and direction of p
+	reset := NewReply(p)
+	reset.Reverse()
+
+	resetHdr := reset.NextHeader.(*header.TCPHeader)
+	resetHdr.SetSeqNum(tcpHdr.SeqNum())
+	resetHdr.SetAckNum(0)
+	resetHdr.SetWindow(0)
+	resetHdr.SetFlags(header.TCPFlagRST)
+	return reset, nil
+}
+
+// Returns the TCP header of p if a reset can answer it
+func rejectableTCP(p *Packet) (*header.TCPHeader, error) {
+	if err := p.VerifyParsed(); err != nil {
+		return nil, err
+	}
+
+	tcpHdr, ok := p.NextHeader.(*header.TCPHeader)
+	if !ok {
+		return nil, errors.New("the packet is not a TCP packet")
+	}
+	// RFC 793: a reset is never answered
+	if tcpHdr.RST() {
+		return nil, errors.New("can't answer a TCP reset with a reset")
+	}
+	return tcpHdr, nil
+}
+
+// Returns an ICMPv4 or ICMPv6 Destination Unreachable message answering p, ready to be sent
+// The message embeds the beginning of p, truncated to MaxICMPv4ErrorLen or MaxICMPv6ErrorLen
+// ICMP error messages, IPv4 fragments other than the first one and packets sent to or from
+// a multicast or broadcast address are never answered (RFC 1122)
+func NewDestUnreachable(p *Packet, code RejectCode) (*Packet, error) {
+	if err := p.VerifyParsed(); err != nil {
+		return nil, err
+	}
+
+	v4Code, v6Code, err := code.icmpCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkICMPErrorAllowed(p); err != nil {
+		return nil, err
+	}
+
+	ipHdrLen, icmpType, icmpCode, protocol, maxLen := header.IPv6HeaderLen,
+		uint8(header.ICMPv6TypeDestUnreachable), v6Code, uint8(header.ICMPv6), MaxICMPv6ErrorLen
+	if p.ipVersion == 4 {
+		ipHdrLen, icmpType, icmpCode, protocol, maxLen = header.IPv4HeaderLen,
+			header.ICMPv4TypeDestUnreachable, v4Code, header.ICMPv4, MaxICMPv4ErrorLen
+	}
+
+	// ICMPv4 and ICMPv6 headers have the same length
+	hdrLen := ipHdrLen + header.ICMPv4HeaderLen
+	original := p.Raw[:p.PacketLen]
+	if hdrLen+len(original) > maxLen {
+		original = original[:maxLen-hdrLen]
+	}
+
+	raw := make([]byte, hdrLen+len(original))
+	copy(raw[:ipHdrLen], p.Raw[:ipHdrLen])
+	copy(raw[hdrLen:], original)
+
+	if p.ipVersion == 4 {
+		// No options, not fragmented
+		raw[0] = 0x45
+		raw[1] = 0
+		raw[6], raw[7] = 0, 0
+		raw[9] = protocol
+	} else {
+		// Clear the traffic class and the flow label
+		raw[0], raw[1], raw[2], raw[3] = 0x60, 0, 0, 0
+		raw[6] = protocol
+	}
+
+	message := &Packet{
+		Raw:       raw,
+		PacketLen: uint(len(raw)),
+	}
+	message.copyAddr(p.Addr)
+
+	message.ParseHeaders()
+	message.setLengths()
+
+	switch ipHdr := message.IpHdr.(type) {
+	case *header.IPv4Header:
+		ipHdr.SetTTL(ReplyTTL)
+	case *header.IPv6Header:
+		ipHdr.SetHopLimit(ReplyTTL)
+	}
+
+	switch icmpHdr := message.NextHeader.(type) {
+	case *header.ICMPv4Header:
+		icmpHdr.SetType(icmpType)
+		icmpHdr.SetCode(icmpCode)
+	case *header.ICMPv6Header:
+		icmpHdr.SetType(icmpType)
+		icmpHdr.SetCode(icmpCode)
+	}
+
+	message.Reverse()
+	return message, nil
+}
+
+// Returns an error if RFC 1122 forbids answering p with an ICMP error message
+func checkICMPErrorAllowed(p *Packet) error {
+	switch nextHdr := p.NextHeader.(type) {
+	case *header.ICMPv4Header:
+		switch nextHdr.Type() {
+		// Echo Reply, Echo Request, Timestamp and Timestamp Reply
+		case 0, 8, 13, 14:
+		default:
+			return errors.New("can't answer an ICMPv4 error message")
+		}
+	case *header.ICMPv6Header:
+		// Types below 128 are error messages
+		if nextHdr.Type() < 128 {
+			return errors.New("can't answer an ICMPv6 error message")
+		}
+	}
+
+	if ipHdr, ok := p.IpHdr.(*header.IPv4Header); ok && ipHdr.FragOff() != 0 {
+		return errors.New("can't answer an IPv4 fragment other than the first one")
+	}
+
+	// RFC 1122 3.2.2: the packet must be sent by a single host to a single host
+	// Directed broadcasts can't be told apart without the netmask of the network
+	if dstIP := p.DstIP(); dstIP.IsMulticast() || dstIP.Equal(net.IPv4bcast) {
+		return errors.New("can't answer a packet sent to a multicast or broadcast address")
+	}
+	if srcIP := p.SrcIP(); srcIP.IsUnspecified() || srcIP.IsMulticast() || srcIP.Equal(net.IPv4bcast) {
+		return errors.New("can't answer a packet whose source isn't a single host")
+	}
+	return nil
+}
+
+// Drop the packet and tell its sender, so that the connection fails at once instead of timing out
+// TCP packets are answered with a reset, the other packets with an ICMP Destination Unreachable message
+// The packet itself is not sent, it only has to be released
+func (wd *WinDivertHandle) Reject(packet *Packet, options RejectOptions) error {
+	if err := packet.VerifyParsed(); err != nil {
+		return err
+	}
+
+	var replies []*Packet
+	if packet.nextHeaderType == header.TCP && !options.ICMPForTCP {
+		reset, err := NewTCPReset(packet)
+		if err != nil {
+			return err
+		}
+		replies = append(replies, reset)
+
+		if options.ResetBoth {
+			forward, err := NewTCPResetForward(packet)
+			if err != nil {
+				return err
+			}
+			replies = append(replies, forward)
+		}
+	} else {
+		message, err := NewDestUnreachable(packet, options.Code)
+		if err != nil {
+			return err
+		}
+		replies = append(replies, message)
+	}
+
+	for _, reply := range replies {
+		if _, err := reply.Send(wd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
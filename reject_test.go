@@ -0,0 +1,168 @@
+package godivert
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+func TestNewTCPReset(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      testpacket.Spec
+		wantErr   bool
+		wantFlags uint8
+		wantSeq   uint32
+		wantAck   uint32
+	}{
+		{
+			name:      "syn",
+			spec:      testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Flags: header.TCPFlagSYN},
+			wantFlags: header.TCPFlagRST | header.TCPFlagACK, wantSeq: 0, wantAck: 1001,
+		},
+		{
+			name: "data",
+			spec: testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Ack: 5000,
+				Flags: header.TCPFlagPSH | header.TCPFlagACK, Payload: make([]byte, 10)},
+			wantFlags: header.TCPFlagRST, wantSeq: 5000, wantAck: 1010,
+		},
+		{
+			name:    "reset",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Flags: header.TCPFlagRST},
+			wantErr: true,
+		},
+		{
+			name:    "udp",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.UDP, SrcPort: 5353, DstPort: 53},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reset, err := NewTCPReset(outboundPacket(t, testpacket.Build(test.spec)))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewTCPReset() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			checkEndpoints(t, reset, test.spec.Dst, test.spec.DstPort, test.spec.Src, test.spec.SrcPort)
+			tcpHdr := reset.NextHeader.(*header.TCPHeader)
+			if tcpHdr.Flags() != test.wantFlags || tcpHdr.Window() != 0 {
+				t.Errorf("Flags() = %#x and Window() = %d, want %#x and 0", tcpHdr.Flags(), tcpHdr.Window(), test.wantFlags)
+			}
+			if tcpHdr.SeqNum() != test.wantSeq || tcpHdr.AckNum() != test.wantAck {
+				t.Errorf("seq %d ack %d, want seq %d ack %d", tcpHdr.SeqNum(), tcpHdr.AckNum(), test.wantSeq, test.wantAck)
+			}
+		})
+	}
+}
+
+func TestNewTCPResetForward(t *testing.T) {
+	raw := testpacket.Build(testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80,
+		Seq: 1000, Ack: 5000, Flags: header.TCPFlagACK})
+
+	reset, err := NewTCPResetForward(outboundPacket(t, raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reset takes the place of the packet
+	if src, dst := reset.SrcIP().String(), reset.DstIP().String(); src != "10.0.0.1" || dst != "10.0.0.2" {
+		t.Errorf("reset from %s to %s, want from 10.0.0.1 to 10.0.0.2", src, dst)
+	}
+	if reset.Direction() != WinDivertDirectionOutbound {
+		t.Error("the reset isn't outbound like the packet")
+	}
+	tcpHdr := reset.NextHeader.(*header.TCPHeader)
+	if tcpHdr.Flags() != header.TCPFlagRST || tcpHdr.SeqNum() != 1000 || tcpHdr.AckNum() != 0 {
+		t.Errorf("flags %#x seq %d ack %d, want RST seq 1000 ack 0", tcpHdr.Flags(), tcpHdr.SeqNum(), tcpHdr.AckNum())
+	}
+}
+
+func TestNewDestUnreachable(t *testing.T) {
+	udpSpec := func(src, dst string, payload int) testpacket.Spec {
+		return testpacket.Spec{Src: src, Dst: dst, Protocol: header.UDP, SrcPort: 5353, DstPort: 53, Payload: make([]byte, payload)}
+	}
+	icmpSpec := func(src, dst string, protocol, icmpType uint8) testpacket.Spec {
+		return testpacket.Spec{Src: src, Dst: dst, Protocol: protocol, Type: icmpType}
+	}
+
+	tests := []struct {
+		name     string
+		spec     testpacket.Spec
+		code     RejectCode
+		wantErr  bool
+		wantType uint8
+		wantCode uint8
+		wantLen  int
+	}{
+		{name: "ipv4 udp", spec: udpSpec("10.0.0.1", "10.0.0.2", 10),
+			wantType: header.ICMPv4TypeDestUnreachable, wantCode: header.ICMPv4CodePortUnreachable, wantLen: 20 + 8 + 38},
+		{name: "ipv4 admin prohibited", spec: udpSpec("10.0.0.1", "10.0.0.2", 10), code: RejectAdminProhibited,
+			wantType: header.ICMPv4TypeDestUnreachable, wantCode: header.ICMPv4CodeAdminProhibited, wantLen: 20 + 8 + 38},
+		{name: "ipv4 truncated", spec: udpSpec("10.0.0.1", "10.0.0.2", 1000),
+			wantType: header.ICMPv4TypeDestUnreachable, wantCode: header.ICMPv4CodePortUnreachable, wantLen: MaxICMPv4ErrorLen},
+		{name: "ipv6 udp", spec: udpSpec("2001:db8::1", "2001:db8::2", 10), code: RejectHostUnreachable,
+			wantType: header.ICMPv6TypeDestUnreachable, wantCode: header.ICMPv6CodeAddressUnreachable, wantLen: 40 + 8 + 58},
+		{name: "ipv6 truncated", spec: udpSpec("2001:db8::1", "2001:db8::2", 2000),
+			wantType: header.ICMPv6TypeDestUnreachable, wantCode: header.ICMPv6CodePortUnreachable, wantLen: MaxICMPv6ErrorLen},
+		{name: "ipv4 echo request", spec: icmpSpec("10.0.0.1", "10.0.0.2", header.ICMPv4, 8),
+			wantType: header.ICMPv4TypeDestUnreachable, wantCode: header.ICMPv4CodePortUnreachable, wantLen: 20 + 8 + 28},
+		{name: "ipv6 echo request", spec: icmpSpec("2001:db8::1", "2001:db8::2", header.ICMPv6, 128),
+			wantType: header.ICMPv6TypeDestUnreachable, wantCode: header.ICMPv6CodePortUnreachable, wantLen: 40 + 8 + 48},
+		{name: "ipv4 icmp error", spec: icmpSpec("10.0.0.1", "10.0.0.2", header.ICMPv4, header.ICMPv4TypeDestUnreachable), wantErr: true},
+		{name: "ipv6 icmp error", spec: icmpSpec("2001:db8::1", "2001:db8::2", header.ICMPv6, header.ICMPv6TypeDestUnreachable), wantErr: true},
+		{name: "later fragment", spec: testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.UDP, FragOffset: 1, Payload: make([]byte, 8)}, wantErr: true},
+		{name: "ipv4 multicast", spec: udpSpec("10.0.0.1", "224.0.0.251", 10), wantErr: true},
+		{name: "ipv4 broadcast", spec: udpSpec("10.0.0.1", "255.255.255.255", 10), wantErr: true},
+		{name: "ipv6 multicast", spec: udpSpec("2001:db8::1", "ff02::fb", 10), wantErr: true},
+		{name: "unspecified source", spec: udpSpec("0.0.0.0", "10.0.0.2", 10), wantErr: true},
+		{name: "unknown code", spec: udpSpec("10.0.0.1", "10.0.0.2", 10), code: RejectCode(42), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := testpacket.Build(test.spec)
+			message, err := NewDestUnreachable(outboundPacket(t, raw), test.code)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewDestUnreachable() = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			checkEndpoints(t, message, test.spec.Dst, 0, test.spec.Src, 0)
+			if int(message.PacketLen) != test.wantLen {
+				t.Errorf("PacketLen = %d, want %d", message.PacketLen, test.wantLen)
+			}
+
+			var icmpType, icmpCode uint8
+			switch icmpHdr := message.NextHeader.(type) {
+			case *header.ICMPv4Header:
+				icmpType, icmpCode = icmpHdr.Type(), icmpHdr.Code()
+			case *header.ICMPv6Header:
+				icmpType, icmpCode = icmpHdr.Type(), icmpHdr.Code()
+			default:
+				t.Fatalf("NextHeader = %T, want an ICMP header", message.NextHeader)
+			}
+			if icmpType != test.wantType || icmpCode != test.wantCode {
+				t.Errorf("type %d code %d, want type %d code %d", icmpType, icmpCode, test.wantType, test.wantCode)
+			}
+
+			// The message embeds the beginning of the packet
+			if embedded := message.Payload(); !bytes.HasPrefix(raw, embedded) || len(embedded) == 0 {
+				t.Errorf("Payload() = %x, want the beginning of %x", embedded, raw)
+			}
+
+			// The message itself is an ICMP error and can't be answered
+			if _, err := NewDestUnreachable(message, test.code); err == nil {
+				t.Error("NewDestUnreachable() answered an ICMP error message")
+			}
+		})
+	}
+}
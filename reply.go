@@ -0,0 +1,193 @@
+package godivert
+
+import (
+	"github.com/williamfhe/godivert/header"
+)
+
+// Hop limit of the packets created by NewReply
+const ReplyTTL = 64
+
+// Returns the length of the transport header of the packet, 0 for unsupported protocols
+func (p *Packet) transportHeaderLen() int {
+	p.VerifyParsed()
+
+	if p.NextHeader == nil {
+		return 0
+	}
+	return p.NextHeader.HeaderLen()
+}
+
+// Returns the data carried by the TCP, UDP or ICMP header of the packet, nil without valid IP header
+func (p *Packet) Payload() []byte {
+	p.VerifyParsed()
+
+	if p.IpHdr == nil {
+		return nil
+	}
+	start := p.hdrLen + p.transportHeaderLen()
+	if start > int(p.PacketLen) {
+		return nil
+	}
+	return p.Raw[start:p.PacketLen]
+}
+
+// Replaces the data carried by the TCP, UDP or ICMP header of the packet
+// The length fields of the IP and UDP headers are updated and the checksums are recalculated by Send
+// Does nothing without valid IP header
+func (p *Packet) SetPayload(payload []byte) {
+	p.VerifyParsed()
+
+	if p.IpHdr == nil {
+		return
+	}
+
+	hdrLen := p.hdrLen + p.transportHeaderLen()
+
+	raw := make([]byte, hdrLen+len(payload))
+	copy(raw, p.Raw[:hdrLen])
+	copy(raw[hdrLen:], payload)
+
+	p.Raw = raw
+	p.PacketLen = uint(len(raw))
+	p.ParseHeaders()
+	p.setLengths()
+}
+
+// Updates the length fields of the IP and UDP headers from the length of Raw
+func (p *Packet) setLengths() {
+	switch ipHdr := p.IpHdr.(type) {
+	case *header.IPv4Header:
+		ipHdr.SetTotalLen(uint16(len(p.Raw)))
+	case *header.IPv6Header:
+		ipHdr.SetPayloadLen(uint16(len(p.Raw) - header.IPv6HeaderLen))
+	}
+
+	if udpHdr, ok := p.NextHeader.(*header.UDPHeader); ok {
+		udpHdr.SetLen(uint16(len(p.Raw) - p.hdrLen))
+	}
+}
+
+// Gives the packet a copy of the address of the packet it is built from
+// The flags describing how the original packet was received don't apply to the new one
+func (p *Packet) copyAddr(addr *WinDivertAddress) {
+	if addr == nil {
+		return
+	}
+
+	p.addr = *addr
+	p.Addr = &p.addr
+
+	p.addr.SetImpostor(false)
+	p.addr.SetSniffed(false)
+	p.addr.SetPseudoIPChecksum(false)
+	p.addr.SetPseudoTCPChecksum(false)
+	p.addr.SetPseudoUDPChecksum(false)
+	p.addr.SetValidIPChecksum(false)
+	p.addr.SetValidTCPChecksum(false)
+	p.addr.SetValidUDPChecksum(false)
+}
+
+// Swap the source and destination IPs and ports of the packet and flip its direction
+// The packet goes back to where it came from, see NewReply to answer a packet instead
+func (p *Packet) Reverse() {
+	p.VerifyParsed()
+
+	srcIP, dstIP := p.SrcIP(), p.DstIP()
+	p.SetSrcIP(dstIP)
+	p.SetDstIP(srcIP)
+
+	switch p.nextHeaderType {
+	case header.TCP, header.UDP:
+		srcPort, _ := p.SrcPort()
+		dstPort, _ := p.DstPort()
+		p.SetSrcPort(dstPort)
+		p.SetDstPort(srcPort)
+	}
+
+	if p.Addr != nil {
+		p.Addr.SetDirection(!p.Addr.Direction())
+	}
+}
+
+// Returns a new packet answering p, without payload and ready to be sent
+// The IPs and ports are swapped, the direction is flipped and the interface of p is kept
+// IPv4 options and TCP options are removed and the hop limit is ReplyTTL
+// A TCP reply has the ACK flag and acknowledges everything p carries: its sequence number is
+// the acknowledgment number of p and its acknowledgment number follows the payload, SYN and FIN of p
+// The flags and the payload of the reply can be changed before sending it, see SetPayload
+// Returns nil if the headers of p are truncated or invalid, or if p has no transport header
+// such as the fragments following the first one
+func NewReply(p *Packet) *Packet {
+	if p.VerifyParsed() != nil || p.NextHeader == nil {
+		return nil
+	}
+
+	ipHdrLen := header.IPv6HeaderLen
+	if p.ipVersion == 4 {
+		ipHdrLen = header.IPv4HeaderLen
+	}
+
+	original, isTCP := p.NextHeader.(*header.TCPHeader)
+	transportLen := p.NextHeader.HeaderLen()
+	if isTCP {
+		transportLen = header.TCPHeaderLen
+	}
+
+	raw := make([]byte, ipHdrLen+transportLen)
+	copy(raw[:ipHdrLen], p.Raw[:ipHdrLen])
+	copy(raw[ipHdrLen:], p.Raw[p.hdrLen:p.hdrLen+transportLen])
+
+	if p.ipVersion == 4 {
+		// No options, keep the Don't Fragment flag only
+		raw[0] = 0x45
+		raw[6] &= 0x40
+		raw[7] = 0
+	} else {
+		// No extension headers
+		raw[6] = p.nextHeaderType
+	}
+
+	reply := &Packet{
+		Raw:       raw,
+		PacketLen: uint(len(raw)),
+	}
+	reply.copyAddr(p.Addr)
+
+	if isTCP {
+		// Data offset of a header without options
+		raw[ipHdrLen+12] = (header.TCPHeaderLen / 4) << 4
+	}
+
+	reply.ParseHeaders()
+	reply.setLengths()
+
+	switch ipHdr := reply.IpHdr.(type) {
+	case *header.IPv4Header:
+		ipHdr.SetTTL(ReplyTTL)
+	case *header.IPv6Header:
+		ipHdr.SetHopLimit(ReplyTTL)
+	}
+
+	if tcpHdr, ok := reply.NextHeader.(*header.TCPHeader); ok {
+		seqLen := uint32(len(p.Payload()))
+		if original.SYN() {
+			seqLen++
+		}
+		if original.FIN() {
+			seqLen++
+		}
+
+		var seqNum uint32
+		if original.ACK() {
+			seqNum = original.AckNum()
+		}
+
+		tcpHdr.SetSeqNum(seqNum)
+		tcpHdr.SetAckNum(original.SeqNum() + seqLen)
+		tcpHdr.SetFlags(header.TCPFlagACK)
+		tcpHdr.Raw[18], tcpHdr.Raw[19] = 0, 0
+	}
+
+	reply.Reverse()
+	return reply
+}
@@ -0,0 +1,172 @@
+package godivert
+
+import (
+	"testing"
+
+	"github.com/williamfhe/godivert/header"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Returns a parsed packet of raw with an outbound address
+func outboundPacket(t *testing.T, raw []byte) *Packet {
+	t.Helper()
+	packet := &Packet{Raw: raw, PacketLen: uint(len(raw)), Addr: &WinDivertAddress{}}
+	packet.Addr.SetDirection(WinDivertDirectionOutbound)
+	if err := packet.ParseHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// Checks the addresses, ports and direction of a packet going from src to dst
+func checkEndpoints(t *testing.T, packet *Packet, src string, srcPort uint16, dst string, dstPort uint16) {
+	t.Helper()
+	if got := packet.SrcIP().String(); got != src {
+		t.Errorf("SrcIP() = %s, want %s", got, src)
+	}
+	if got := packet.DstIP().String(); got != dst {
+		t.Errorf("DstIP() = %s, want %s", got, dst)
+	}
+	if got, _ := packet.SrcPort(); got != srcPort {
+		t.Errorf("SrcPort() = %d, want %d", got, srcPort)
+	}
+	if got, _ := packet.DstPort(); got != dstPort {
+		t.Errorf("DstPort() = %d, want %d", got, dstPort)
+	}
+	if got := packet.Direction(); got != WinDivertDirectionInbound {
+		t.Errorf("Direction() = %v, want inbound", got)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		srcPort uint16
+		dstPort uint16
+	}{
+		{"tcp", testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN), 80, 49368},
+		{"udp ipv6", testpacket.UDP("2001:db8::1", 5353, "2001:db8::2", 53, []byte("query")), 53, 5353},
+		{"icmp without ports", testpacket.Build(testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.ICMPv4, Type: 8}), 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := outboundPacket(t, test.raw)
+			src, dst := packet.SrcIP().String(), packet.DstIP().String()
+
+			packet.Reverse()
+			checkEndpoints(t, packet, dst, test.srcPort, src, test.dstPort)
+		})
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    testpacket.Spec
+		wantNil bool
+		wantSeq uint32
+		wantAck uint32
+	}{
+		{
+			name:    "syn without ack",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Flags: header.TCPFlagSYN},
+			wantSeq: 0, wantAck: 1001,
+		},
+		{
+			name:    "syn ack",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Ack: 5000, Flags: header.TCPFlagSYN | header.TCPFlagACK},
+			wantSeq: 5000, wantAck: 1001,
+		},
+		{
+			name: "data",
+			spec: testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Ack: 5000,
+				Flags: header.TCPFlagPSH | header.TCPFlagACK, Payload: make([]byte, 10)},
+			wantSeq: 5000, wantAck: 1010,
+		},
+		{
+			name: "fin with data",
+			spec: testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 1000, Ack: 5000,
+				Flags: header.TCPFlagFIN | header.TCPFlagACK, Payload: make([]byte, 3)},
+			wantSeq: 5000, wantAck: 1004,
+		},
+		{
+			name:    "sequence number wrapping",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, SrcPort: 49368, DstPort: 80, Seq: 0xffffffff, Flags: header.TCPFlagSYN},
+			wantSeq: 0, wantAck: 0,
+		},
+		{
+			name: "ipv6 data",
+			spec: testpacket.Spec{Src: "2001:db8::1", Dst: "2001:db8::2", Protocol: header.TCP, SrcPort: 49368, DstPort: 443, Seq: 7, Ack: 9,
+				Flags: header.TCPFlagACK, Payload: make([]byte, 5)},
+			wantSeq: 9, wantAck: 12,
+		},
+		{
+			name: "udp",
+			spec: testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.UDP, SrcPort: 5353, DstPort: 53, Payload: []byte("query")},
+		},
+		{
+			name:    "later tcp fragment",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: header.TCP, FragOffset: 1, Payload: make([]byte, 16)},
+			wantNil: true,
+		},
+		{
+			name:    "unsupported protocol",
+			spec:    testpacket.Spec{Src: "10.0.0.1", Dst: "10.0.0.2", Protocol: 47, Payload: make([]byte, 4)},
+			wantNil: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := outboundPacket(t, testpacket.Build(test.spec))
+
+			reply := NewReply(packet)
+			if (reply == nil) != test.wantNil {
+				t.Fatalf("NewReply() = %v, want nil %v", reply, test.wantNil)
+			}
+			if reply == nil {
+				return
+			}
+
+			checkEndpoints(t, reply, test.spec.Dst, test.spec.DstPort, test.spec.Src, test.spec.SrcPort)
+			if len(reply.Payload()) != 0 {
+				t.Errorf("Payload() = %x, want none", reply.Payload())
+			}
+			if hopLimit(reply) != ReplyTTL {
+				t.Errorf("TTL = %d, want %d", hopLimit(reply), ReplyTTL)
+			}
+
+			tcpHdr, ok := reply.NextHeader.(*header.TCPHeader)
+			if test.spec.Protocol != header.TCP {
+				if ok {
+					t.Error("reply to a non TCP packet has a TCP header")
+				}
+				return
+			}
+			if tcpHdr.Flags() != header.TCPFlagACK {
+				t.Errorf("Flags() = %#x, want ACK", tcpHdr.Flags())
+			}
+			if tcpHdr.SeqNum() != test.wantSeq || tcpHdr.AckNum() != test.wantAck {
+				t.Errorf("seq %d ack %d, want seq %d ack %d", tcpHdr.SeqNum(), tcpHdr.AckNum(), test.wantSeq, test.wantAck)
+			}
+		})
+	}
+
+	truncated := testpacket.TCP("10.0.0.1", 49368, "10.0.0.2", 80, header.TCPFlagSYN)[:30]
+	if reply := NewReply(&Packet{Raw: truncated, PacketLen: uint(len(truncated))}); reply != nil {
+		t.Errorf("NewReply() of a truncated packet = %v, want nil", reply)
+	}
+}
+
+// Returns the TTL or hop limit of the packet
+func hopLimit(p *Packet) uint8 {
+	switch ipHdr := p.IpHdr.(type) {
+	case *header.IPv4Header:
+		return ipHdr.TTL()
+	case *header.IPv6Header:
+		return ipHdr.HopLimit()
+	}
+	return 0
+}
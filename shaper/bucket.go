@@ -0,0 +1,86 @@
+package shaper
+
+import "time"
+
+// Represents a token bucket filled at Rate bytes per second up to Burst bytes
+// A TokenBucket isn't safe for concurrent use
+type TokenBucket struct {
+	Rate  int64
+	Burst int64
+
+	tokens float64
+	last   time.Time
+}
+
+// Create a new full TokenBucket
+// If burst is 0, the bucket can hold a tenth of a second of traffic with a minimum of DefaultBurst
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	if burst <= 0 {
+		burst = rate / 10
+		if burst < DefaultBurst {
+			burst = DefaultBurst
+		}
+	}
+
+	return &TokenBucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: float64(burst),
+	}
+}
+
+// Adds the tokens accumulated since the last call
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.Rate)
+		if b.tokens > float64(b.Burst) {
+			b.tokens = float64(b.Burst)
+		}
+	}
+	b.last = now
+}
+
+// Returns the number of tokens available at the given time
+func (b *TokenBucket) Tokens(now time.Time) float64 {
+	b.refill(now)
+	return b.tokens
+}
+
+// Returns true if n tokens are available at the given time
+// More than Burst tokens are never available, n is considered available once the bucket is full
+// so that packets larger than the bucket aren't held forever
+func (b *TokenBucket) Has(n int, now time.Time) bool {
+	if n > int(b.Burst) {
+		n = int(b.Burst)
+	}
+	return b.Tokens(now) >= float64(n)
+}
+
+// Returns true if the bucket is full at the given time
+func (b *TokenBucket) full(now time.Time) bool {
+	return b.Tokens(now) >= float64(b.Burst)
+}
+
+// Removes n tokens from the bucket, the bucket can go down to -Burst,
+// or to Burst-n to pay back a packet larger than the bucket
+func (b *TokenBucket) Take(n int, now time.Time) {
+	b.refill(now)
+	b.tokens -= float64(n)
+
+	debt := b.Burst
+	if int64(n)-b.Burst > debt {
+		debt = int64(n) - b.Burst
+	}
+	if b.tokens < -float64(debt) {
+		b.tokens = -float64(debt)
+	}
+}
+
+// Takes n tokens and returns true if they are available at the given time
+func (b *TokenBucket) Allow(n int, now time.Time) bool {
+	if !b.Has(n, now) {
+		return false
+	}
+	b.Take(n, now)
+	return true
+}
@@ -0,0 +1,164 @@
+package shaper
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/williamfhe/godivert"
+)
+
+// Represents a traffic class
+// Classes form a tree: a class can send at Rate on its own
+// and borrow unused tokens from its ancestors up to Ceil (HTB-like)
+type Class struct {
+	Name   string
+	Parent *Class
+
+	// Guaranteed rate in bytes per second
+	Rate int64
+	// Maximum rate in bytes per second when borrowing, 0 means Rate
+	Ceil int64
+	// Size of the buckets in bytes, 0 means the default of NewTokenBucket
+	Burst int64
+
+	// Maximum number of queued packets, 0 means DefaultQueueLimit
+	QueueLimit int
+	// Random Early Detection, nil means drop-tail
+	RED *RED
+
+	// If set, each key gets its own queue and buckets using this class as a template
+	// The per-key classes share the parent of this class
+	Key KeyFunc
+}
+
+// Returns a key used to split a class into per-key sub-classes
+type KeyFunc func(packet *godivert.Packet) string
+
+// Random Early Detection parameters
+// https://en.wikipedia.org/wiki/Random_early_detection
+type RED struct {
+	// Average queue length (in packets) under which no packet is dropped
+	MinThreshold float64
+	// Average queue length (in packets) above which every packet is dropped
+	MaxThreshold float64
+	// Drop probability when the average queue length reaches MaxThreshold
+	MaxP float64
+	// Weight of the current queue length in the average, 0 means DefaultREDWeight
+	Weight float64
+}
+
+// Returns the canonical 5-tuple of the packet
+// Both directions of a connection share the same key
+func KeyFlow(packet *godivert.Packet) string {
+	return packet.FlowKey().Canonical().String()
+}
+
+// Returns the source IP of the packet
+func KeySrcIP(packet *godivert.Packet) string {
+	return packet.SrcIP().String()
+}
+
+// Returns the destination IP of the packet
+func KeyDstIP(packet *godivert.Packet) string {
+	return packet.DstIP().String()
+}
+
+// Returns the IP of the remote host: the destination of outbound packets
+// and the source of inbound packets
+func KeyRemoteIP(packet *godivert.Packet) string {
+	if packet.Direction() == godivert.WinDivertDirectionInbound {
+		return KeySrcIP(packet)
+	}
+	return KeyDstIP(packet)
+}
+
+// Returns the source port of the packet
+func KeySrcPort(packet *godivert.Packet) string {
+	port, _ := packet.SrcPort()
+	return strconv.Itoa(int(port))
+}
+
+// Returns the destination port of the packet
+func KeyDstPort(packet *godivert.Packet) string {
+	port, _ := packet.DstPort()
+	return strconv.Itoa(int(port))
+}
+
+// Represents an instance of a class with its buckets and queue
+type node struct {
+	name   string
+	class  *Class
+	parent *node
+	// Key of the per-key leaves
+	key string
+
+	rate *TokenBucket
+	ceil *TokenBucket
+
+	queue []*godivert.Packet
+	avg   float64
+
+	stats ClassStats
+}
+
+func newNode(name string, class *Class, parent *node) *node {
+	ceil := class.Ceil
+	if ceil < class.Rate {
+		ceil = class.Rate
+	}
+
+	return &node{
+		name:   name,
+		class:  class,
+		parent: parent,
+		rate:   NewTokenBucket(class.Rate, class.Burst),
+		ceil:   NewTokenBucket(ceil, class.Burst),
+	}
+}
+
+// Returns true if the packet has to be dropped instead of being queued
+func (n *node) drop(rng *rand.Rand) bool {
+	limit := n.class.QueueLimit
+	if limit <= 0 {
+		limit = DefaultQueueLimit
+	}
+	if len(n.queue) >= limit {
+		return true
+	}
+
+	red := n.class.RED
+	if red == nil {
+		return false
+	}
+
+	weight := red.Weight
+	if weight <= 0 {
+		weight = DefaultREDWeight
+	}
+	n.avg = (1-weight)*n.avg + weight*float64(len(n.queue))
+
+	switch {
+	case n.avg < red.MinThreshold:
+		return false
+	case n.avg >= red.MaxThreshold:
+		return true
+	default:
+		p := red.MaxP * (n.avg - red.MinThreshold) / (red.MaxThreshold - red.MinThreshold)
+		return rng.Float64() < p
+	}
+}
+
+// Validates the class, its ancestors are validated when their node is created
+func (c *Class) validate() error {
+	if c.Rate <= 0 {
+		return fmt.Errorf("class %q: the rate must be positive", c.Name)
+	}
+	if c.Ceil != 0 && c.Ceil < c.Rate {
+		return fmt.Errorf("class %q: the ceil can't be lower than the rate", c.Name)
+	}
+	if red := c.RED; red != nil && (red.MinThreshold >= red.MaxThreshold || red.MaxP < 0 || red.MaxP > 1) {
+		return fmt.Errorf("class %q: invalid RED parameters", c.Name)
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+// Package shaper queues diverted packets and releases them according to
+// hierarchical token buckets.
+//
+// Packets are mapped to a Class by a Classifier. A class can be split
+// per flow, per host or per port with a KeyFunc, and borrow the unused
+// bandwidth of its ancestors up to its Ceil:
+//
+//	total := &shaper.Class{Name: "total", Rate: 1 << 20}
+//	perHost := &shaper.Class{Name: "host", Parent: total, Rate: 64 << 10, Ceil: 256 << 10, Key: shaper.KeyRemoteIP}
+//	s := shaper.NewShaper(winDivert, func(*godivert.Packet) *shaper.Class { return perHost })
+//	go s.Run()
+//	for packet := range packetChan {
+//		s.Enqueue(packet)
+//	}
+package shaper
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+)
+
+const (
+	// Default size of a bucket in bytes, a full size Ethernet frame
+	DefaultBurst = 1514
+	// Default maximum number of queued packets per class
+	DefaultQueueLimit = 1000
+	// Default weight of the current queue length in the RED average
+	DefaultREDWeight = 0.002
+	// Default interval at which the queues are checked
+	DefaultTick = time.Millisecond
+	// Interval at which the idle per-key queues are removed
+	evictInterval = time.Second
+)
+
+// Returns the class of a packet
+// Packets with a nil class aren't shaped and are sent immediately
+type Classifier func(packet *godivert.Packet) *Class
+
+// Returns a Classifier using separate classes for inbound and outbound packets
+// Both classes can be nil
+func ByDirection(inbound, outbound *Class) Classifier {
+	return func(packet *godivert.Packet) *Class {
+		if packet.Direction() == godivert.WinDivertDirectionInbound {
+			return inbound
+		}
+		return outbound
+	}
+}
+
+// Implemented by senders owning the packets they are given, such as a sender completing deferred packets
+// The shaper gives them the packets it drops instead of releasing them
+type dropper interface {
+	Drop(packet *godivert.Packet)
+}
+
+// Counters of a class
+type ClassStats struct {
+	SentPackets    uint64
+	SentBytes      uint64
+	DroppedPackets uint64
+	DroppedBytes   uint64
+	SendErrors     uint64
+	Backlog        int
+	Borrowed       uint64
+}
+
+// Shaper queues packets per class and sends them when the buckets allow it
+// The packets dropped by the queues and the ones that can't be sent are released,
+// or given to the Drop method of the sender if it has one
+type Shaper struct {
+	sender   godivert.Sender
+	classify Classifier
+
+	// Interval at which the queues are checked when no packet can be sent
+	Tick time.Duration
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	nodes  map[*Class]*node
+	keyed  map[*Class]map[string]*node
+	leaves []*node
+	next   int
+	closed bool
+	// Last time the idle per-key queues were removed
+	lastEvict time.Time
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// Create a new Shaper sending packets with the sender
+func NewShaper(sender godivert.Sender, classify Classifier) *Shaper {
+	return &Shaper{
+		sender:   sender,
+		classify: classify,
+		Tick:     DefaultTick,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		nodes:    make(map[*Class]*node),
+		keyed:    make(map[*Class]map[string]*node),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Sets the seed of the RNG used by RED
+func (s *Shaper) Seed(seed int64) {
+	s.mu.Lock()
+	s.rng = rand.New(rand.NewSource(seed))
+	s.mu.Unlock()
+}
+
+// Queue the packet in its class
+// Returns false if the packet has been dropped because the queue is full
+// Packets without class are sent immediately, the caller keeps the packets when an error is returned
+func (s *Shaper) Enqueue(packet *godivert.Packet) (bool, error) {
+	class := s.classify(packet)
+	if class == nil {
+		_, err := s.sender.Send(packet)
+		return err == nil, err
+	}
+
+	var key string
+	if class.Key != nil {
+		key = class.Key(packet)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, errors.New("the shaper is closed")
+	}
+
+	leaf, err := s.leaf(class, key)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+
+	dropped := leaf.drop(s.rng)
+	if dropped {
+		leaf.stats.DroppedPackets++
+		leaf.stats.DroppedBytes += uint64(len(packet.Raw))
+	} else {
+		leaf.queue = append(leaf.queue, packet)
+	}
+	s.mu.Unlock()
+
+	if dropped {
+		s.drop(packet)
+		return false, nil
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Returns the node of the class, creating it and its ancestors if needed
+// The classes are validated when their node is created
+// Must be called with s.mu held
+func (s *Shaper) node(class *Class) (*node, error) {
+	if n, ok := s.nodes[class]; ok {
+		return n, nil
+	}
+
+	if err := class.validate(); err != nil {
+		return nil, err
+	}
+
+	var parent *node
+	if class.Parent != nil {
+		var err error
+		if parent, err = s.node(class.Parent); err != nil {
+			return nil, err
+		}
+	}
+
+	n := newNode(class.Name, class, parent)
+	s.nodes[class] = n
+	return n, nil
+}
+
+// Returns the leaf node holding the queue of the class and key
+// Must be called with s.mu held
+func (s *Shaper) leaf(class *Class, key string) (*node, error) {
+	if class.Key == nil {
+		n, err := s.node(class)
+		if err != nil {
+			return nil, err
+		}
+		if !s.isLeaf(n) {
+			s.leaves = append(s.leaves, n)
+		}
+		return n, nil
+	}
+
+	byKey, ok := s.keyed[class]
+	if !ok {
+		// The per-key leaves share the class, it is validated once
+		if err := class.validate(); err != nil {
+			return nil, err
+		}
+		byKey = make(map[string]*node)
+		s.keyed[class] = byKey
+	}
+
+	if n, ok := byKey[key]; ok {
+		return n, nil
+	}
+
+	var parent *node
+	if class.Parent != nil {
+		var err error
+		if parent, err = s.node(class.Parent); err != nil {
+			return nil, err
+		}
+	}
+
+	n := newNode(class.Name+"/"+key, class, parent)
+	n.key = key
+	byKey[key] = n
+	s.leaves = append(s.leaves, n)
+	return n, nil
+}
+
+// Must be called with s.mu held
+func (s *Shaper) isLeaf(n *node) bool {
+	for _, leaf := range s.leaves {
+		if leaf == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the leaf can send size bytes now, taking the tokens if so
+// The leaf uses its own tokens first then borrows from the first ancestor having
+// enough tokens, as long as every class on the way stays under its ceil
+func canSend(leaf *node, size int, now time.Time) bool {
+	borrowed := false
+
+	lender := leaf
+	for ; lender != nil; lender = lender.parent {
+		if !lender.ceil.Has(size, now) {
+			return false
+		}
+		if lender.rate.Has(size, now) {
+			break
+		}
+		borrowed = true
+	}
+	if lender == nil {
+		return false
+	}
+
+	// Charge every class up to the root so that parents account for their children
+	for n := leaf; n != nil; n = n.parent {
+		n.rate.Take(size, now)
+		n.ceil.Take(size, now)
+	}
+
+	if borrowed {
+		leaf.stats.Borrowed++
+	}
+	return true
+}
+
+// Represents a packet popped from the queue of a leaf
+type queuedPacket struct {
+	leaf   *node
+	packet *godivert.Packet
+}
+
+// Pops the packets that can be sent now, visiting the leaves in round-robin
+// Must be called with s.mu held
+func (s *Shaper) popReady(now time.Time) []queuedPacket {
+	var ready []queuedPacket
+
+	for progress := true; progress; {
+		progress = false
+		for i := 0; i < len(s.leaves); i++ {
+			leaf := s.leaves[(s.next+i)%len(s.leaves)]
+			if len(leaf.queue) == 0 {
+				continue
+			}
+
+			packet := leaf.queue[0]
+			if !canSend(leaf, len(packet.Raw), now) {
+				continue
+			}
+
+			leaf.queue[0] = nil
+			leaf.queue = leaf.queue[1:]
+			ready = append(ready, queuedPacket{leaf: leaf, packet: packet})
+			progress = true
+		}
+		if len(s.leaves) > 0 {
+			s.next = (s.next + 1) % len(s.leaves)
+		}
+	}
+
+	return ready
+}
+
+// Removes the per-key leaves with an empty queue and full buckets,
+// they behave like the leaves created for new keys
+// Must be called with s.mu held
+func (s *Shaper) evictIdle(now time.Time) {
+	if now.Sub(s.lastEvict) < evictInterval {
+		return
+	}
+	s.lastEvict = now
+
+	leaves := s.leaves[:0]
+	for _, leaf := range s.leaves {
+		if leaf.class.Key != nil && len(leaf.queue) == 0 && leaf.rate.full(now) && leaf.ceil.full(now) {
+			delete(s.keyed[leaf.class], leaf.key)
+			continue
+		}
+		leaves = append(leaves, leaf)
+	}
+	for i := len(leaves); i < len(s.leaves); i++ {
+		s.leaves[i] = nil
+	}
+	s.leaves = leaves
+
+	if s.next >= len(s.leaves) {
+		s.next = 0
+	}
+}
+
+// Sends a packet popped from a leaf, the packet is dropped if it can't be sent
+func (s *Shaper) send(queued queuedPacket) error {
+	packet := queued.packet
+	_, err := s.sender.Send(packet)
+
+	s.mu.Lock()
+	if err != nil {
+		queued.leaf.stats.SendErrors++
+	} else {
+		queued.leaf.stats.SentPackets++
+		queued.leaf.stats.SentBytes += uint64(len(packet.Raw))
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.drop(packet)
+	}
+	return err
+}
+
+// Gives a dropped packet to the sender if it owns the packets, releases it otherwise
+func (s *Shaper) drop(packet *godivert.Packet) {
+	if d, ok := s.sender.(dropper); ok {
+		d.Drop(packet)
+		return
+	}
+	packet.Release()
+}
+
+// Send the queued packets as the buckets allow it until Close is called
+// The per-key queues are removed once they are idle
+// The packets that can't be sent are counted in the SendErrors of their class and dropped
+func (s *Shaper) Run() {
+	ticker := time.NewTicker(s.Tick)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		now := time.Now()
+		ready := s.popReady(now)
+		s.evictIdle(now)
+		s.mu.Unlock()
+
+		for _, queued := range ready {
+			s.send(queued)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the counters of every class
+// Per-key classes are named "class/key", their counters are reset when they are removed after being idle
+func (s *Shaper) Stats() map[string]ClassStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]ClassStats, len(s.nodes)+len(s.leaves))
+	for _, n := range s.nodes {
+		stats[n.name] = n.stats
+	}
+	for _, leaf := range s.leaves {
+		leafStats := leaf.stats
+		leafStats.Backlog = len(leaf.queue)
+		stats[leaf.name] = leafStats
+	}
+	return stats
+}
+
+// Stop Run and send the queued packets immediately
+// so that no packet is lost
+// Returns the first error of the packets that can't be sent, they are dropped
+func (s *Shaper) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("the shaper is already closed")
+	}
+	s.closed = true
+
+	var pending []queuedPacket
+	for _, leaf := range s.leaves {
+		for _, packet := range leaf.queue {
+			pending = append(pending, queuedPacket{leaf: leaf, packet: packet})
+		}
+		leaf.queue = nil
+	}
+	s.mu.Unlock()
+
+	close(s.done)
+
+	var failed int
+	var firstErr error
+	for _, queued := range pending {
+		if err := s.send(queued); err != nil {
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d queued packets couldn't be sent: %v", failed, firstErr)
+	}
+	return nil
+}
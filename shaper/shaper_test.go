@@ -0,0 +1,279 @@
+package shaper
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/internal/testpacket"
+)
+
+// Sender recording the packets sent and dropped, failing while err is set
+type fakeSender struct {
+	mu      sync.Mutex
+	err     error
+	sent    []*godivert.Packet
+	dropped []*godivert.Packet
+}
+
+func (s *fakeSender) Send(packet *godivert.Packet) (uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.sent = append(s.sent, packet)
+	return packet.PacketLen, nil
+}
+
+func (s *fakeSender) Drop(packet *godivert.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped = append(s.dropped, packet)
+}
+
+// Returns a UDP datagram of length bytes sent to the port
+func udpPacket(port uint16, length int) *godivert.Packet {
+	raw := testpacket.UDP("10.0.0.1", 53, "10.0.0.2", port, make([]byte, length-28))
+	return &godivert.Packet{Raw: raw, PacketLen: uint(len(raw))}
+}
+
+var base = time.Unix(1700000000, 0)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 500)
+
+	steps := []struct {
+		name    string
+		at      time.Duration
+		take    int
+		wantHas bool
+		want    float64
+	}{
+		{"full", 0, 300, true, 200},
+		{"refill", 100 * time.Millisecond, 0, false, 300},
+		{"capped at burst", 10 * time.Second, 0, true, 500},
+		// A packet larger than the bucket is sent once the bucket is full and leaves a debt
+		{"larger than burst", 10 * time.Second, 1200, true, -700},
+		{"paying back", 10*time.Second + 700*time.Millisecond, 0, false, 0},
+		{"paid back", 11*time.Second + 200*time.Millisecond, 0, true, 500},
+		{"debt of a larger packet", 11*time.Second + 200*time.Millisecond, 5000, true, -4500},
+	}
+
+	for _, step := range steps {
+		now := base.Add(step.at)
+		if got := b.Has(1000, now); got != step.wantHas {
+			t.Errorf("%s: Has(1000) = %v, want %v", step.name, got, step.wantHas)
+		}
+		b.Take(step.take, now)
+		if got := b.Tokens(now); got != step.want {
+			t.Errorf("%s: Tokens() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestCanSendBorrow(t *testing.T) {
+	root := &Class{Name: "root", Rate: 1, Burst: 1 << 20}
+	child := &Class{Name: "child", Parent: root, Rate: 1000, Ceil: 2000, Burst: 1000}
+
+	s := NewShaper(&fakeSender{}, nil)
+	leaf, err := s.leaf(child, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name         string
+		at           time.Duration
+		want         bool
+		wantBorrowed uint64
+	}{
+		{"own tokens", 0, true, 0},
+		{"empty buckets", 0, false, 0},
+		// The child has 500 tokens and its ceil 1000, the rest is borrowed from the root
+		{"borrowed", 500 * time.Millisecond, true, 1},
+		{"borrowed again", time.Second, true, 2},
+		// The root still has tokens but the child reached its ceil
+		{"over ceil", time.Second, false, 2},
+	}
+
+	for _, step := range steps {
+		if got := canSend(leaf, 1000, base.Add(step.at)); got != step.want {
+			t.Errorf("%s: canSend() = %v, want %v", step.name, got, step.want)
+		}
+		if leaf.stats.Borrowed != step.wantBorrowed {
+			t.Errorf("%s: Borrowed = %d, want %d", step.name, leaf.stats.Borrowed, step.wantBorrowed)
+		}
+	}
+
+	// The root is charged for the 3000 bytes sent by its child and refilled 1 byte in a second
+	if got := s.nodes[root].rate.Tokens(base.Add(time.Second)); got != 1<<20-2999 {
+		t.Errorf("root tokens = %v, want %d", got, 1<<20-2999)
+	}
+}
+
+func TestClassValidation(t *testing.T) {
+	root := &Class{Name: "root", Rate: 1000}
+	tests := []struct {
+		name  string
+		class *Class
+	}{
+		{"no rate", &Class{Name: "a"}},
+		{"ceil under rate", &Class{Name: "a", Rate: 1000, Ceil: 500}},
+		{"red thresholds", &Class{Name: "a", Rate: 1000, RED: &RED{MinThreshold: 5, MaxThreshold: 5}}},
+		{"invalid parent", &Class{Name: "a", Rate: 1000, Parent: &Class{Name: "parent"}}},
+		{"invalid keyed class", &Class{Name: "a", Parent: root, Key: KeyDstPort}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender := &fakeSender{}
+			s := NewShaper(sender, func(*godivert.Packet) *Class { return test.class })
+			if queued, err := s.Enqueue(udpPacket(80, 100)); err == nil || queued {
+				t.Errorf("Enqueue() = %v, %v, want an error", queued, err)
+			}
+			if len(sender.sent) != 0 || len(sender.dropped) != 0 {
+				t.Errorf("the packet was sent or dropped, the caller keeps it")
+			}
+		})
+	}
+}
+
+func TestRED(t *testing.T) {
+	class := &Class{Name: "red", Rate: 1000, QueueLimit: 100, RED: &RED{MinThreshold: 2, MaxThreshold: 10, MaxP: 0.5, Weight: 1}}
+
+	// Returns the queue results of 20 packets
+	run := func(seed int64) []bool {
+		sender := &fakeSender{}
+		s := NewShaper(sender, func(*godivert.Packet) *Class { return class })
+		s.Seed(seed)
+
+		var results []bool
+		for i := 0; i < 20; i++ {
+			queued, err := s.Enqueue(udpPacket(80, 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, queued)
+		}
+
+		stats := s.Stats()["red"]
+		if stats.Backlog+len(sender.dropped) != 20 || int(stats.DroppedPackets) != len(sender.dropped) {
+			t.Errorf("backlog %d and %d dropped packets, want 20 packets queued or dropped", stats.Backlog, len(sender.dropped))
+		}
+		if stats.Backlog > 10 {
+			t.Errorf("backlog %d over the maximum threshold", stats.Backlog)
+		}
+		return results
+	}
+
+	first := run(42)
+	for i, queued := range first[:2] {
+		if !queued {
+			t.Errorf("packet %d dropped under the minimum threshold", i)
+		}
+	}
+	if second := run(42); !equalResults(first, second) {
+		t.Errorf("the drops differ with the same seed: %v and %v", first, second)
+	}
+}
+
+func equalResults(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEvictIdle(t *testing.T) {
+	fixed := &Class{Name: "fixed", Rate: 1000}
+	perPort := &Class{Name: "port", Rate: 1000, Burst: 1000, Key: KeyDstPort}
+
+	sender := &fakeSender{}
+	s := NewShaper(sender, func(packet *godivert.Packet) *Class {
+		if port, _ := packet.DstPort(); port == 53 {
+			return fixed
+		}
+		return perPort
+	})
+	now := base
+	for _, port := range []uint16{53, 80, 443, 443} {
+		if _, err := s.Enqueue(udpPacket(port, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first packet of each leaf is sent, the second packet to 443 waits for tokens
+	s.mu.Lock()
+	ready := s.popReady(now)
+	s.mu.Unlock()
+	if len(ready) != 3 {
+		t.Fatalf("%d packets ready, want 3", len(ready))
+	}
+
+	// The buckets of port 80 are full again but the queue of port 443 isn't empty
+	now = now.Add(evictInterval)
+	s.mu.Lock()
+	s.evictIdle(now)
+	s.mu.Unlock()
+
+	stats := s.Stats()
+	for name, want := range map[string]bool{"fixed": true, "port/80": false, "port/443": true} {
+		if _, ok := stats[name]; ok != want {
+			t.Errorf("leaf %s present = %v, want %v", name, ok, want)
+		}
+	}
+	if _, ok := s.keyed[perPort]["80"]; ok {
+		t.Error("the idle key is still indexed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	slow := &Class{Name: "slow", Rate: 1, Burst: 1}
+
+	sender := &fakeSender{}
+	s := NewShaper(sender, func(*godivert.Packet) *Class { return slow })
+	for i := 0; i < 3; i++ {
+		if _, err := s.Enqueue(udpPacket(80, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 3 {
+		t.Errorf("%d packets sent by Close, want 3", len(sender.sent))
+	}
+	if _, err := s.Enqueue(udpPacket(80, 100)); err == nil {
+		t.Error("Enqueue() succeeded after Close")
+	}
+	if err := s.Close(); err == nil {
+		t.Error("the second Close succeeded")
+	}
+
+	// The packets that can't be sent are reported and dropped
+	sender = &fakeSender{err: errors.New("send failed")}
+	s = NewShaper(sender, func(*godivert.Packet) *Class { return slow })
+	for i := 0; i < 2; i++ {
+		if _, err := s.Enqueue(udpPacket(80, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err == nil {
+		t.Error("Close() didn't report the send errors")
+	}
+	if len(sender.dropped) != 2 {
+		t.Errorf("%d packets dropped, want 2", len(sender.dropped))
+	}
+	if stats := s.Stats()["slow"]; stats.SendErrors != 2 || stats.SentPackets != 0 {
+		t.Errorf("SendErrors = %d and SentPackets = %d, want 2 and 0", stats.SendErrors, stats.SentPackets)
+	}
+}
@@ -0,0 +1,160 @@
+package stats
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Represents the format of the snapshots written by Report
+type Format int
+
+const (
+	// A JSON object per line
+	JSON Format = iota
+	// A CSV row per entry, preceded by a header row
+	CSV
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "JSON"
+	case CSV:
+		return "CSV"
+	default:
+		return "Unknown Format"
+	}
+}
+
+// Columns of the CSV format
+var csvHeader = []string{"time", "dimension", "key", "packets", "bytes",
+	"packets_per_second", "bytes_per_second", "total_packets", "total_bytes"}
+
+// Represents the top entries of every dimension at a point in time
+type Snapshot struct {
+	Time time.Time `json:"time"`
+	// Length of the sliding window in seconds
+	Window float64 `json:"windowSeconds"`
+
+	Hosts     []Entry `json:"hosts"`
+	Ports     []Entry `json:"ports"`
+	Protocols []Entry `json:"protocols"`
+	Flows     []Entry `json:"flows"`
+}
+
+// Returns the n entries with the most bytes of every dimension, all of them if n <= 0
+func (a *Aggregator) Snapshot(n int) *Snapshot {
+	t := a.now()
+	return &Snapshot{
+		Time:      t,
+		Window:    a.Window().Seconds(),
+		Hosts:     a.top(Host, n, ByBytes, t),
+		Ports:     a.top(Port, n, ByBytes, t),
+		Protocols: a.top(Protocol, n, ByBytes, t),
+		Flows:     a.top(Flow, n, ByBytes, t),
+	}
+}
+
+// Returns the entries of the dimension
+func (s *Snapshot) Entries(dimension Dimension) []Entry {
+	switch dimension {
+	case Host:
+		return s.Hosts
+	case Port:
+		return s.Ports
+	case Protocol:
+		return s.Protocols
+	case Flow:
+		return s.Flows
+	default:
+		return nil
+	}
+}
+
+// Writes the snapshot as a single line of JSON
+func (s *Snapshot) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(s)
+}
+
+// Writes a CSV row per entry, without header row
+func (s *Snapshot) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := s.writeCSV(writer); err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (s *Snapshot) writeCSV(writer *csv.Writer) error {
+	t := s.Time.Format(time.RFC3339Nano)
+	for _, dimension := range Dimensions {
+		for _, entry := range s.Entries(dimension) {
+			err := writer.Write([]string{t, dimension.String(), entry.Key,
+				strconv.FormatUint(entry.Packets, 10),
+				strconv.FormatUint(entry.Bytes, 10),
+				strconv.FormatFloat(entry.PacketRate, 'f', -1, 64),
+				strconv.FormatFloat(entry.ByteRate, 'f', -1, 64),
+				strconv.FormatUint(entry.TotalPackets, 10),
+				strconv.FormatUint(entry.TotalBytes, 10)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes a snapshot of the n top entries of every dimension every interval until ctx is done
+// Returns ctx.Err() once ctx is done, or the error of the writer
+func (a *Aggregator) Report(ctx context.Context, w io.Writer, format Format, interval time.Duration, n int) error {
+	if interval <= 0 {
+		return fmt.Errorf("the interval must be positive, got %v", interval)
+	}
+
+	var writer *csv.Writer
+	switch format {
+	case JSON:
+	case CSV:
+		writer = csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %d", format)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		snapshot := a.Snapshot(n)
+		if writer == nil {
+			if err := snapshot.WriteJSON(w); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := snapshot.writeCSV(writer); err != nil {
+			return err
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Package stats aggregates diverted packets into per-host, per-port, per-protocol
+// and per-flow packet and byte rates over a sliding window.
+//
+// The window is divided in buckets of the resolution, old buckets are forgotten
+// as time goes by and the keys without traffic in the window are removed:
+//
+//	agg, err := stats.NewAggregator(time.Minute, time.Second)
+//	...
+//	for packet := range packetChan {
+//		agg.Add(packet)
+//		winDivert.Send(packet)
+//	}
+//
+//	for _, entry := range agg.Top(stats.Host, 10, stats.ByBytes) {
+//		fmt.Println(entry.Key, entry.ByteRate)
+//	}
+//
+// Report writes a snapshot of the top entries as JSON or CSV at regular intervals.
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+)
+
+// Default length of the sliding window
+const DefaultWindow = time.Minute
+
+// Default length of the buckets of the window
+const DefaultResolution = time.Second
+
+// Represents what the traffic is grouped by
+type Dimension int
+
+const (
+	// Traffic sent or received by an IP address, a packet counts for its source and its destination
+	Host Dimension = iota
+	// Traffic from or to a TCP or UDP port, a packet counts for its source and its destination port
+	Port
+	// Traffic of an IP protocol
+	Protocol
+	// Traffic of a connection, both directions are counted together
+	Flow
+)
+
+// Dimensions of a Snapshot
+var Dimensions = []Dimension{Host, Port, Protocol, Flow}
+
+func (d Dimension) String() string {
+	switch d {
+	case Host:
+		return "host"
+	case Port:
+		return "port"
+	case Protocol:
+		return "protocol"
+	case Flow:
+		return "flow"
+	default:
+		return "Unknown Dimension"
+	}
+}
+
+// Represents how the entries of a top-N query are sorted
+type Order int
+
+const (
+	ByBytes Order = iota
+	ByPackets
+)
+
+// Represents the traffic of a key
+type Entry struct {
+	// Address, "TCP/443", "UDP" or "TCP 10.0.0.2:51234 > 1.1.1.1:443" depending on the dimension
+	Key string `json:"key"`
+
+	// Traffic in the window
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// Traffic in the window divided by the time it covers
+	PacketRate float64 `json:"packetsPerSecond"`
+	ByteRate   float64 `json:"bytesPerSecond"`
+
+	// Traffic since the key was first seen, keys are forgotten once they have no traffic in the window
+	TotalPackets uint64 `json:"totalPackets"`
+	TotalBytes   uint64 `json:"totalBytes"`
+}
+
+// Identifies the port of a protocol
+type portKey struct {
+	protocol uint8
+	port     uint16
+}
+
+// Aggregates the traffic of packets over a sliding window
+// An Aggregator is safe for concurrent use
+type Aggregator struct {
+	resolution time.Duration
+	buckets    int
+
+	// Returns the current time, time.Now if nil
+	// Set it to the time of the last packet to query the traffic of a capture added with AddAt
+	Now func() time.Time
+
+	mu        sync.Mutex
+	start     int64
+	lastPrune int64
+	hosts     map[[16]byte]*window
+	ports     map[portKey]*window
+	protocols map[uint8]*window
+	flows     map[godivert.FlowKey]*window
+}
+
+// Create a new Aggregator with a sliding window of length divided in buckets of resolution
+// A length or a resolution of 0 uses DefaultWindow or DefaultResolution,
+// the window is rounded up to a multiple of the resolution
+func NewAggregator(length, resolution time.Duration) (*Aggregator, error) {
+	if length < 0 || resolution < 0 {
+		return nil, errors.New("the window and the resolution can't be negative")
+	}
+	if length == 0 {
+		length = DefaultWindow
+	}
+	if resolution == 0 {
+		resolution = DefaultResolution
+	}
+	if resolution > length {
+		return nil, fmt.Errorf("the resolution %v is longer than the window %v", resolution, length)
+	}
+
+	return &Aggregator{
+		resolution: resolution,
+		buckets:    int((length + resolution - 1) / resolution),
+		start:      -1,
+		hosts:      make(map[[16]byte]*window),
+		ports:      make(map[portKey]*window),
+		protocols:  make(map[uint8]*window),
+		flows:      make(map[godivert.FlowKey]*window),
+	}, nil
+}
+
+// Returns the length of the sliding window
+func (a *Aggregator) Window() time.Duration {
+	return time.Duration(a.buckets) * a.resolution
+}
+
+func (a *Aggregator) now() time.Time {
+	if a.Now != nil {
+		return a.Now()
+	}
+	return time.Now()
+}
+
+// Returns the bucket slot of the time
+func (a *Aggregator) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(a.resolution)
+}
+
+// Add the packet received now
+func (a *Aggregator) Add(packet *godivert.Packet) {
+	a.AddAt(packet, a.now())
+}
+
+// Add the packet received at t, to aggregate the packets of a capture for example
+// Packets without IP header, such as the ones of the Flow and Socket layers, are ignored
+// Packets with a truncated transport header only count for their hosts and protocol
+func (a *Aggregator) AddAt(packet *godivert.Packet, t time.Time) {
+	err := packet.VerifyParsed()
+	if packet.IpHdr == nil {
+		return
+	}
+
+	key := packet.FlowKey()
+	length := uint64(packet.PacketLen)
+	slot := a.slot(t)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.start < 0 || slot < a.start {
+		a.start = slot
+	}
+	if slot > a.lastPrune {
+		a.prune(slot)
+		a.lastPrune = slot
+	}
+
+	a.addToHost(key.SrcIP, slot, length)
+	if key.DstIP != key.SrcIP {
+		a.addToHost(key.DstIP, slot, length)
+	}
+
+	if packet.NextHeader != nil && (key.Protocol == header.TCP || key.Protocol == header.UDP) {
+		src := portKey{protocol: key.Protocol, port: key.SrcPort}
+		dst := portKey{protocol: key.Protocol, port: key.DstPort}
+		a.addToPort(src, slot, length)
+		if dst != src {
+			a.addToPort(dst, slot, length)
+		}
+	}
+
+	w, ok := a.protocols[key.Protocol]
+	if !ok {
+		w = newWindow(a.buckets)
+		a.protocols[key.Protocol] = w
+	}
+	w.add(slot, length)
+
+	if err != nil {
+		return
+	}
+	flow := key.Canonical()
+	w, ok = a.flows[flow]
+	if !ok {
+		w = newWindow(a.buckets)
+		a.flows[flow] = w
+	}
+	w.add(slot, length)
+}
+
+func (a *Aggregator) addToHost(ip [16]byte, slot int64, length uint64) {
+	w, ok := a.hosts[ip]
+	if !ok {
+		w = newWindow(a.buckets)
+		a.hosts[ip] = w
+	}
+	w.add(slot, length)
+}
+
+func (a *Aggregator) addToPort(key portKey, slot int64, length uint64) {
+	w, ok := a.ports[key]
+	if !ok {
+		w = newWindow(a.buckets)
+		a.ports[key] = w
+	}
+	w.add(slot, length)
+}
+
+// Removes the keys without traffic in the window ending with the slot
+// Called at most once per bucket
+func (a *Aggregator) prune(slot int64) {
+	for key, w := range a.hosts {
+		if w.expired(slot) {
+			delete(a.hosts, key)
+		}
+	}
+	for key, w := range a.ports {
+		if w.expired(slot) {
+			delete(a.ports, key)
+		}
+	}
+	for key, w := range a.protocols {
+		if w.expired(slot) {
+			delete(a.protocols, key)
+		}
+	}
+	for key, w := range a.flows {
+		if w.expired(slot) {
+			delete(a.flows, key)
+		}
+	}
+}
+
+// Returns the n keys with the most traffic in the window, all of them if n <= 0
+func (a *Aggregator) Top(dimension Dimension, n int, order Order) []Entry {
+	return a.top(dimension, n, order, a.now())
+}
+
+func (a *Aggregator) top(dimension Dimension, n int, order Order, t time.Time) []Entry {
+	slot := a.slot(t)
+
+	a.mu.Lock()
+	seconds := a.covered(slot)
+	entries := []Entry{}
+	switch dimension {
+	case Host:
+		for ip, w := range a.hosts {
+			entries = appendEntry(entries, net.IP(ip[:]).String(), w, slot, seconds)
+		}
+	case Port:
+		for key, w := range a.ports {
+			entries = appendEntry(entries, fmt.Sprintf("%s/%d", protocolName(key.protocol), key.port), w, slot, seconds)
+		}
+	case Protocol:
+		for protocol, w := range a.protocols {
+			entries = appendEntry(entries, protocolName(protocol), w, slot, seconds)
+		}
+	case Flow:
+		for key, w := range a.flows {
+			entries = appendEntry(entries, flowName(key), w, slot, seconds)
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		x, y := entries[i], entries[j]
+		if order == ByPackets && x.Packets != y.Packets {
+			return x.Packets > y.Packets
+		}
+		if x.Bytes != y.Bytes {
+			return x.Bytes > y.Bytes
+		}
+		if x.Packets != y.Packets {
+			return x.Packets > y.Packets
+		}
+		return x.Key < y.Key
+	})
+
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Returns the number of seconds of the window ending with the slot during which packets were added
+// The window isn't full until it has been running for its whole length
+func (a *Aggregator) covered(slot int64) float64 {
+	slots := int64(a.buckets)
+	if a.start >= 0 && slot-a.start+1 < slots {
+		slots = slot - a.start + 1
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	return (time.Duration(slots) * a.resolution).Seconds()
+}
+
+// Appends the entry of the window if it has traffic in the window ending with the slot
+func appendEntry(entries []Entry, key string, w *window, slot int64, seconds float64) []Entry {
+	packets, bytes := w.sum(slot)
+	if packets == 0 {
+		return entries
+	}
+
+	return append(entries, Entry{
+		Key:          key,
+		Packets:      packets,
+		Bytes:        bytes,
+		PacketRate:   float64(packets) / seconds,
+		ByteRate:     float64(bytes) / seconds,
+		TotalPackets: w.totalPackets,
+		TotalBytes:   w.totalBytes,
+	})
+}
+
+// Returns the name of the protocol, "ip-proto-N" for the protocols without name
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case header.ICMPv4, header.TCP, header.UDP, header.ICMPv6:
+		return header.ProtocolName(protocol)
+	default:
+		return fmt.Sprintf("ip-proto-%d", protocol)
+	}
+}
+
+// Returns the flow as "TCP 10.0.0.2:51234 > 1.1.1.1:443", without ports for the protocols without ports
+func flowName(key godivert.FlowKey) string {
+	if key.Protocol != header.TCP && key.Protocol != header.UDP {
+		return fmt.Sprintf("%s %s > %s", protocolName(key.Protocol), key.Src(), key.Dst())
+	}
+	return fmt.Sprintf("%s %s > %s", protocolName(key.Protocol),
+		net.JoinHostPort(key.Src().String(), fmt.Sprint(key.SrcPort)),
+		net.JoinHostPort(key.Dst().String(), fmt.Sprint(key.DstPort)))
+}
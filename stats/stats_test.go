@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/williamfhe/godivert"
+	"github.com/williamfhe/godivert/header"
+)
+
+// Returns an IPv4 TCP packet of length bytes, truncated to keep bytes if keep > 0
+func tcpPacket(src, dst string, srcPort, dstPort uint16, length, keep int) *godivert.Packet {
+	raw := make([]byte, length)
+	raw[0] = 0x45
+	raw[9] = header.TCP
+	copy(raw[12:16], net.ParseIP(src).To4())
+	copy(raw[16:20], net.ParseIP(dst).To4())
+	if length >= 40 {
+		raw[20], raw[21] = byte(srcPort>>8), byte(srcPort)
+		raw[22], raw[23] = byte(dstPort>>8), byte(dstPort)
+		raw[32] = 0x50
+	}
+	if keep > 0 {
+		raw = raw[:keep]
+	}
+	return &godivert.Packet{Raw: raw, PacketLen: uint(len(raw))}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	agg, err := NewAggregator(10*time.Second, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Unix(1700000000, 0)
+	now := base
+	agg.Now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		at := base.Add(time.Duration(i) * time.Second)
+		agg.AddAt(tcpPacket("10.0.0.2", "1.1.1.1", 5000, 443, 1000, 0), at)
+		agg.AddAt(tcpPacket("1.1.1.1", "10.0.0.2", 443, 5000, 100, 0), at)
+	}
+
+	now = base.Add(4 * time.Second)
+	flows := agg.Top(Flow, 0, ByBytes)
+	if len(flows) != 1 || flows[0].Packets != 10 || flows[0].Bytes != 5500 {
+		t.Fatalf("Top(Flow) = %+v, want a single flow of 10 packets and 5500 bytes", flows)
+	}
+	if flows[0].ByteRate != 1100 {
+		t.Errorf("ByteRate = %v over the 5 seconds covered, want 1100", flows[0].ByteRate)
+	}
+
+	// The slots 0, 1 and 2 left the window ending with slot 12
+	now = base.Add(12 * time.Second)
+	hosts := agg.Top(Host, 1, ByPackets)
+	if len(hosts) != 1 || hosts[0].Packets != 4 || hosts[0].TotalPackets != 10 {
+		t.Errorf("Top(Host, 1) = %+v, want 4 packets in the window and 10 in total", hosts)
+	}
+
+	// Adding a packet after the window prunes the keys without traffic
+	now = base.Add(30 * time.Second)
+	agg.AddAt(tcpPacket("10.0.0.9", "8.8.4.4", 7000, 80, 40, 0), now)
+	if hosts := agg.Top(Host, 0, ByBytes); len(hosts) != 2 {
+		t.Errorf("Top(Host) = %+v, want only the hosts of the last packet", hosts)
+	}
+}
+
+func TestAggregatorMalformedPackets(t *testing.T) {
+	agg, err := NewAggregator(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	agg.Now = func() time.Time { return now }
+
+	agg.Add(&godivert.Packet{})
+	agg.Add(&godivert.Packet{Raw: []byte{1, 2, 3}, PacketLen: 3})
+	agg.Add(tcpPacket("10.0.0.2", "1.1.1.1", 0, 0, 60, 16))
+	// IPv4 header and 4 bytes of TCP
+	agg.Add(tcpPacket("10.0.0.2", "1.1.1.1", 5000, 443, 60, 24))
+
+	if hosts := agg.Top(Host, 0, ByBytes); len(hosts) != 2 {
+		t.Errorf("Top(Host) = %+v, want the 2 hosts of the truncated TCP packet", hosts)
+	}
+	if ports := agg.Top(Port, 0, ByBytes); len(ports) != 0 {
+		t.Errorf("Top(Port) = %+v, want no port for a truncated TCP header", ports)
+	}
+	if flows := agg.Top(Flow, 0, ByBytes); len(flows) != 0 {
+		t.Errorf("Top(Flow) = %+v, want no flow for a truncated TCP header", flows)
+	}
+}
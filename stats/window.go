@@ -0,0 +1,59 @@
+package stats
+
+// Counts the packets and bytes of a key in the buckets of a sliding window
+// Bucket i of the ring holds the traffic of the time slot j with j % len(ring) == i
+type window struct {
+	packets []uint64
+	bytes   []uint64
+	// Latest slot written
+	last int64
+
+	totalPackets uint64
+	totalBytes   uint64
+}
+
+func newWindow(buckets int) *window {
+	return &window{
+		packets: make([]uint64, buckets),
+		bytes:   make([]uint64, buckets),
+	}
+}
+
+// Add a packet to the slot, packets older than the window are only added to the totals
+func (w *window) add(slot int64, length uint64) {
+	w.totalPackets++
+	w.totalBytes += length
+
+	buckets := int64(len(w.packets))
+	if slot > w.last {
+		// Clear the buckets of the slots skipped since the last packet
+		for s := w.last + 1; s <= slot && s <= w.last+buckets; s++ {
+			w.packets[s%buckets] = 0
+			w.bytes[s%buckets] = 0
+		}
+		w.last = slot
+	} else if slot <= w.last-buckets {
+		return
+	}
+
+	w.packets[slot%buckets]++
+	w.bytes[slot%buckets] += length
+}
+
+// Returns the packets and bytes of the window ending with the slot
+func (w *window) sum(slot int64) (packets, bytes uint64) {
+	buckets := int64(len(w.packets))
+	for s := w.last; s > slot-buckets && s > w.last-buckets; s-- {
+		if s > slot {
+			continue
+		}
+		packets += w.packets[s%buckets]
+		bytes += w.bytes[s%buckets]
+	}
+	return packets, bytes
+}
+
+// Returns true if no packet of the window ending with the slot has been added
+func (w *window) expired(slot int64) bool {
+	return w.last <= slot-int64(len(w.packets))
+}
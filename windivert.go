@@ -1,54 +1,73 @@
 package godivert
 
 import (
+	"context"
 	"errors"
-	"runtime"
-	"syscall"
-	"unsafe"
+	"sync"
+	"sync/atomic"
 )
 
-var (
-	winDivertDLL *syscall.LazyDLL
+// Returned by every call to WinDivert on systems other than Windows
+var ErrNotSupported = errors.New("WinDivert is only available on Windows")
 
-	winDivertOpen                *syscall.LazyProc
-	winDivertClose               *syscall.LazyProc
-	winDivertRecv                *syscall.LazyProc
-	winDivertSend                *syscall.LazyProc
-	winDivertHelperCalcChecksums *syscall.LazyProc
-	winDivertHelperEvalFilter    *syscall.LazyProc
-	winDivertHelperCheckFilter   *syscall.LazyProc
-)
+// Returned when a handle is used after being closed
+var ErrClosed = errors.New("the handle is closed")
+
+// Returned by Send once the handle has been shut down for sending
+var ErrShutdown = errors.New("the handle has been shut down")
 
-func init() {
-	LoadDLL("WinDivert.dll", "WinDivert.dll")
+// Implemented by anything able to produce diverted packets
+// WinDivertHandle is the main implementation, pcap.Reader reads them from a file
+type Receiver interface {
+	Recv() (*Packet, error)
+}
+
+// Implemented by anything able to inject packets on the Network Stack
+// WinDivertHandle is the main implementation
+type Sender interface {
+	Send(packet *Packet) (uint, error)
+}
+
+// Notified of the packets received and sent by a handle, see HandleOptions
+// The metrics package implements it, the calls must not block
+type Observer interface {
+	// Called after each receive, packet is nil when err isn't
+	ObserveRecv(packet *Packet, err error)
+	// Called after each packet sent
+	ObserveSend(packet *Packet, err error)
 }
 
 // Used to call WinDivert's functions
 type WinDivertHandle struct {
 	handle uintptr
-	open   bool
+	// Bits of handleClosed, handleShutdownRecv and handleShutdownSend, zero while the handle is open
+	state atomic.Uint32
+
+	abi      ABIVersion
+	layer    Layer
+	priority int16
+	flags    Flags
+
+	// Pool of the received packets, nil to copy them in buffers of their size
+	pool *BufferPool
+	// Notified of the packets received and sent, may be nil
+	observer Observer
+
+	errMutex sync.Mutex
+	err      error
+	queue    *packetQueue
 }
 
-// LoadDLL loads the WinDivert DLL depending the OS (x64 or x86) and the given DLL path.
-// The path can be a relative path (from the .exe folder) or absolute path.
-func LoadDLL(path64, path32 string) {
-	var dllPath string
-
-	if runtime.GOARCH == "amd64" {
-		dllPath = path64
-	} else {
-		dllPath = path32
-	}
-
-	winDivertDLL = syscall.NewLazyDLL(dllPath)
+const (
+	handleShutdownRecv = uint32(WinDivertShutdownRecv)
+	handleShutdownSend = uint32(WinDivertShutdownSend)
+	handleClosed       = 0x4
+)
 
-	winDivertOpen = winDivertDLL.NewProc("WinDivertOpen")
-	winDivertClose = winDivertDLL.NewProc("WinDivertClose")
-	winDivertRecv = winDivertDLL.NewProc("WinDivertRecv")
-	winDivertSend = winDivertDLL.NewProc("WinDivertSend")
-	winDivertHelperCalcChecksums = winDivertDLL.NewProc("WinDivertHelperCalcChecksums")
-	winDivertHelperEvalFilter = winDivertDLL.NewProc("WinDivertHelperEvalFilter")
-	winDivertHelperCheckFilter = winDivertDLL.NewProc("WinDivertHelperCheckFilter")
+// Returns the ABI version of the loaded WinDivert DLL
+// WinDivert 2.x DLLs export WinDivertHelperCompileFilter which doesn't exist in 1.x
+func DetectABIVersion() (ABIVersion, error) {
+	return divertABI()
 }
 
 // Create a new WinDivertHandle by calling WinDivertOpen and returns it
@@ -62,62 +81,243 @@ func NewWinDivertHandle(filter string) (*WinDivertHandle, error) {
 // The string parameter is the fiter that packets have to match
 // and flags are the used flags used
 // https://reqrypt.org/windivert-doc.html#divert_open
-func NewWinDivertHandleWithFlags(filter string, flags uint8) (*WinDivertHandle, error) {
-	filterBytePtr, err := syscall.BytePtrFromString(filter)
+func NewWinDivertHandleWithFlags(filter string, flags Flags) (*WinDivertHandle, error) {
+	return NewWinDivertHandleWithLayer(filter, WinDivertLayerNetwork, 0, flags)
+}
+
+// Create a new WinDivertHandle by calling WinDivertOpen and returns it
+// The string parameter is the fiter that packets have to match,
+// layer is the WinDivert layer to open, priority orders the handles diverting the same packets
+// (highest first) and flags are the used flags used
+// The Flow, Socket and Reflect layers require WinDivert 2.x
+// https://reqrypt.org/windivert-doc.html#divert_open
+func NewWinDivertHandleWithLayer(filter string, layer Layer, priority int16, flags Flags) (*WinDivertHandle, error) {
+	return NewWinDivertHandleWithOptions(filter, HandleOptions{
+		Layer:    layer,
+		Priority: priority,
+		Flags:    flags,
+	})
+}
+
+// Create a new WinDivertHandle by calling WinDivertOpen and returns it
+// The options are validated before opening the handle,
+// the queue parameters are then set with WinDivertSetParam
+// https://reqrypt.org/windivert-doc.html#divert_open
+func NewWinDivertHandleWithOptions(filter string, options HandleOptions) (*WinDivertHandle, error) {
+	abi, err := divertABI()
 	if err != nil {
 		return nil, err
 	}
 
-	handle, _, err := winDivertOpen.Call(uintptr(unsafe.Pointer(filterBytePtr)),
-		uintptr(0),
-		uintptr(0),
-		uintptr(flags))
+	if err := options.validate(abi); err != nil {
+		return nil, err
+	}
 
-	if handle == uintptr(syscall.InvalidHandle) {
+	handle, err := divertOpen(filter, options.Layer, options.Priority, uint64(options.Flags))
+	if err != nil {
 		return nil, err
 	}
 
 	winDivertHandle := &WinDivertHandle{
-		handle: handle,
-		open:   true,
+		handle:   handle,
+		abi:      abi,
+		layer:    options.Layer,
+		priority: options.Priority,
+		flags:    options.Flags,
+		pool:     options.BufferPool,
+		observer: options.Observer,
 	}
+
+	for _, param := range options.params() {
+		if err := winDivertHandle.SetParam(param.param, param.value); err != nil {
+			winDivertHandle.Close()
+			return nil, err
+		}
+	}
+
 	return winDivertHandle, nil
 }
 
+// Returns the ABI version used by the handle
+func (wd *WinDivertHandle) ABIVersion() ABIVersion {
+	return wd.abi
+}
+
+// Returns the layer the handle has been opened on
+func (wd *WinDivertHandle) Layer() Layer {
+	return wd.layer
+}
+
+// Returns the priority of the handle
+func (wd *WinDivertHandle) Priority() int16 {
+	return wd.priority
+}
+
+// Sets bits of the state of the handle and returns the previous state
+func (wd *WinDivertHandle) setState(bits uint32) uint32 {
+	for {
+		state := wd.state.Load()
+		if wd.state.CompareAndSwap(state, state|bits) {
+			return state
+		}
+	}
+}
+
+// Returns true once the handle has been closed
+func (wd *WinDivertHandle) closed() bool {
+	return wd.state.Load()&handleClosed != 0
+}
+
+// Returns an error if packets can't be received with the handle
+func (wd *WinDivertHandle) checkRecv() error {
+	if wd.closed() {
+		return ErrClosed
+	}
+	if !wd.CanRecv() {
+		return &ModeError{Op: "receive", Flags: wd.flags}
+	}
+	return nil
+}
+
+// Returns an error if packets can't be sent with the handle
+func (wd *WinDivertHandle) checkSend() error {
+	state := wd.state.Load()
+	if state&handleClosed != 0 {
+		return ErrClosed
+	}
+	if !wd.CanSend() {
+		return &ModeError{Op: "send", Flags: wd.flags}
+	}
+	if state&handleShutdownSend != 0 {
+		return ErrShutdown
+	}
+	return nil
+}
+
 // Close the Handle
+// Pending and future calls to Recv fail, closing a handle twice returns ErrClosed
 // See https://reqrypt.org/windivert-doc.html#divert_close
 func (wd *WinDivertHandle) Close() error {
-	_, _, err := winDivertClose.Call(wd.handle)
-	wd.open = false
-	return err
+	if wd.setState(handleClosed)&handleClosed != 0 {
+		return ErrClosed
+	}
+	return divertClose(wd.handle)
+}
+
+// Shut down the handle for receiving, sending or both (WinDivert 2.x)
+// Once shut down for receiving no new packet is queued, Recv returns the queued packets and then fails
+// See https://reqrypt.org/windivert-doc.html#divert_shutdown
+func (wd *WinDivertHandle) Shutdown(how Shutdown) error {
+	if how&^WinDivertShutdownBoth != 0 || how == 0 {
+		return errors.New("invalid shutdown mode")
+	}
+	if wd.abi == ABIVersion1 {
+		return errors.New("WinDivertShutdown requires WinDivert 2.x")
+	}
+	if wd.closed() {
+		return ErrClosed
+	}
+
+	wd.setState(uint32(how))
+	return divertShutdown(wd.handle, how)
 }
 
 // Divert a packet from the Network Stack
+// Packets up to MaxPacketSize bytes are received, or up to the size of the handle's BufferPool
 // https://reqrypt.org/windivert-doc.html#divert_recv
 func (wd *WinDivertHandle) Recv() (*Packet, error) {
-	if !wd.open {
-		return nil, errors.New("can't receive, the handle isn't open")
+	if err := wd.checkRecv(); err != nil {
+		return nil, err
 	}
 
-	packetBuffer := make([]byte, PacketBufferSize)
+	packet, err := wd.recvPacket(nil)
+	wd.observeRecv(packet, err)
+	return packet, err
+}
 
-	var packetLen uint
-	var addr WinDivertAddress
-	success, _, err := winDivertRecv.Call(wd.handle,
-		uintptr(unsafe.Pointer(&packetBuffer[0])),
-		uintptr(PacketBufferSize),
-		uintptr(unsafe.Pointer(&addr)),
-		uintptr(unsafe.Pointer(&packetLen)))
+// Divert a packet from the Network Stack
+// The call is cancelled when ctx is done and ctx.Err() is returned
+// https://reqrypt.org/windivert-doc.html#divert_recv_ex
+func (wd *WinDivertHandle) RecvContext(ctx context.Context) (*Packet, error) {
+	if ctx.Done() == nil {
+		return wd.Recv()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := wd.checkRecv(); err != nil {
+		return nil, err
+	}
 
-	if success == 0 {
+	packet, err := wd.recvPacket(ctx.Done())
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		wd.observeRecv(nil, err)
+		return nil, err
+	}
+	wd.observeRecv(packet, nil)
+	return packet, nil
+}
+
+func (wd *WinDivertHandle) observeRecv(packet *Packet, err error) {
+	if wd.observer != nil {
+		wd.observer.ObserveRecv(packet, err)
+	}
+}
+
+func (wd *WinDivertHandle) observeSend(packet *Packet, err error) {
+	if wd.observer != nil {
+		wd.observer.ObserveSend(packet, err)
+	}
+}
+
+// Receives a packet in a buffer of the handle's pool, the receive is cancellable if cancel isn't nil
+// Without pool, the packet is received in a scratch buffer and copied in a buffer of its size
+func (wd *WinDivertHandle) recvPacket(cancel <-chan struct{}) (*Packet, error) {
+	var addrBuffer [WinDivertAddressSizeV2]byte
+
+	recv := func(buffer []byte) (uint, error) {
+		if cancel != nil {
+			return divertRecvCancel(wd.handle, buffer, addrBuffer[:], wd.abi, cancel)
+		}
+		return divertRecv(wd.handle, buffer, addrBuffer[:], wd.abi)
+	}
+
+	if wd.pool != nil {
+		packet := wd.pool.Get()
+		packetLen, err := recv(packet.buffer)
+		if err == nil {
+			err = packet.addr.UnmarshalABI(addrBuffer[:], wd.abi)
+		}
+		if err != nil {
+			packet.Release()
+			return nil, err
+		}
+
+		packet.reset(packet.buffer[:packetLen])
+		return packet, nil
+	}
+
+	scratch := recvBufferPool.Get().(*[MaxPacketSize]byte)
+	defer recvBufferPool.Put(scratch)
+
+	packetLen, err := recv(scratch[:])
+	if err != nil {
 		return nil, err
 	}
 
 	packet := &Packet{
-		Raw:       packetBuffer[:packetLen],
-		Addr:      &addr,
+		Raw:       make([]byte, packetLen),
 		PacketLen: packetLen,
 	}
+	copy(packet.Raw, scratch[:packetLen])
+
+	if err := packet.addr.UnmarshalABI(addrBuffer[:], wd.abi); err != nil {
+		return nil, err
+	}
+	packet.Addr = &packet.addr
 
 	return packet, nil
 }
@@ -125,97 +325,184 @@ func (wd *WinDivertHandle) Recv() (*Packet, error) {
 // Inject the packet on the Network Stack
 // https://reqrypt.org/windivert-doc.html#divert_send
 func (wd *WinDivertHandle) Send(packet *Packet) (uint, error) {
-	var sendLen uint
+	sendLen, err := wd.send(packet)
+	wd.observeSend(packet, err)
+	return sendLen, err
+}
 
-	if !wd.open {
-		return 0, errors.New("can't Send, the handle isn't open")
+func (wd *WinDivertHandle) send(packet *Packet) (uint, error) {
+	if err := wd.checkSend(); err != nil {
+		return 0, err
 	}
 
-	success, _, err := winDivertSend.Call(wd.handle,
-		uintptr(unsafe.Pointer(&(packet.Raw[0]))),
-		uintptr(packet.PacketLen),
-		uintptr(unsafe.Pointer(packet.Addr)),
-		uintptr(unsafe.Pointer(&sendLen)))
+	var addr WinDivertAddress
+	if packet.Addr != nil {
+		addr = *packet.Addr
+	}
 
-	if success == 0 {
+	var addrBuffer [WinDivertAddressSizeV2]byte
+	if err := addr.encode(addrBuffer[:], wd.abi); err != nil {
 		return 0, err
 	}
 
-	return sendLen, nil
+	return divertSend(wd.handle, packet.Raw[:packet.PacketLen], addrBuffer[:], wd.abi)
 }
 
 // Calls WinDivertHelperCalcChecksum to calculate the packet's chacksum
 // https://reqrypt.org/windivert-doc.html#divert_helper_calc_checksums
+// The pseudo checksum flags of the packet's address are updated
 func (wd *WinDivertHandle) HelperCalcChecksum(packet *Packet) {
-	winDivertHelperCalcChecksums.Call(
-		uintptr(unsafe.Pointer(&packet.Raw[0])),
-		uintptr(packet.PacketLen),
-		uintptr(unsafe.Pointer(&packet.Addr)),
-		uintptr(0))
+	if packet.Addr == nil {
+		divertCalcChecksums(packet.Raw[:packet.PacketLen], nil)
+		return
+	}
+
+	var addrBuffer [WinDivertAddressSizeV2]byte
+	if packet.Addr.encode(addrBuffer[:], wd.abi) != nil {
+		return
+	}
+	divertCalcChecksums(packet.Raw[:packet.PacketLen], addrBuffer[:wd.abi.AddressSize()])
+	packet.Addr.UnmarshalABI(addrBuffer[:], wd.abi)
 }
 
 // Take the given filter and check if it contains any error
 // https://reqrypt.org/windivert-doc.html#divert_helper_check_filter
 func HelperCheckFilter(filter string) (bool, int) {
-	var errorPos uint
-
-	filterBytePtr, _ := syscall.BytePtrFromString(filter)
+	ok, pos, _ := HelperCheckFilterLayer(filter, WinDivertLayerNetwork)
+	return ok, pos
+}
 
-	success, _, _ := winDivertHelperCheckFilter.Call(
-		uintptr(unsafe.Pointer(filterBytePtr)),
-		uintptr(0),
-		uintptr(0), // Not implemented yet
-		uintptr(unsafe.Pointer(&errorPos)))
+// Take the given filter and check if it contains any error for the given layer
+// Returns the position of the error and its description if the filter is invalid
+// https://reqrypt.org/windivert-doc.html#divert_helper_compile_filter
+func HelperCheckFilterLayer(filter string, layer Layer) (bool, int, string) {
+	abi, err := divertABI()
+	if err != nil {
+		return false, 0, err.Error()
+	}
+	return divertCheckFilter(filter, layer, abi)
+}
 
-	if success == 1 {
-		return true, -1
+// Returns the filter in the canonical form used by WinDivert, with its macros expanded and its constants simplified
+// https://reqrypt.org/windivert-doc.html#divert_helper_format_filter
+func HelperFormatFilter(filter string, layer Layer) (string, error) {
+	abi, err := divertABI()
+	if err != nil {
+		return "", err
 	}
-	return false, int(errorPos)
+	if abi == ABIVersion1 {
+		return "", errors.New("formatting a filter requires WinDivert 2.x")
+	}
+	return divertFormatFilter(filter, layer)
 }
 
 // Take a packet and compare it with the given filter
 // Returns true if the packet matches the filter
 // https://reqrypt.org/windivert-doc.html#divert_helper_eval_filter
 func HelperEvalFilter(packet *Packet, filter string) (bool, error) {
-	filterBytePtr, err := syscall.BytePtrFromString(filter)
+	abi, err := divertABI()
 	if err != nil {
 		return false, err
 	}
 
-	success, _, err := winDivertHelperEvalFilter.Call(
-		uintptr(unsafe.Pointer(filterBytePtr)),
-		uintptr(0),
-		uintptr(unsafe.Pointer(&packet.Raw[0])),
-		uintptr(packet.PacketLen),
-		uintptr(unsafe.Pointer(&packet.Addr)))
+	var addr WinDivertAddress
+	if packet.Addr != nil {
+		addr = *packet.Addr
+	}
 
-	if success == 0 {
+	var addrBuffer [WinDivertAddressSizeV2]byte
+	if err := addr.encode(addrBuffer[:], abi); err != nil {
 		return false, err
 	}
 
-	return true, nil
+	return divertEvalFilter(filter, packet.Raw[:packet.PacketLen], addrBuffer[:], abi)
 }
 
-// A loop that capture packets by calling Recv and sends them on a channel as long as the handle is open
-// If Recv() returns an error, the loop is stopped and the channel is closed
-func (wd *WinDivertHandle) recvLoop(packetChan chan<- *Packet) {
-	for wd.open {
-		packet, err := wd.Recv()
+// A loop that capture packets by calling RecvContext and queues them until it fails
+// The queue is then closed and the terminal error is stored for Err
+func (wd *WinDivertHandle) recvLoop(ctx context.Context, queue *packetQueue) {
+	defer queue.close()
+
+	for {
+		packet, err := wd.RecvContext(ctx)
 		if err != nil {
-			//close(packetChan)
-			break
+			wd.setErr(ctx, err)
+			return
+		}
+
+		if !queue.push(ctx, packet) {
+			wd.setErr(ctx, ctx.Err())
+			return
 		}
+	}
+}
 
-		packetChan <- packet
+// Stores the error that stopped recvLoop
+// Errors caused by closing or shutting down the handle aren't errors for the loop
+func (wd *WinDivertHandle) setErr(ctx context.Context, err error) {
+	if ctx.Err() == nil && wd.state.Load()&(handleClosed|handleShutdownRecv) != 0 {
+		err = nil
 	}
+
+	wd.errMutex.Lock()
+	wd.err = err
+	wd.errMutex.Unlock()
+}
+
+// Returns the error that closed the channel of Packets, PacketsContext or PacketsWithOptions
+// It is nil if the handle has been closed or shut down for receiving
+func (wd *WinDivertHandle) Err() error {
+	wd.errMutex.Lock()
+	defer wd.errMutex.Unlock()
+	return wd.err
 }
 
 // Create a new channel that will be used to pass captured packets and returns it calls recvLoop to maintain a loop
+// The channel is closed once the handle is closed or Recv fails, see Err
 func (wd *WinDivertHandle) Packets() (chan *Packet, error) {
-	if !wd.open {
-		return nil, errors.New("the handle isn't open")
+	return wd.PacketsContext(context.Background())
+}
+
+// Same as Packets but the loop also stops when ctx is done
+func (wd *WinDivertHandle) PacketsContext(ctx context.Context) (chan *Packet, error) {
+	return wd.PacketsWithOptions(ctx, PacketsOptions{})
+}
+
+// Same as PacketsContext with a configurable capacity, overflow policy and watchdog
+// When ctx is done, the packets still waiting for the consumer are reinjected
+func (wd *WinDivertHandle) PacketsWithOptions(ctx context.Context, options PacketsOptions) (chan *Packet, error) {
+	if err := wd.checkRecv(); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
 	}
-	packetChan := make(chan *Packet, PacketChanCapacity)
-	go wd.recvLoop(packetChan)
+
+	var sender Sender
+	if wd.CanSend() {
+		sender = wd
+	}
+	queue := newPacketQueue(sender, options)
+
+	wd.errMutex.Lock()
+	wd.err = nil
+	wd.queue = queue
+	wd.errMutex.Unlock()
+
+	packetChan := make(chan *Packet)
+	go wd.recvLoop(ctx, queue)
+	go queue.forward(ctx, packetChan)
 	return packetChan, nil
 }
+
+// Returns the counters of the last channel returned by Packets, PacketsContext or PacketsWithOptions
+func (wd *WinDivertHandle) PacketsStats() PacketsStats {
+	wd.errMutex.Lock()
+	queue := wd.queue
+	wd.errMutex.Unlock()
+
+	if queue == nil {
+		return PacketsStats{}
+	}
+	return queue.Stats()
+}